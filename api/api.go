@@ -3,10 +3,12 @@ package api
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
 	"net/http"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
@@ -19,35 +21,54 @@ import (
 )
 
 type MemoryServer struct {
-	listenAddr string
-	store      storage.Storage
-	memory     memory.Memory
+	listenAddr  string
+	store       storage.Storage
+	memory      memory.Memory
+	authEnabled bool
 }
 
-func NewMemoryServer(listenAddr string, store storage.Storage, memory memory.Memory) *MemoryServer {
+func NewMemoryServer(listenAddr string, store storage.Storage, memory memory.Memory, authEnabled bool) *MemoryServer {
 	return &MemoryServer{
-		listenAddr: listenAddr,
-		store:      store,
-		memory:     memory,
+		listenAddr:  listenAddr,
+		store:       store,
+		memory:      memory,
+		authEnabled: authEnabled,
 	}
 }
 
 func (m *MemoryServer) Run() error {
-	r := http.NewServeMux()
-	r.HandleFunc("POST /add_memory", convertToHandleFunc(m.InsertIntoMemory))
-	r.HandleFunc("POST /get_memory", convertToHandleFunc(m.GetMemory))
-	r.HandleFunc("GET /get_all/{id}", convertToHandleFunc(m.GetAllUserMemories))
-	r.HandleFunc("GET /get_core/{id}", convertToHandleFunc(m.GetCoreMemories))
-	r.HandleFunc("GET /health", convertToHandleFunc(m.HealthCheck))
-	r.HandleFunc("POST /delete_memory", convertToHandleFunc(m.DeleteUserMemory))
-
-	if err := http.ListenAndServe(m.listenAddr, r); err != nil {
+	if err := http.ListenAndServe(m.listenAddr, m.routes()); err != nil {
 		slog.Error("Got this error while trying to listen and serve the http server", "error", err)
 		return err
 	}
 	return nil
 }
 
+// routes registers every endpoint. Everything but the health check needs an API key and only sees its tenant's data.
+func (m *MemoryServer) routes() *http.ServeMux {
+	r := http.NewServeMux()
+	r.HandleFunc("POST /add_memory", m.authenticate(convertToHandleFunc(m.InsertIntoMemory)))
+	r.HandleFunc("POST /get_memory", m.authenticate(convertToHandleFunc(m.GetMemory)))
+	r.HandleFunc("GET /get_all/{id}", m.authenticate(convertToHandleFunc(m.GetAllUserMemories)))
+	r.HandleFunc("GET /get_core/{id}", m.authenticate(convertToHandleFunc(m.GetCoreMemories)))
+	r.HandleFunc("GET /health", convertToHandleFunc(m.HealthCheck))
+	r.HandleFunc("POST /delete_memory", m.authenticate(convertToHandleFunc(m.DeleteUserMemory)))
+	r.HandleFunc("GET /jobs/{id}", m.authenticate(convertToHandleFunc(m.GetJob)))
+	r.HandleFunc("POST /jobs/{id}/revert", m.authenticate(convertToHandleFunc(m.RevertJob)))
+	r.HandleFunc("GET /users/{id}/history", m.authenticate(convertToHandleFunc(m.GetUserHistory)))
+	r.HandleFunc("DELETE /users/{id}", m.authenticate(convertToHandleFunc(m.ForgetUser)))
+	r.HandleFunc("GET /users/{id}/export", m.authenticate(convertToHandleFunc(m.ExportUserMemories)))
+	r.HandleFunc("POST /users/{id}/import", m.authenticate(convertToHandleFunc(m.ImportUserMemories)))
+	r.HandleFunc("POST /users/{id}/memories", m.authenticate(convertToHandleFunc(m.CreateMemory)))
+	r.HandleFunc("PUT /users/{id}/memories/{memoryId}", m.authenticate(convertToHandleFunc(m.UpdateMemory)))
+	r.HandleFunc("DELETE /users/{id}/memories/{memoryId}", m.authenticate(convertToHandleFunc(m.DeleteMemoryById)))
+	r.HandleFunc("GET /dlq", m.authenticate(convertToHandleFunc(m.ListDeadLetters)))
+	r.HandleFunc("GET /dlq/{id}", m.authenticate(convertToHandleFunc(m.GetDeadLetter)))
+	r.HandleFunc("POST /dlq/{id}/replay", m.authenticate(convertToHandleFunc(m.ReplayDeadLetter)))
+	r.HandleFunc("POST /users/{id}/dlq/replay", m.authenticate(convertToHandleFunc(m.ReplayUserDeadLetters)))
+	return r
+}
+
 type APIError struct {
 	Error   error
 	Message string //don't wanna send the user/hacker at the frontend .. anything that they might wanna know ... like the error itself
@@ -102,18 +123,31 @@ func (m *MemoryServer) InsertIntoMemory(w http.ResponseWriter, r *http.Request)
 	memJob := types.MemoryInsertionJob{
 		Messages:  req.Messages,
 		ReqId:     reqId,
+		TenantId:  types.TenantId(r.Context()),
 		UserId:    req.UserId,
 		Threshold: 0.6,
 	}
+	// The ledger entry has to exist before the job is queued, otherwise a fast worker could try to update a job that isn't there yet.
+	if err := m.store.InsertMemoryJob(memJob, r.Context()); err != nil {
+		slog.Error("Got this error while trying to record the memory job", "error", err, "reqId", reqId)
+		return &APIError{
+			Error:   err,
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to queue the memory insertion job",
+		}
+	}
 	err := m.memory.SumbitMemoryInsertionRequest(memJob)
 	if err != nil {
 		slog.Info("Got this error while trying to insert memory", "error", err)
+		if err := m.store.UpdateJobStatus(reqId, types.JobStatusFailed, err, r.Context()); err != nil {
+			slog.Error("Got this error while marking the memory job as failed", "error", err, "reqId", reqId)
+		}
 		return &APIError{
-			Error:  err,
-			Status: http.StatusInternalServerError,
+			Error:   err,
+			Status:  http.StatusInternalServerError,
+			Message: "Failed to queue the memory insertion job",
 		}
 	}
-	m.store.InsertMemoryRequest(req, reqId) //Sumbit this one as well .....
 	writeJSON(w, http.StatusOK, MemoryInsertionResponse{
 		ReqId: reqId,
 		Msg:   "Memory Insertion Job has been queued for insertion!",
@@ -121,6 +155,18 @@ func (m *MemoryServer) InsertIntoMemory(w http.ResponseWriter, r *http.Request)
 	return nil
 }
 
+const (
+	// maxSearchLimit caps how many general memories a single /get_memory request can ask for.
+	maxSearchLimit = 100
+	// defaultPageSize and maxPageSize are the number of general memories on a page of /get_all/{id}.
+	defaultPageSize = 100
+	maxPageSize     = 1000
+)
+
+// partialResultHeader lists the stages of /get_memory and /get_all/{id} that failed when the memories of the other one
+// were returned.
+const partialResultHeader = "X-Partial-Result"
+
 func (m *MemoryServer) GetMemory(w http.ResponseWriter, r *http.Request) *APIError {
 
 	var req = &types.MemoryRetrievalRequest{}
@@ -146,8 +192,17 @@ func (m *MemoryServer) GetMemory(w http.ResponseWriter, r *http.Request) *APIErr
 		slog.Info("threshold wasn't provided by default .. using the default value")
 		req.Threshold = 0.65
 	}
+	if req.Limit < 0 || req.Limit > maxSearchLimit {
+		return &APIError{
+			Error:   fmt.Errorf("invalid limit %d", req.Limit),
+			Message: fmt.Sprintf("limit must be between 1 and %d", maxSearchLimit),
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.Int("limit", req.Limit))
 	reqId := uuid.NewString()
 	req.ReqId = reqId
+	var query string
 	if req.Messages != nil {
 		span.SetAttributes(attribute.String("type", "messages"))
 		if len(req.Messages) == 0 {
@@ -160,10 +215,19 @@ func (m *MemoryServer) GetMemory(w http.ResponseWriter, r *http.Request) *APIErr
 		}
 		slog.Info("Messages type request came in here!", "reqId", reqId)
 		//TODO: Update the python grpc server ... to support asymmetric retreival ... (Sparse query: 2000 chars, Dense query: 500 characters)
-		query := ConstructContextualQuery(req.Messages, 500)
-		Memories, err := m.memory.GetMemories(query, req.UserId, reqId, req.Threshold, ctx)
+		query = ConstructContextualQuery(req.Messages, 500)
+	} else if req.UserQuery != "" {
+		span.SetAttributes(attribute.String("type", "userQuery"))
+		slog.Info("UserQuery type request came in here!", "reqId", reqId, "userQuery", req.UserQuery)
+		query = req.UserQuery
+	} else {
+		return nil
+	}
+	span.SetAttributes(attribute.Bool("debug", req.Debug))
+	if req.Debug {
+		debug, err := m.memory.ExplainMemories(query, req.UserId, reqId, req.Threshold, req.Limit, ctx)
 		if err != nil {
-			slog.Error("Got this error while trying to get memories", "error", err)
+			slog.Error("Got this error while trying to explain the memory retrieval", "error", err)
 			span.RecordError(err)
 			return &APIError{
 				Message: "Memory Retrieval Failed!",
@@ -171,30 +235,42 @@ func (m *MemoryServer) GetMemory(w http.ResponseWriter, r *http.Request) *APIErr
 				Status:  http.StatusInternalServerError,
 			}
 		}
-		writeJSON(w, http.StatusOK, Memories)
+		writeJSON(w, http.StatusOK, debug)
 		return nil
 	}
-	if req.UserQuery != "" {
-		span.SetAttributes(attribute.String("type", "userQuery"))
-		slog.Info("UserQuery type request came in here!", "reqId", reqId, "userQuery", req.UserQuery)
-		userQuery := req.UserQuery
-		Memories, err := m.memory.GetMemories(userQuery, req.UserId, reqId, req.Threshold, ctx)
-		if err != nil {
-			span.RecordError(err)
-			slog.Error("Got this error while trying to get memories", "error", err)
-			return &APIError{
-				Message: "Memory Retrieval Failed!",
-				Error:   err,
-				Status:  http.StatusInternalServerError,
-			}
+	result, err := m.memory.GetMemories(query, req.UserId, reqId, req.Threshold, req.Limit, ctx)
+	if err != nil {
+		slog.Error("Got this error while trying to get memories", "error", err)
+		span.RecordError(err)
+		return &APIError{
+			Message: "Memory Retrieval Failed!",
+			Error:   err,
+			Status:  http.StatusInternalServerError,
 		}
-		writeJSON(w, http.StatusOK, Memories)
 	}
+	setPartialResult(w, result)
+	writeJSON(w, http.StatusOK, result.Memories)
 	return nil
 }
 
+// setPartialResult names the stages a partial result is missing in a header, the body stays a plain list of memories.
+func setPartialResult(w http.ResponseWriter, result *types.RetrievalResult) {
+	if !result.Partial {
+		return
+	}
+	stages := make([]string, len(result.FailedStages))
+	for i, stage := range result.FailedStages {
+		stages[i] = string(stage)
+	}
+	w.Header().Set(partialResultHeader, strings.Join(stages, ","))
+}
+
 func GetId(r *http.Request) (string, error) {
-	id := r.PathValue("id")
+	return getPathValue(r, "id")
+}
+
+func getPathValue(r *http.Request, name string) (string, error) {
+	id := r.PathValue(name)
 	cleanId := strings.Trim(id, "\"' ")
 
 	slog.Info("parsing id", "raw", id, "clean", cleanId)
@@ -224,7 +300,42 @@ func (m *MemoryServer) GetAllUserMemories(w http.ResponseWriter, r *http.Request
 	}
 	span.SetAttributes(attribute.String("userId", userId))
 
-	mem, err := m.memory.GetAllUserMemories(userId, ctx)
+	// asking for a limit or a cursor pages through the memories, everything is returned at once otherwise
+	query := r.URL.Query()
+	if query.Has("limit") || query.Has("cursor") {
+		limit := defaultPageSize
+		if l := query.Get("limit"); l != "" {
+			limit, err = strconv.Atoi(l)
+			if err != nil || limit <= 0 || limit > maxPageSize {
+				return &APIError{
+					Error:   fmt.Errorf("invalid limit %q", l),
+					Message: fmt.Sprintf("limit must be between 1 and %d", maxPageSize),
+					Status:  http.StatusBadRequest,
+				}
+			}
+		}
+		page, err := m.memory.ListUserMemories(userId, limit, query.Get("cursor"), ctx)
+		if err != nil {
+			span.RecordError(err)
+			if errors.Is(err, memory.ErrInvalidCursor) {
+				return &APIError{
+					Error:   err,
+					Message: "cursor must be the nextCursor of a previous page",
+					Status:  http.StatusBadRequest,
+				}
+			}
+			slog.Error("Got this error while trying to get a page of the memories of the user", "error", err, "userId", userId)
+			return &APIError{
+				Message: "Failed to get the user memories",
+				Status:  http.StatusInternalServerError,
+				Error:   err,
+			}
+		}
+		writeJSON(w, http.StatusOK, page)
+		return nil
+	}
+
+	result, err := m.memory.GetAllUserMemories(userId, ctx)
 	if err != nil {
 		span.RecordError(err)
 		slog.Error("Got this error while trying to get all memories of the user (in the memory agent)", "error", err, "userId", userId)
@@ -234,7 +345,8 @@ func (m *MemoryServer) GetAllUserMemories(w http.ResponseWriter, r *http.Request
 			Error:   err,
 		}
 	}
-	writeJSON(w, http.StatusOK, mem)
+	setPartialResult(w, result)
+	writeJSON(w, http.StatusOK, result.Memories)
 	return nil
 }
 
@@ -277,8 +389,8 @@ func (m *MemoryServer) GetCoreMemories(w http.ResponseWriter, r *http.Request) *
 	return nil
 }
 
+// DeleteUserMemory deletes general and core memories of a user and answers with what happened to every id.
 func (m *MemoryServer) DeleteUserMemory(w http.ResponseWriter, r *http.Request) *APIError {
-	//TODO: Update this endpoint to take in core memory Ids as well!
 	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
 	ctx, span := Tracer.Start(ctx, "DeleteUserMemory")
 	defer span.End()
@@ -292,8 +404,15 @@ func (m *MemoryServer) DeleteUserMemory(w http.ResponseWriter, r *http.Request)
 			Status:  http.StatusBadRequest,
 		}
 	}
+	if req.UserId == "" || len(req.MemoryIds)+len(req.CoreMemoryIds) == 0 {
+		return &APIError{
+			Message: "userId and at least one memoryId or coreMemoryId are required",
+			Error:   fmt.Errorf("incomplete delete request"),
+			Status:  http.StatusBadRequest,
+		}
+	}
 	span.SetAttributes(attribute.String("userId", req.UserId))
-	err := m.memory.DeleteMemory(req.MemoryIds, ctx)
+	results, err := m.memory.DeleteMemory(req.UserId, req.MemoryIds, req.CoreMemoryIds, ctx)
 	if err != nil {
 		span.RecordError(err)
 		slog.Error("Got this error while trying to delete memory", "error", err, "userId", req.UserId)
@@ -303,11 +422,581 @@ func (m *MemoryServer) DeleteUserMemory(w http.ResponseWriter, r *http.Request)
 			Status:  http.StatusInternalServerError,
 		}
 	}
+	writeJSON(w, http.StatusOK, struct{ Results []types.MemoryDeletionResult }{Results: results})
+	return nil
+}
+
+func (m *MemoryServer) GetJob(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	ctx, span := Tracer.Start(ctx, "GetJob")
+	defer span.End()
+	defer cancel()
+	reqId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while getting Id for GetJob", "error", err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("reqId", reqId))
+
+	job, err := m.store.GetMemoryJob(reqId, ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrJobNotFound) {
+			return &APIError{
+				Error:   err,
+				Message: "No memory job exists with this reqId",
+				Status:  http.StatusNotFound,
+			}
+		}
+		span.RecordError(err)
+		slog.Error("Got this error while trying to get the memory job", "error", err, "reqId", reqId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to get the memory job",
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	writeJSON(w, http.StatusOK, job)
+	return nil
+}
+
+func (m *MemoryServer) RevertJob(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
+	ctx, span := Tracer.Start(ctx, "RevertJob")
+	defer span.End()
+	defer cancel()
+	reqId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while getting Id for RevertJob", "error", err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("reqId", reqId))
+
+	result, err := m.memory.RevertMemoryJob(reqId, ctx)
+	if err != nil {
+		switch {
+		case errors.Is(err, storage.ErrJobNotFound):
+			return &APIError{
+				Error:   err,
+				Message: "No memory job exists with this reqId",
+				Status:  http.StatusNotFound,
+			}
+		case errors.Is(err, memory.ErrJobAlreadyReverted), errors.Is(err, memory.ErrJobNotFinished):
+			return &APIError{
+				Error:   err,
+				Message: err.Error(),
+				Status:  http.StatusConflict,
+			}
+		}
+		span.RecordError(err)
+		slog.Error("Got this error while trying to revert the memory job", "error", err, "reqId", reqId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to revert the memory job",
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+func (m *MemoryServer) GetUserHistory(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	ctx, span := Tracer.Start(ctx, "GetUserHistory")
+	defer span.End()
+	defer cancel()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while getting Id for GetUserHistory", "error", err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId))
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			return &APIError{
+				Error:   fmt.Errorf("invalid limit %q", l),
+				Message: "limit must be a positive integer",
+				Status:  http.StatusBadRequest,
+			}
+		}
+	}
+
+	history, err := m.store.GetMemoryHistory(userId, limit, ctx)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to get the memory history of the user", "error", err, "userId", userId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to get the memory history of the user",
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	writeJSON(w, http.StatusOK, history)
+	return nil
+}
+
+// ForgetUser erases all the data of a user and answers with a receipt of what was deleted.
+func (m *MemoryServer) ForgetUser(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*60)
+	ctx, span := Tracer.Start(ctx, "ForgetUser")
+	defer span.End()
+	defer cancel()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while getting Id for ForgetUser", "error", err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId))
+
+	receipt, err := m.memory.ForgetUser(userId, ctx)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to forget the user", "error", err, "userId", userId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to delete all the data of the user, the request is safe to retry",
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	writeJSON(w, http.StatusOK, receipt)
+	return nil
+}
+
+// maxBundleSize caps the size of an imported bundle, vectors make up most of it.
+const maxBundleSize = 64 << 20
+
+// ExportUserMemories answers with all the memories of a user as a bundle, as JSONL with ?format=jsonl and with the
+// vectors of the general memories with ?vectors=true.
+func (m *MemoryServer) ExportUserMemories(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
+	ctx, span := Tracer.Start(ctx, "ExportUserMemories")
+	defer span.End()
+	defer cancel()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while getting Id for ExportUserMemories", "error", err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId))
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "jsonl" {
+		return &APIError{
+			Error:   fmt.Errorf("invalid format %q", format),
+			Message: "format must be json or jsonl",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	withVectors := r.URL.Query().Get("vectors") == "true"
+
+	bundle, err := m.memory.ExportUserMemories(userId, withVectors, ctx)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to export the memories of the user", "error", err, "userId", userId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to export the memories of the user",
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	if format == "jsonl" {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		if err := memory.WriteBundleJSONL(w, bundle); err != nil {
+			slog.Error("Got this error while writing the exported bundle", "error", err, "userId", userId)
+		}
+		return nil
+	}
+	writeJSON(w, http.StatusOK, bundle)
+	return nil
+}
+
+// ImportUserMemories loads a bundle, as JSON or JSONL, into the memories of a user.
+func (m *MemoryServer) ImportUserMemories(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*60)
+	ctx, span := Tracer.Start(ctx, "ImportUserMemories")
+	defer span.End()
+	defer cancel()
+	defer r.Body.Close()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while getting Id for ImportUserMemories", "error", err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId))
+
+	bundle, err := memory.ReadBundle(http.MaxBytesReader(w, r.Body, maxBundleSize))
+	if err != nil {
+		span.RecordError(err)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			return &APIError{
+				Error:   err,
+				Message: fmt.Sprintf("Bundle is larger than %d bytes", maxBundleSize),
+				Status:  http.StatusRequestEntityTooLarge,
+			}
+		}
+		return &APIError{
+			Error:   err,
+			Message: err.Error(),
+			Status:  http.StatusBadRequest,
+		}
+	}
+	result, err := m.memory.ImportUserMemories(userId, bundle, ctx)
+	if err != nil {
+		span.RecordError(err)
+		if errors.Is(err, memory.ErrInvalidBundle) {
+			return &APIError{
+				Error:   err,
+				Message: err.Error(),
+				Status:  http.StatusBadRequest,
+			}
+		}
+		if apiErr := coreMemoryLimitError(err); apiErr != nil {
+			return apiErr
+		}
+		slog.Error("Got this error while trying to import the memories of the user", "error", err, "userId", userId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to import the memories of the user",
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	writeJSON(w, http.StatusOK, result)
+	return nil
+}
+
+// decodeMemoryWrite reads the body of a manual memory write, the text is required and kept as the user typed it.
+func decodeMemoryWrite(r *http.Request) (*types.MemoryWriteRequest, *APIError) {
+	req := &types.MemoryWriteRequest{}
+	if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+		return nil, &APIError{
+			Error:   err,
+			Message: "Request format is wrong",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	if strings.TrimSpace(req.Text) == "" {
+		return nil, &APIError{
+			Error:   fmt.Errorf("empty memory text"),
+			Message: "text is required",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	return req, nil
+}
+
+// coreMemoryLimitError answers a write that would take the core memories of the user over their limits with a 409,
+// the user has to delete or shorten some first. It is nil for any other error.
+func coreMemoryLimitError(err error) *APIError {
+	if !errors.Is(err, memory.ErrCoreMemoryLimit) {
+		return nil
+	}
 	return &APIError{
-		Error:   nil,
-		Message: "Memory Deletion succesful",
-		Status:  http.StatusOK,
+		Error:   err,
+		Message: err.Error(),
+		Status:  http.StatusConflict,
+	}
+}
+
+// memoryLookupError maps the errors of finding a single memory of a user to a response.
+func memoryLookupError(err error, message string) *APIError {
+	switch {
+	case errors.Is(err, memory.ErrMemoryNotFound):
+		return &APIError{
+			Error:   err,
+			Message: "No memory exists with this id",
+			Status:  http.StatusNotFound,
+		}
+	case errors.Is(err, memory.ErrMemoryForbidden):
+		return &APIError{
+			Error:   err,
+			Message: "The memory belongs to another user",
+			Status:  http.StatusForbidden,
+		}
+	}
+	return &APIError{
+		Error:   err,
+		Message: message,
+		Status:  http.StatusInternalServerError,
+	}
+}
+
+func (m *MemoryServer) CreateMemory(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*15)
+	ctx, span := Tracer.Start(ctx, "CreateMemory")
+	defer span.End()
+	defer cancel()
+	defer r.Body.Close()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId))
+	req, apiErr := decodeMemoryWrite(r)
+	if apiErr != nil {
+		return apiErr
+	}
+	if req.Type != types.MemoryTypeCore && req.Type != types.MemoryTypeGeneral {
+		return &APIError{
+			Error:   fmt.Errorf("invalid memory type %q", req.Type),
+			Message: "type must be core or general",
+			Status:  http.StatusBadRequest,
+		}
+	}
+
+	mem, err := m.memory.CreateMemory(userId, req.Type, req.Text, ctx)
+	if err != nil {
+		span.RecordError(err)
+		if apiErr := coreMemoryLimitError(err); apiErr != nil {
+			return apiErr
+		}
+		slog.Error("Got this error while trying to create the memory", "error", err, "userId", userId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to create the memory",
+			Status:  http.StatusInternalServerError,
+		}
 	}
+	writeJSON(w, http.StatusCreated, mem)
+	return nil
+}
+
+func (m *MemoryServer) UpdateMemory(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*15)
+	ctx, span := Tracer.Start(ctx, "UpdateMemory")
+	defer span.End()
+	defer cancel()
+	defer r.Body.Close()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	memoryId, err := getPathValue(r, "memoryId")
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId), attribute.String("memoryId", memoryId))
+	req, apiErr := decodeMemoryWrite(r)
+	if apiErr != nil {
+		return apiErr
+	}
+
+	mem, err := m.memory.UpdateMemory(userId, memoryId, req.Text, ctx)
+	if err != nil {
+		span.RecordError(err)
+		if apiErr := coreMemoryLimitError(err); apiErr != nil {
+			return apiErr
+		}
+		slog.Error("Got this error while trying to update the memory", "error", err, "userId", userId, "memoryId", memoryId)
+		return memoryLookupError(err, "Failed to update the memory")
+	}
+	writeJSON(w, http.StatusOK, mem)
+	return nil
+}
+
+func (m *MemoryServer) DeleteMemoryById(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	ctx, span := Tracer.Start(ctx, "DeleteMemoryById")
+	defer span.End()
+	defer cancel()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	memoryId, err := getPathValue(r, "memoryId")
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId), attribute.String("memoryId", memoryId))
+
+	if err := m.memory.DeleteMemoryById(userId, memoryId, ctx); err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to delete the memory", "error", err, "userId", userId, "memoryId", memoryId)
+		return memoryLookupError(err, "Failed to delete the memory")
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return nil
+}
+
+func (m *MemoryServer) ListDeadLetters(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
+	ctx, span := Tracer.Start(ctx, "ListDeadLetters")
+	defer span.End()
+	defer cancel()
+	userId := r.URL.Query().Get("userId")
+	span.SetAttributes(attribute.String("userId", userId))
+
+	deadLetters, err := m.memory.ListDeadLetters(userId, ctx)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to list the dead-lettered jobs", "error", err, "userId", userId)
+		return &APIError{
+			Error:   err,
+			Message: "Failed to list the dead-lettered jobs",
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	writeJSON(w, http.StatusOK, deadLetters)
+	return nil
+}
+
+// GetSeq parses the {id} path value as the sequence of a message in the dead-letter stream.
+func GetSeq(r *http.Request) (uint64, error) {
+	id, err := GetId(r)
+	if err != nil {
+		return 0, err
+	}
+	seq, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a valid dead-letter sequence: %w", id, err)
+	}
+	return seq, nil
+}
+
+func deadLetterError(err error, message string) *APIError {
+	if errors.Is(err, memory.ErrDeadLetterNotFound) {
+		return &APIError{
+			Error:   err,
+			Message: "No dead-lettered job exists with this sequence",
+			Status:  http.StatusNotFound,
+		}
+	}
+	return &APIError{
+		Error:   err,
+		Message: message,
+		Status:  http.StatusInternalServerError,
+	}
+}
+
+func (m *MemoryServer) GetDeadLetter(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	ctx, span := Tracer.Start(ctx, "GetDeadLetter")
+	defer span.End()
+	defer cancel()
+	seq, err := GetSeq(r)
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	deadLetter, err := m.memory.GetDeadLetter(seq, ctx)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to get the dead-lettered job", "error", err, "seq", seq)
+		return deadLetterError(err, "Failed to get the dead-lettered job")
+	}
+	writeJSON(w, http.StatusOK, deadLetter)
+	return nil
+}
+
+func (m *MemoryServer) ReplayDeadLetter(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*5)
+	ctx, span := Tracer.Start(ctx, "ReplayDeadLetter")
+	defer span.End()
+	defer cancel()
+	seq, err := GetSeq(r)
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	if err := m.memory.ReplayDeadLetter(seq, ctx); err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to replay the dead-lettered job", "error", err, "seq", seq)
+		return deadLetterError(err, "Failed to replay the dead-lettered job")
+	}
+	writeJSON(w, http.StatusOK, struct{ Replayed int }{Replayed: 1})
+	return nil
+}
+
+func (m *MemoryServer) ReplayUserDeadLetters(w http.ResponseWriter, r *http.Request) *APIError {
+	ctx, cancel := context.WithTimeout(r.Context(), time.Second*30)
+	ctx, span := Tracer.Start(ctx, "ReplayUserDeadLetters")
+	defer span.End()
+	defer cancel()
+	userId, err := GetId(r)
+	if err != nil {
+		span.RecordError(err)
+		return &APIError{
+			Error:   err,
+			Message: "Bad Request",
+			Status:  http.StatusBadRequest,
+		}
+	}
+	span.SetAttributes(attribute.String("userId", userId))
+	replayed, err := m.memory.ReplayUserDeadLetters(userId, ctx)
+	if err != nil {
+		span.RecordError(err)
+		slog.Error("Got this error while trying to replay the dead-lettered jobs of the user", "error", err, "userId", userId, "replayed", replayed)
+		return &APIError{
+			Error:   err,
+			Message: fmt.Sprintf("Replay stopped after %d jobs", replayed),
+			Status:  http.StatusInternalServerError,
+		}
+	}
+	writeJSON(w, http.StatusOK, struct{ Replayed int }{Replayed: replayed})
+	return nil
 }
 
 func ConstructContextualQuery(messages []types.Message, charLimit int) string {
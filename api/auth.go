@@ -0,0 +1,90 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/Prateek-Gupta001/GoMemory/storage"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/google/uuid"
+)
+
+const apiKeyPrefix = "gm_"
+
+// Tenant ids end up in Redis keys and Qdrant payloads, so they are kept to a boring alphabet.
+var tenantIdPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+
+// HashAPIKey is what a key is stored and looked up under. Keys are 32 random bytes, so a plain SHA-256 is enough,
+// there is nothing to brute force.
+func HashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// CreateAPIKey issues a new key for a tenant. The key itself is only ever returned here, the store keeps its hash.
+func CreateAPIKey(store storage.Storage, tenantId string, name string, ctx context.Context) (string, *types.APIKey, error) {
+	if !tenantIdPattern.MatchString(tenantId) {
+		return "", nil, fmt.Errorf("tenant id %q must be 1-64 letters, digits, '-' or '_'", tenantId)
+	}
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return "", nil, err
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(secret)
+	apiKey := &types.APIKey{
+		Id:       uuid.NewString(),
+		TenantId: tenantId,
+		Name:     name,
+	}
+	if err := store.InsertAPIKey(*apiKey, HashAPIKey(key), ctx); err != nil {
+		return "", nil, err
+	}
+	return key, apiKey, nil
+}
+
+// apiKeyFromRequest reads the key from "Authorization: Bearer <key>" or, failing that, the X-API-Key header.
+func apiKeyFromRequest(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		if key, ok := strings.CutPrefix(auth, "Bearer "); ok {
+			return strings.TrimSpace(key)
+		}
+	}
+	return strings.TrimSpace(r.Header.Get("X-API-Key"))
+}
+
+// authenticate resolves the API key of the request to its tenant and scopes the request context to it, everything
+// downstream reads the tenant from there. With authentication disabled every request belongs to the default tenant.
+func (m *MemoryServer) authenticate(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !m.authEnabled {
+			next(w, r.WithContext(types.WithTenantId(r.Context(), types.DefaultTenantId)))
+			return
+		}
+		key := apiKeyFromRequest(r)
+		if key == "" {
+			writeJSON(w, http.StatusUnauthorized, struct{ Error string }{Error: "Missing API key"})
+			return
+		}
+		apiKey, err := m.store.GetAPIKeyByHash(HashAPIKey(key), r.Context())
+		if err != nil {
+			if errors.Is(err, storage.ErrAPIKeyNotFound) {
+				slog.Warn("Request with an unknown or revoked API key", "path", r.URL.Path)
+				writeJSON(w, http.StatusUnauthorized, struct{ Error string }{Error: "Invalid API key"})
+				return
+			}
+			slog.Error("Got this error while looking up the API key", "error", err)
+			writeJSON(w, http.StatusInternalServerError, struct{ Error string }{Error: "Oops something went wrong! Please try again later!"})
+			return
+		}
+		next(w, r.WithContext(types.WithTenantId(r.Context(), apiKey.TenantId)))
+	}
+}
@@ -0,0 +1,79 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/Prateek-Gupta001/GoMemory/storage"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// keyStore only implements the api key part of storage.Storage, anything else panics.
+type keyStore struct {
+	storage.Storage
+	keys map[string]types.APIKey
+}
+
+func (s *keyStore) InsertAPIKey(key types.APIKey, keyHash string, ctx context.Context) error {
+	s.keys[keyHash] = key
+	return nil
+}
+
+func (s *keyStore) GetAPIKeyByHash(keyHash string, ctx context.Context) (*types.APIKey, error) {
+	key, ok := s.keys[keyHash]
+	if !ok {
+		return nil, storage.ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
+
+func TestAuthenticate(t *testing.T) {
+	store := &keyStore{keys: make(map[string]types.APIKey)}
+	key, apiKey, err := CreateAPIKey(store, "acme", "staging", t.Context())
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix))
+	assert.NotContains(t, store.keys, key, "only the hash of the key may be stored")
+	assert.Equal(t, "acme", apiKey.TenantId)
+
+	var tenantId string
+	handler := func(w http.ResponseWriter, r *http.Request) {
+		tenantId = types.TenantId(r.Context())
+	}
+	serve := func(m *MemoryServer, header string, value string) int {
+		tenantId = ""
+		req := httptest.NewRequest(http.MethodGet, "/get_all/user_123", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		rec := httptest.NewRecorder()
+		m.authenticate(handler)(rec, req)
+		return rec.Code
+	}
+
+	m := NewMemoryServer(":0", store, nil, true)
+	assert.Equal(t, http.StatusUnauthorized, serve(m, "", ""))
+	assert.Equal(t, http.StatusUnauthorized, serve(m, "Authorization", "Bearer gm_not_a_key"))
+	assert.Empty(t, tenantId)
+
+	assert.Equal(t, http.StatusOK, serve(m, "Authorization", "Bearer "+key))
+	assert.Equal(t, "acme", tenantId)
+	assert.Equal(t, http.StatusOK, serve(m, "X-API-Key", key))
+	assert.Equal(t, "acme", tenantId)
+
+	open := NewMemoryServer(":0", store, nil, false)
+	assert.Equal(t, http.StatusOK, serve(open, "", ""))
+	assert.Equal(t, types.DefaultTenantId, tenantId)
+}
+
+func TestCreateAPIKeyRejectsBadTenantIds(t *testing.T) {
+	store := &keyStore{keys: make(map[string]types.APIKey)}
+	for _, tenantId := range []string{"", "acme:prod", strings.Repeat("a", 65)} {
+		_, _, err := CreateAPIKey(store, tenantId, "", t.Context())
+		assert.Error(t, err, tenantId)
+	}
+}
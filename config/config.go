@@ -0,0 +1,314 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds every host, port and knob GoMemory needs. It is built from the defaults below, then the YAML file
+// (if any) and finally the environment variables, each overriding the one before.
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Postgres  PostgresConfig  `yaml:"postgres"`
+	Redis     RedisConfig     `yaml:"redis"`
+	VectorDB  VectorDBConfig  `yaml:"vectordb"`
+	Embedding EmbeddingConfig `yaml:"embedding"`
+	NATS      NATSConfig      `yaml:"nats"`
+	Telemetry TelemetryConfig `yaml:"telemetry"`
+	LLM       LLMConfig       `yaml:"llm"`
+	Memory    MemoryConfig    `yaml:"memory"`
+}
+
+type ServerConfig struct {
+	ListenAddr   string `yaml:"listen_addr"`
+	AuthDisabled bool   `yaml:"auth_disabled"` //every request then belongs to the default tenant, only for local setups
+}
+
+type PostgresConfig struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	User     string `yaml:"user"`
+	Password string `yaml:"password"`
+	DBName   string `yaml:"dbname"`
+	SSLMode  string `yaml:"sslmode"`
+}
+
+// ConnString is the lib/pq connection string for the database.
+func (p PostgresConfig) ConnString() string {
+	return fmt.Sprintf("host=%s port=%d user=%s dbname=%s password=%s sslmode=%s", p.Host, p.Port, p.User, p.DBName, p.Password, p.SSLMode)
+}
+
+type RedisConfig struct {
+	Addr     string `yaml:"addr"`
+	Password string `yaml:"password"`
+	DB       int    `yaml:"db"`
+}
+
+type VectorDBConfig struct {
+	Backend string       `yaml:"backend"` //qdrant, pgvector or memory
+	Qdrant  QdrantConfig `yaml:"qdrant"`
+	Path    string       `yaml:"path"` //file the memory backend persists to, optional
+}
+
+type QdrantConfig struct {
+	Host       string `yaml:"host"`
+	Port       int    `yaml:"port"`
+	Collection string `yaml:"collection"`
+}
+
+type EmbeddingConfig struct {
+	Addr string `yaml:"addr"`
+}
+
+type NATSConfig struct {
+	URL string `yaml:"url"`
+}
+
+type TelemetryConfig struct {
+	ServiceName  string `yaml:"service_name"`
+	OTLPEndpoint string `yaml:"otlp_endpoint"`
+}
+
+type LLMConfig struct {
+	Provider string       `yaml:"provider"` //gemini or openai
+	Gemini   GeminiConfig `yaml:"gemini"`
+	OpenAI   OpenAIConfig `yaml:"openai"`
+}
+
+type GeminiConfig struct {
+	Model  string `yaml:"model"`
+	APIKey string `yaml:"api_key"`
+}
+
+type OpenAIConfig struct {
+	BaseURL string `yaml:"base_url"`
+	Model   string `yaml:"model"`
+	APIKey  string `yaml:"api_key"`
+}
+
+type MemoryConfig struct {
+	Workers    int `yaml:"workers"`
+	QueueLen   int `yaml:"queue_len"`
+	MaxDeliver int `yaml:"max_deliver"` //how many times a job is attempted before it is dead-lettered
+	// WorkLanes is how many lanes jobs are spread over, see memory/lanes.go. Every instance must use the same number.
+	WorkLanes int `yaml:"work_lanes"`
+	// The core memories of a user are consolidated once there are more than MaxCoreMemories of them or they take up
+	// more than about CoreMemoryTokenBudget tokens. 0 turns either limit off, which is the default.
+	MaxCoreMemories       int `yaml:"max_core_memories"`
+	CoreMemoryTokenBudget int `yaml:"core_memory_token_budget"`
+}
+
+// maxWorkLanes bounds memory.work_lanes, every lane is a durable consumer of its own on the NATS server.
+const maxWorkLanes = 1024
+
+// Default is the zero-friction local setup matching docker-compose.yml.
+func Default() *Config {
+	return &Config{
+		Server: ServerConfig{ListenAddr: ":9000"},
+		Postgres: PostgresConfig{
+			Host:     "127.0.0.1",
+			Port:     5433,
+			User:     "postgres",
+			Password: "postgres",
+			DBName:   "memory",
+			SSLMode:  "disable",
+		},
+		Redis: RedisConfig{Addr: "localhost:6379"},
+		VectorDB: VectorDBConfig{
+			Backend: "qdrant",
+			Qdrant: QdrantConfig{
+				Host:       "localhost",
+				Port:       6336,
+				Collection: "Go_Memory_db",
+			},
+		},
+		Embedding: EmbeddingConfig{Addr: "localhost:50051"},
+		NATS:      NATSConfig{URL: "nats://127.0.0.1:4222"},
+		Telemetry: TelemetryConfig{
+			ServiceName:  "Go_Memory",
+			OTLPEndpoint: "localhost:4318",
+		},
+		LLM: LLMConfig{
+			Provider: "gemini",
+			Gemini:   GeminiConfig{Model: "gemini-3-flash-preview"},
+		},
+		Memory: MemoryConfig{
+			Workers:    2,
+			QueueLen:   5000,
+			MaxDeliver: 5,
+			WorkLanes:  16,
+		},
+	}
+}
+
+// Load builds the config from the defaults, the YAML file at path (skipped when path is empty) and the environment,
+// and validates the result.
+func Load(path string) (*Config, error) {
+	cfg := Default()
+	if path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			slog.Error("Got this error while reading the config file", "error", err, "path", path)
+			return nil, err
+		}
+		if err := yaml.Unmarshal(data, cfg); err != nil {
+			slog.Error("Got this error while parsing the config file", "error", err, "path", path)
+			return nil, err
+		}
+	}
+	if err := cfg.applyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// applyEnv overrides the config with the environment variables that are set. The names that existed before the
+// config file (DB_PASSWORD, LLM_PROVIDER, OPENAI_*, MAX_DELIVER, VECTOR_DB, ...) keep working.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	strs := map[string]*string{
+		"LISTEN_ADDR":       &c.Server.ListenAddr,
+		"DB_HOST":           &c.Postgres.Host,
+		"DB_USER":           &c.Postgres.User,
+		"DB_PASSWORD":       &c.Postgres.Password,
+		"DB_NAME":           &c.Postgres.DBName,
+		"DB_SSLMODE":        &c.Postgres.SSLMode,
+		"REDIS_ADDR":        &c.Redis.Addr,
+		"REDIS_PASSWORD":    &c.Redis.Password,
+		"VECTOR_DB":         &c.VectorDB.Backend,
+		"VECTOR_DB_PATH":    &c.VectorDB.Path,
+		"QDRANT_HOST":       &c.VectorDB.Qdrant.Host,
+		"QDRANT_COLLECTION": &c.VectorDB.Qdrant.Collection,
+		"EMBEDDING_ADDR":    &c.Embedding.Addr,
+		"NATS_URL":          &c.NATS.URL,
+		"OTLP_ENDPOINT":     &c.Telemetry.OTLPEndpoint,
+		"LLM_PROVIDER":      &c.LLM.Provider,
+		"GEMINI_MODEL":      &c.LLM.Gemini.Model,
+		"OPENAI_BASE_URL":   &c.LLM.OpenAI.BaseURL,
+		"OPENAI_MODEL":      &c.LLM.OpenAI.Model,
+		"OPENAI_API_KEY":    &c.LLM.OpenAI.APIKey,
+	}
+	for name, field := range strs {
+		if v, ok := lookup(name); ok && v != "" {
+			*field = v
+		}
+	}
+	// the key has historically been read lowercase from .env, the README spells it uppercase
+	for _, name := range []string{"gemini_api_key", "GEMINI_API_KEY"} {
+		if v, ok := lookup(name); ok && v != "" {
+			c.LLM.Gemini.APIKey = v
+		}
+	}
+	ints := map[string]*int{
+		"DB_PORT":                  &c.Postgres.Port,
+		"REDIS_DB":                 &c.Redis.DB,
+		"QDRANT_PORT":              &c.VectorDB.Qdrant.Port,
+		"NUM_WORKERS":              &c.Memory.Workers,
+		"QUEUE_LEN":                &c.Memory.QueueLen,
+		"MAX_DELIVER":              &c.Memory.MaxDeliver,
+		"WORK_LANES":               &c.Memory.WorkLanes,
+		"MAX_CORE_MEMORIES":        &c.Memory.MaxCoreMemories,
+		"CORE_MEMORY_TOKEN_BUDGET": &c.Memory.CoreMemoryTokenBudget,
+	}
+	bools := map[string]*bool{
+		"AUTH_DISABLED": &c.Server.AuthDisabled,
+	}
+	for name, field := range bools {
+		v, ok := lookup(name)
+		if !ok || v == "" {
+			continue
+		}
+		b, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("%s must be true or false, got %q", name, v)
+		}
+		*field = b
+	}
+	for name, field := range ints {
+		v, ok := lookup(name)
+		if !ok || v == "" {
+			continue
+		}
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return fmt.Errorf("%s must be an integer, got %q", name, v)
+		}
+		*field = n
+	}
+	return nil
+}
+
+// Validate reports every problem with the config at once, so a bad deployment fails at startup and not on the
+// first request.
+func (c *Config) Validate() error {
+	var errs []error
+	required := func(name, value string) {
+		if value == "" {
+			errs = append(errs, fmt.Errorf("%s is required", name))
+		}
+	}
+	port := func(name string, value int) {
+		if value < 1 || value > 65535 {
+			errs = append(errs, fmt.Errorf("%s must be between 1 and 65535, got %d", name, value))
+		}
+	}
+	positive := func(name string, value int) {
+		if value < 1 {
+			errs = append(errs, fmt.Errorf("%s must be at least 1, got %d", name, value))
+		}
+	}
+	nonNegative := func(name string, value int) {
+		if value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %d", name, value))
+		}
+	}
+
+	required("server.listen_addr", c.Server.ListenAddr)
+	required("postgres.host", c.Postgres.Host)
+	port("postgres.port", c.Postgres.Port)
+	required("postgres.user", c.Postgres.User)
+	required("postgres.dbname", c.Postgres.DBName)
+	required("redis.addr", c.Redis.Addr)
+	if c.Redis.DB < 0 {
+		errs = append(errs, fmt.Errorf("redis.db can't be negative, got %d", c.Redis.DB))
+	}
+	switch c.VectorDB.Backend {
+	case "qdrant":
+		required("vectordb.qdrant.host", c.VectorDB.Qdrant.Host)
+		port("vectordb.qdrant.port", c.VectorDB.Qdrant.Port)
+		required("vectordb.qdrant.collection", c.VectorDB.Qdrant.Collection)
+	case "pgvector", "memory":
+	default:
+		errs = append(errs, fmt.Errorf("vectordb.backend must be qdrant, pgvector or memory, got %q", c.VectorDB.Backend))
+	}
+	required("embedding.addr", c.Embedding.Addr)
+	required("nats.url", c.NATS.URL)
+	required("telemetry.service_name", c.Telemetry.ServiceName)
+	required("telemetry.otlp_endpoint", c.Telemetry.OTLPEndpoint)
+	switch c.LLM.Provider {
+	case "gemini":
+		required("llm.gemini.model", c.LLM.Gemini.Model)
+		required("llm.gemini.api_key", c.LLM.Gemini.APIKey)
+	case "openai":
+		required("llm.openai.base_url", c.LLM.OpenAI.BaseURL)
+		required("llm.openai.model", c.LLM.OpenAI.Model)
+	default:
+		errs = append(errs, fmt.Errorf("llm.provider must be gemini or openai, got %q", c.LLM.Provider))
+	}
+	positive("memory.workers", c.Memory.Workers)
+	positive("memory.queue_len", c.Memory.QueueLen)
+	positive("memory.max_deliver", c.Memory.MaxDeliver)
+	if c.Memory.WorkLanes < 1 || c.Memory.WorkLanes > maxWorkLanes {
+		errs = append(errs, fmt.Errorf("memory.work_lanes must be between 1 and %d, got %d", maxWorkLanes, c.Memory.WorkLanes))
+	}
+	nonNegative("memory.max_core_memories", c.Memory.MaxCoreMemories)
+	nonNegative("memory.core_memory_token_budget", c.Memory.CoreMemoryTokenBudget)
+	return errors.Join(errs...)
+}
@@ -0,0 +1,81 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v3"
+)
+
+func TestLoadFileAndEnvOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gomemory.yaml")
+	err := os.WriteFile(path, []byte(`
+server:
+  listen_addr: ":8080"
+vectordb:
+  qdrant:
+    host: qdrant.internal
+    collection: staging_memories
+llm:
+  gemini:
+    api_key: from-file
+memory:
+  workers: 8
+`), 0o600)
+	require.NoError(t, err)
+	t.Setenv("QDRANT_PORT", "6334")
+	t.Setenv("MAX_DELIVER", "3")
+	t.Setenv("DB_PASSWORD", "secret")
+
+	cfg, err := Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, ":8080", cfg.Server.ListenAddr)
+	assert.Equal(t, QdrantConfig{Host: "qdrant.internal", Port: 6334, Collection: "staging_memories"}, cfg.VectorDB.Qdrant)
+	assert.Equal(t, 8, cfg.Memory.Workers)
+	assert.Equal(t, 3, cfg.Memory.MaxDeliver)
+	assert.Equal(t, 5000, cfg.Memory.QueueLen)
+	assert.Zero(t, cfg.Memory.MaxCoreMemories, "core memories aren't consolidated unless asked for")
+	assert.Zero(t, cfg.Memory.CoreMemoryTokenBudget)
+	assert.Equal(t, "host=127.0.0.1 port=5433 user=postgres dbname=memory password=secret sslmode=disable", cfg.Postgres.ConnString())
+}
+
+func TestValidate(t *testing.T) {
+	cfg := Default()
+	cfg.LLM.Gemini.APIKey = "key"
+	require.NoError(t, cfg.Validate())
+
+	cfg.VectorDB.Backend = "milvus"
+	cfg.Memory.Workers = 0
+	cfg.Postgres.Port = 70000
+	cfg.Memory.MaxCoreMemories = -1
+	cfg.Memory.WorkLanes = 0
+	err := cfg.Validate()
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "vectordb.backend")
+	assert.ErrorContains(t, err, "memory.workers")
+	assert.ErrorContains(t, err, "postgres.port")
+	assert.ErrorContains(t, err, "memory.max_core_memories")
+	assert.ErrorContains(t, err, "memory.work_lanes")
+}
+
+func TestApplyEnvRejectsBadIntegers(t *testing.T) {
+	cfg := Default()
+	err := cfg.applyEnv(func(name string) (string, bool) {
+		if name == "NUM_WORKERS" {
+			return "two", true
+		}
+		return "", false
+	})
+	assert.ErrorContains(t, err, "NUM_WORKERS")
+}
+
+func TestExampleConfigMatchesDefaults(t *testing.T) {
+	data, err := os.ReadFile("../config.example.yaml")
+	require.NoError(t, err)
+	cfg := &Config{}
+	require.NoError(t, yaml.Unmarshal(data, cfg))
+	assert.Equal(t, Default(), cfg)
+}
@@ -18,11 +18,21 @@ import (
 type Embed interface {
 	GenerateEmbeddings(user_query []string, ctx context.Context) ([]types.DenseEmbedding, []types.SparseEmbedding, error)
 	GenerateDenseEmbedding(query string) (types.DenseEmbedding, error)
+	Model() string  //identifies the models the embeddings come from, vectors of different models can't be mixed
+	Dimension() int //the size of the dense vectors
 }
 
+// DefaultModel names the dense and sparse models the Python embedding service runs.
+const DefaultModel = "BAAI/bge-small-en-v1.5+prithivida/Splade_PP_en_v1"
+
+// DefaultDimension is the size of the dense vectors of BAAI/bge-small-en-v1.5.
+const DefaultDimension = 384
+
 // EmbeddingClient handles gRPC communication with the embedding service
 type EmbeddingClient struct {
 	EmbedServiceUrl string
+	ModelName       string
+	DenseDimension  int
 	conn            *grpc.ClientConn
 	client          pb.EmbeddingServiceClient
 }
@@ -43,11 +53,21 @@ func NewEmbeddingClient(EmbedServiceUrl string) (*EmbeddingClient, error) {
 
 	return &EmbeddingClient{
 		EmbedServiceUrl: EmbedServiceUrl,
+		ModelName:       DefaultModel,
+		DenseDimension:  DefaultDimension,
 		conn:            conn,
 		client:          client,
 	}, nil
 }
 
+func (e *EmbeddingClient) Model() string {
+	return e.ModelName
+}
+
+func (e *EmbeddingClient) Dimension() int {
+	return e.DenseDimension
+}
+
 // Close closes the gRPC connection
 func (e *EmbeddingClient) Close() error {
 	if e.conn != nil {
@@ -59,3 +59,31 @@ func TestGenerateEmbeddings(t *testing.T) {
 	slog.Info("Hot Inference Time", "duration", duration)
 	slog.Info("Per Query Latency", "latency", duration/time.Duration(len(user_query)))
 }
+
+func TestFakeEmbedder(t *testing.T) {
+	f := NewFakeEmbedder()
+	dense, sparse, err := f.GenerateEmbeddings([]string{"User lives in Paris", "_Query_User lives in Paris", "User drives a car"}, t.Context())
+	if err != nil {
+		t.Fatal("Got this error while generating fake embeddings", err)
+	}
+	if len(dense[0].Values) != FakeDenseDimension {
+		t.Errorf("expected %d dense dimensions, got %d", FakeDenseDimension, len(dense[0].Values))
+	}
+	// the query marker must not change the embedding, otherwise queries would never match stored memories
+	for i := range dense[0].Values {
+		if dense[0].Values[i] != dense[1].Values[i] {
+			t.Fatal("query and memory with the same text embedded differently")
+		}
+	}
+	var same, other float32
+	for i := range dense[0].Values {
+		same += dense[0].Values[i] * dense[1].Values[i]
+		other += dense[0].Values[i] * dense[2].Values[i]
+	}
+	if same <= other {
+		t.Errorf("expected identical texts to be closer than different ones, got %f <= %f", same, other)
+	}
+	if len(sparse[0].Indices) != len(sparse[0].Values) || len(sparse[0].Indices) == 0 {
+		t.Errorf("malformed sparse embedding %v", sparse[0])
+	}
+}
@@ -0,0 +1,114 @@
+package embed
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"math"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+const (
+	// FakeDenseDimension matches the size of BAAI/bge-small-en-v1.5, which the vector dbs are set up for.
+	FakeDenseDimension = 384
+	// FakeSparseVocabulary matches the vocabulary size of the SPLADE model.
+	FakeSparseVocabulary = 30522
+)
+
+// FakeEmbedder generates deterministic embeddings without the Python embedding service. Every word is hashed into a
+// dense bucket (with a hashed sign) and a sparse index, so texts sharing words are similar under both cosine
+// similarity and sparse dot product, which is enough to exercise hybrid search in tests.
+type FakeEmbedder struct{}
+
+func NewFakeEmbedder() *FakeEmbedder {
+	return &FakeEmbedder{}
+}
+
+func (f *FakeEmbedder) GenerateEmbeddings(user_query []string, ctx context.Context) ([]types.DenseEmbedding, []types.SparseEmbedding, error) {
+	if len(user_query) == 0 {
+		return nil, nil, fmt.Errorf("user_query cannot be empty")
+	}
+	dense := make([]types.DenseEmbedding, len(user_query))
+	sparse := make([]types.SparseEmbedding, len(user_query))
+	for i, q := range user_query {
+		dense[i] = fakeDense(q)
+		sparse[i] = fakeSparse(q)
+	}
+	return dense, sparse, nil
+}
+
+// FakeModel is what the FakeEmbedder reports as its model, its vectors mean nothing to a real model.
+const FakeModel = "gomemory-fake-embedder"
+
+func (f *FakeEmbedder) Model() string {
+	return FakeModel
+}
+
+func (f *FakeEmbedder) Dimension() int {
+	return FakeDenseDimension
+}
+
+func (f *FakeEmbedder) GenerateDenseEmbedding(query string) (types.DenseEmbedding, error) {
+	if query == "" {
+		return types.DenseEmbedding{}, fmt.Errorf("query cannot be empty")
+	}
+	return fakeDense(query), nil
+}
+
+// fakeTokens lowercases the text and splits it into words. The "_Query_" marker the memory agent puts in front of
+// queries is dropped so a query and a memory with the same words embed the same.
+func fakeTokens(text string) []string {
+	text = strings.TrimPrefix(text, "_Query_")
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func fakeHash(token string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(token))
+	return h.Sum32()
+}
+
+func fakeDense(text string) types.DenseEmbedding {
+	values := make([]float32, FakeDenseDimension)
+	for _, token := range fakeTokens(text) {
+		h := fakeHash(token)
+		sign := float32(1)
+		if h&(1<<31) != 0 {
+			sign = -1
+		}
+		values[h%FakeDenseDimension] += sign
+	}
+	var norm float64
+	for _, v := range values {
+		norm += float64(v * v)
+	}
+	if norm > 0 {
+		norm = math.Sqrt(norm)
+		for i := range values {
+			values[i] = float32(float64(values[i]) / norm)
+		}
+	}
+	return types.DenseEmbedding{Values: values}
+}
+
+func fakeSparse(text string) types.SparseEmbedding {
+	counts := make(map[uint32]float32)
+	for _, token := range fakeTokens(text) {
+		counts[fakeHash(token)%FakeSparseVocabulary]++
+	}
+	sparse := types.SparseEmbedding{}
+	for idx := range counts {
+		sparse.Indices = append(sparse.Indices, idx)
+	}
+	sort.Slice(sparse.Indices, func(i, j int) bool { return sparse.Indices[i] < sparse.Indices[j] })
+	for _, idx := range sparse.Indices {
+		sparse.Values = append(sparse.Values, counts[idx])
+	}
+	return sparse
+}
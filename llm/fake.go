@@ -0,0 +1,186 @@
+package llm
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+var ErrNoFakeResponse = errors.New("fake llm has no response scripted for this input")
+
+// FakeLLM is a deterministic, scriptable LLM for tests. Responses are keyed by the content of the last user message
+// (see FakeKey), so a test can script a whole conversation without any network.
+//
+// Scripted DELETE actions may name their target by the text of an existing memory instead of its id, the fake swaps
+// it for the real id the same way the real backends swap their integer ids back. So may the sources of scripted merges.
+type FakeLLM struct {
+	mu               sync.Mutex
+	expandedQueries  map[string]string
+	memoryOutputs    map[string]*types.MemoryOutput
+	errors           map[string]error
+	consolidation    *types.ConsolidationOutput
+	consolidationErr error
+	GenerateCalls    []FakeGenerateCall
+	ConsolidateCalls []FakeConsolidateCall
+}
+
+// FakeGenerateCall is what GenerateMemoryText was called with, for assertions.
+type FakeGenerateCall struct {
+	Messages     []types.Message
+	CoreMemories []types.Memory
+	OldMemories  []types.Memory
+}
+
+// FakeConsolidateCall is what ConsolidateCoreMemories was called with, for assertions.
+type FakeConsolidateCall struct {
+	CoreMemories []types.Memory
+	MaxMemories  int
+	TokenBudget  int
+}
+
+func NewFakeLLM() *FakeLLM {
+	return &FakeLLM{
+		expandedQueries: make(map[string]string),
+		memoryOutputs:   make(map[string]*types.MemoryOutput),
+		errors:          make(map[string]error),
+	}
+}
+
+// FakeKey is the key responses are looked up by: the content of the last user message, or of the last message if
+// there is no user message.
+func FakeKey(messages []types.Message) string {
+	for i := len(messages) - 1; i >= 0; i-- {
+		if messages[i].Role == types.RoleUser {
+			return strings.TrimSpace(messages[i].Content)
+		}
+	}
+	if len(messages) == 0 {
+		return ""
+	}
+	return strings.TrimSpace(messages[len(messages)-1].Content)
+}
+
+// OnExpandQuery scripts the query ExpandQuery returns for input. Unscripted inputs are answered with "SKIP".
+func (f *FakeLLM) OnExpandQuery(input string, query string) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.expandedQueries[strings.TrimSpace(input)] = query
+	return f
+}
+
+// OnGenerateMemoryText scripts the MemoryOutput GenerateMemoryText returns for input.
+func (f *FakeLLM) OnGenerateMemoryText(input string, output *types.MemoryOutput) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.memoryOutputs[strings.TrimSpace(input)] = output
+	return f
+}
+
+// FailGenerateMemoryText makes GenerateMemoryText fail with err for input.
+func (f *FakeLLM) FailGenerateMemoryText(input string, err error) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.errors[strings.TrimSpace(input)] = err
+	return f
+}
+
+// OnConsolidateCoreMemories scripts the ConsolidationOutput every call of ConsolidateCoreMemories returns. Unscripted
+// calls fail with ErrNoFakeResponse.
+func (f *FakeLLM) OnConsolidateCoreMemories(output *types.ConsolidationOutput) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.consolidation = output
+	return f
+}
+
+// FailConsolidateCoreMemories makes ConsolidateCoreMemories fail with err.
+func (f *FakeLLM) FailConsolidateCoreMemories(err error) *FakeLLM {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.consolidationErr = err
+	return f
+}
+
+func (f *FakeLLM) ExpandQuery(messages []types.Message, ctx context.Context) string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if query, ok := f.expandedQueries[FakeKey(messages)]; ok {
+		return query
+	}
+	return "SKIP"
+}
+
+func (f *FakeLLM) GenerateMemoryText(messages []types.Message, coreMemories []types.Memory, oldMemories []types.Memory, ctx context.Context) (*types.MemoryOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.GenerateCalls = append(f.GenerateCalls, FakeGenerateCall{
+		Messages:     messages,
+		CoreMemories: coreMemories,
+		OldMemories:  oldMemories,
+	})
+	key := FakeKey(messages)
+	if err, ok := f.errors[key]; ok {
+		return nil, err
+	}
+	scripted, ok := f.memoryOutputs[key]
+	if !ok {
+		return nil, ErrNoFakeResponse
+	}
+	textToId := make(map[string]string)
+	for _, m := range append(append([]types.Memory{}, coreMemories...), oldMemories...) {
+		textToId[m.Memory_text] = m.Memory_Id
+	}
+	resolve := func(actions []types.MemoryAction) []types.MemoryAction {
+		resolved := make([]types.MemoryAction, len(actions))
+		copy(resolved, actions)
+		for idx, action := range resolved {
+			if action.TargetMemoryID == nil {
+				continue
+			}
+			if id, ok := textToId[*action.TargetMemoryID]; ok {
+				resolved[idx].TargetMemoryID = &id
+			}
+		}
+		return resolved
+	}
+	return &types.MemoryOutput{
+		Reasoning:            scripted.Reasoning,
+		CoreMemoryActions:    resolve(scripted.CoreMemoryActions),
+		GeneralMemoryActions: resolve(scripted.GeneralMemoryActions),
+	}, nil
+}
+
+func (f *FakeLLM) ConsolidateCoreMemories(coreMemories []types.Memory, maxMemories int, tokenBudget int, ctx context.Context) (*types.ConsolidationOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.ConsolidateCalls = append(f.ConsolidateCalls, FakeConsolidateCall{
+		CoreMemories: coreMemories,
+		MaxMemories:  maxMemories,
+		TokenBudget:  tokenBudget,
+	})
+	if f.consolidationErr != nil {
+		return nil, f.consolidationErr
+	}
+	if f.consolidation == nil {
+		return nil, ErrNoFakeResponse
+	}
+	textToId := make(map[string]string)
+	for _, m := range coreMemories {
+		textToId[m.Memory_text] = m.Memory_Id
+	}
+	output := &types.ConsolidationOutput{Reasoning: f.consolidation.Reasoning}
+	for _, merge := range f.consolidation.Merges {
+		resolved := types.CoreMemoryMerge{Payload: merge.Payload}
+		for _, source := range merge.SourceMemoryIds {
+			if id, ok := textToId[source]; ok {
+				source = id
+			}
+			resolved.SourceMemoryIds = append(resolved.SourceMemoryIds, source)
+		}
+		output.Merges = append(output.Merges, resolved)
+	}
+	return output, nil
+}
@@ -3,17 +3,16 @@ package llm
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
-	"os"
-	"strconv"
+	"net/url"
 	"strings"
 	"time"
 
 	"math/rand"
 
 	"github.com/Prateek-Gupta001/GoMemory/types"
-	"github.com/joho/godotenv"
 	"go.opentelemetry.io/otel"
 
 	// "github.com/google/uuid"
@@ -24,6 +23,8 @@ import (
 type LLM interface {
 	GenerateMemoryText(messages []types.Message, coreMemories []types.Memory, oldMemories []types.Memory, ctx context.Context) (*types.MemoryOutput, error)
 	ExpandQuery([]types.Message, context.Context) string
+	// ConsolidateCoreMemories asks for merges that bring the core memories within maxMemories and tokenBudget.
+	ConsolidateCoreMemories(coreMemories []types.Memory, maxMemories int, tokenBudget int, ctx context.Context) (*types.ConsolidationOutput, error)
 }
 
 type GeminiLLM struct {
@@ -31,107 +32,29 @@ type GeminiLLM struct {
 	GeminiClient *genai.Client
 }
 
-func NewGeminiLLM() (*GeminiLLM, error) {
-	err := godotenv.Load()
-	if err != nil {
-		slog.Error("got this error while trying to load a dotenv file", "error", err)
-	}
-
+func NewGeminiLLM(apiKey string, modelName string) (*GeminiLLM, error) {
 	client, err := genai.NewClient(context.Background(), &genai.ClientConfig{
-		APIKey: os.Getenv("gemini_api_key"),
+		APIKey: apiKey,
 	})
 	if err != nil {
 		slog.Error("Got this error while trying to generate Gemini Client", "error", err)
 		return &GeminiLLM{}, err
 	}
 	return &GeminiLLM{
-		ModelName:    "Gemini",
+		ModelName:    modelName,
 		GeminiClient: client,
 	}, nil
 }
 
-type Existing_Memory struct {
-	Memory_text string           `json:"text"`
-	Type        types.MemoryType `json:"type"`
-	MemoryId    string           `json:"id"`
-}
-
 var Tracer = otel.Tracer("Go_Memory")
 
 func (llm *GeminiLLM) GenerateMemoryText(messages []types.Message, coreMemories []types.Memory, oldMemories []types.Memory, ctx context.Context) (*types.MemoryOutput, error) {
 	ctx, span := Tracer.Start(ctx, "Generating MemoryOutput from LLM")
 	defer span.End()
-	var allUserText string
-	var prompt string
-	var Existing_Memories_old []Existing_Memory
-	var Existing_Memories_core []Existing_Memory
-	var sb strings.Builder
-	for _, msg := range messages {
-		//TODO: Think about whether you actually want the allUserText or just the latest turn .. since the memories for the previous turns would
-		//TODO: already have been stored by won't show up in existing memories .. or the dev should only do this .. after a fix no. of turns
-		//TODO: something like that .. think about that in the docs. How should the developer experience in that be..
-		switch msg.Role {
-		case types.RoleUser:
-			sb.WriteString("User: ")
-		case types.RoleAssistant:
-			sb.WriteString("Assistant: ")
-		case types.RoleSystem:
-			sb.WriteString("System: ")
-		default:
-			continue
-		}
-		sb.WriteString(msg.Content)
-		sb.WriteString("\n")
-		//TODO: Write now .. all the message content goes .. change this .. or keep it turn wise or something like that.
-	}
-	allUserText = sb.String()
-	type DoubleMap struct {
-		UUIDtoInt map[string]string
-		IntTOUUID map[string]string
-	}
-	UUIDtoInt := make(map[string]string)
-	UIntTOUUID := make(map[string]string)
-	dMap := DoubleMap{
-		UUIDtoInt: UUIDtoInt,
-		IntTOUUID: UIntTOUUID,
-	}
-
-	for idx, m := range coreMemories {
-		//TODO: Add a check to ensure that these are actually core memories!
-		dMap.UUIDtoInt[m.Memory_Id] = strconv.Itoa(idx)
-		dMap.IntTOUUID[strconv.Itoa(idx)] = m.Memory_Id
-		Existing_Memories_core = append(Existing_Memories_core, Existing_Memory{
-			Memory_text: m.Memory_text,
-			Type:        m.Type,
-			MemoryId:    dMap.UUIDtoInt[m.Memory_Id],
-		})
-	}
-	for idx, m := range oldMemories {
-		displacedId := idx + len(coreMemories)
-		dMap.UUIDtoInt[m.Memory_Id] = strconv.Itoa(displacedId)
-		dMap.IntTOUUID[strconv.Itoa(displacedId)] = m.Memory_Id
-		Existing_Memories_old = append(Existing_Memories_old, Existing_Memory{
-			Memory_text: m.Memory_text,
-			Type:        m.Type,
-			MemoryId:    dMap.UUIDtoInt[m.Memory_Id],
-		})
-	}
-
-	slog.Info("Here is the mapping here", "map", dMap)
-	OldMemorybytes, err := json.MarshalIndent(Existing_Memories_old, "", " ")
-	if err != nil {
-		slog.Error("Got this error while doing json.MarshalIndent.. and while generating memory text", "err", err)
-		return nil, err
-	}
-	coreMemoryBytes, err := json.MarshalIndent(Existing_Memories_core, "", " ")
+	prompt, intToUUID, err := BuildArchivistPrompt(messages, coreMemories, oldMemories)
 	if err != nil {
-		slog.Error("Got this error while doing json.MarshalIndent.. and while generating memory text", "err", err)
 		return nil, err
 	}
-
-	slog.Info("Here are the thing being passed into the prompt", "Existing Old Memories", string(OldMemorybytes), "Existing Core Memories", string(coreMemoryBytes), "UserInput", allUserText)
-
-	prompt = "<EXISTING_CORE_MEMORIES> \n" + string(coreMemoryBytes) + "\n </EXISTING_CORE_MEMORIES> \n" + "<EXISTING_OLD_MEMORIES> \n" + string(OldMemorybytes) + "\n </EXISTING_OLD_MEMORIES> \n" + "<USER_INPUT> \n" + allUserText + "\n </USER_INPUT>"
 	// Action Schema (Same as before)
 	ptr := true
 
@@ -141,7 +64,7 @@ func (llm *GeminiLLM) GenerateMemoryText(messages []types.Message, coreMemories
 		Properties: map[string]*genai.Schema{
 			"action_type": {
 				Type: genai.TypeString,
-				Enum: []string{"INSERT", "DELETE"},
+				Enum: MemoryActionTypes,
 			},
 			"payload": {
 				Type:     genai.TypeString,
@@ -150,7 +73,7 @@ func (llm *GeminiLLM) GenerateMemoryText(messages []types.Message, coreMemories
 			"target_memory_id": {
 				Type:        genai.TypeString,
 				Nullable:    &ptr,
-				Description: "The Integer ID of the memory to delete.",
+				Description: "The Integer ID of the memory to update or delete.",
 			},
 		},
 		Required: []string{"action_type"},
@@ -161,17 +84,9 @@ func (llm *GeminiLLM) GenerateMemoryText(messages []types.Message, coreMemories
 		Title: "MemoryArchivistOutput",
 		Properties: map[string]*genai.Schema{
 			"step_1 critical_reasoning": {
-				Type:  genai.TypeString,
-				Title: "The Analyst Workbench",
-				Description: `CRITICAL: You must output your thought process here BEFORE generating actions.
-            Follow this EXACT structure in your text:
-            1. [INPUT ANALYSIS] List distinct facts found in User Input. Think about what new facts have been mentioned by the user.
-            2. [CORE SCAN] Check 'Existing_Core_Memories' for conflicts.
-               - IF Conflict Found: Write "CONFLICT: Core ID [X] says '...' vs New Input '...' -> Must DELETE [X] and INSERT new."
-            3. [GENERAL SCAN] Check 'Existing_General_Memories' for conflicts.
-               - IF Conflict Found: Write "CONFLICT: Gen ID [Y] says '...' vs New Input '...' -> Must DELETE [Y] and INSERT new."
-            4. [DUPLICATION CHECK] verify that the new fact doesn't already exist perfectly.
-            `,
+				Type:        genai.TypeString,
+				Title:       "The Analyst Workbench",
+				Description: ReasoningDescription,
 			},
 			"step_2 core_memory_actions": {
 				Type:  genai.TypeArray,
@@ -187,79 +102,8 @@ func (llm *GeminiLLM) GenerateMemoryText(messages []types.Message, coreMemories
 		Required: []string{"step_1 critical_reasoning", "step_2 core_memory_actions", "step_3 general_memory_actions"},
 	}
 	config := &genai.GenerateContentConfig{
-		SystemInstruction: genai.NewContentFromText(`### ROLE
-You are the **Memory Archivist**. You are a Ruthless Database Administrator. Your goal is to maintain a pristine, high-signal database.
-
-### THE "GATEKEEPER" PROTOCOL (Spam Filter)
-**90% of user conversation is NOT memory-worthy. Do not archive temporary context.**
-You must aggressively filter out noise. Only store permanent truths.
-
-* **TRASH (Do Not Save):**
-    * *Chitchat:* "Hello", "How are you?", "Thanks".
-    * *Temporary States:* "I'm hungry", "I'm going to sleep", "I'm driving right now".
-    * *Task Context:* "Here is my code, fix it", "Write a poem about dogs". (The user asking for code is not a memory; the user *liking* Python is).
-    * *Vague Statements:* "That's cool", "I like that".
-
-* **TREASURE (Save Immediately):**
-    * *Biographical:* "I am 25", "I live in Berlin".
-    * *Preferences:* "I prefer short answers", "I hate Java".
-    * *Projects:* "I am building a RAG app with Qdrant".
-
-### THE "PREDATORY PRUNING" PROTOCOL
-**Passive recording is insufficient. You must ACTIVELY HUNT for obsolete data.**
-Your default mode is "Search and Destroy." Treat every new piece of information as a weapon to eliminate outdated facts.
-
-**EXECUTION RULES:**
-1.  **Assume Conflict:** For every single fact you extract, *assume* a contradiction already exists in the database. Your job is to find it.
-2.  **Stalk the Target:** If a new fact updates a user's status (e.g., "Student" -> "Employed"), you MUST issue a DELETE command for the old ID.
-3.  **Zero Tolerance:** Allowing two conflicting versions of the truth to coexist is a CRITICAL SYSTEM FAILURE.
-
-### MEMORY CLASSIFICATION
-**TIER 1: CORE MEMORIES (Identity & Existence)**
-* **Scope:** Name, Age, Gender, Location, Profession, Global AI Instructions.
-* **Action:** If these change, the old memory MUST be deleted immediately.
-
-**TIER 2: GENERAL MEMORIES (Biographical & Tastes)**
-* **Scope:** Projects, specific tech stack skills, pets, likes/dislikes.
-* **Action:** Refine vague memories into specific ones.
-
-### INPUT DATA
-1.  *Existing_Core_Memories*: List of { "id": "1", "text": "..." }
-2.  *Existing_General_Memories*: List of { "id": "101", "text": "..." }
-3.  *User_Input*: The new text to process.
-
-### PROCESS (The Analyst Workbench)
-In your "step_1_critical_reasoning" field:
-1.  **Filter:** explicitly state what you are IGNORING (e.g., "Ignored 'Hi' as chitchat").
-2.  **Extract:** List the actual memory-worthy facts.
-3.  **Target:** Identify specific IDs to DELETE.
-4.  **Decide:** List the Kill List and the New Entries.
-
-### ID HANDLING
-* **CRITICAL:** When generating a DELETE action, you MUST output the exact Integer ID as a string (e.g., "42").
-
-### ONE-SHOT DEMONSTRATION
-**Input:**
-* Existing_Core_Memories: [{"id": "1", "text": "User lives in Berlin"}, {"id": "2", "text": "User is a Student"}]
-* Existing_General_Memories: [{"id": "55", "text": "User is learning Python basics"}]
-* User_Input: "Hey Gemini! I actually just finished my degree and moved to London! Can you help me write a Go script for my new job? I've stopped using Python btw."
-
-**Correct Output:**
-{
-  "step_1_critical_reasoning": "1. FILTERING: Ignored 'Hey Gemini' (Chitchat). Ignored 'Can you help me write a Go script' (Task Context). \n2. FACTS: User graduated (Student -> Worker), Moved (Berlin -> London), Tech Switch (Drop Python, Add Go). \n3. PREDATORY SCAN: Target ID '1' (Berlin) -> DELETE. Target ID '2' (Student) -> DELETE. Target ID '55' (Python) -> DELETE.",
-  "step_2_core_memory_actions": [
-    { "action_type": "DELETE", "target_memory_id": "1", "payload": null },
-    { "action_type": "INSERT", "payload": "User lives in London, UK.", "target_memory_id": null },
-    { "action_type": "DELETE", "target_memory_id": "2", "payload": null },
-    { "action_type": "INSERT", "payload": "User is a working professional (Graduated).", "target_memory_id": null }
-  ],
-  "step_3_general_memory_actions": [
-    { "action_type": "DELETE", "target_memory_id": "55", "payload": null },
-    { "action_type": "INSERT", "payload": "User codes primarily in Golang and has stopped using Python.", "target_memory_id": null }
-  ]
-}
-`, genai.RoleUser),
-		ResponseMIMEType: "application/json",
+		SystemInstruction: genai.NewContentFromText(ArchivistInstruction, genai.RoleUser),
+		ResponseMIMEType:  "application/json",
 		ThinkingConfig: &genai.ThinkingConfig{
 			ThinkingLevel:   "high",
 			IncludeThoughts: false,
@@ -272,7 +116,7 @@ In your "step_1_critical_reasoning" field:
 		slog.Info("In the for loop for response generation!")
 		result, err = llm.GeminiClient.Models.GenerateContent(
 			ctx,
-			"gemini-3-flash-preview",
+			llm.ModelName,
 			genai.Text(prompt),
 			config)
 		if err == nil {
@@ -305,31 +149,7 @@ In your "step_1_critical_reasoning" field:
 		slog.Error("Got malformed JSON output from the LLM", "error", err)
 		return nil, err
 	}
-	for idx, _ := range memoryOutput.CoreMemoryActions {
-		if memoryOutput.CoreMemoryActions[idx].ActionType == "DELETE" {
-			slog.Info("Have Core Delete")
-			if memoryOutput.CoreMemoryActions[idx].TargetMemoryID != nil {
-				slog.Info("Have id", "id", *memoryOutput.CoreMemoryActions[idx].TargetMemoryID)
-				id := *memoryOutput.CoreMemoryActions[idx].TargetMemoryID
-				uuid := dMap.IntTOUUID[id]
-				memoryOutput.CoreMemoryActions[idx].TargetMemoryID = &uuid
-				slog.Info("Swapping it for this id", "new_id", *memoryOutput.CoreMemoryActions[idx].TargetMemoryID)
-			}
-		}
-	}
-	for idx, _ := range memoryOutput.GeneralMemoryActions {
-		if memoryOutput.GeneralMemoryActions[idx].ActionType == "DELETE" {
-			slog.Info("Have General Delete")
-			if memoryOutput.GeneralMemoryActions[idx].TargetMemoryID != nil {
-				slog.Info("Have id", "id", *memoryOutput.GeneralMemoryActions[idx].TargetMemoryID)
-				id := *memoryOutput.GeneralMemoryActions[idx].TargetMemoryID
-				uuid := dMap.IntTOUUID[id]
-				memoryOutput.GeneralMemoryActions[idx].TargetMemoryID = &uuid
-				slog.Info("Swapping it for this id", "new_id", *memoryOutput.GeneralMemoryActions[idx].TargetMemoryID)
-			}
-		}
-	}
-
+	RestoreMemoryIds(memoryOutput, intToUUID)
 	return memoryOutput, nil
 }
 
@@ -337,38 +157,13 @@ func (llm *GeminiLLM) ExpandQuery(messages []types.Message, ctx context.Context)
 	ctx, span := Tracer.Start(ctx, "Getting Expanded Query from the LLM")
 	defer span.End()
 	history := GetGeminiHistory(messages)
-	chat, _ := llm.GeminiClient.Chats.Create(ctx, "gemini-3-flash-preview", nil, history)
-	expandQueryPrompt := ` 
-	--- SYSTEM INSTRUCTION ---
-	### Role
-	You are a Memory Query Generator. Your goal is to generate a search query to check a vector database for EXISTING memories that might conflict with or relate to the conversation history provided to you.
-
-	### Instructions
-	1. Analyze the user and the LLM conversation in the context of the history.
-	2. Identify if the user is stating a **new fact, preference, or plan**.
-	3. If yes, generate a keyword-heavy search query to find *previous* memories about that specific **TOPIC**.
-	4. If the user is just chatting (e.g., "Hi", "Help me code"), output "SKIP".
-
-	### Examples
-	Assistant: "Do you still live in London?"
-	User: "No, I moved to Tokyo last week."
-	Query: current residence location home address city
-
-	User: "My dog's name is actually Rover, not Rex."
-	Query: pet dog name pets animal companions
-
-	User: "How do I reverse a linked list?"
-	Query: SKIP
-
-	### Output
-	Return ONLY the query string or "SKIP". Do not add markdown or explanations.
-	`
+	chat, _ := llm.GeminiClient.Chats.Create(ctx, llm.ModelName, nil, history)
 
 	//TODO: Test this properly .... can cause error maybe ....
 	var res *genai.GenerateContentResponse
 	var err error
 	for i := 0; i < 5; i++ {
-		res, err = chat.SendMessage(ctx, genai.Part{Text: expandQueryPrompt})
+		res, err = chat.SendMessage(ctx, genai.Part{Text: ExpandQueryPrompt})
 
 		if err == nil {
 			break
@@ -388,24 +183,113 @@ func (llm *GeminiLLM) ExpandQuery(messages []types.Message, ctx context.Context)
 
 	if err != nil {
 		slog.Error("Got this error while trying to Expand Query Falling back to messages based query", "error", err)
-		var sb strings.Builder
-		for i := len(messages) - 1; i >= 0; i-- {
-			msgContent := messages[i].Content
-			sb.WriteString(msgContent)
-			sb.WriteString("\n")
-			if sb.Len()+len(msgContent) > 2000 {
-				break
-			}
-		}
-		expandedQuery := sb.String()
-		return expandedQuery
+		return FallbackQuery(messages)
 	}
 
 	return res.Text()
 }
 
+func (llm *GeminiLLM) ConsolidateCoreMemories(coreMemories []types.Memory, maxMemories int, tokenBudget int, ctx context.Context) (*types.ConsolidationOutput, error) {
+	ctx, span := Tracer.Start(ctx, "Consolidating Core Memories with the LLM")
+	defer span.End()
+	prompt, intToUUID, err := BuildConsolidationPrompt(coreMemories, maxMemories, tokenBudget)
+	if err != nil {
+		return nil, err
+	}
+	responseSchema := &genai.Schema{
+		Type:  genai.TypeObject,
+		Title: "MemoryConsolidatorOutput",
+		Properties: map[string]*genai.Schema{
+			"step_1 critical_reasoning": {
+				Type:        genai.TypeString,
+				Title:       "The Analyst Workbench",
+				Description: ConsolidationReasoningDescription,
+			},
+			"step_2 merges": {
+				Type:  genai.TypeArray,
+				Title: "Merges",
+				Items: &genai.Schema{
+					Type:  genai.TypeObject,
+					Title: "SingleMerge",
+					Properties: map[string]*genai.Schema{
+						"source_memory_ids": {
+							Type:        genai.TypeArray,
+							Items:       &genai.Schema{Type: genai.TypeString},
+							Description: "The Integer IDs of the core memories merged into this one.",
+						},
+						"payload": {
+							Type: genai.TypeString,
+						},
+					},
+					Required: []string{"source_memory_ids", "payload"},
+				},
+			},
+		},
+		Required: []string{"step_1 critical_reasoning", "step_2 merges"},
+	}
+	config := &genai.GenerateContentConfig{
+		SystemInstruction:  genai.NewContentFromText(ConsolidatorInstruction, genai.RoleUser),
+		ResponseMIMEType:   "application/json",
+		ResponseJsonSchema: responseSchema,
+	}
+
+	var result *genai.GenerateContentResponse
+	for i := 0; i < 5; i++ {
+		result, err = llm.GeminiClient.Models.GenerateContent(
+			ctx,
+			llm.ModelName,
+			genai.Text(prompt),
+			config)
+		if err == nil {
+			break
+		}
+		if !RetryAbleError(err) {
+			return nil, err
+		}
+		backoff := time.Duration(1<<i) * time.Second
+		jitter := time.Duration(rand.Int63n(int64(backoff)/5*2) - int64(backoff)/5)
+		retryDuration := backoff + jitter
+		slog.Error("Got this error while consolidating core memories.. in the llm call. Retrying after some time", "error", err, "time", retryDuration)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retryDuration):
+		}
+		slog.Info("Retrying!")
+	}
+
+	if err != nil {
+		slog.Error("Got this error while consolidating core memories.. in the llm call.", "error", err)
+		return nil, err
+	}
+	output := &types.ConsolidationOutput{}
+	if err := json.NewDecoder(strings.NewReader(result.Text())).Decode(output); err != nil {
+		slog.Error("Got malformed JSON output from the LLM", "error", err)
+		return nil, err
+	}
+	RestoreMergeIds(output, intToUUID)
+	return output, nil
+}
+
 func RetryAbleError(err error) bool {
 	slog.Info("Retryable error was called!")
+	// The genai SDK reports HTTP failures as a genai.APIError value, older google clients as *googleapi.Error.
+	var aErr genai.APIError
+	if errors.As(err, &aErr) {
+		slog.Info("Retryable Error", "errcode", aErr.Code)
+		return aErr.Code == 429 || aErr.Code >= 500
+	}
+	var oErr *OpenAIError
+	if errors.As(err, &oErr) {
+		slog.Info("Retryable Error", "errcode", oErr.StatusCode)
+		return oErr.StatusCode == 429 || oErr.StatusCode >= 500
+	}
+	// A self-hosted endpoint that can't be reached is most likely restarting.
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return true
+	}
 	if gErr, ok := err.(*googleapi.Error); ok {
 		slog.Info("Retryable Error", "errcode", gErr.Code)
 		if gErr.Code == 503 {
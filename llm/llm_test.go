@@ -5,13 +5,14 @@ import (
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"os"
 	"testing"
 
 	"github.com/Prateek-Gupta001/GoMemory/types"
 )
 
 func TestGenerateMemoryText(t *testing.T) {
-	llm, err := NewGeminiLLM()
+	llm, err := NewGeminiLLM(os.Getenv("gemini_api_key"), "gemini-3-flash-preview")
 	if err != nil {
 		t.Fatal("Got this error while trying to generate a llm", "error", err)
 	}
@@ -81,7 +82,7 @@ func TestGenerateMemoryText(t *testing.T) {
 }
 
 func TestGenerateMemoryText_GodMode(t *testing.T) {
-	llm, err := NewGeminiLLM()
+	llm, err := NewGeminiLLM(os.Getenv("gemini_api_key"), "gemini-3-flash-preview")
 	if err != nil {
 		t.Fatal("Failed to initialize LLM", "error", err)
 	}
@@ -0,0 +1,319 @@
+package llm
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+// OpenAICompatibleLLM talks to any server implementing the OpenAI chat completions API with JSON-schema structured
+// output, e.g. OpenAI itself or self-hosted models behind vLLM or Ollama.
+type OpenAICompatibleLLM struct {
+	BaseURL    string //e.g. http://localhost:8000/v1
+	ModelName  string
+	APIKey     string //optional, self-hosted servers usually don't need one
+	HTTPClient *http.Client
+}
+
+func NewOpenAICompatibleLLM(baseURL string, modelName string, apiKey string) (*OpenAICompatibleLLM, error) {
+	if baseURL == "" {
+		return nil, fmt.Errorf("base URL of the OpenAI-compatible endpoint is empty")
+	}
+	if modelName == "" {
+		return nil, fmt.Errorf("model name for the OpenAI-compatible endpoint is empty")
+	}
+	return &OpenAICompatibleLLM{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		ModelName:  modelName,
+		APIKey:     apiKey,
+		HTTPClient: &http.Client{Timeout: 2 * time.Minute},
+	}, nil
+}
+
+// OpenAIError is a non-2xx response from the chat completions endpoint.
+type OpenAIError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *OpenAIError) Error() string {
+	return fmt.Sprintf("chat completions request failed with status %d: %s", e.StatusCode, e.Body)
+}
+
+type openAIMessage struct {
+	Role    string `json:"role"`
+	Content string `json:"content"`
+}
+
+type openAIJSONSchema struct {
+	Name   string         `json:"name"`
+	Strict bool           `json:"strict"`
+	Schema map[string]any `json:"schema"`
+}
+
+type openAIResponseFormat struct {
+	Type       string           `json:"type"`
+	JSONSchema openAIJSONSchema `json:"json_schema"`
+}
+
+type openAIChatRequest struct {
+	Model          string               `json:"model"`
+	Messages       []openAIMessage      `json:"messages"`
+	ResponseFormat openAIResponseFormat `json:"response_format"`
+}
+
+type openAIChatResponse struct {
+	Choices []struct {
+		Message openAIMessage `json:"message"`
+	} `json:"choices"`
+}
+
+// archivistSchema mirrors the Gemini response schema. Strict mode wants every property required, so the optional
+// fields are nullable instead.
+func archivistSchema() map[string]any {
+	action := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"action_type": map[string]any{
+				"type": "string",
+				"enum": MemoryActionTypes,
+			},
+			"payload": map[string]any{
+				"type": []string{"string", "null"},
+			},
+			"target_memory_id": map[string]any{
+				"type":        []string{"string", "null"},
+				"description": "The Integer ID of the memory to update or delete.",
+			},
+		},
+		"required":             []string{"action_type", "payload", "target_memory_id"},
+		"additionalProperties": false,
+	}
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"step_1 critical_reasoning": map[string]any{
+				"type":        "string",
+				"description": ReasoningDescription,
+			},
+			"step_2 core_memory_actions": map[string]any{
+				"type":  "array",
+				"items": action,
+			},
+			"step_3 general_memory_actions": map[string]any{
+				"type":  "array",
+				"items": action,
+			},
+		},
+		"required":             []string{"step_1 critical_reasoning", "step_2 core_memory_actions", "step_3 general_memory_actions"},
+		"additionalProperties": false,
+	}
+}
+
+// consolidationSchema mirrors the Gemini response schema of the consolidator.
+func consolidationSchema() map[string]any {
+	merge := map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"source_memory_ids": map[string]any{
+				"type":        "array",
+				"items":       map[string]any{"type": "string"},
+				"description": "The Integer IDs of the core memories merged into this one.",
+			},
+			"payload": map[string]any{
+				"type": "string",
+			},
+		},
+		"required":             []string{"source_memory_ids", "payload"},
+		"additionalProperties": false,
+	}
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"step_1 critical_reasoning": map[string]any{
+				"type":        "string",
+				"description": ConsolidationReasoningDescription,
+			},
+			"step_2 merges": map[string]any{
+				"type":  "array",
+				"items": merge,
+			},
+		},
+		"required":             []string{"step_1 critical_reasoning", "step_2 merges"},
+		"additionalProperties": false,
+	}
+}
+
+func expandQuerySchema() map[string]any {
+	return map[string]any{
+		"type": "object",
+		"properties": map[string]any{
+			"query": map[string]any{
+				"type":        "string",
+				"description": `The search query, or "SKIP".`,
+			},
+		},
+		"required":             []string{"query"},
+		"additionalProperties": false,
+	}
+}
+
+func (llm *OpenAICompatibleLLM) GenerateMemoryText(messages []types.Message, coreMemories []types.Memory, oldMemories []types.Memory, ctx context.Context) (*types.MemoryOutput, error) {
+	ctx, span := Tracer.Start(ctx, "Generating MemoryOutput from LLM")
+	defer span.End()
+	prompt, intToUUID, err := BuildArchivistPrompt(messages, coreMemories, oldMemories)
+	if err != nil {
+		return nil, err
+	}
+	content, err := llm.chatCompletion([]openAIMessage{
+		{Role: "system", Content: ArchivistInstruction},
+		{Role: "user", Content: prompt},
+	}, "MemoryArchivistOutput", archivistSchema(), ctx)
+	if err != nil {
+		slog.Error("Got this error while generating memory text.. in the llm call.", "error", err)
+		return nil, err
+	}
+	memoryOutput := &types.MemoryOutput{}
+	if err := json.NewDecoder(strings.NewReader(content)).Decode(memoryOutput); err != nil {
+		slog.Error("Got malformed JSON output from the LLM", "error", err)
+		return nil, err
+	}
+	RestoreMemoryIds(memoryOutput, intToUUID)
+	return memoryOutput, nil
+}
+
+func (llm *OpenAICompatibleLLM) ExpandQuery(messages []types.Message, ctx context.Context) string {
+	ctx, span := Tracer.Start(ctx, "Getting Expanded Query from the LLM")
+	defer span.End()
+	history := make([]openAIMessage, 0, len(messages)+1)
+	for _, msg := range messages {
+		role := string(msg.Role)
+		if msg.Role == types.RoleAssistant {
+			role = "assistant"
+		}
+		history = append(history, openAIMessage{Role: role, Content: msg.Content})
+	}
+	history = append(history, openAIMessage{Role: "user", Content: ExpandQueryPrompt})
+	content, err := llm.chatCompletion(history, "ExpandedQuery", expandQuerySchema(), ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ""
+		}
+		slog.Error("Got this error while trying to Expand Query Falling back to messages based query", "error", err)
+		return FallbackQuery(messages)
+	}
+	res := struct {
+		Query string `json:"query"`
+	}{}
+	if err := json.Unmarshal([]byte(content), &res); err != nil {
+		slog.Error("Got malformed JSON while trying to Expand Query Falling back to messages based query", "error", err)
+		return FallbackQuery(messages)
+	}
+	return res.Query
+}
+
+func (llm *OpenAICompatibleLLM) ConsolidateCoreMemories(coreMemories []types.Memory, maxMemories int, tokenBudget int, ctx context.Context) (*types.ConsolidationOutput, error) {
+	ctx, span := Tracer.Start(ctx, "Consolidating Core Memories with the LLM")
+	defer span.End()
+	prompt, intToUUID, err := BuildConsolidationPrompt(coreMemories, maxMemories, tokenBudget)
+	if err != nil {
+		return nil, err
+	}
+	content, err := llm.chatCompletion([]openAIMessage{
+		{Role: "system", Content: ConsolidatorInstruction},
+		{Role: "user", Content: prompt},
+	}, "MemoryConsolidatorOutput", consolidationSchema(), ctx)
+	if err != nil {
+		slog.Error("Got this error while consolidating core memories.. in the llm call.", "error", err)
+		return nil, err
+	}
+	output := &types.ConsolidationOutput{}
+	if err := json.NewDecoder(strings.NewReader(content)).Decode(output); err != nil {
+		slog.Error("Got malformed JSON output from the LLM", "error", err)
+		return nil, err
+	}
+	RestoreMergeIds(output, intToUUID)
+	return output, nil
+}
+
+// chatCompletion sends the messages and returns the content of the first choice, retrying the same way the Gemini
+// client does.
+func (llm *OpenAICompatibleLLM) chatCompletion(messages []openAIMessage, schemaName string, schema map[string]any, ctx context.Context) (string, error) {
+	body, err := json.Marshal(openAIChatRequest{
+		Model:    llm.ModelName,
+		Messages: messages,
+		ResponseFormat: openAIResponseFormat{
+			Type: "json_schema",
+			JSONSchema: openAIJSONSchema{
+				Name:   schemaName,
+				Strict: true,
+				Schema: schema,
+			},
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+	var content string
+	for i := 0; i < 5; i++ {
+		content, err = llm.doChatCompletion(body, ctx)
+		if err == nil {
+			return content, nil
+		}
+		if !RetryAbleError(err) {
+			return "", err
+		}
+		backoff := time.Duration(1<<i) * time.Second
+		jitter := time.Duration(rand.Int63n(int64(backoff)/5*2) - int64(backoff)/5)
+		retryDuration := backoff + jitter
+		slog.Error("Got this error from the chat completions endpoint. Retrying after some time", "error", err, "time", retryDuration)
+
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(retryDuration):
+		}
+		slog.Info("Retrying!")
+	}
+	return "", err
+}
+
+func (llm *OpenAICompatibleLLM) doChatCompletion(body []byte, ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, llm.BaseURL+"/chat/completions", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if llm.APIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+llm.APIKey)
+	}
+	resp, err := llm.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return "", &OpenAIError{StatusCode: resp.StatusCode, Body: string(respBody)}
+	}
+	chatResp := &openAIChatResponse{}
+	if err := json.Unmarshal(respBody, chatResp); err != nil {
+		return "", fmt.Errorf("malformed chat completions response: %w", err)
+	}
+	if len(chatResp.Choices) == 0 {
+		return "", fmt.Errorf("chat completions response has no choices")
+	}
+	return chatResp.Choices[0].Message.Content, nil
+}
@@ -0,0 +1,155 @@
+package llm
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestOpenAIServer stands in for a vLLM/Ollama server, answering every chat completion with the given content.
+func newTestOpenAIServer(t *testing.T, content func(req openAIChatRequest) string) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/chat/completions", r.URL.Path)
+		assert.Equal(t, "Bearer test-key", r.Header.Get("Authorization"))
+		req := openAIChatRequest{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		assert.Equal(t, "test-model", req.Model)
+		assert.Equal(t, "json_schema", req.ResponseFormat.Type)
+		assert.True(t, req.ResponseFormat.JSONSchema.Strict)
+		json.NewEncoder(w).Encode(map[string]any{
+			"choices": []map[string]any{
+				{"message": map[string]string{"role": "assistant", "content": content(req)}},
+			},
+		})
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestOpenAICompatibleGenerateMemoryText(t *testing.T) {
+	server := newTestOpenAIServer(t, func(req openAIChatRequest) string {
+		assert.Equal(t, "MemoryArchivistOutput", req.ResponseFormat.JSONSchema.Name)
+		require.Len(t, req.Messages, 2)
+		assert.Equal(t, "system", req.Messages[0].Role)
+		assert.Contains(t, req.Messages[1].Content, "User lives in Berlin")
+		assert.Contains(t, req.Messages[1].Content, "I just moved to London")
+		// ids 0 and 1 are what the prompt calls core_01 and gen_101
+		return `{
+			"step_1 critical_reasoning": "Berlin -> London",
+			"step_2 core_memory_actions": [
+				{"action_type": "DELETE", "target_memory_id": "0", "payload": null},
+				{"action_type": "INSERT", "target_memory_id": null, "payload": "User lives in London"}
+			],
+			"step_3 general_memory_actions": [
+				{"action_type": "UPDATE", "target_memory_id": "1", "payload": "User likes the London techno scene"}
+			]
+		}`
+	})
+	llm, err := NewOpenAICompatibleLLM(server.URL+"/", "test-model", "test-key")
+	require.NoError(t, err)
+
+	res, err := llm.GenerateMemoryText(
+		[]types.Message{{Role: types.RoleUser, Content: "I just moved to London"}},
+		[]types.Memory{{Memory_Id: "core_01", Memory_text: "User lives in Berlin", Type: types.MemoryTypeCore}},
+		[]types.Memory{{Memory_Id: "gen_101", Memory_text: "User likes the Berlin techno scene", Type: types.MemoryTypeGeneral}},
+		t.Context())
+	require.NoError(t, err)
+
+	assert.Equal(t, "Berlin -> London", res.Reasoning)
+	require.Len(t, res.CoreMemoryActions, 2)
+	assert.Equal(t, "core_01", *res.CoreMemoryActions[0].TargetMemoryID, "integer ids must be swapped back for the real ones")
+	assert.Equal(t, "User lives in London", *res.CoreMemoryActions[1].Payload)
+	require.Len(t, res.GeneralMemoryActions, 1)
+	assert.Equal(t, "gen_101", *res.GeneralMemoryActions[0].TargetMemoryID, "so must the ids of updates")
+	assert.Equal(t, "User likes the London techno scene", *res.GeneralMemoryActions[0].Payload)
+}
+
+func TestOpenAICompatibleConsolidateCoreMemories(t *testing.T) {
+	server := newTestOpenAIServer(t, func(req openAIChatRequest) string {
+		assert.Equal(t, "MemoryConsolidatorOutput", req.ResponseFormat.JSONSchema.Name)
+		require.Len(t, req.Messages, 2)
+		assert.Equal(t, ConsolidatorInstruction, req.Messages[0].Content)
+		assert.Contains(t, req.Messages[1].Content, "User lives in London")
+		assert.Contains(t, req.Messages[1].Content, "Maximum core memories: 2")
+		return `{
+			"step_1 critical_reasoning": "0 and 1 are both about where the user lives",
+			"step_2 merges": [
+				{"source_memory_ids": ["0", "1", "7"], "payload": "User lives in London, having moved there from Berlin"}
+			]
+		}`
+	})
+	llm, err := NewOpenAICompatibleLLM(server.URL, "test-model", "test-key")
+	require.NoError(t, err)
+
+	res, err := llm.ConsolidateCoreMemories([]types.Memory{
+		{Memory_Id: "core_01", Memory_text: "User lives in London", Type: types.MemoryTypeCore},
+		{Memory_Id: "core_02", Memory_text: "User moved from Berlin", Type: types.MemoryTypeCore},
+		{Memory_Id: "core_03", Memory_text: "User is a nurse", Type: types.MemoryTypeCore},
+	}, 2, 0, t.Context())
+	require.NoError(t, err)
+
+	require.Len(t, res.Merges, 1)
+	assert.Equal(t, []string{"core_01", "core_02"}, res.Merges[0].SourceMemoryIds, "ids it was never shown must be dropped")
+	assert.Equal(t, "User lives in London, having moved there from Berlin", res.Merges[0].Payload)
+}
+
+func TestOpenAICompatibleExpandQuery(t *testing.T) {
+	server := newTestOpenAIServer(t, func(req openAIChatRequest) string {
+		assert.Equal(t, "ExpandedQuery", req.ResponseFormat.JSONSchema.Name)
+		require.Len(t, req.Messages, 3)
+		assert.Equal(t, "assistant", req.Messages[0].Role, "gemini's model role must be mapped to assistant")
+		assert.Equal(t, "user", req.Messages[1].Role)
+		assert.Equal(t, ExpandQueryPrompt, req.Messages[2].Content)
+		return `{"query": "current residence location home city"}`
+	})
+	llm, err := NewOpenAICompatibleLLM(server.URL, "test-model", "test-key")
+	require.NoError(t, err)
+
+	query := llm.ExpandQuery([]types.Message{
+		{Role: types.RoleAssistant, Content: "Do you still live in Berlin?"},
+		{Role: types.RoleUser, Content: "No, I moved to London last week."},
+	}, t.Context())
+	assert.Equal(t, "current residence location home city", query)
+}
+
+func TestOpenAICompatibleRetriesOverloadedServer(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			http.Error(w, "model is loading", http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte(`{"choices": [{"message": {"role": "assistant", "content": "{\"query\": \"SKIP\"}"}}]}`))
+	}))
+	defer server.Close()
+	llm, err := NewOpenAICompatibleLLM(server.URL, "test-model", "")
+	require.NoError(t, err)
+
+	query := llm.ExpandQuery([]types.Message{{Role: types.RoleUser, Content: "Hi!"}}, t.Context())
+	assert.Equal(t, "SKIP", query)
+	assert.Equal(t, int32(2), calls.Load())
+}
+
+func TestOpenAICompatibleDoesNotRetryBadRequests(t *testing.T) {
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		http.Error(w, "response_format json_schema is not supported", http.StatusBadRequest)
+	}))
+	defer server.Close()
+	llm, err := NewOpenAICompatibleLLM(server.URL, "test-model", "")
+	require.NoError(t, err)
+
+	_, err = llm.GenerateMemoryText([]types.Message{{Role: types.RoleUser, Content: "I am 25"}}, nil, nil, t.Context())
+	require.Error(t, err)
+	assert.False(t, RetryAbleError(err))
+	assert.True(t, strings.Contains(err.Error(), "400"))
+	assert.Equal(t, int32(1), calls.Load())
+}
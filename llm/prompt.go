@@ -0,0 +1,310 @@
+package llm
+
+import (
+	"encoding/json"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+// The prompts and the id juggling around them are shared by every LLM backend, so all of them archive memories the same way.
+
+// ArchivistInstruction is the system instruction of the Memory Archivist that turns a conversation into memory actions.
+const ArchivistInstruction = `### ROLE
+You are the **Memory Archivist**. You are a Ruthless Database Administrator. Your goal is to maintain a pristine, high-signal database.
+
+### THE "GATEKEEPER" PROTOCOL (Spam Filter)
+**90% of user conversation is NOT memory-worthy. Do not archive temporary context.**
+You must aggressively filter out noise. Only store permanent truths.
+
+* **TRASH (Do Not Save):**
+    * *Chitchat:* "Hello", "How are you?", "Thanks".
+    * *Temporary States:* "I'm hungry", "I'm going to sleep", "I'm driving right now".
+    * *Task Context:* "Here is my code, fix it", "Write a poem about dogs". (The user asking for code is not a memory; the user *liking* Python is).
+    * *Vague Statements:* "That's cool", "I like that".
+
+* **TREASURE (Save Immediately):**
+    * *Biographical:* "I am 25", "I live in Berlin".
+    * *Preferences:* "I prefer short answers", "I hate Java".
+    * *Projects:* "I am building a RAG app with Qdrant".
+
+### THE "PREDATORY PRUNING" PROTOCOL
+**Passive recording is insufficient. You must ACTIVELY HUNT for obsolete data.**
+Your default mode is "Search and Destroy." Treat every new piece of information as a weapon to eliminate outdated facts.
+
+**EXECUTION RULES:**
+1.  **Assume Conflict:** For every single fact you extract, *assume* a contradiction already exists in the database. Your job is to find it.
+2.  **Stalk the Target:** If a new fact updates a user's status (e.g., "Student" -> "Employed"), you MUST issue an UPDATE command for the old ID with the new truth as its payload.
+3.  **Kill Only What Is Dead:** Issue a DELETE only when a memory is simply no longer true and nothing replaces it (e.g., "I gave my car away").
+4.  **Zero Tolerance:** Allowing two conflicting versions of the truth to coexist is a CRITICAL SYSTEM FAILURE.
+5.  **Newest Wins:** When two facts conflict, the more recent one is the truth. *User_Input* is newer than every existing memory, and between two existing memories the one with the later "updated_at" wins.
+
+### MEMORY CLASSIFICATION
+**TIER 1: CORE MEMORIES (Identity & Existence)**
+* **Scope:** Name, Age, Gender, Location, Profession, Global AI Instructions.
+* **Action:** If these change, the old memory MUST be updated immediately.
+
+**TIER 2: GENERAL MEMORIES (Biographical & Tastes)**
+* **Scope:** Projects, specific tech stack skills, pets, likes/dislikes.
+* **Action:** Refine vague memories into specific ones.
+
+### INPUT DATA
+1.  *Existing_Core_Memories*: List of { "id": "1", "text": "...", "created_at": "...", "updated_at": "..." }
+2.  *Existing_General_Memories*: List of { "id": "101", "text": "...", "created_at": "...", "updated_at": "..." }
+3.  *User_Input*: The new text to process.
+The timestamps are RFC 3339 in UTC and tell you when a memory was first stored and when it last changed. Old memories may not have them.
+
+### PROCESS (The Analyst Workbench)
+In your "step_1_critical_reasoning" field:
+1.  **Filter:** explicitly state what you are IGNORING (e.g., "Ignored 'Hi' as chitchat").
+2.  **Extract:** List the actual memory-worthy facts.
+3.  **Target:** Identify specific IDs to UPDATE or DELETE.
+4.  **Decide:** List the Rewrite List, the Kill List and the New Entries.
+
+### ID HANDLING
+* **CRITICAL:** When generating an UPDATE or DELETE action, you MUST output the exact Integer ID as a string (e.g., "42").
+* An UPDATE replaces the whole text of the memory, so its payload must be the complete new memory, not just what changed.
+
+### ONE-SHOT DEMONSTRATION
+**Input:**
+* Existing_Core_Memories: [{"id": "1", "text": "User lives in Berlin"}, {"id": "2", "text": "User is a Student"}]
+* Existing_General_Memories: [{"id": "55", "text": "User is learning Python basics"}, {"id": "56", "text": "User commutes by bike"}]
+* User_Input: "Hey Gemini! I actually just finished my degree and moved to London! Can you help me write a Go script for my new job? I've stopped using Python btw, and I sold my bike."
+
+**Correct Output:**
+{
+  "step_1_critical_reasoning": "1. FILTERING: Ignored 'Hey Gemini' (Chitchat). Ignored 'Can you help me write a Go script' (Task Context). \n2. FACTS: User graduated (Student -> Worker), Moved (Berlin -> London), Tech Switch (Drop Python, Add Go), Sold the bike. \n3. PREDATORY SCAN: Target ID '1' (Berlin) -> UPDATE. Target ID '2' (Student) -> UPDATE. Target ID '55' (Python) -> UPDATE. Target ID '56' (Bike) -> DELETE, nothing replaces it.",
+  "step_2_core_memory_actions": [
+    { "action_type": "UPDATE", "target_memory_id": "1", "payload": "User lives in London, UK." },
+    { "action_type": "UPDATE", "target_memory_id": "2", "payload": "User is a working professional (Graduated)." }
+  ],
+  "step_3_general_memory_actions": [
+    { "action_type": "UPDATE", "target_memory_id": "55", "payload": "User codes primarily in Golang and has stopped using Python." },
+    { "action_type": "DELETE", "target_memory_id": "56", "payload": null }
+  ]
+}
+`
+
+// ExpandQueryPrompt asks the LLM for a search query that finds the existing memories a conversation might conflict with.
+const ExpandQueryPrompt = ` 
+	--- SYSTEM INSTRUCTION ---
+	### Role
+	You are a Memory Query Generator. Your goal is to generate a search query to check a vector database for EXISTING memories that might conflict with or relate to the conversation history provided to you.
+
+	### Instructions
+	1. Analyze the user and the LLM conversation in the context of the history.
+	2. Identify if the user is stating a **new fact, preference, or plan**.
+	3. If yes, generate a keyword-heavy search query to find *previous* memories about that specific **TOPIC**.
+	4. If the user is just chatting (e.g., "Hi", "Help me code"), output "SKIP".
+
+	### Examples
+	Assistant: "Do you still live in London?"
+	User: "No, I moved to Tokyo last week."
+	Query: current residence location home address city
+
+	User: "My dog's name is actually Rover, not Rex."
+	Query: pet dog name pets animal companions
+
+	User: "How do I reverse a linked list?"
+	Query: SKIP
+
+	### Output
+	Return ONLY the query string or "SKIP". Do not add markdown or explanations.
+`
+
+// MemoryActionTypes are the actions the archivist may emit for a memory.
+var MemoryActionTypes = []string{"INSERT", "UPDATE", "DELETE"}
+
+// ReasoningDescription describes the reasoning field of the archivist's response schema.
+const ReasoningDescription = `CRITICAL: You must output your thought process here BEFORE generating actions.
+            Follow this EXACT structure in your text:
+            1. [INPUT ANALYSIS] List distinct facts found in User Input. Think about what new facts have been mentioned by the user.
+            2. [CORE SCAN] Check 'Existing_Core_Memories' for conflicts.
+               - IF Conflict Found: Write "CONFLICT: Core ID [X] says '...' vs New Input '...' -> Must UPDATE [X]."
+            3. [GENERAL SCAN] Check 'Existing_General_Memories' for conflicts.
+               - IF Conflict Found: Write "CONFLICT: Gen ID [Y] says '...' vs New Input '...' -> Must UPDATE [Y]."
+            4. [DUPLICATION CHECK] verify that the new fact doesn't already exist perfectly.
+            `
+
+type Existing_Memory struct {
+	Memory_text string           `json:"text"`
+	Type        types.MemoryType `json:"type"`
+	MemoryId    string           `json:"id"`
+	CreatedAt   string           `json:"created_at,omitempty"`
+	UpdatedAt   string           `json:"updated_at,omitempty"`
+}
+
+// existingMemory is how a memory is shown to the archivist, under its integer id and with its timestamps (if it has
+// any) so the LLM can tell which of two conflicting memories is newer.
+func existingMemory(m types.Memory, id string) Existing_Memory {
+	em := Existing_Memory{
+		Memory_text: m.Memory_text,
+		Type:        m.Type,
+		MemoryId:    id,
+	}
+	if !m.CreatedAt.IsZero() {
+		em.CreatedAt = m.CreatedAt.UTC().Format(time.RFC3339)
+	}
+	if !m.UpdatedAt.IsZero() {
+		em.UpdatedAt = m.UpdatedAt.UTC().Format(time.RFC3339)
+	}
+	return em
+}
+
+// BuildArchivistPrompt renders the existing memories and the conversation into the archivist prompt. The LLM only ever
+// sees small integer ids instead of our UUIDs (they are far less likely to be mangled), the returned map turns them back.
+func BuildArchivistPrompt(messages []types.Message, coreMemories []types.Memory, oldMemories []types.Memory) (string, map[string]string, error) {
+	var allUserText string
+	var Existing_Memories_old []Existing_Memory
+	var Existing_Memories_core []Existing_Memory
+	var sb strings.Builder
+	for _, msg := range messages {
+		//TODO: Think about whether you actually want the allUserText or just the latest turn .. since the memories for the previous turns would
+		//TODO: already have been stored by won't show up in existing memories .. or the dev should only do this .. after a fix no. of turns
+		//TODO: something like that .. think about that in the docs. How should the developer experience in that be..
+		switch msg.Role {
+		case types.RoleUser:
+			sb.WriteString("User: ")
+		case types.RoleAssistant:
+			sb.WriteString("Assistant: ")
+		case types.RoleSystem:
+			sb.WriteString("System: ")
+		default:
+			continue
+		}
+		sb.WriteString(msg.Content)
+		sb.WriteString("\n")
+		//TODO: Write now .. all the message content goes .. change this .. or keep it turn wise or something like that.
+	}
+	allUserText = sb.String()
+	UUIDtoInt := make(map[string]string)
+	IntTOUUID := make(map[string]string)
+
+	for idx, m := range coreMemories {
+		//TODO: Add a check to ensure that these are actually core memories!
+		UUIDtoInt[m.Memory_Id] = strconv.Itoa(idx)
+		IntTOUUID[strconv.Itoa(idx)] = m.Memory_Id
+		Existing_Memories_core = append(Existing_Memories_core, existingMemory(m, UUIDtoInt[m.Memory_Id]))
+	}
+	for idx, m := range oldMemories {
+		displacedId := idx + len(coreMemories)
+		UUIDtoInt[m.Memory_Id] = strconv.Itoa(displacedId)
+		IntTOUUID[strconv.Itoa(displacedId)] = m.Memory_Id
+		Existing_Memories_old = append(Existing_Memories_old, existingMemory(m, UUIDtoInt[m.Memory_Id]))
+	}
+
+	slog.Info("Here is the mapping here", "map", IntTOUUID)
+	OldMemorybytes, err := json.MarshalIndent(Existing_Memories_old, "", " ")
+	if err != nil {
+		slog.Error("Got this error while doing json.MarshalIndent.. and while generating memory text", "err", err)
+		return "", nil, err
+	}
+	coreMemoryBytes, err := json.MarshalIndent(Existing_Memories_core, "", " ")
+	if err != nil {
+		slog.Error("Got this error while doing json.MarshalIndent.. and while generating memory text", "err", err)
+		return "", nil, err
+	}
+
+	slog.Info("Here are the thing being passed into the prompt", "Existing Old Memories", string(OldMemorybytes), "Existing Core Memories", string(coreMemoryBytes), "UserInput", allUserText)
+
+	prompt := "<EXISTING_CORE_MEMORIES> \n" + string(coreMemoryBytes) + "\n </EXISTING_CORE_MEMORIES> \n" + "<EXISTING_OLD_MEMORIES> \n" + string(OldMemorybytes) + "\n </EXISTING_OLD_MEMORIES> \n" + "<USER_INPUT> \n" + allUserText + "\n </USER_INPUT>"
+	return prompt, IntTOUUID, nil
+}
+
+// RestoreMemoryIds swaps the integer ids of the UPDATE and DELETE actions back to the UUIDs they stand for.
+func RestoreMemoryIds(memoryOutput *types.MemoryOutput, IntTOUUID map[string]string) {
+	restore := func(actions []types.MemoryAction) {
+		for idx := range actions {
+			if (actions[idx].ActionType != "DELETE" && actions[idx].ActionType != "UPDATE") || actions[idx].TargetMemoryID == nil {
+				continue
+			}
+			id := *actions[idx].TargetMemoryID
+			uuid := IntTOUUID[id]
+			actions[idx].TargetMemoryID = &uuid
+			slog.Info("Swapping it for this id", "id", id, "new_id", uuid)
+		}
+	}
+	restore(memoryOutput.CoreMemoryActions)
+	restore(memoryOutput.GeneralMemoryActions)
+}
+
+// ConsolidatorInstruction is the system instruction of the Memory Consolidator that shrinks a profile of core memories
+// that grew too large.
+const ConsolidatorInstruction = `### ROLE
+You are the **Memory Consolidator**. The core memories of a user are sent along with every request they make, and they have grown past the space they are allowed. Your job is to make the profile smaller WITHOUT LOSING A SINGLE FACT.
+
+### RULES
+1.  **Merge Related Facts:** Combine core memories about the same topic into one entry (e.g., "User lives in Paris" and "User moved to Paris in 2023" -> "User lives in Paris, having moved there in 2023").
+2.  **Never Invent:** A merged entry may only say what its sources say. Do not add, guess or generalise.
+3.  **Newest Wins:** If two sources conflict, keep the one with the later "updated_at" and drop the other.
+4.  **Keep It Dense:** Write every merged entry as a single short factual statement about the User.
+5.  **Leave The Rest Alone:** Core memories you don't list in any merge are kept as they are. Never list a core memory in more than one merge.
+6.  **Shortening Counts:** A merge with a single source rewrites that memory more compactly.
+
+### INPUT DATA
+1.  *Existing_Core_Memories*: List of { "id": "1", "text": "...", "created_at": "...", "updated_at": "..." }
+2.  *Limits*: The most core memories the user may have and roughly how many tokens all of them may take up together. A limit of 0 means there is none.
+
+### PROCESS
+In your "step_1_critical_reasoning" field, group the related memories and explain for every group what the merged entry keeps. Then list the merges in "step_2_merges", each with the exact Integer IDs of its sources as strings (e.g., "42") and the text of the merged entry as its payload.
+`
+
+// ConsolidationReasoningDescription describes the reasoning field of the consolidator's response schema.
+const ConsolidationReasoningDescription = `CRITICAL: You must output your thought process here BEFORE listing the merges.
+            1. [GROUPING] Group the core memories that are about the same topic.
+            2. [CONFLICTS] Within each group, name the facts that conflict and which one is newer.
+            3. [BUDGET] Check that after the merges the profile fits the limits.
+            `
+
+// BuildConsolidationPrompt renders the core memories and the limits they have to fit into the consolidator prompt. The
+// ids are swapped for integers the same way BuildArchivistPrompt does.
+func BuildConsolidationPrompt(coreMemories []types.Memory, maxMemories int, tokenBudget int) (string, map[string]string, error) {
+	IntTOUUID := make(map[string]string)
+	existing := make([]Existing_Memory, 0, len(coreMemories))
+	for idx, m := range coreMemories {
+		IntTOUUID[strconv.Itoa(idx)] = m.Memory_Id
+		existing = append(existing, existingMemory(m, strconv.Itoa(idx)))
+	}
+	coreMemoryBytes, err := json.MarshalIndent(existing, "", " ")
+	if err != nil {
+		slog.Error("Got this error while doing json.MarshalIndent.. and while consolidating core memories", "err", err)
+		return "", nil, err
+	}
+	limits := "Maximum core memories: " + strconv.Itoa(maxMemories) + "\nToken budget: " + strconv.Itoa(tokenBudget)
+	prompt := "<EXISTING_CORE_MEMORIES> \n" + string(coreMemoryBytes) + "\n </EXISTING_CORE_MEMORIES> \n" + "<LIMITS> \n" + limits + "\n </LIMITS>"
+	return prompt, IntTOUUID, nil
+}
+
+// RestoreMergeIds swaps the integer ids of the sources of every merge back to the UUIDs they stand for. Ids the LLM
+// made up are dropped.
+func RestoreMergeIds(output *types.ConsolidationOutput, IntTOUUID map[string]string) {
+	for idx := range output.Merges {
+		var ids []string
+		for _, id := range output.Merges[idx].SourceMemoryIds {
+			uuid, ok := IntTOUUID[id]
+			if !ok {
+				slog.Warn("LLM merged a core memory it was never shown.. dropping it", "id", id)
+				continue
+			}
+			ids = append(ids, uuid)
+		}
+		output.Merges[idx].SourceMemoryIds = ids
+	}
+}
+
+// FallbackQuery builds a search query straight from the latest messages, for when the LLM couldn't expand one.
+func FallbackQuery(messages []types.Message) string {
+	var sb strings.Builder
+	for i := len(messages) - 1; i >= 0; i-- {
+		msgContent := messages[i].Content
+		sb.WriteString(msgContent)
+		sb.WriteString("\n")
+		if sb.Len()+len(msgContent) > 2000 {
+			break
+		}
+	}
+	return sb.String()
+}
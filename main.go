@@ -2,11 +2,13 @@ package main
 
 import (
 	"context"
+	"flag"
 	"fmt"
 	"log/slog"
 	"os"
 
 	"github.com/Prateek-Gupta001/GoMemory/api"
+	"github.com/Prateek-Gupta001/GoMemory/config"
 	"github.com/Prateek-Gupta001/GoMemory/embed"
 	"github.com/Prateek-Gupta001/GoMemory/llm"
 	logger "github.com/Prateek-Gupta001/GoMemory/log"
@@ -55,25 +57,92 @@ func main() {
 	if err != nil {
 		slog.Error("got this error while trying to load a dotenv file", "error", err)
 	}
-	store, err := storage.NewPostgresStore()
+	configPath := flag.String("config", os.Getenv("GOMEMORY_CONFIG"), "path to the YAML config file, environment variables override it")
+	createAPIKey := flag.String("create-api-key", "", "issue an API key for this tenant, print it and exit")
+	apiKeyName := flag.String("api-key-name", "", "name to remember the key issued with -create-api-key by")
+	migrateCoreMemoryKeys := flag.Bool("migrate-core-memory-keys", false, "move core memories stored in Redis in an older layout to the current one and exit")
+	warmCoreMemories := flag.Bool("warm-core-memories", false, "load the core memories of every user from Postgres into Redis and exit")
+	flag.Parse()
+	cfg, err := config.Load(*configPath)
 	if err != nil {
-		panic(err)
+		slog.Error("Got this error while loading the config", "error", err)
+		os.Exit(1)
 	}
-	vectordb, err := vectordb.NewQdrantMemoryDB()
+	store, err := storage.NewPostgresStore(cfg.Postgres.ConnString())
 	if err != nil {
-		slog.Error("Got this error while trying to intialise the vector db", "err", err)
+		panic(err)
+	}
+	if *createAPIKey != "" {
+		key, apiKey, err := api.CreateAPIKey(store, *createAPIKey, *apiKeyName, context.Background())
+		if err != nil {
+			slog.Error("Got this error while creating the API key", "error", err, "tenantId", *createAPIKey)
+			os.Exit(1)
+		}
+		fmt.Printf("API key %s for tenant %s (shown only once):\n%s\n", apiKey.Id, apiKey.TenantId, key)
+		return
+	}
+	RC := redis.NewRedisCoreMemoryCache(cfg.Redis.Addr, cfg.Redis.Password, cfg.Redis.DB)
+	if *migrateCoreMemoryKeys {
+		migrated, err := RC.MigrateKeys(context.Background())
+		if err != nil {
+			slog.Error("Got this error while migrating the core memory keys", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Migrated %d core memory keys\n", migrated)
+		return
+	}
+	coreMemories := redis.NewDurableCoreMemoryCache(RC, store)
+	if *warmCoreMemories {
+		copied, warmed, err := coreMemories.Warm(context.Background())
+		if err != nil {
+			slog.Error("Got this error while warming the core memory cache", "error", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Copied the core memories of %d users from Redis to Postgres and loaded %d users into Redis\n", copied, warmed)
+		return
+	}
+	var memoryDB vectordb.VectorDB
+	switch cfg.VectorDB.Backend {
+	case "qdrant":
+		memoryDB, err = vectordb.NewQdrantMemoryDB(cfg.VectorDB.Qdrant.Host, cfg.VectorDB.Qdrant.Port, cfg.VectorDB.Qdrant.Collection)
+		if err != nil {
+			slog.Error("Got this error while trying to intialise the vector db", "err", err)
 
+		}
+	case "memory":
+		// the path is optional, without it the memories are gone when the process exits
+		memoryDB, err = vectordb.NewInMemoryMemoryDB(cfg.VectorDB.Path)
+		if err != nil {
+			slog.Error("Got this error while trying to intialise the in-memory vector db", "err", err)
+			os.Exit(1)
+		}
+	case "pgvector":
+		memoryDB, err = vectordb.NewPgVectorMemoryDB(store.DB())
+		if err != nil {
+			slog.Error("Got this error while trying to intialise the pgvector memory db", "err", err)
+			os.Exit(1)
+		}
 	}
-	llm, err := llm.NewGeminiLLM()
-	if err != nil {
-		slog.Error("Got this error while trying to generate a new geminiLLM client", "error", err)
-		os.Exit(1)
+	var archivist llm.LLM
+	switch cfg.LLM.Provider {
+	case "gemini":
+		archivist, err = llm.NewGeminiLLM(cfg.LLM.Gemini.APIKey, cfg.LLM.Gemini.Model)
+		if err != nil {
+			slog.Error("Got this error while trying to generate a new geminiLLM client", "error", err)
+			os.Exit(1)
+		}
+	case "openai":
+		archivist, err = llm.NewOpenAICompatibleLLM(cfg.LLM.OpenAI.BaseURL, cfg.LLM.OpenAI.Model, cfg.LLM.OpenAI.APIKey)
+		if err != nil {
+			slog.Error("Got this error while trying to generate a new OpenAI-compatible LLM client", "error", err)
+			os.Exit(1)
+		}
 	}
-	embedClient, err := embed.NewEmbeddingClient("localhost:50051")
+	embedClient, err := embed.NewEmbeddingClient(cfg.Embedding.Addr)
 	if err != nil {
 		slog.Info("Got this error while creating a new embedding client!")
 	}
-	nc, err := nats.Connect(nats.DefaultURL)
+	nc, err := nats.Connect(cfg.NATS.URL)
 	if err != nil {
 		slog.Error("can't connect to NATS", "error", err)
 		panic(err)
@@ -83,15 +152,13 @@ func main() {
 	if err != nil {
 		panic(err)
 	}
-	_, err = js.AddStream(&nats.StreamConfig{
-		Name:     "MEMORY_SYSTEM",
-		Subjects: []string{"memory_work"},
-		// Storage:  nats.FileStorage,     //For production, uncomment this line! This will make our stuff persist in file and
-	}) //and allow us to not loose our memory jobs!
-	if err != nil {
+	if err := memory.AddWorkStream(js); err != nil {
+		panic(err)
+	}
+	if err := memory.AddDeadLetterStream(js); err != nil {
 		panic(err)
 	}
-	shutdown, err := telemetry.InitTracer("Go_Memory")
+	shutdown, err := telemetry.InitTracer(cfg.Telemetry.ServiceName, cfg.Telemetry.OTLPEndpoint)
 	if err != nil {
 		slog.Error("failed to init tracer", "error", err)
 		os.Exit(1)
@@ -103,12 +170,11 @@ func main() {
 		}
 	}()
 	defer nc.Close()
-	RC := redis.NewRedisCoreMemoryCache()
-	memory, err := memory.NewMemoryAgent(vectordb, llm, embedClient, js, RC, 5000, 2)
+	memory, err := memory.NewMemoryAgent(memoryDB, archivist, embedClient, js, coreMemories, store, cfg.Memory.QueueLen, cfg.Memory.Workers, cfg.Memory.MaxDeliver, cfg.Memory.WorkLanes, cfg.Memory.MaxCoreMemories, cfg.Memory.CoreMemoryTokenBudget)
 	if err != nil {
 		slog.Error("Got this error while trying to intialise the new Qdrant Memory DB", "error", err)
 	}
-	server := api.NewMemoryServer(":9000", store, memory)
+	server := api.NewMemoryServer(cfg.Server.ListenAddr, store, memory, !cfg.Server.AuthDisabled)
 	if err := server.Run(); err != nil {
 		panic(err)
 	}
@@ -0,0 +1,278 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// BundleVersion is the version of the MemoryBundle format GoMemory writes and reads.
+const BundleVersion = 1
+
+var ErrInvalidBundle = errors.New("invalid memory bundle")
+
+// ExportUserMemories bundles every core and general memory of a user, the general ones with their vectors if asked to.
+func (m *MemoryAgent) ExportUserMemories(userId string, withVectors bool, ctx context.Context) (*types.MemoryBundle, error) {
+	ctx, span := Tracer.Start(ctx, "Exporting User Memories")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId), attribute.Bool("withVectors", withVectors))
+	bundle := &types.MemoryBundle{
+		Version:    BundleVersion,
+		UserId:     userId,
+		ExportedAt: time.Now(),
+		Memories:   []types.BundleMemory{},
+	}
+	core, err := m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+	if err != nil {
+		slog.Error("Got this error while exporting the core memories of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	for _, mem := range core {
+		mem.Type = types.MemoryTypeCore
+		bundle.Memories = append(bundle.Memories, types.BundleMemory{Memory: mem})
+	}
+	general, err := m.Vectordb.GetAllUserMemories(userId, ctx)
+	if err != nil {
+		slog.Error("Got this error while exporting the general memories of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	if !withVectors {
+		for _, mem := range general {
+			bundle.Memories = append(bundle.Memories, types.BundleMemory{Memory: mem})
+		}
+		return bundle, nil
+	}
+	ids := make([]string, 0, len(general))
+	for _, mem := range general {
+		ids = append(ids, mem.Memory_Id)
+	}
+	points, err := m.Vectordb.GetMemoriesByIds(ids, ctx)
+	if err != nil {
+		slog.Error("Got this error while exporting the vectors of the user's memories", "error", err, "userId", userId)
+		return nil, err
+	}
+	bundle.EmbeddingModel = m.EmbedClient.Model()
+	for _, p := range points {
+		bundle.Memories = append(bundle.Memories, types.BundleMemory{Memory: p.Memory, Dense: &p.Dense, Sparse: &p.Sparse})
+	}
+	return bundle, nil
+}
+
+// ImportUserMemories loads a bundle into the memories of a user, next to the ones the user already has. Core memories
+// keep their ids. General memories get the id GoMemory derives from their text and user, which is the id they had
+// whenever the bundle comes from the same user of the same tenant, unless the user already has them under the id they
+// had in the bundle, and is imported once however many times it is in the bundle. Vectors are only reused if they were
+// made with the model GoMemory embeds with, and are refused with ErrInvalidBundle if they don't have its size; everything
+// else is embedded again. Core memories go first: a bundle whose core memories would take the user over the core memory limits
+// is refused with ErrCoreMemoryLimit before anything is written.
+func (m *MemoryAgent) ImportUserMemories(userId string, bundle *types.MemoryBundle, ctx context.Context) (*types.ImportResult, error) {
+	ctx, span := Tracer.Start(ctx, "Importing User Memories")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId), attribute.Int("memories", len(bundle.Memories)))
+	if bundle.Version != BundleVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidBundle, bundle.Version)
+	}
+	result := &types.ImportResult{UserId: userId}
+	reqId := uuid.NewString()
+	var changes []types.MemoryChange
+	newChange := func(mem types.Memory) types.MemoryChange {
+		return types.MemoryChange{
+			ReqId:      reqId,
+			UserId:     userId,
+			MemoryId:   mem.Memory_Id,
+			MemoryType: mem.Type,
+			Action:     "INSERT",
+			After:      &mem.Memory_text,
+			Reasoning:  "Imported from a memory bundle",
+		}
+	}
+
+	var core []types.Memory
+	var points []types.MemoryPoint
+	sameModel := bundle.EmbeddingModel == m.EmbedClient.Model()
+	for i, bm := range bundle.Memories {
+		mem := bm.Memory
+		if mem.Memory_text == "" {
+			return nil, fmt.Errorf("%w: memory %d has no text", ErrInvalidBundle, i)
+		}
+		mem.UserId = userId
+		switch mem.Type {
+		case types.MemoryTypeCore:
+			if mem.Memory_Id == "" {
+				mem.Memory_Id = uuid.NewString()
+			}
+			core = append(core, mem)
+		case types.MemoryTypeGeneral:
+			p := types.MemoryPoint{TenantId: types.TenantId(ctx), Memory: mem}
+			if sameModel && bm.Dense != nil && bm.Sparse != nil {
+				if len(bm.Dense.Values) != m.EmbedClient.Dimension() {
+					return nil, fmt.Errorf("%w: memory %d has a dense vector of size %d instead of %d", ErrInvalidBundle, i, len(bm.Dense.Values), m.EmbedClient.Dimension())
+				}
+				p.Dense, p.Sparse = *bm.Dense, *bm.Sparse
+			}
+			points = append(points, p)
+		default:
+			return nil, fmt.Errorf("%w: memory %d has unknown type %q", ErrInvalidBundle, i, mem.Type)
+		}
+	}
+
+	if len(core) != 0 {
+		var coreChanges []types.MemoryChange
+		err := m.modifyCoreMemories(userId, func(existing []types.Memory) ([]types.Memory, error) {
+			coreChanges, result.CoreMemories = nil, 0
+			known := make(map[string]bool, len(existing))
+			for _, mem := range existing {
+				known[mem.Memory_Id] = true
+			}
+			for _, mem := range core {
+				if known[mem.Memory_Id] {
+					continue
+				}
+				known[mem.Memory_Id] = true
+				existing = append(existing, mem)
+				coreChanges = append(coreChanges, newChange(mem))
+				result.CoreMemories++
+			}
+			if result.CoreMemories != 0 && m.overCoreMemoryLimits(existing) {
+				return nil, m.coreMemoryLimitError()
+			}
+			return existing, nil
+		}, ctx)
+		if err != nil {
+			slog.Error("Got this error while writing the imported core memories", "error", err, "userId", userId)
+			return nil, err
+		}
+		changes = append(changes, coreChanges...)
+	}
+
+	if err := m.importedMemoryIds(points, userId, ctx); err != nil {
+		slog.Error("Got this error while picking the ids of the imported memories", "error", err, "userId", userId)
+		return nil, err
+	}
+	// A memory that is in the bundle more than once is written and counted once.
+	seen := make(map[string]bool, len(points))
+	unique := points[:0]
+	for _, p := range points {
+		if !seen[p.Memory.Memory_Id] {
+			seen[p.Memory.Memory_Id] = true
+			unique = append(unique, p)
+		}
+	}
+	points = unique
+	var toEmbed []int //indices into points
+	for i, p := range points {
+		if p.Dense.Values == nil {
+			toEmbed = append(toEmbed, i)
+		}
+	}
+	if len(toEmbed) != 0 {
+		texts := make([]string, len(toEmbed))
+		for i, idx := range toEmbed {
+			texts[i] = points[idx].Memory.Memory_text
+		}
+		dense, sparse, err := m.EmbedClient.GenerateEmbeddings(texts, ctx)
+		if err != nil {
+			slog.Error("Got this error while embedding the imported memories", "error", err, "userId", userId)
+			return nil, err
+		}
+		for i, idx := range toEmbed {
+			points[idx].Dense, points[idx].Sparse = dense[i], sparse[i]
+		}
+		result.Reembedded = len(toEmbed)
+	}
+	if len(points) != 0 {
+		if err := m.Vectordb.UpsertMemories(points, ctx); err != nil {
+			slog.Error("Got this error while writing the imported general memories", "error", err, "userId", userId)
+			return nil, err
+		}
+		for _, p := range points {
+			changes = append(changes, newChange(p.Memory))
+		}
+		result.GeneralMemories = len(points)
+	}
+
+	if len(changes) != 0 {
+		if err := m.Store.InsertMemoryChanges(changes, ctx); err != nil {
+			slog.Warn("Got this error while recording the import in the audit log", "error", err, "userId", userId)
+		}
+	}
+	slog.Info("Memories have been imported", "userId", userId, "result", result)
+	return result, nil
+}
+
+// importedMemoryIds sets the ids the imported general memories are stored under. A memory the user already has under
+// the id it had in the bundle, with the same text, keeps that id: it was edited after its id was derived from its text.
+// The others get the ids new memories get (see generalMemoryIds).
+func (m *MemoryAgent) importedMemoryIds(points []types.MemoryPoint, userId string, ctx context.Context) error {
+	if len(points) == 0 {
+		return nil
+	}
+	var bundleIds []string
+	texts := make([]string, len(points))
+	for i, p := range points {
+		if uuid.Validate(p.Memory.Memory_Id) == nil {
+			bundleIds = append(bundleIds, p.Memory.Memory_Id)
+		}
+		texts[i] = p.Memory.Memory_text
+	}
+	existing, err := m.Vectordb.GetMemoriesByIds(bundleIds, ctx)
+	if err != nil {
+		return err
+	}
+	present := make(map[string]types.Memory)
+	for _, p := range existing {
+		present[p.Memory.Memory_Id] = p.Memory
+	}
+	ids, err := m.generalMemoryIds(texts, userId, ctx)
+	if err != nil {
+		return err
+	}
+	for i := range points {
+		if mem, ok := present[points[i].Memory.Memory_Id]; ok && mem.UserId == userId && mem.Memory_text == texts[i] {
+			continue
+		}
+		points[i].Memory.Memory_Id = ids[i]
+	}
+	return nil
+}
+
+// WriteBundleJSONL writes a bundle as JSONL: the bundle without its memories first, then a line per memory.
+func WriteBundleJSONL(w io.Writer, bundle *types.MemoryBundle) error {
+	enc := json.NewEncoder(w)
+	header := *bundle
+	header.Memories = nil
+	if err := enc.Encode(header); err != nil {
+		return err
+	}
+	for _, mem := range bundle.Memories {
+		if err := enc.Encode(mem); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ReadBundle reads a bundle written either as a single JSON document or as JSONL.
+func ReadBundle(r io.Reader) (*types.MemoryBundle, error) {
+	dec := json.NewDecoder(r)
+	bundle := &types.MemoryBundle{}
+	if err := dec.Decode(bundle); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidBundle, err)
+	}
+	for dec.More() {
+		mem := types.BundleMemory{}
+		if err := dec.Decode(&mem); err != nil {
+			return nil, fmt.Errorf("%w: line %d: %w", ErrInvalidBundle, len(bundle.Memories)+2, err)
+		}
+		bundle.Memories = append(bundle.Memories, mem)
+	}
+	return bundle, nil
+}
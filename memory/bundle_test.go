@@ -0,0 +1,119 @@
+package memory
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Prateek-Gupta001/GoMemory/llm"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	source := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, source)
+	bundle, err := source.ExportUserMemories("user_123", true, t.Context())
+	require.NoError(t, err)
+	require.Len(t, bundle.Memories, 3)
+	assert.Equal(t, types.MemoryTypeCore, bundle.Memories[0].Memory.Type)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteBundleJSONL(&buf, bundle))
+	assert.Equal(t, 4, bytes.Count(buf.Bytes(), []byte("\n")))
+	read, err := ReadBundle(&buf)
+	require.NoError(t, err)
+
+	target := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	result, err := target.ImportUserMemories("user_123", read, t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, &types.ImportResult{UserId: "user_123", CoreMemories: 1, GeneralMemories: 2}, result)
+
+	exported, err := target.ExportUserMemories("user_123", true, t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, bundle.Memories, exported.Memories, "the same user gets the same ids and vectors back")
+
+	// importing again doesn't duplicate anything
+	_, err = target.ImportUserMemories("user_123", read, t.Context())
+	require.NoError(t, err)
+	all, err := target.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Len(t, all.Memories, 3)
+}
+
+func TestImportReembedsForeignVectors(t *testing.T) {
+	source := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, source)
+	bundle, err := source.ExportUserMemories("user_123", true, t.Context())
+	require.NoError(t, err)
+	bundle.EmbeddingModel = "some-other-model"
+	bundle.Memories = append(bundle.Memories, types.BundleMemory{Memory: types.Memory{Memory_text: "User is vegetarian", Type: types.MemoryTypeGeneral}})
+
+	target := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	result, err := target.ImportUserMemories("user_456", bundle, t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Reembedded)
+
+	// the other model's vectors were dropped, so the memories are found by the fake embedder's
+	retrieved, err := target.GetMemories("vegetarian", "user_456", "req", 0.3, 0, t.Context())
+	require.NoError(t, err)
+	memories := retrieved.Memories
+	assert.Contains(t, memoryTexts(memories), "User is vegetarian")
+	for _, mem := range memories {
+		assert.Equal(t, "user_456", mem.UserId)
+	}
+}
+
+func TestImportRejectsInvalidBundles(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	_, err := agent.ImportUserMemories("user_123", &types.MemoryBundle{Version: 2}, t.Context())
+	assert.ErrorIs(t, err, ErrInvalidBundle)
+	_, err = agent.ImportUserMemories("user_123", &types.MemoryBundle{Version: BundleVersion, Memories: []types.BundleMemory{
+		{Memory: types.Memory{Memory_text: "User is vegetarian", Type: "episodic"}},
+	}}, t.Context())
+	assert.ErrorIs(t, err, ErrInvalidBundle)
+
+	source := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, source)
+	bundle, err := source.ExportUserMemories("user_123", true, t.Context())
+	require.NoError(t, err)
+	bundle.Memories[1].Dense = &types.DenseEmbedding{Values: []float32{0.1, 0.2, 0.3}}
+	_, err = agent.ImportUserMemories("user_123", bundle, t.Context())
+	assert.ErrorIs(t, err, ErrInvalidBundle, "a vector of the wrong size can't be searched next to the others")
+	_, err = ReadBundle(bytes.NewBufferString(`{"version": 1}` + "\n" + `{"memory": `))
+	assert.ErrorIs(t, err, ErrInvalidBundle)
+}
+
+func TestImportRefusesCoreMemoriesOverTheLimits(t *testing.T) {
+	source := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, source)
+	bundle, err := source.ExportUserMemories("user_123", false, t.Context())
+	require.NoError(t, err)
+
+	target := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	target.MaxCoreMemories = 1
+	_, err = target.CreateMemory("user_123", types.MemoryTypeCore, "User is vegetarian", t.Context())
+	require.NoError(t, err)
+	_, err = target.ImportUserMemories("user_123", bundle, t.Context())
+	assert.ErrorIs(t, err, ErrCoreMemoryLimit)
+	all, err := target.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User is vegetarian"}, memoryTexts(all.Memories), "nothing of the bundle is imported")
+}
+
+func TestImportCountsEveryMemoryOnce(t *testing.T) {
+	source := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, source)
+	bundle, err := source.ExportUserMemories("user_123", true, t.Context())
+	require.NoError(t, err)
+	bundle.Memories = append(bundle.Memories, bundle.Memories[1],
+		types.BundleMemory{Memory: types.Memory{Memory_text: bundle.Memories[2].Memory.Memory_text, Type: types.MemoryTypeGeneral}})
+
+	target := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	result, err := target.ImportUserMemories("user_456", bundle, t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.GeneralMemories)
+	all, err := target.GetAllUserMemories("user_456", t.Context())
+	require.NoError(t, err)
+	assert.Len(t, all.Memories, 3)
+}
@@ -0,0 +1,225 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Every /get_memory response and every archivist prompt carries all the core memories of the user, so they are kept
+// within MaxCoreMemories and CoreMemoryTokenBudget. A job that leaves them over either limit, or finds them there, asks
+// the LLM to merge the related ones. The merges belong to the job: they go in its snapshot, so reverting the job undoes
+// them along with the rest of it, and in the audit log as a MERGE of every memory that was merged away followed by the
+// INSERT of the memory they became.
+
+// errNoMerges tells writeCoreMemories there is nothing left to merge.
+var errNoMerges = errors.New("no core memories to merge")
+
+// ErrCoreMemoryLimit refuses a core memory written through the API, or imported, that would take the user over the
+// limits. Those are the user's own words, so they aren't merged away behind their back like the archivist's are.
+var ErrCoreMemoryLimit = errors.New("the core memories of the user would go over their limits")
+
+// coreMemoryLimitError is ErrCoreMemoryLimit with the limits of the agent in it.
+func (m *MemoryAgent) coreMemoryLimitError() error {
+	return fmt.Errorf("%w of %d core memories and about %d tokens", ErrCoreMemoryLimit, m.MaxCoreMemories, m.CoreMemoryTokenBudget)
+}
+
+// checkCoreMemoryLimits returns ErrCoreMemoryLimit if writing mem, as a new core memory or in place of the one with
+// its id, leaves the core memories of the user over the limits. Shortening one is always fine, it only helps.
+func (m *MemoryAgent) checkCoreMemoryLimits(userId string, mem types.Memory, ctx context.Context) error {
+	existing, err := m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+	if err != nil {
+		return err
+	}
+	idx := slices.IndexFunc(existing, func(e types.Memory) bool { return e.Memory_Id == mem.Memory_Id })
+	if idx != -1 && estimateTokens(mem.Memory_text) <= estimateTokens(existing[idx].Memory_text) {
+		return nil
+	}
+	after := slices.DeleteFunc(slices.Clone(existing), func(e types.Memory) bool { return e.Memory_Id == mem.Memory_Id })
+	if m.overCoreMemoryLimits(append(after, mem)) {
+		return m.coreMemoryLimitError()
+	}
+	return nil
+}
+
+// appliedMerge is a merge that made it into the core memories: the memory it made and the ones it was made from.
+type appliedMerge struct {
+	Merged  types.Memory
+	Sources []types.Memory
+}
+
+// estimateTokens roughly counts the tokens of text, at about four characters a token.
+func estimateTokens(text string) int {
+	return (utf8.RuneCountInString(text) + 3) / 4
+}
+
+// overCoreMemoryLimits reports whether the core memories are over either of the limits of the agent.
+func (m *MemoryAgent) overCoreMemoryLimits(coreMemories []types.Memory) bool {
+	if m.MaxCoreMemories > 0 && len(coreMemories) > m.MaxCoreMemories {
+		return true
+	}
+	if m.CoreMemoryTokenBudget <= 0 {
+		return false
+	}
+	tokens := 0
+	for _, mem := range coreMemories {
+		tokens += estimateTokens(mem.Memory_text)
+	}
+	return tokens > m.CoreMemoryTokenBudget
+}
+
+// applyMerges replaces the sources of every merge with the memory they were merged into, which takes the place of the
+// first of them. seen holds the texts the LLM was shown. A merge is dropped if any of its sources is gone, was changed
+// since the LLM saw it or already went into an earlier merge.
+func applyMerges(existing []types.Memory, merges []types.CoreMemoryMerge, seen map[string]string, reqId string, now time.Time) ([]types.Memory, []appliedMerge) {
+	current := make(map[string]types.Memory)
+	for _, mem := range existing {
+		current[mem.Memory_Id] = mem
+	}
+	taken := make(map[string]bool)
+	first := make(map[string]int) //first source of a merge -> the merge
+	var applied []appliedMerge
+	for _, merge := range merges {
+		if strings.TrimSpace(merge.Payload) == "" || len(merge.SourceMemoryIds) == 0 {
+			slog.Warn("LLM made a mistake and gave a merge without a payload or sources.. skipping")
+			continue
+		}
+		var sources []types.Memory
+		for _, id := range merge.SourceMemoryIds {
+			mem, ok := current[id]
+			if !ok || taken[id] || mem.Memory_text != seen[id] || slices.ContainsFunc(sources, func(s types.Memory) bool { return s.Memory_Id == id }) {
+				sources = nil
+				break
+			}
+			sources = append(sources, mem)
+		}
+		if len(sources) == 0 {
+			slog.Warn("Skipping a merge of core memories that are gone, changed or merged already", "sourceMemoryIds", merge.SourceMemoryIds)
+			continue
+		}
+		id, _ := uuid.NewUUID()
+		merged := types.Memory{
+			Memory_text: merge.Payload,
+			Memory_Id:   id.String(),
+			Type:        types.MemoryTypeCore,
+			UserId:      sources[0].UserId,
+			CreatedAt:   now,
+			UpdatedAt:   now,
+			SourceReqId: reqId,
+		}
+		for _, mem := range sources {
+			taken[mem.Memory_Id] = true
+			merged.MergedFrom = append(merged.MergedFrom, mem.Memory_Id)
+		}
+		first[sources[0].Memory_Id] = len(applied)
+		applied = append(applied, appliedMerge{Merged: merged, Sources: sources})
+	}
+	var result []types.Memory
+	for _, mem := range existing {
+		if idx, ok := first[mem.Memory_Id]; ok {
+			result = append(result, applied[idx].Merged)
+			continue
+		}
+		if !taken[mem.Memory_Id] {
+			result = append(result, mem)
+		}
+	}
+	return result, applied
+}
+
+// recordMerges returns the snapshot with the merges added to it, so that reverting the job takes the merged memories
+// out and puts back what they were made from, as it was before the job. A source the job inserted itself is simply
+// no longer there to remove, one it updated comes back as it was before the update.
+func recordMerges(snapshot types.JobSnapshot, applied []appliedMerge) types.JobSnapshot {
+	snapshot.InsertedCoreMemoryIds = slices.Clone(snapshot.InsertedCoreMemoryIds)
+	snapshot.UpdatedCoreMemories = slices.Clone(snapshot.UpdatedCoreMemories)
+	snapshot.DeletedCoreMemories = slices.Clone(snapshot.DeletedCoreMemories)
+	for _, merge := range applied {
+		for _, src := range merge.Sources {
+			if idx := slices.Index(snapshot.InsertedCoreMemoryIds, src.Memory_Id); idx != -1 {
+				snapshot.InsertedCoreMemoryIds = slices.Delete(snapshot.InsertedCoreMemoryIds, idx, idx+1)
+				continue
+			}
+			if idx := slices.IndexFunc(snapshot.UpdatedCoreMemories, func(mem types.Memory) bool { return mem.Memory_Id == src.Memory_Id }); idx != -1 {
+				src = snapshot.UpdatedCoreMemories[idx]
+				snapshot.UpdatedCoreMemories = slices.Delete(snapshot.UpdatedCoreMemories, idx, idx+1)
+			}
+			snapshot.DeletedCoreMemories = append(snapshot.DeletedCoreMemories, src)
+		}
+		snapshot.InsertedCoreMemoryIds = append(snapshot.InsertedCoreMemoryIds, merge.Merged.Memory_Id)
+	}
+	return snapshot
+}
+
+// compactCoreMemories consolidates the core memories of the user of the job if they are over the limits, adding the
+// merges to the snapshot of the job, and returns the changes it made for the audit log. Core memories that couldn't be
+// consolidated are left as they are: they are still right, only bigger than they should be.
+func (m *MemoryAgent) compactCoreMemories(memjob *types.MemoryInsertionJob, snapshot *types.JobSnapshot, ctx context.Context) []types.MemoryChange {
+	ctx, span := Tracer.Start(ctx, "Compacting Core Memories")
+	defer span.End()
+	existing, version, err := m.CoreMemoryCache.GetCoreMemoryVersion(memjob.UserId, ctx)
+	if err != nil {
+		slog.Warn("Got this error while reading the core memories to see if they need compacting", "error", err, "userId", memjob.UserId)
+		return nil
+	}
+	if !m.overCoreMemoryLimits(existing) {
+		return nil
+	}
+	span.SetAttributes(attribute.Int("coreMemories", len(existing)))
+	slog.Info("Core memories of the user are over the limits, consolidating them", "userId", memjob.UserId, "coreMemories", len(existing), "maxCoreMemories", m.MaxCoreMemories, "tokenBudget", m.CoreMemoryTokenBudget)
+	output, err := m.LLM.ConsolidateCoreMemories(existing, m.MaxCoreMemories, m.CoreMemoryTokenBudget, ctx)
+	if err != nil {
+		slog.Warn("Got this error while consolidating the core memories of the user, leaving them as they are", "error", err, "userId", memjob.UserId)
+		return nil
+	}
+	seen := make(map[string]string)
+	for _, mem := range existing {
+		seen[mem.Memory_Id] = mem.Memory_text
+	}
+	now := time.Now().UTC()
+	base := *snapshot
+	var compacted []types.Memory
+	var applied []appliedMerge
+	err = m.writeCoreMemories(memjob.UserId, existing, version, func(current []types.Memory) ([]types.Memory, error) {
+		compacted, applied = applyMerges(current, output.Merges, seen, memjob.ReqId, now)
+		if len(applied) == 0 {
+			return nil, errNoMerges
+		}
+		*snapshot = recordMerges(base, applied)
+		if err := m.Store.SaveJobSnapshot(*snapshot, ctx); err != nil {
+			slog.Error("Got this error while saving the merges in the job snapshot, not merging the core memories", "error", err, "reqId", memjob.ReqId)
+			return nil, err
+		}
+		return compacted, nil
+	}, ctx)
+	if err != nil {
+		*snapshot = base
+		if errors.Is(err, errNoMerges) {
+			slog.Info("The LLM didn't come up with any merges of the core memories", "userId", memjob.UserId, "LLM's thinking", output.Reasoning)
+		} else {
+			slog.Warn("Got this error while writing the consolidated core memories of the user", "error", err, "userId", memjob.UserId)
+		}
+		return nil
+	}
+	var changes []types.MemoryChange
+	for _, merge := range applied {
+		for _, src := range merge.Sources {
+			changes = append(changes, types.MemoryChange{ReqId: memjob.ReqId, UserId: memjob.UserId, MemoryId: src.Memory_Id, MemoryType: types.MemoryTypeCore, Action: "MERGE", Before: &src.Memory_text, After: &merge.Merged.Memory_text, Reasoning: output.Reasoning})
+		}
+		changes = append(changes, types.MemoryChange{ReqId: memjob.ReqId, UserId: memjob.UserId, MemoryId: merge.Merged.Memory_Id, MemoryType: types.MemoryTypeCore, Action: "INSERT", After: &merge.Merged.Memory_text, Reasoning: output.Reasoning})
+	}
+	slog.Info("Core memories of the user have been consolidated", "userId", memjob.UserId, "before", len(existing), "after", len(compacted), "merges", len(applied))
+	if m.overCoreMemoryLimits(compacted) {
+		slog.Warn("Core memories of the user are still over the limits after consolidating them", "userId", memjob.UserId, "coreMemories", len(compacted))
+	}
+	return changes
+}
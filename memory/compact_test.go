@@ -0,0 +1,140 @@
+package memory
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/llm"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newCrowdedAgent is an agent that allows two core memories, for a user whose Paris move leaves them with three.
+func newCrowdedAgent(t *testing.T, fakeLLM *llm.FakeLLM) *MemoryAgent {
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	agent.MaxCoreMemories = 2
+	seedMemories(t, agent)
+	setCoreMemories(t, agent, "user_123", []types.Memory{
+		{Memory_text: "User is a nurse", Type: types.MemoryTypeCore, Memory_Id: "core-2", UserId: "user_123"},
+		{Memory_text: "User lives in Italy", Type: types.MemoryTypeCore, Memory_Id: "core-1", UserId: "user_123"},
+		{Memory_text: "User works night shifts at a hospital", Type: types.MemoryTypeCore, Memory_Id: "core-3", UserId: "user_123"},
+	})
+	return agent
+}
+
+func TestInsertMemoryConsolidatesCoreMemories(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	fakeLLM.OnConsolidateCoreMemories(&types.ConsolidationOutput{
+		Reasoning: "Both are about the user's job.",
+		Merges: []types.CoreMemoryMerge{
+			{SourceMemoryIds: []string{"User is a nurse", "User works night shifts at a hospital"}, Payload: "User is a nurse working night shifts at a hospital"},
+		},
+	})
+	agent := newCrowdedAgent(t, fakeLLM)
+	job := newParisJob(t, agent)
+
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	assert.Equal(t, types.JobStatusSucceeded, status)
+
+	require.Len(t, fakeLLM.ConsolidateCalls, 1)
+	assert.Equal(t, 2, fakeLLM.ConsolidateCalls[0].MaxMemories)
+	assert.Equal(t, []string{"User is a nurse", "User works night shifts at a hospital", "User lives in Paris"}, memoryTexts(fakeLLM.ConsolidateCalls[0].CoreMemories))
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User is a nurse working night shifts at a hospital", "User lives in Paris"}, memoryTexts(core))
+	assert.Equal(t, []string{"core-2", "core-3"}, core[0].MergedFrom)
+
+	history, err := agent.Store.GetMemoryHistory("user_123", 100, t.Context())
+	require.NoError(t, err)
+	var merged []string
+	for _, change := range history {
+		if change.Action == "MERGE" {
+			merged = append(merged, change.MemoryId)
+			assert.Equal(t, "User is a nurse working night shifts at a hospital", *change.After)
+			assert.Equal(t, "Both are about the user's job.", change.Reasoning)
+		}
+	}
+	assert.ElementsMatch(t, []string{"core-2", "core-3"}, merged)
+
+	// reverting the job undoes the merge along with everything else
+	require.NoError(t, agent.Store.UpdateJobStatus(job.ReqId, status, nil, t.Context()))
+	result, err := agent.RevertMemoryJob(job.ReqId, t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.RestoredCoreMemories)
+	assert.Equal(t, 2, result.RemovedCoreMemories)
+	core, err = agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User is a nurse", "User lives in Italy", "User works night shifts at a hospital"}, memoryTexts(core))
+}
+
+func TestInsertMemoryKeepsCoreMemoriesWhenConsolidationFails(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	fakeLLM.FailConsolidateCoreMemories(errors.New("model is overloaded"))
+	agent := newCrowdedAgent(t, fakeLLM)
+	job := newParisJob(t, agent)
+
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	assert.Equal(t, types.JobStatusSucceeded, status)
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User is a nurse", "User works night shifts at a hospital", "User lives in Paris"}, memoryTexts(core))
+}
+
+func TestInsertMemoryLeavesCoreMemoriesWithinLimitsAlone(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	agent := newCrowdedAgent(t, fakeLLM)
+	agent.MaxCoreMemories = 3
+	agent.CoreMemoryTokenBudget = 100
+	job := newParisJob(t, agent)
+
+	_, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	assert.Empty(t, fakeLLM.ConsolidateCalls)
+}
+
+func TestApplyMergesDropsBadMerges(t *testing.T) {
+	existing := []types.Memory{
+		{Memory_Id: "a", Memory_text: "User lives in Paris"},
+		{Memory_Id: "b", Memory_text: "User moved to Paris in 2023"},
+		{Memory_Id: "c", Memory_text: "User is a nurse"},
+	}
+	seen := map[string]string{"a": "User lives in Paris", "b": "User moved to Paris in 2023", "c": "User was a student"}
+	result, applied := applyMerges(existing, []types.CoreMemoryMerge{
+		{SourceMemoryIds: []string{"a", "b"}, Payload: "User lives in Paris since 2023"},
+		{SourceMemoryIds: []string{"b"}, Payload: "User moved in 2023"},       //b is merged already
+		{SourceMemoryIds: []string{"c"}, Payload: "User is a former student"}, //c changed since the LLM saw it
+		{SourceMemoryIds: []string{"d"}, Payload: "User has a dog"},           //there is no d
+		{SourceMemoryIds: []string{"c"}, Payload: " "},
+	}, seen, "req", time.Now())
+
+	require.Len(t, applied, 1)
+	assert.Equal(t, []string{"User lives in Paris since 2023", "User is a nurse"}, memoryTexts(result))
+	assert.Equal(t, []string{"a", "b"}, result[0].MergedFrom)
+}
+
+func TestRecordMerges(t *testing.T) {
+	snapshot := types.JobSnapshot{
+		InsertedCoreMemoryIds: []string{"new"},
+		UpdatedCoreMemories:   []types.Memory{{Memory_Id: "updated", Memory_text: "User is a student"}},
+	}
+	recorded := recordMerges(snapshot, []appliedMerge{{
+		Merged: types.Memory{Memory_Id: "merged"},
+		Sources: []types.Memory{
+			{Memory_Id: "new", Memory_text: "User lives in Paris"},
+			{Memory_Id: "updated", Memory_text: "User is a nurse"},
+			{Memory_Id: "old", Memory_text: "User is 30"},
+		},
+	}})
+
+	assert.Equal(t, []string{"merged"}, recorded.InsertedCoreMemoryIds, "the job's own memory is gone with the merge")
+	assert.Empty(t, recorded.UpdatedCoreMemories)
+	assert.Equal(t, []string{"User is a student", "User is 30"}, memoryTexts(recorded.DeletedCoreMemories), "an updated memory comes back as it was before the job")
+	assert.Equal(t, []string{"new"}, snapshot.InsertedCoreMemoryIds, "the snapshot it was given is left alone")
+}
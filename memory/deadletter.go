@@ -0,0 +1,190 @@
+package memory
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/storage"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/nats-io/nats.go"
+)
+
+const (
+	// DeadLetterSubject is where jobs that failed for good end up, under the tenant of the job. Jobs dead-lettered
+	// before that are still on DeadLetterSubject itself.
+	DeadLetterSubject = "memory_dlq"
+	// DeadLetterStream captures the dead-letter subjects so failed jobs can be inspected and replayed later.
+	DeadLetterStream = "MEMORY_DLQ"
+)
+
+var ErrDeadLetterNotFound = errors.New("dead-lettered job not found")
+
+// AddDeadLetterStream creates the MEMORY_DLQ stream if it isn't there yet, and makes an existing one capture the
+// subjects of the tenants too.
+func AddDeadLetterStream(js nats.JetStreamContext) error {
+	subjects := []string{DeadLetterSubject, DeadLetterSubject + ".*"}
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     DeadLetterStream,
+		Subjects: subjects,
+		// Storage:  nats.FileStorage,     //For production, uncomment this line! Dead-lettered jobs should survive a restart.
+	})
+	if !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return err
+	}
+	info, err := js.StreamInfo(DeadLetterStream)
+	if err != nil {
+		return err
+	}
+	info.Config.Subjects = subjects
+	_, err = js.UpdateStream(&info.Config)
+	return err
+}
+
+// deadLetterSubject is the subject the dead-lettered jobs of the tenant go to. Tenant ids are kept to letters, digits,
+// '-' and '_', so they make a valid subject token, which userIds wouldn't.
+func deadLetterSubject(tenantId string) string {
+	return DeadLetterSubject + "." + tenantId
+}
+
+// deadLetter parks a job that can't succeed on the dead-letter subject, along with why and after how many attempts it
+// failed. If it can't, the job stays where it is: the caller must not let go of it.
+func (m *MemoryAgent) deadLetter(memJob *types.MemoryInsertionJob, jobErr error, attempts int) error {
+	data, err := json.Marshal(types.DeadLetterJob{
+		Job:      *memJob,
+		Reason:   jobErr.Error(),
+		Attempts: attempts,
+		FailedAt: time.Now(),
+	})
+	if err != nil {
+		slog.Error("Got this error while marshalling the dead-lettered job", "error", err, "reqId", memJob.ReqId)
+		return err
+	}
+	if _, err := m.JSClient.Publish(deadLetterSubject(jobTenantId(*memJob)), data); err != nil {
+		slog.Error("Got this error while publishing the job to the dead-letter subject", "error", err, "reqId", memJob.ReqId)
+		return err
+	}
+	slog.Warn("Memory job has been dead-lettered", "reqId", memJob.ReqId, "userId", memJob.UserId, "attempts", attempts, "reason", jobErr)
+	return nil
+}
+
+// ListDeadLetters returns every dead-lettered job of the tenant, oldest first. An empty userId lists the jobs of all its
+// users. Only the subject of the tenant, and the one jobs were dead-lettered on before there was one per tenant, are
+// read, so the jobs of other tenants never leave the server.
+func (m *MemoryAgent) ListDeadLetters(userId string, ctx context.Context) ([]types.DeadLetterJob, error) {
+	ctx, span := Tracer.Start(ctx, "Listing Dead Letters")
+	defer span.End()
+	deadLetters := []types.DeadLetterJob{}
+	for _, subject := range []string{DeadLetterSubject, deadLetterSubject(types.TenantId(ctx))} {
+		jobs, err := m.readDeadLetters(subject, ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, deadLetter := range jobs {
+			if jobTenantId(deadLetter.Job) != types.TenantId(ctx) || (userId != "" && deadLetter.Job.UserId != userId) {
+				continue
+			}
+			deadLetters = append(deadLetters, deadLetter)
+		}
+	}
+	slices.SortFunc(deadLetters, func(a, b types.DeadLetterJob) int { return cmp.Compare(a.Seq, b.Seq) })
+	return deadLetters, nil
+}
+
+// readDeadLetters reads every job dead-lettered on subject, oldest first.
+func (m *MemoryAgent) readDeadLetters(subject string, ctx context.Context) ([]types.DeadLetterJob, error) {
+	var deadLetters []types.DeadLetterJob
+	err := m.readSubject(DeadLetterStream, subject, ctx, func(seq uint64, data []byte) {
+		deadLetter := types.DeadLetterJob{}
+		if err := json.Unmarshal(data, &deadLetter); err != nil {
+			slog.Warn("Skipping a dead-lettered message that isn't a memory job", "error", err, "seq", seq)
+			return
+		}
+		deadLetter.Seq = seq
+		deadLetters = append(deadLetters, deadLetter)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+func (m *MemoryAgent) GetDeadLetter(seq uint64, ctx context.Context) (*types.DeadLetterJob, error) {
+	msg, err := m.JSClient.GetMsg(DeadLetterStream, seq, nats.Context(ctx))
+	if err != nil {
+		if errors.Is(err, nats.ErrMsgNotFound) {
+			return nil, ErrDeadLetterNotFound
+		}
+		slog.Error("Got this error while getting the dead-lettered job", "error", err, "seq", seq)
+		return nil, err
+	}
+	deadLetter := &types.DeadLetterJob{}
+	if err := json.Unmarshal(msg.Data, deadLetter); err != nil {
+		slog.Error("Got this error while unmarshalling the dead-lettered job", "error", err, "seq", seq)
+		return nil, err
+	}
+	if jobTenantId(deadLetter.Job) != types.TenantId(ctx) {
+		return nil, ErrDeadLetterNotFound
+	}
+	deadLetter.Seq = msg.Sequence
+	return deadLetter, nil
+}
+
+// ReplayDeadLetter puts a dead-lettered job back onto the lane of its user under its original reqId and removes it
+// from the dead-letter stream.
+func (m *MemoryAgent) ReplayDeadLetter(seq uint64, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Replaying Dead Letter")
+	defer span.End()
+	deadLetter, err := m.GetDeadLetter(seq, ctx)
+	if err != nil {
+		return err
+	}
+	if err := m.requeueJob(deadLetter.Job, ctx); err != nil {
+		return err
+	}
+	if err := m.SumbitMemoryInsertionRequest(deadLetter.Job); err != nil {
+		slog.Error("Got this error while replaying the dead-lettered job", "error", err, "reqId", deadLetter.Job.ReqId)
+		return err
+	}
+	if err := m.JSClient.DeleteMsg(DeadLetterStream, seq, nats.Context(ctx)); err != nil {
+		slog.Error("Got this error while removing the replayed job from the dead-letter stream", "error", err, "seq", seq)
+		return err
+	}
+	slog.Info("Dead-lettered job has been replayed", "reqId", deadLetter.Job.ReqId, "seq", seq)
+	return nil
+}
+
+// requeueJob puts the job back in the ledger as queued, writing its entry anew if it never had one, say because it was
+// dead-lettered before there was a ledger. The dead-lettered copy is only let go of once the ledger has the job.
+func (m *MemoryAgent) requeueJob(job types.MemoryInsertionJob, ctx context.Context) error {
+	err := m.Store.UpdateJobStatus(job.ReqId, types.JobStatusQueued, nil, ctx)
+	if errors.Is(err, storage.ErrJobNotFound) {
+		slog.Info("The dead-lettered job isn't in the ledger, adding it", "reqId", job.ReqId)
+		err = m.Store.InsertMemoryJob(job, ctx)
+	}
+	if err != nil {
+		slog.Error("Got this error while re-queueing the job in the ledger, leaving it dead-lettered", "error", err, "reqId", job.ReqId)
+		return err
+	}
+	return nil
+}
+
+// ReplayUserDeadLetters replays all the dead-lettered jobs of a user in the order they failed and returns how many were replayed.
+func (m *MemoryAgent) ReplayUserDeadLetters(userId string, ctx context.Context) (int, error) {
+	deadLetters, err := m.ListDeadLetters(userId, ctx)
+	if err != nil {
+		return 0, err
+	}
+	replayed := 0
+	for _, deadLetter := range deadLetters {
+		if err := m.ReplayDeadLetter(deadLetter.Seq, ctx); err != nil {
+			return replayed, err
+		}
+		replayed++
+	}
+	return replayed, nil
+}
@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/llm"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDeadLettersStayWithTheirTenant(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	agent.JSClient = connectJetStream(t, runNATS(t))
+	failed := errors.New("model is overloaded")
+	require.NoError(t, agent.deadLetter(&types.MemoryInsertionJob{ReqId: "req-1", TenantId: "acme", UserId: "user_123"}, failed, 5))
+	require.NoError(t, agent.deadLetter(&types.MemoryInsertionJob{ReqId: "req-2", TenantId: "globex", UserId: "user_123"}, failed, 5))
+	require.NoError(t, agent.deadLetter(&types.MemoryInsertionJob{ReqId: "req-3", TenantId: "acme", UserId: "user_456"}, failed, 5))
+	// dead-lettered before there was a subject per tenant
+	for _, job := range []types.MemoryInsertionJob{{ReqId: "req-4", TenantId: "acme", UserId: "user_123"}, {ReqId: "req-5", TenantId: "globex", UserId: "user_123"}} {
+		data, err := json.Marshal(types.DeadLetterJob{Job: job, Reason: failed.Error(), Attempts: 5, FailedAt: time.Now()})
+		require.NoError(t, err)
+		_, err = agent.JSClient.Publish(DeadLetterSubject, data)
+		require.NoError(t, err)
+	}
+	acme := types.WithTenantId(t.Context(), "acme")
+
+	deadLetters, err := agent.ListDeadLetters("", acme)
+	require.NoError(t, err)
+	var reqIds []string
+	for _, deadLetter := range deadLetters {
+		reqIds = append(reqIds, deadLetter.Job.ReqId)
+	}
+	assert.Equal(t, []string{"req-1", "req-3", "req-4"}, reqIds, "oldest first and only the jobs of the tenant")
+
+	deadLetters, err = agent.ListDeadLetters("user_123", acme)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 2)
+	assert.Equal(t, "req-1", deadLetters[0].Job.ReqId)
+
+	_, err = agent.GetDeadLetter(2, acme)
+	assert.ErrorIs(t, err, ErrDeadLetterNotFound, "the job of another tenant is out of reach")
+	require.NoError(t, agent.ReplayDeadLetter(deadLetters[0].Seq, acme))
+	replayed, err := agent.Store.GetMemoryJob("req-1", acme)
+	require.NoError(t, err, "a job dead-lettered without a ledger entry gets one when it is replayed")
+	assert.Equal(t, types.JobStatusQueued, replayed.Status)
+	deadLetters, err = agent.ListDeadLetters("user_123", acme)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 1)
+	assert.Equal(t, "req-4", deadLetters[0].Job.ReqId, "replayed jobs are gone")
+
+	deadLetters, err = agent.ListDeadLetters("", types.WithTenantId(t.Context(), "initech"))
+	require.NoError(t, err)
+	assert.Empty(t, deadLetters)
+}
+
+func TestDeadLetterKeepsTheJobWhenItCantBeParked(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	agent.JSClient = connectJetStream(t, runNATS(t))
+	require.NoError(t, agent.JSClient.DeleteStream(DeadLetterStream))
+
+	err := agent.deadLetter(&types.MemoryInsertionJob{ReqId: "req-1", UserId: "user_123"}, errors.New("model is overloaded"), 5)
+	assert.Error(t, err, "the worker has to hold on to the job")
+}
@@ -0,0 +1,82 @@
+package memory
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+
+	"github.com/Prateek-Gupta001/GoMemory/llm"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// JobError is what InsertMemory fails with. Transient errors (an LLM 503, the embedding service restarting, a Qdrant
+// hiccup) are worth retrying, permanent ones (malformed LLM output, bad input) will fail the same way every time.
+type JobError struct {
+	Err       error
+	Transient bool
+}
+
+func (e *JobError) Error() string {
+	if e.Transient {
+		return "transient: " + e.Err.Error()
+	}
+	return "permanent: " + e.Err.Error()
+}
+
+func (e *JobError) Unwrap() error {
+	return e.Err
+}
+
+// IsTransient reports whether a failed job should be retried.
+func IsTransient(err error) bool {
+	var jobErr *JobError
+	if errors.As(err, &jobErr) {
+		return jobErr.Transient
+	}
+	return false
+}
+
+// classifyError wraps err in a JobError. The embedding service and Qdrant both talk gRPC so their status codes tell
+// us whether the service is just unavailable, the LLM errors are judged by their HTTP code. A connection to Redis,
+// Postgres or anything else that was refused, dropped or timed out is retried too, whoever it was to.
+func classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var jobErr *JobError
+	if errors.As(err, &jobErr) {
+		return err
+	}
+	transient := false
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		transient = true
+	case llm.RetryAbleError(err):
+		transient = true
+	case connectionError(err):
+		transient = true
+	default:
+		switch status.Code(err) {
+		case codes.Unavailable, codes.DeadlineExceeded, codes.ResourceExhausted, codes.Aborted:
+			transient = true
+		}
+	}
+	return &JobError{Err: err, Transient: transient}
+}
+
+// connectionError reports whether err is a connection that couldn't be made or broke off halfway.
+func connectionError(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) ||
+		errors.Is(err, io.EOF) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, net.ErrClosed) ||
+		errors.Is(err, driver.ErrBadConn) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE)
+}
@@ -0,0 +1,54 @@
+package memory
+
+import (
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/genai"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestClassifyError(t *testing.T) {
+	assert := assert.New(t)
+
+	assert.Nil(classifyError(nil))
+	assert.True(IsTransient(classifyError(context.DeadlineExceeded)), "timeouts should be retried")
+	assert.True(IsTransient(classifyError(genai.APIError{Code: 503})), "an overloaded LLM should be retried")
+	assert.True(IsTransient(classifyError(genai.APIError{Code: 429})), "rate limits should be retried")
+	assert.False(IsTransient(classifyError(genai.APIError{Code: 400})), "a bad request will fail the same way again")
+	assert.True(IsTransient(classifyError(fmt.Errorf("failed to create embeddings: %w", status.Error(codes.Unavailable, "connection refused")))), "a restarting embedding service should be retried")
+	assert.False(IsTransient(classifyError(status.Error(codes.InvalidArgument, "wrong vector size"))))
+	assert.False(IsTransient(classifyError(&json.SyntaxError{})), "malformed LLM output is permanent")
+
+	// Redis, Postgres or Qdrant going away is just as worth waiting for
+	refused := &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	assert.True(IsTransient(classifyError(fmt.Errorf("reading the core memories: %w", refused))), "a refused connection should be retried")
+	assert.True(IsTransient(classifyError(syscall.ECONNRESET)), "a reset connection should be retried")
+	assert.True(IsTransient(classifyError(io.EOF)), "a connection closed halfway should be retried")
+	assert.True(IsTransient(classifyError(io.ErrUnexpectedEOF)))
+	assert.True(IsTransient(classifyError(fmt.Errorf("saving the snapshot: %w", driver.ErrBadConn))), "a bad Postgres connection should be retried")
+	assert.False(IsTransient(classifyError(errors.New("pq: duplicate key value violates unique constraint"))))
+
+	// Already classified errors are passed through untouched.
+	err := &JobError{Err: fmt.Errorf("boom"), Transient: true}
+	assert.Same(err, classifyError(err))
+}
+
+func TestRetryDelay(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(5*time.Second, retryDelay(1))
+	assert.Equal(10*time.Second, retryDelay(2))
+	assert.Equal(40*time.Second, retryDelay(4))
+	assert.Equal(5*time.Minute, retryDelay(20))
+}
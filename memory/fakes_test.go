@@ -0,0 +1,258 @@
+package memory
+
+import (
+	"context"
+	"slices"
+	"sync"
+
+	"github.com/Prateek-Gupta001/GoMemory/redis"
+	"github.com/Prateek-Gupta001/GoMemory/storage"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+// The doubles below keep everything in maps so the memory pipeline can be tested without Redis or Postgres. Like the
+// real stores they are scoped to the tenant of the context they are handed.
+
+type fakeCoreMemoryCache struct {
+	mu       sync.Mutex
+	memories map[string][]types.Memory
+	versions map[string]int64
+	// race, when set, runs once right before the next compare and set, standing in for a writer that got there first.
+	race func()
+}
+
+func newFakeCoreMemoryCache() *fakeCoreMemoryCache {
+	return &fakeCoreMemoryCache{memories: make(map[string][]types.Memory), versions: make(map[string]int64)}
+}
+
+func (f *fakeCoreMemoryCache) GetCoreMemory(userId string, ctx context.Context) ([]types.Memory, error) {
+	mem, _, err := f.GetCoreMemoryVersion(userId, ctx)
+	return mem, err
+}
+
+func (f *fakeCoreMemoryCache) GetCoreMemoryVersion(userId string, ctx context.Context) ([]types.Memory, int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := types.TenantId(ctx) + ":" + userId
+	return slices.Clone(f.memories[key]), f.versions[key], nil
+}
+
+func (f *fakeCoreMemoryCache) CompareAndSetCoreMemory(userId string, CoreMemories []types.Memory, version int64, ctx context.Context) error {
+	if race := f.race; race != nil {
+		f.race = nil
+		race()
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := types.TenantId(ctx) + ":" + userId
+	if f.versions[key] != version {
+		return redis.ErrCoreMemoryConflict
+	}
+	if len(CoreMemories) == 0 {
+		delete(f.memories, key)
+	} else {
+		f.memories[key] = slices.Clone(CoreMemories)
+	}
+	f.versions[key]++
+	return nil
+}
+
+func (f *fakeCoreMemoryCache) AddCoreMemory(userId string, mem types.Memory, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := types.TenantId(ctx) + ":" + userId
+	f.memories[key] = append(slices.DeleteFunc(f.memories[key], func(m types.Memory) bool { return m.Memory_Id == mem.Memory_Id }), mem)
+	f.versions[key]++
+	return nil
+}
+
+func (f *fakeCoreMemoryCache) UpdateCoreMemory(userId string, mem types.Memory, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := types.TenantId(ctx) + ":" + userId
+	i := slices.IndexFunc(f.memories[key], func(m types.Memory) bool { return m.Memory_Id == mem.Memory_Id })
+	if i < 0 {
+		return redis.ErrCoreMemoryNotFound
+	}
+	f.memories[key][i] = mem
+	f.versions[key]++
+	return nil
+}
+
+func (f *fakeCoreMemoryCache) DeleteCoreMemory(userId string, coreMemoryIds []string, ctx context.Context) ([]string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := types.TenantId(ctx) + ":" + userId
+	var deleted []string
+	f.memories[key] = slices.DeleteFunc(f.memories[key], func(mem types.Memory) bool {
+		if slices.Contains(coreMemoryIds, mem.Memory_Id) {
+			deleted = append(deleted, mem.Memory_Id)
+			return true
+		}
+		return false
+	})
+	if len(deleted) != 0 {
+		f.versions[key]++
+	}
+	return deleted, nil
+}
+
+func (f *fakeCoreMemoryCache) DeleteUserCoreMemories(userId string, ctx context.Context) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := types.TenantId(ctx) + ":" + userId
+	deleted := len(f.memories[key])
+	delete(f.memories, key)
+	delete(f.versions, key)
+	return deleted, nil
+}
+
+type fakeStore struct {
+	mu         sync.Mutex
+	jobs       map[string]*types.MemoryJob
+	jobTenants map[string]string
+	changes    []types.MemoryChange
+	snapshots  map[string]types.JobSnapshot
+	apiKeys    map[string]types.APIKey
+	forgotten  map[string]bool
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{
+		jobs:       make(map[string]*types.MemoryJob),
+		jobTenants: make(map[string]string),
+		snapshots:  make(map[string]types.JobSnapshot),
+		apiKeys:    make(map[string]types.APIKey),
+		forgotten:  make(map[string]bool),
+	}
+}
+
+func (f *fakeStore) InsertMemoryJob(job types.MemoryInsertionJob, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.jobs[job.ReqId] = &types.MemoryJob{ReqId: job.ReqId, UserId: job.UserId, Messages: job.Messages, Threshold: job.Threshold, Status: types.JobStatusQueued}
+	f.jobTenants[job.ReqId] = types.TenantId(types.WithTenantId(ctx, job.TenantId))
+	return nil
+}
+
+func (f *fakeStore) UpdateJobStatus(reqId string, status types.JobStatus, jobErr error, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, ok := f.jobs[reqId]
+	if !ok {
+		return storage.ErrJobNotFound
+	}
+	job.Status = status
+	if jobErr != nil {
+		job.Error = jobErr.Error()
+	}
+	return nil
+}
+
+func (f *fakeStore) GetMemoryJob(reqId string, ctx context.Context) (*types.MemoryJob, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	job, ok := f.jobs[reqId]
+	if !ok || f.jobTenants[reqId] != types.TenantId(ctx) {
+		return nil, storage.ErrJobNotFound
+	}
+	j := *job
+	return &j, nil
+}
+
+func (f *fakeStore) InsertMemoryChanges(changes []types.MemoryChange, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.changes = append(f.changes, changes...)
+	return nil
+}
+
+func (f *fakeStore) GetMemoryHistory(userId string, limit int, ctx context.Context) ([]types.MemoryChange, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var changes []types.MemoryChange
+	for i := len(f.changes) - 1; i >= 0 && len(changes) < limit; i-- {
+		if f.changes[i].UserId == userId {
+			changes = append(changes, f.changes[i])
+		}
+	}
+	return changes, nil
+}
+
+func (f *fakeStore) SaveJobSnapshot(snapshot types.JobSnapshot, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if previous, ok := f.snapshots[snapshot.ReqId]; ok {
+		snapshot = storage.MergeJobSnapshots(previous, snapshot)
+	}
+	f.snapshots[snapshot.ReqId] = snapshot
+	return nil
+}
+
+func (f *fakeStore) GetJobSnapshot(reqId string, ctx context.Context) (*types.JobSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	snapshot, ok := f.snapshots[reqId]
+	if !ok {
+		return nil, storage.ErrSnapshotNotFound
+	}
+	return &snapshot, nil
+}
+
+func (f *fakeStore) InsertAPIKey(key types.APIKey, keyHash string, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.apiKeys[keyHash] = key
+	return nil
+}
+
+func (f *fakeStore) DeleteUserRecords(userId string, ctx context.Context) (*types.DeletedUserRecords, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	deleted := &types.DeletedUserRecords{}
+	for reqId, job := range f.jobs {
+		if job.UserId == userId && f.jobTenants[reqId] == types.TenantId(ctx) {
+			delete(f.jobs, reqId)
+			deleted.Jobs++
+		}
+	}
+	f.changes = slices.DeleteFunc(f.changes, func(c types.MemoryChange) bool {
+		if c.UserId == userId {
+			deleted.MemoryChanges++
+			return true
+		}
+		return false
+	})
+	for reqId, snapshot := range f.snapshots {
+		if snapshot.UserId == userId {
+			delete(f.snapshots, reqId)
+			deleted.Snapshots++
+		}
+	}
+	f.forgotten[types.TenantId(ctx)+":"+userId] = true
+	return deleted, nil
+}
+
+func (f *fakeStore) UserForgotten(userId string, ctx context.Context) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.forgotten[types.TenantId(ctx)+":"+userId], nil
+}
+
+func (f *fakeStore) DeleteJobRecords(reqId string, ctx context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.changes = slices.DeleteFunc(f.changes, func(c types.MemoryChange) bool { return c.ReqId == reqId })
+	delete(f.snapshots, reqId)
+	return nil
+}
+
+func (f *fakeStore) GetAPIKeyByHash(keyHash string, ctx context.Context) (*types.APIKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.apiKeys[keyHash]
+	if !ok {
+		return nil, storage.ErrAPIKeyNotFound
+	}
+	return &key, nil
+}
@@ -0,0 +1,161 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/google/uuid"
+	"github.com/nats-io/nats.go"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// WorkStream captures the memory_work subjects the workers consume memory jobs from.
+const WorkStream = "MEMORY_SYSTEM"
+
+// ForgetUser erases everything GoMemory holds about a user of the tenant: their queued and dead-lettered jobs, their
+// jobs, changes and snapshots in Postgres, and their general and core memories. Queued jobs go first so a worker can't
+// pick one up after the user has been forgotten. Only the lane of the user, the memory_work subject and the
+// dead-letter subjects of the tenant are read for them. The job ledger goes next, before the memories, and leaves a
+// tombstone of the user: a job that is already being worked on looks its own ledger entry up before it writes and once
+// more when it is done, and takes back what it wrote if the entry is gone and the tombstone is there. Whatever it wrote
+// before the ledger went is deleted along with the memories.
+// It stops at the first store that fails, calling it again picks up where it left off.
+func (m *MemoryAgent) ForgetUser(userId string, ctx context.Context) (*types.UserDeletionReceipt, error) {
+	ctx, span := Tracer.Start(ctx, "Forgetting User")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId))
+	receipt := &types.UserDeletionReceipt{
+		ReceiptId: uuid.NewString(),
+		TenantId:  types.TenantId(ctx),
+		UserId:    userId,
+	}
+	var err error
+	lane := workSubject(types.MemoryInsertionJob{TenantId: types.TenantId(ctx), UserId: userId}, m.WorkLanes)
+	if receipt.QueuedJobs, err = m.purgeUserJobs(WorkStream, []string{lane, WorkSubject}, userId, ctx, func(data []byte) (types.MemoryInsertionJob, error) {
+		job := types.MemoryInsertionJob{}
+		err := json.Unmarshal(data, &job)
+		return job, err
+	}); err != nil {
+		return nil, fmt.Errorf("purging the queued jobs: %w", err)
+	}
+	if receipt.DeadLetters, err = m.purgeUserJobs(DeadLetterStream, []string{deadLetterSubject(types.TenantId(ctx)), DeadLetterSubject}, userId, ctx, func(data []byte) (types.MemoryInsertionJob, error) {
+		deadLetter := types.DeadLetterJob{}
+		err := json.Unmarshal(data, &deadLetter)
+		return deadLetter.Job, err
+	}); err != nil {
+		return nil, fmt.Errorf("purging the dead-lettered jobs: %w", err)
+	}
+	records, err := m.Store.DeleteUserRecords(userId, ctx)
+	if err != nil {
+		return nil, fmt.Errorf("deleting the job and audit records: %w", err)
+	}
+	receipt.DeletedUserRecords = *records
+	if receipt.GeneralMemories, err = m.Vectordb.DeleteUserMemories(userId, ctx); err != nil {
+		return nil, fmt.Errorf("deleting the general memories: %w", err)
+	}
+	if receipt.CoreMemories, err = m.CoreMemoryCache.DeleteUserCoreMemories(userId, ctx); err != nil {
+		return nil, fmt.Errorf("deleting the core memories: %w", err)
+	}
+	receipt.DeletedAt = time.Now()
+	slog.Info("User has been forgotten", "receipt", receipt)
+	return receipt, nil
+}
+
+// errUserForgotten stops a job whose user was forgotten while it was running.
+var errUserForgotten = errors.New("the user of the memory job has been forgotten")
+
+// eraseJob takes back what the job wrote for a user that was forgotten while it ran: the general memories it inserted
+// or rewrote, the core memories, which it wrote as a whole list and may have brought back, and its changes and
+// snapshot. No other job of the user runs meanwhile, its lane sees to that.
+func (m *MemoryAgent) eraseJob(memjob *types.MemoryInsertionJob, snapshot types.JobSnapshot, ctx context.Context) {
+	ctx, span := Tracer.Start(ctx, "Erasing the Job of a Forgotten User")
+	defer span.End()
+	written := slices.Clone(snapshot.InsertedGeneralMemoryIds)
+	for _, p := range snapshot.UpdatedGeneralMemories {
+		written = append(written, p.Memory.Memory_Id)
+	}
+	if len(written) != 0 {
+		if err := m.Vectordb.DeleteMemories(written, ctx); err != nil {
+			slog.Error("Got this error while erasing the general memories the job wrote for a forgotten user", "error", err, "reqId", memjob.ReqId, "userId", memjob.UserId)
+		}
+	}
+	if _, err := m.CoreMemoryCache.DeleteUserCoreMemories(memjob.UserId, ctx); err != nil {
+		slog.Error("Got this error while erasing the core memories the job wrote for a forgotten user", "error", err, "reqId", memjob.ReqId, "userId", memjob.UserId)
+	}
+	if err := m.Store.DeleteJobRecords(memjob.ReqId, ctx); err != nil {
+		slog.Error("Got this error while erasing the records of the job of a forgotten user", "error", err, "reqId", memjob.ReqId, "userId", memjob.UserId)
+	}
+	slog.Warn("The user of the memory job was forgotten while it ran, erased what it wrote", "reqId", memjob.ReqId, "userId", memjob.UserId)
+}
+
+// purgeUserJobs securely deletes every job of the user of the tenant on the subjects of a stream and returns how many
+// were deleted. Only the subjects the jobs of the user can be on are read, not the whole stream.
+func (m *MemoryAgent) purgeUserJobs(stream string, subjects []string, userId string, ctx context.Context, jobOf func([]byte) (types.MemoryInsertionJob, error)) (int, error) {
+	var seqs []uint64
+	for _, subject := range subjects {
+		err := m.readSubject(stream, subject, ctx, func(seq uint64, data []byte) {
+			job, err := jobOf(data)
+			if err != nil {
+				slog.Warn("Skipping a message that isn't a memory job", "error", err, "stream", stream, "seq", seq)
+				return
+			}
+			if job.UserId == userId && jobTenantId(job) == types.TenantId(ctx) {
+				seqs = append(seqs, seq)
+			}
+		})
+		if err != nil {
+			return 0, err
+		}
+	}
+	purged := 0
+	for _, seq := range seqs {
+		if err := m.JSClient.SecureDeleteMsg(stream, seq, nats.Context(ctx)); err != nil {
+			if errors.Is(err, nats.ErrMsgNotFound) {
+				continue //deleted in the meantime
+			}
+			slog.Error("Got this error while deleting a job of the user from the stream", "error", err, "stream", stream, "seq", seq)
+			return purged, err
+		}
+		purged++
+	}
+	return purged, nil
+}
+
+// readSubject hands every message the stream holds on subject to fn, oldest first, through an ordered consumer that is
+// only handed the messages of that subject. It stops at the message that has none pending after it.
+func (m *MemoryAgent) readSubject(stream string, subject string, ctx context.Context, fn func(seq uint64, data []byte)) error {
+	info, err := m.JSClient.StreamInfo(stream, &nats.StreamInfoRequest{SubjectsFilter: subject}, nats.Context(ctx))
+	if err != nil {
+		slog.Error("Got this error while getting the info of the stream", "error", err, "stream", stream, "subject", subject)
+		return err
+	}
+	if info.State.Subjects[subject] == 0 {
+		return nil
+	}
+	sub, err := m.JSClient.SubscribeSync(subject, nats.BindStream(stream), nats.OrderedConsumer(), nats.DeliverAll())
+	if err != nil {
+		slog.Error("Got this error while subscribing to the subject", "error", err, "stream", stream, "subject", subject)
+		return err
+	}
+	defer sub.Unsubscribe()
+	for pending := uint64(1); pending > 0; {
+		msg, err := sub.NextMsgWithContext(ctx)
+		if err != nil {
+			slog.Error("Got this error while reading the messages of the subject", "error", err, "stream", stream, "subject", subject)
+			return err
+		}
+		meta, err := msg.Metadata()
+		if err != nil {
+			return err
+		}
+		pending = meta.NumPending
+		fn(meta.Sequence.Stream, msg.Data)
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package memory
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/Prateek-Gupta001/GoMemory/llm"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/Prateek-Gupta001/GoMemory/vectordb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newForgettingAgent is an agent with user_123 seeded, queues of its own and a Paris move job in the ledger.
+func newForgettingAgent(t *testing.T) (*MemoryAgent, *types.MemoryInsertionJob) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	agent.JSClient = connectJetStream(t, runNATS(t))
+	seedMemories(t, agent)
+	return agent, newParisJob(t, agent)
+}
+
+// requireForgotten checks that nothing of user_123 is left.
+func requireForgotten(t *testing.T, agent *MemoryAgent, reqId string) {
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, general, "no general memories are left")
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, core, "no core memories are left")
+	history, err := agent.Store.GetMemoryHistory("user_123", 100, t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, history, "no changes are left")
+	_, err = agent.Store.GetJobSnapshot(reqId, t.Context())
+	assert.Error(t, err, "no snapshot is left")
+}
+
+func TestForgetUser(t *testing.T) {
+	agent, job := newForgettingAgent(t)
+	require.NoError(t, agent.SumbitMemoryInsertionRequest(*job))
+	other := types.MemoryInsertionJob{ReqId: "5678", UserId: "user_456", Messages: job.Messages}
+	require.NoError(t, agent.SumbitMemoryInsertionRequest(other))
+	otherTenant := types.MemoryInsertionJob{ReqId: "9012", TenantId: "acme", UserId: "user_123", Messages: job.Messages}
+	require.NoError(t, agent.SumbitMemoryInsertionRequest(otherTenant))
+	// queued before there were lanes
+	legacy, err := json.Marshal(types.MemoryInsertionJob{ReqId: "3456", UserId: "user_123", Messages: job.Messages})
+	require.NoError(t, err)
+	_, err = agent.JSClient.Publish(WorkSubject, legacy)
+	require.NoError(t, err)
+	require.NoError(t, agent.deadLetter(&types.MemoryInsertionJob{ReqId: "7890", UserId: "user_123"}, errors.New("model is overloaded"), 5))
+
+	receipt, err := agent.ForgetUser("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 2, receipt.QueuedJobs)
+	assert.Equal(t, 1, receipt.DeadLetters)
+	assert.Equal(t, 2, receipt.GeneralMemories)
+	assert.Equal(t, 1, receipt.CoreMemories)
+	assert.Equal(t, 1, receipt.DeletedUserRecords.Jobs)
+	requireForgotten(t, agent, job.ReqId)
+
+	info, err := agent.JSClient.StreamInfo(WorkStream)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), info.State.Msgs, "the jobs of other users stay queued")
+	assert.True(t, agent.userForgotten(job), "a job left running is dropped")
+}
+
+func TestJobsWithoutALedgerEntryStillRun(t *testing.T) {
+	agent, _ := newForgettingAgent(t)
+	// queued before there was a ledger
+	job := &types.MemoryInsertionJob{ReqId: "legacy", UserId: "user_123", Messages: []types.Message{{Role: types.RoleUser, Content: parisMove}}}
+	assert.False(t, agent.userForgotten(job))
+
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	assert.Equal(t, types.JobStatusSucceeded, status)
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Contains(t, memoryTexts(core), "User lives in Paris")
+}
+
+// forgettingLLM forgets the user of the job the moment the archivist has answered, while the job is still running.
+type forgettingLLM struct {
+	*llm.FakeLLM
+	forget func()
+}
+
+func (f *forgettingLLM) GenerateMemoryText(messages []types.Message, coreMemories []types.Memory, oldMemories []types.Memory, ctx context.Context) (*types.MemoryOutput, error) {
+	output, err := f.FakeLLM.GenerateMemoryText(messages, coreMemories, oldMemories, ctx)
+	f.forget()
+	return output, err
+}
+
+func TestInsertMemoryStopsOnceTheUserIsForgotten(t *testing.T) {
+	agent, job := newForgettingAgent(t)
+	agent.LLM = &forgettingLLM{FakeLLM: agent.LLM.(*llm.FakeLLM), forget: func() {
+		_, err := agent.ForgetUser("user_123", t.Context())
+		require.NoError(t, err)
+	}}
+
+	_, err := agent.InsertMemory(job)
+	assert.ErrorIs(t, err, errUserForgotten)
+	requireForgotten(t, agent, job.ReqId)
+}
+
+func TestInsertMemoryRetryingCoreMemoriesStopsOnceTheUserIsForgotten(t *testing.T) {
+	agent, job := newForgettingAgent(t)
+	// forgotten right before the core memories are written, which brings them back in a fresh row unless the job stops
+	agent.CoreMemoryCache.(*fakeCoreMemoryCache).race = func() {
+		_, err := agent.ForgetUser("user_123", t.Context())
+		require.NoError(t, err)
+	}
+
+	_, err := agent.InsertMemory(job)
+	assert.ErrorIs(t, err, errUserForgotten)
+	requireForgotten(t, agent, job.ReqId)
+}
+
+// forgettingVectorDB forgets the user right before the job inserts its general memories, so they land after everything
+// of the user was deleted.
+type forgettingVectorDB struct {
+	vectordb.VectorDB
+	forget func()
+}
+
+func (f *forgettingVectorDB) UpsertMemories(points []types.MemoryPoint, ctx context.Context) error {
+	f.forget()
+	return f.VectorDB.UpsertMemories(points, ctx)
+}
+
+func TestInsertMemoryErasesWhatItWroteAfterTheUserWasForgotten(t *testing.T) {
+	agent, job := newForgettingAgent(t)
+	agent.Vectordb = &forgettingVectorDB{VectorDB: agent.Vectordb, forget: func() {
+		_, err := agent.ForgetUser("user_123", t.Context())
+		require.NoError(t, err)
+	}}
+
+	_, err := agent.InsertMemory(job)
+	assert.ErrorIs(t, err, errUserForgotten)
+	requireForgotten(t, agent, job.ReqId)
+}
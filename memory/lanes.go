@@ -0,0 +1,67 @@
+package memory
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/nats-io/nats.go"
+)
+
+// Two jobs of the same user must never run at once: both would read the same core memories and the one that finishes
+// last would overwrite what the other one learnt. So every job goes to one of the WorkLanes subjects of the agent,
+// picked from its tenant and user, and each lane has a durable consumer of its own that hands out a single job at a
+// time to the whole fleet of workers. The jobs of a user always take the same lane and therefore run one after the
+// other, in the order they were submitted, while the other lanes keep going.
+//
+// The price is head-of-line blocking. A lane is shared by every user that hashes to it, and a job that is waiting to
+// be retried holds its lane back, since letting the next one through would run it before the job it came after. The
+// NakWithDelay backoff of a failing job, up to 5 minutes between attempts, therefore stalls every other user of its
+// lane as well. More lanes spread users thinner, so fewer of them sit behind a failing job, at the cost of a durable
+// consumer per lane on the NATS server. WorkLanes is also the most jobs that can run at once across every instance.
+// Every instance has to agree on it: changing it moves users to other lanes while their jobs may still be queued.
+
+// WorkSubject is the subject jobs were published on before they were spread over lanes. It is still consumed so
+// the jobs queued before an upgrade aren't lost.
+const WorkSubject = "memory_work"
+
+// AddWorkStream creates the MEMORY_SYSTEM stream if it isn't there yet, and makes an existing one capture the lanes too.
+func AddWorkStream(js nats.JetStreamContext) error {
+	subjects := []string{WorkSubject, WorkSubject + ".*"}
+	_, err := js.AddStream(&nats.StreamConfig{
+		Name:     WorkStream,
+		Subjects: subjects,
+		// Storage:  nats.FileStorage,     //For production, uncomment this line! This will make our stuff persist in file and
+	}) //and allow us to not loose our memory jobs!
+	if !errors.Is(err, nats.ErrStreamNameAlreadyInUse) {
+		return err
+	}
+	info, err := js.StreamInfo(WorkStream)
+	if err != nil {
+		return err
+	}
+	info.Config.Subjects = subjects
+	_, err = js.UpdateStream(&info.Config)
+	return err
+}
+
+// workLane is the lane out of lanes the jobs of the user of the tenant go to.
+func workLane(tenantId string, userId string, lanes int) int {
+	h := fnv.New32a()
+	h.Write([]byte(tenantId))
+	h.Write([]byte{0})
+	h.Write([]byte(userId))
+	return int(h.Sum32() % uint32(lanes))
+}
+
+// workSubject is the subject the job is published on. UserIds can be any string, so the subject carries the lane
+// rather than the userId itself.
+func workSubject(job types.MemoryInsertionJob, lanes int) string {
+	return fmt.Sprintf("%s.%d", WorkSubject, workLane(jobTenantId(job), job.UserId, lanes))
+}
+
+// laneConsumer is the durable consumer, and queue group, of a lane.
+func laneConsumer(lane int) string {
+	return fmt.Sprintf("workers-%d", lane)
+}
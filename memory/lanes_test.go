@@ -0,0 +1,140 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/llm"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkSubject(t *testing.T) {
+	assert := assert.New(t)
+	job := types.MemoryInsertionJob{UserId: "user_123", TenantId: "acme"}
+	assert.Equal(workSubject(job, 16), workSubject(types.MemoryInsertionJob{UserId: "user_123", TenantId: "acme", ReqId: "another"}, 16), "every job of a user takes the same lane")
+	assert.Equal(workSubject(types.MemoryInsertionJob{UserId: "user_123"}, 16), workSubject(types.MemoryInsertionJob{UserId: "user_123", TenantId: types.DefaultTenantId}, 16), "jobs from before tenants belong to the default one")
+	assert.Regexp(`^memory_work\.\d+$`, workSubject(types.MemoryInsertionJob{UserId: "user.with.*.wildcards >"}, 16), "the userId never leaks into the subject")
+
+	lanes := map[int]bool{}
+	for i := range 1000 {
+		lane := workLane("acme", fmt.Sprintf("user_%d", i), 16)
+		assert.GreaterOrEqual(lane, 0)
+		assert.Less(lane, 16)
+		lanes[lane] = true
+	}
+	assert.Len(lanes, 16, "users are spread over every lane")
+}
+
+// overlapLLM is a FakeLLM that notices when the jobs of a user are handled at the same time. Every job says which
+// user it belongs to and takes a moment, so overlapping jobs can't miss each other.
+type overlapLLM struct {
+	*llm.FakeLLM
+	mu       sync.Mutex
+	running  map[string]int
+	overlaps int
+	handled  map[string][]string
+}
+
+func (o *overlapLLM) GenerateMemoryText(messages []types.Message, coreMemories []types.Memory, oldMemories []types.Memory, ctx context.Context) (*types.MemoryOutput, error) {
+	userId, _, _ := strings.Cut(llm.FakeKey(messages), ":")
+	o.mu.Lock()
+	o.running[userId]++
+	if o.running[userId] > 1 {
+		o.overlaps++
+	}
+	o.handled[userId] = append(o.handled[userId], llm.FakeKey(messages))
+	o.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	defer func() {
+		o.mu.Lock()
+		o.running[userId]--
+		o.mu.Unlock()
+	}()
+	return o.FakeLLM.GenerateMemoryText(messages, coreMemories, oldMemories, ctx)
+}
+
+// runNATS starts a NATS server with JetStream in the test, with the work and dead-letter streams added, and returns
+// its url.
+func runNATS(t *testing.T) string {
+	srv, err := server.NewServer(&server.Options{Port: -1, JetStream: true, StoreDir: t.TempDir(), NoLog: true, NoSigs: true})
+	require.NoError(t, err)
+	go srv.Start()
+	require.True(t, srv.ReadyForConnections(5*time.Second))
+	t.Cleanup(srv.Shutdown)
+	js := connectJetStream(t, srv.ClientURL())
+	require.NoError(t, AddWorkStream(js))
+	require.NoError(t, AddDeadLetterStream(js))
+	return srv.ClientURL()
+}
+
+// connectJetStream is a connection of its own, the way every instance of GoMemory has one.
+func connectJetStream(t *testing.T, url string) nats.JetStreamContext {
+	nc, err := nats.Connect(url)
+	require.NoError(t, err)
+	t.Cleanup(nc.Close)
+	js, err := nc.JetStream()
+	require.NoError(t, err)
+	return js
+}
+
+func TestJobsOfAUserNeverRunAtOnce(t *testing.T) {
+	fakeLLM := &overlapLLM{FakeLLM: llm.NewFakeLLM(), running: map[string]int{}, handled: map[string][]string{}}
+	agent := NewtestMemoryAgent(t, fakeLLM.FakeLLM)
+	agent.LLM = fakeLLM
+	agent.WorkLanes = 4
+	// two instances sharing the same stores, so the jobs of a lane are handed to both of them
+	url := runNATS(t)
+	const numWorker = 3
+	for range 2 {
+		instance := *agent
+		instance.JSClient = connectJetStream(t, url)
+		for id := range numWorker {
+			instance.MemoryWorker(id, numWorker)
+		}
+	}
+	agent.JSClient = connectJetStream(t, url)
+
+	users := []string{"user_a", "user_b", "user_c"}
+	submitted := map[string][]string{}
+	var reqIds []string
+	for i := range 4 {
+		for _, userId := range users {
+			text := fmt.Sprintf("%s: fact %d", userId, i)
+			fakeLLM.OnExpandQuery(text, "What does the user know")
+			fakeLLM.OnGenerateMemoryText(text, &types.MemoryOutput{CoreMemoryActions: []types.MemoryAction{{ActionType: "INSERT", Payload: ptr(text)}}})
+			job := types.MemoryInsertionJob{ReqId: fmt.Sprintf("%s-%d", userId, i), UserId: userId, Messages: []types.Message{{Role: types.RoleUser, Content: text}}}
+			require.NoError(t, agent.Store.InsertMemoryJob(job, t.Context()))
+			require.NoError(t, agent.SumbitMemoryInsertionRequest(job))
+			submitted[userId] = append(submitted[userId], text)
+			reqIds = append(reqIds, job.ReqId)
+		}
+	}
+
+	require.Eventually(t, func() bool {
+		for _, reqId := range reqIds {
+			job, err := agent.Store.GetMemoryJob(reqId, t.Context())
+			if err != nil || job.Status != types.JobStatusSucceeded {
+				return false
+			}
+		}
+		return true
+	}, 20*time.Second, 50*time.Millisecond)
+
+	fakeLLM.mu.Lock()
+	defer fakeLLM.mu.Unlock()
+	assert.Zero(t, fakeLLM.overlaps, "two jobs of one user were handled at the same time")
+	for _, userId := range users {
+		assert.Equal(t, submitted[userId], fakeLLM.handled[userId], "the jobs of a user run in the order they were submitted")
+		core, err := agent.CoreMemoryCache.GetCoreMemory(userId, t.Context())
+		require.NoError(t, err)
+		assert.Equal(t, submitted[userId], memoryTexts(core), "no job overwrote what an earlier one learnt")
+	}
+}
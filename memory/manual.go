@@ -0,0 +1,175 @@
+package memory
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/redis"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/google/uuid"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// The memories written here skip the queue and the archivist: they come straight from the user, so they are applied
+// right away and recorded in the history like the changes of a job, under a reqId of their own. That reqId is also the
+// source of the memory, which has no message to quote. A core memory that would take the user over the core memory
+// limits is refused with ErrCoreMemoryLimit. The limits are looked at just before the write, so two writes racing
+// each other may still both get in, a later job consolidates them then.
+
+var (
+	ErrMemoryNotFound  = errors.New("memory not found")
+	ErrMemoryForbidden = errors.New("memory belongs to another user")
+)
+
+// CreateMemory stores a core or general memory for the user as is.
+func (m *MemoryAgent) CreateMemory(userId string, memoryType types.MemoryType, text string, ctx context.Context) (*types.Memory, error) {
+	ctx, span := Tracer.Start(ctx, "Creating Memory")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId), attribute.String("type", string(memoryType)))
+	reqId := uuid.NewString()
+	now := time.Now().UTC()
+	mem := &types.Memory{Memory_text: text, Type: memoryType, UserId: userId, CreatedAt: now, UpdatedAt: now, SourceReqId: reqId}
+	switch memoryType {
+	case types.MemoryTypeCore:
+		mem.Memory_Id = uuid.NewString()
+		if err := m.checkCoreMemoryLimits(userId, *mem, ctx); err != nil {
+			return nil, err
+		}
+		if err := m.CoreMemoryCache.AddCoreMemory(userId, *mem, ctx); err != nil {
+			return nil, err
+		}
+	case types.MemoryTypeGeneral:
+		dense, sparse, err := m.EmbedClient.GenerateEmbeddings([]string{text}, ctx)
+		if err != nil {
+			slog.Error("Got this error while embedding the new memory", "error", err, "userId", userId)
+			return nil, err
+		}
+		ids, err := m.generalMemoryIds([]string{text}, userId, ctx)
+		if err != nil {
+			return nil, err
+		}
+		mem.Memory_Id = ids[0]
+		point := types.MemoryPoint{TenantId: types.TenantId(ctx), Memory: *mem, Dense: dense[0], Sparse: sparse[0]}
+		if err := m.Vectordb.UpsertMemories([]types.MemoryPoint{point}, ctx); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown memory type %q", memoryType)
+	}
+	m.recordManualChange(reqId, *mem, "INSERT", nil, &mem.Memory_text, ctx)
+	slog.Info("Memory has been created", "userId", userId, "memory", mem)
+	return mem, nil
+}
+
+// UpdateMemory replaces the text of a memory of the user, keeping its id. General memories are embedded again.
+func (m *MemoryAgent) UpdateMemory(userId string, memoryId string, text string, ctx context.Context) (*types.Memory, error) {
+	ctx, span := Tracer.Start(ctx, "Updating Memory")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId), attribute.String("memoryId", memoryId))
+	mem, err := m.findMemory(userId, memoryId, ctx)
+	if err != nil {
+		return nil, err
+	}
+	reqId := uuid.NewString()
+	before := mem.Memory_text
+	mem.Memory_text = text
+	stamp(mem, reqId, "", time.Now().UTC())
+	switch mem.Type {
+	case types.MemoryTypeCore:
+		if err := m.checkCoreMemoryLimits(userId, *mem, ctx); err != nil {
+			return nil, err
+		}
+		if err := m.CoreMemoryCache.UpdateCoreMemory(userId, *mem, ctx); err != nil {
+			if errors.Is(err, redis.ErrCoreMemoryNotFound) {
+				return nil, ErrMemoryNotFound //deleted by someone else in the meantime
+			}
+			return nil, err
+		}
+	case types.MemoryTypeGeneral:
+		dense, sparse, err := m.EmbedClient.GenerateEmbeddings([]string{text}, ctx)
+		if err != nil {
+			slog.Error("Got this error while embedding the edited memory", "error", err, "memoryId", memoryId)
+			return nil, err
+		}
+		point := types.MemoryPoint{TenantId: types.TenantId(ctx), Memory: *mem, Dense: dense[0], Sparse: sparse[0]}
+		if err := m.Vectordb.UpsertMemories([]types.MemoryPoint{point}, ctx); err != nil {
+			return nil, err
+		}
+	}
+	m.recordManualChange(reqId, *mem, "UPDATE", &before, &mem.Memory_text, ctx)
+	slog.Info("Memory has been updated", "userId", userId, "memoryId", memoryId, "before", before, "after", text)
+	return mem, nil
+}
+
+// DeleteMemoryById deletes a single core or general memory of the user.
+func (m *MemoryAgent) DeleteMemoryById(userId string, memoryId string, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Deleting Memory by Id")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId), attribute.String("memoryId", memoryId))
+	mem, err := m.findMemory(userId, memoryId, ctx)
+	if err != nil {
+		return err
+	}
+	var memoryIds, coreMemoryIds []string
+	if mem.Type == types.MemoryTypeCore {
+		coreMemoryIds = []string{memoryId}
+	} else {
+		memoryIds = []string{memoryId}
+	}
+	results, err := m.DeleteMemory(userId, memoryIds, coreMemoryIds, ctx)
+	if err != nil {
+		return err
+	}
+	if results[0].Status != types.DeletionStatusDeleted {
+		return ErrMemoryNotFound //deleted by someone else in the meantime
+	}
+	return nil
+}
+
+// findMemory looks a memory of the user up among their core memories first and their general memories after.
+func (m *MemoryAgent) findMemory(userId string, memoryId string, ctx context.Context) (*types.Memory, error) {
+	core, err := m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, mem := range core {
+		if mem.Memory_Id == memoryId {
+			mem.Type = types.MemoryTypeCore
+			return &mem, nil
+		}
+	}
+	if uuid.Validate(memoryId) != nil {
+		return nil, ErrMemoryNotFound
+	}
+	points, err := m.Vectordb.GetMemoriesByIds([]string{memoryId}, ctx)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, ErrMemoryNotFound
+	}
+	if points[0].Memory.UserId != userId {
+		return nil, ErrMemoryForbidden
+	}
+	mem := points[0].Memory
+	return &mem, nil
+}
+
+func (m *MemoryAgent) recordManualChange(reqId string, mem types.Memory, action string, before *string, after *string, ctx context.Context) {
+	change := types.MemoryChange{
+		ReqId:      reqId,
+		UserId:     mem.UserId,
+		MemoryId:   mem.Memory_Id,
+		MemoryType: mem.Type,
+		Action:     action,
+		Before:     before,
+		After:      after,
+		Reasoning:  "Written through the API",
+	}
+	if err := m.Store.InsertMemoryChanges([]types.MemoryChange{change}, ctx); err != nil {
+		slog.Warn("Got this error while recording the change in the audit log", "error", err, "userId", mem.UserId, "memoryId", mem.Memory_Id)
+	}
+}
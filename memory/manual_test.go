@@ -0,0 +1,131 @@
+package memory
+
+import (
+	"testing"
+
+	"github.com/Prateek-Gupta001/GoMemory/llm"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManualMemoryCRUD(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	ctx := t.Context()
+
+	core, err := agent.CreateMemory("user_123", types.MemoryTypeCore, "User is vegetarian", ctx)
+	require.NoError(t, err)
+	general, err := agent.CreateMemory("user_123", types.MemoryTypeGeneral, "User drives a Honda Civic", ctx)
+	require.NoError(t, err)
+	assert.Empty(t, fakeLLM.GenerateCalls, "manual writes never reach the archivist")
+
+	edited, err := agent.UpdateMemory("user_123", general.Memory_Id, "User drives a Toyota Corolla", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, general.Memory_Id, edited.Memory_Id)
+	retrieved, err := agent.GetMemories("which car does the user drive, Toyota?", "user_123", "req", 0.3, 0, ctx)
+	require.NoError(t, err)
+	memories := retrieved.Memories
+	assert.Equal(t, []string{"User is vegetarian", "User drives a Toyota Corolla"}, memoryTexts(memories), "the edit is embedded again")
+
+	_, err = agent.UpdateMemory("user_123", core.Memory_Id, "User is vegan", ctx)
+	require.NoError(t, err)
+	coreMemories, err := agent.GetCoreMemories("user_123", ctx)
+	require.NoError(t, err)
+	require.Len(t, coreMemories, 1)
+	assert.Equal(t, "User is vegan", coreMemories[0].Memory_text)
+	assert.Equal(t, core.CreatedAt, coreMemories[0].CreatedAt, "an edit keeps the creation time")
+	assert.NotEqual(t, core.SourceReqId, coreMemories[0].SourceReqId, "and is sourced from the edit")
+
+	_, err = agent.UpdateMemory("user_456", general.Memory_Id, "User drives a tank", ctx)
+	assert.ErrorIs(t, err, ErrMemoryForbidden)
+	assert.ErrorIs(t, agent.DeleteMemoryById("user_456", core.Memory_Id, ctx), ErrMemoryNotFound)
+
+	require.NoError(t, agent.DeleteMemoryById("user_123", general.Memory_Id, ctx))
+	require.NoError(t, agent.DeleteMemoryById("user_123", core.Memory_Id, ctx))
+	assert.ErrorIs(t, agent.DeleteMemoryById("user_123", general.Memory_Id, ctx), ErrMemoryNotFound)
+	all, err := agent.GetAllUserMemories("user_123", ctx)
+	require.NoError(t, err)
+	assert.Empty(t, all.Memories)
+
+	history, err := agent.Store.GetMemoryHistory("user_123", 100, ctx)
+	require.NoError(t, err)
+	var actions []string
+	for _, change := range history {
+		actions = append(actions, change.Action)
+	}
+	assert.Equal(t, []string{"DELETE", "DELETE", "UPDATE", "UPDATE", "INSERT", "INSERT"}, actions)
+}
+
+func TestListUserMemoriesPages(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, agent)
+	ctx := t.Context()
+
+	first, err := agent.ListUserMemories("user_123", 1, "", ctx)
+	require.NoError(t, err)
+	assert.Len(t, first.Memories, 2, "the first page holds the core memories on top of the limit")
+	assert.Equal(t, types.MemoryTypeCore, first.Memories[0].Type)
+	require.NotEmpty(t, first.NextCursor)
+
+	second, err := agent.ListUserMemories("user_123", 1, first.NextCursor, ctx)
+	require.NoError(t, err)
+	require.Len(t, second.Memories, 1)
+	assert.Equal(t, types.MemoryTypeGeneral, second.Memories[0].Type)
+	assert.NotEqual(t, first.Memories[1].Memory_Id, second.Memories[0].Memory_Id)
+	assert.Empty(t, second.NextCursor)
+
+	_, err = agent.ListUserMemories("user_123", 1, "not-a-cursor", ctx)
+	assert.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestEditedMemoryKeepsItsId(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	ctx := t.Context()
+	honda, err := agent.CreateMemory("user_123", types.MemoryTypeGeneral, "User drives a Honda Civic", ctx)
+	require.NoError(t, err)
+	_, err = agent.UpdateMemory("user_123", honda.Memory_Id, "User drives a Toyota Corolla", ctx)
+	require.NoError(t, err)
+
+	// the old text would derive the id the edited memory is still stored under
+	again, err := agent.CreateMemory("user_123", types.MemoryTypeGeneral, "User drives a Honda Civic", ctx)
+	require.NoError(t, err)
+	assert.NotEqual(t, honda.Memory_Id, again.Memory_Id)
+	all, err := agent.GetAllUserMemories("user_123", ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User drives a Toyota Corolla", "User drives a Honda Civic"}, memoryTexts(all.Memories))
+
+	// importing the user's own export doesn't duplicate the edited memory
+	bundle, err := agent.ExportUserMemories("user_123", true, ctx)
+	require.NoError(t, err)
+	_, err = agent.ImportUserMemories("user_123", bundle, ctx)
+	require.NoError(t, err)
+	all, err = agent.GetAllUserMemories("user_123", ctx)
+	require.NoError(t, err)
+	assert.Len(t, all.Memories, 2)
+}
+
+func TestManualCoreMemoriesStayWithinTheLimits(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	agent.MaxCoreMemories = 2
+	agent.CoreMemoryTokenBudget = 20
+	ctx := t.Context()
+	_, err := agent.CreateMemory("user_123", types.MemoryTypeCore, "User is vegetarian", ctx)
+	require.NoError(t, err)
+	nurse, err := agent.CreateMemory("user_123", types.MemoryTypeCore, "User is a nurse", ctx)
+	require.NoError(t, err)
+
+	_, err = agent.CreateMemory("user_123", types.MemoryTypeCore, "User lives in Paris", ctx)
+	assert.ErrorIs(t, err, ErrCoreMemoryLimit, "a third core memory is one too many")
+	_, err = agent.UpdateMemory("user_123", nurse.Memory_Id, "User is a nurse working night shifts at the children's hospital of Paris", ctx)
+	assert.ErrorIs(t, err, ErrCoreMemoryLimit, "so is going over the token budget")
+	_, err = agent.CreateMemory("user_123", types.MemoryTypeGeneral, "User lives in Paris", ctx)
+	assert.NoError(t, err, "general memories have no limits")
+
+	agent.CoreMemoryTokenBudget = 5
+	_, err = agent.UpdateMemory("user_123", nurse.Memory_Id, "User nurses", ctx)
+	assert.NoError(t, err, "shortening a core memory is always fine")
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User is vegetarian", "User nurses"}, memoryTexts(core))
+}
@@ -1,30 +1,50 @@
 package memory
 
 import (
+	"cmp"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/Prateek-Gupta001/GoMemory/embed"
 	"github.com/Prateek-Gupta001/GoMemory/llm"
 	"github.com/Prateek-Gupta001/GoMemory/redis"
+	"github.com/Prateek-Gupta001/GoMemory/storage"
 	"github.com/Prateek-Gupta001/GoMemory/types"
 	"github.com/Prateek-Gupta001/GoMemory/vectordb"
 	"github.com/google/uuid"
 	"github.com/nats-io/nats.go"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"golang.org/x/sync/errgroup"
 )
 
 type Memory interface {
-	GetMemories(user_query string, userId string, reqId string, threshold float32, ctx context.Context) ([]types.Memory, error) //For normal messages
-	DeleteMemory(memoryIds []string, ctx context.Context) error                                                                 //from the db
+	GetMemories(user_query string, userId string, reqId string, threshold float32, limit int, ctx context.Context) (*types.RetrievalResult, error) //For normal messages
+	ExplainMemories(user_query string, userId string, reqId string, threshold float32, limit int, ctx context.Context) (*types.RetrievalDebug, error)
+	DeleteMemory(userId string, memoryIds []string, coreMemoryIds []string, ctx context.Context) ([]types.MemoryDeletionResult, error)
 	SumbitMemoryInsertionRequest(memJob types.MemoryInsertionJob) error
-	GetAllUserMemories(userId string, ctx context.Context) ([]types.Memory, error)
+	GetAllUserMemories(userId string, ctx context.Context) (*types.RetrievalResult, error)
+	ListUserMemories(userId string, limit int, cursor string, ctx context.Context) (*types.MemoryPage, error)
 	GetCoreMemories(userId string, ctx context.Context) ([]types.Memory, error)
+	RevertMemoryJob(reqId string, ctx context.Context) (*types.JobRevertResult, error)
+	ListDeadLetters(userId string, ctx context.Context) ([]types.DeadLetterJob, error)
+	GetDeadLetter(seq uint64, ctx context.Context) (*types.DeadLetterJob, error)
+	ReplayDeadLetter(seq uint64, ctx context.Context) error
+	ReplayUserDeadLetters(userId string, ctx context.Context) (int, error)
+	ForgetUser(userId string, ctx context.Context) (*types.UserDeletionReceipt, error)
+	ExportUserMemories(userId string, withVectors bool, ctx context.Context) (*types.MemoryBundle, error)
+	ImportUserMemories(userId string, bundle *types.MemoryBundle, ctx context.Context) (*types.ImportResult, error)
+	CreateMemory(userId string, memoryType types.MemoryType, text string, ctx context.Context) (*types.Memory, error)
+	UpdateMemory(userId string, memoryId string, text string, ctx context.Context) (*types.Memory, error)
+	DeleteMemoryById(userId string, memoryId string, ctx context.Context) error
 	// in the future: delete user's memories and delete memory by Id...
 }
 
@@ -34,42 +54,144 @@ type MemoryAgent struct {
 	EmbedClient     embed.Embed
 	CoreMemoryCache redis.CoreMemoryCache
 	JSClient        nats.JetStreamContext
+	Store           storage.Storage
+	MaxDeliver      int //how many times a job is attempted before it is dead-lettered
+	WorkLanes       int //how many lanes jobs are spread over, see lanes.go
+	// The limits the core memories of a user are consolidated at, see compact.go. 0 turns either one off.
+	MaxCoreMemories       int
+	CoreMemoryTokenBudget int //roughly, in tokens of about four characters
 }
 
-func NewMemoryAgent(vectordb vectordb.VectorDB, llm llm.LLM, embedClient embed.Embed, nc nats.JetStreamContext, RC redis.CoreMemoryCache, queueLen int, numWorker int) (*MemoryAgent, error) {
+func NewMemoryAgent(vectordb vectordb.VectorDB, llm llm.LLM, embedClient embed.Embed, nc nats.JetStreamContext, RC redis.CoreMemoryCache, store storage.Storage, queueLen int, numWorker int, maxDeliver int, workLanes int, maxCoreMemories int, coreMemoryTokenBudget int) (*MemoryAgent, error) {
 	m := &MemoryAgent{
-		Vectordb:        vectordb,
-		LLM:             llm,
-		EmbedClient:     embedClient,
-		CoreMemoryCache: RC,
-		JSClient:        nc,
+		Vectordb:              vectordb,
+		LLM:                   llm,
+		EmbedClient:           embedClient,
+		CoreMemoryCache:       RC,
+		JSClient:              nc,
+		Store:                 store,
+		MaxDeliver:            maxDeliver,
+		WorkLanes:             workLanes,
+		MaxCoreMemories:       maxCoreMemories,
+		CoreMemoryTokenBudget: coreMemoryTokenBudget,
+	}
+	if numWorker > workLanes {
+		slog.Warn("There are more workers than lanes, the extra workers will stay idle", "workers", numWorker, "lanes", workLanes)
 	}
 	for i := 0; i < numWorker; i++ {
-		go m.MemoryWorker(i)
+		go m.MemoryWorker(i, numWorker)
 	}
 	return m, nil
 }
 
 var Tracer = otel.Tracer("Go_Memory")
 
-func (m *MemoryAgent) MemoryWorker(id int) {
-	m.JSClient.QueueSubscribe("memory_work", "workers", func(msg *nats.Msg) {
-		fmt.Printf("----------------------------------- Worker got a memory Job: %s\n ----------------------------------- \n", string(msg.Data))
-		memJob := &types.MemoryInsertionJob{}
-		if err := json.Unmarshal(msg.Data, memJob); err != nil {
-			slog.Error("error while unmarshalling NATS-jetstream data", "error", err)
-			msg.Term()
+var (
+	ErrJobAlreadyReverted = errors.New("memory job has already been reverted")
+	ErrJobNotFinished     = errors.New("memory job hasn't finished yet")
+)
+
+// jobAckWait is how long a worker has to finish a job. InsertMemory alone may take up to 60s, the default 30s would
+// redeliver jobs that are still running.
+const jobAckWait = time.Second * 90
+
+// MemoryWorker consumes the lanes that fall to worker id out of numWorker, every lane one job at a time. The first worker
+// also drains the jobs that were queued on the memory_work subject before there were lanes.
+func (m *MemoryAgent) MemoryWorker(id int, numWorker int) {
+	for lane := id; lane < m.WorkLanes; lane += numWorker {
+		subject := fmt.Sprintf("%s.%d", WorkSubject, lane)
+		_, err := m.JSClient.QueueSubscribe(subject, laneConsumer(lane), m.handleMemoryJob, nats.ManualAck(), nats.AckWait(jobAckWait), nats.MaxAckPending(1))
+		if err != nil {
+			slog.Error("Got this error while subscribing the worker to its lane", "error", err, "worker", id, "lane", lane)
+		}
+	}
+	if id == 0 {
+		if _, err := m.JSClient.QueueSubscribe(WorkSubject, "workers", m.handleMemoryJob, nats.ManualAck(), nats.AckWait(jobAckWait)); err != nil {
+			slog.Error("Got this error while subscribing the worker to the memory_work subject", "error", err, "worker", id)
+		}
+	}
+}
+
+// handleMemoryJob runs a single memory job off the queue and acks, retries or dead-letters it depending on how it went.
+func (m *MemoryAgent) handleMemoryJob(msg *nats.Msg) {
+	fmt.Printf("----------------------------------- Worker got a memory Job: %s\n ----------------------------------- \n", string(msg.Data))
+	memJob := &types.MemoryInsertionJob{}
+	if err := json.Unmarshal(msg.Data, memJob); err != nil {
+		slog.Error("error while unmarshalling NATS-jetstream data", "error", err)
+		msg.Term()
+		return
+	}
+	if m.userForgotten(memJob) {
+		slog.Warn("Dropping the memory job, its user has been forgotten", "reqId", memJob.ReqId, "userId", memJob.UserId)
+		msg.Term()
+		return
+	}
+	m.updateJobStatus(memJob.ReqId, types.JobStatusProcessing, nil)
+	status, err := m.InsertMemory(memJob)
+	if errors.Is(err, errUserForgotten) {
+		slog.Warn("Dropping the memory job, its user was forgotten while it ran", "reqId", memJob.ReqId, "userId", memJob.UserId)
+		msg.Term()
+		return
+	}
+	if err != nil {
+		slog.Info("Memory worker encountered an error while working", "error", err, "reqId", memJob.ReqId, "userId", memJob.UserId)
+		attempt := 1
+		if meta, metaErr := msg.Metadata(); metaErr == nil {
+			attempt = int(meta.NumDelivered)
+		}
+		if IsTransient(err) && attempt < m.MaxDeliver {
+			delay := retryDelay(attempt)
+			slog.Warn("Transient failure, the memory job will be retried", "reqId", memJob.ReqId, "attempt", attempt, "maxDeliver", m.MaxDeliver, "delay", delay)
+			m.updateJobStatus(memJob.ReqId, types.JobStatusRetrying, err)
+			msg.NakWithDelay(delay)
 			return
 		}
-		if err := m.InsertMemory(memJob); err != nil {
-			slog.Info("Memory worker encountered an error while working", "error", err, "reqId", memJob.ReqId, "userId", memJob.UserId)
-			//TODO: Check from InsertMemory if its a deterministic error or not .. if its an API server issue or an OpenAI issue or an LLM issue
-			//TODO: .. You would wanna retry the job .. in that case .. otherwise not!
-			msg.Term()
+		if dlqErr := m.deadLetter(memJob, err, attempt); dlqErr != nil {
+			// terminating it now would lose the job, so it stays on its lane until it can be parked
+			m.updateJobStatus(memJob.ReqId, types.JobStatusRetrying, err)
+			msg.NakWithDelay(retryDelay(attempt))
 			return
 		}
-		msg.Ack()
-	})
+		m.updateJobStatus(memJob.ReqId, types.JobStatusFailed, err)
+		msg.Term()
+		return
+	}
+	m.updateJobStatus(memJob.ReqId, status, nil)
+	msg.Ack()
+}
+
+// userForgotten reports whether the user of the job was forgotten after the job was submitted: its ledger entry is
+// gone and ForgetUser left a tombstone of the user. A job without a ledger entry whose user was never forgotten, say
+// one queued or dead-lettered before there was a ledger, is no reason to drop it and is run like any other.
+func (m *MemoryAgent) userForgotten(memJob *types.MemoryInsertionJob) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	ctx = types.WithTenantId(ctx, memJob.TenantId)
+	if _, err := m.Store.GetMemoryJob(memJob.ReqId, ctx); !errors.Is(err, storage.ErrJobNotFound) {
+		return false
+	}
+	forgotten, err := m.Store.UserForgotten(memJob.UserId, ctx)
+	if err != nil {
+		slog.Warn("Got this error while looking for the tombstone of the user of the job, running it", "error", err, "reqId", memJob.ReqId, "userId", memJob.UserId)
+		return false
+	}
+	return forgotten
+}
+
+// retryDelay backs off exponentially from 5 seconds, capped at 5 minutes.
+func retryDelay(attempt int) time.Duration {
+	delay := time.Duration(1<<min(attempt-1, 6)) * 5 * time.Second
+	return min(delay, 5*time.Minute)
+}
+
+// updateJobStatus records the job's progress in the ledger. A failing ledger write is only logged, it should never
+// decide the fate of the memory job itself.
+func (m *MemoryAgent) updateJobStatus(reqId string, status types.JobStatus, jobErr error) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+	defer cancel()
+	if err := m.Store.UpdateJobStatus(reqId, status, jobErr, ctx); err != nil {
+		slog.Warn("Got this error while updating the status of the memory job", "error", err, "reqId", reqId, "status", status)
+	}
 }
 
 func (m *MemoryAgent) SumbitMemoryInsertionRequest(memJob types.MemoryInsertionJob) error {
@@ -80,7 +202,7 @@ func (m *MemoryAgent) SumbitMemoryInsertionRequest(memJob types.MemoryInsertionJ
 		slog.Info("Got this error while marshalling the MemoryInsertionJob ", "error", err)
 		return err
 	}
-	_, err = m.JSClient.Publish("memory_work", memJson)
+	_, err = m.JSClient.Publish(workSubject(memJob, m.WorkLanes), memJson)
 	return err
 }
 
@@ -93,42 +215,219 @@ func (m *MemoryAgent) GetCoreMemories(userId string, ctx context.Context) ([]typ
 	return mem, nil
 }
 
-func (m *MemoryAgent) GetMemories(text string, userId string, reqId string, threshold float32, ctx context.Context) ([]types.Memory, error) {
-	dense, sparse, err := m.EmbedClient.GenerateEmbeddings([]string{"_Query_" + text}, ctx)
-	//TODO: Make these two independent requests concurrent using goroutines and waitgroups, errgroups. Here AND in GetAllUserMemories.
+// queryPrefix marks the text of a search, as opposed to a memory, for the embedding service.
+const queryPrefix = "_Query_"
+
+// How long each stage of the read path may take before it is given up on and reported as failed. The core memories
+// don't depend on the embedding, so they are fetched while the general memories are being searched for.
+const (
+	embedTimeout      = 2 * time.Second
+	searchTimeout     = 2 * time.Second
+	coreMemoryTimeout = time.Second
+)
+
+// GetMemories returns the core memories of the user followed by at most limit general memories matching the text,
+// vectordb.DefaultSearchLimit for a limit of 0. A stage that fails only fails the retrieval if the other one did too.
+func (m *MemoryAgent) GetMemories(text string, userId string, reqId string, threshold float32, limit int, ctx context.Context) (*types.RetrievalResult, error) {
+	return m.searchMemories(queryPrefix+text, userId, reqId, threshold, limit, false, ctx)
+}
+
+// ExplainMemories runs the same search as GetMemories and explains it: the text that was embedded, and how the dense
+// and the sparse stage of the hybrid search ranked each general memory that came back.
+func (m *MemoryAgent) ExplainMemories(text string, userId string, reqId string, threshold float32, limit int, ctx context.Context) (*types.RetrievalDebug, error) {
+	debug := &types.RetrievalDebug{Query: text, EmbeddedQuery: queryPrefix + text, Threshold: threshold}
+	result, err := m.searchMemories(debug.EmbeddedQuery, userId, reqId, threshold, limit, true, ctx)
 	if err != nil {
-		slog.Error("Got this error while generating emebddings", "error", err, "reqId", reqId)
 		return nil, err
 	}
-	GeneralMemories, err := m.Vectordb.GetSimilarMemories(dense[0], sparse[0], userId, threshold, ctx)
+	debug.RetrievalResult = *result
+	return debug, nil
+}
+
+func (m *MemoryAgent) searchMemories(query string, userId string, reqId string, threshold float32, limit int, explain bool, ctx context.Context) (*types.RetrievalResult, error) {
+	ctx, span := Tracer.Start(ctx, "Searching Memories")
+	defer span.End()
+	var CoreMemories, GeneralMemories []types.Memory
+	var coreErr, generalErr error
+	// the stages report their own errors, neither of them should cancel the other
+	var g errgroup.Group
+	g.Go(func() error {
+		ctx, cancel := context.WithTimeout(ctx, coreMemoryTimeout)
+		defer cancel()
+		CoreMemories, coreErr = m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+		return coreErr
+	})
+	g.Go(func() error {
+		GeneralMemories, generalErr = m.searchGeneralMemories(query, userId, threshold, limit, explain, ctx)
+		return generalErr
+	})
+	g.Wait()
+
+	result := &types.RetrievalResult{}
+	if coreErr != nil {
+		slog.Warn("Got this error while trying to get core memories, returning the general ones only", "userId", userId, "error", coreErr, "reqId", reqId)
+		result.FailedStages = append(result.FailedStages, types.RetrievalStageCore)
+	}
+	if generalErr != nil {
+		slog.Warn("Got this error while getting similar memories, returning the core ones only", "error", generalErr, "reqId", reqId)
+		result.FailedStages = append(result.FailedStages, types.RetrievalStageGeneral)
+	}
+	if coreErr != nil && generalErr != nil {
+		span.RecordError(generalErr)
+		return nil, errors.Join(coreErr, generalErr)
+	}
+	result.Partial = len(result.FailedStages) != 0
+	span.SetAttributes(attribute.Bool("partial", result.Partial))
+	result.Memories = append(CoreMemories, GeneralMemories...)
+	if result.Memories == nil {
+		result.Memories = []types.Memory{}
+	}
+	return result, nil
+}
+
+// searchGeneralMemories embeds the query and runs the hybrid search with it, each under its own timeout.
+func (m *MemoryAgent) searchGeneralMemories(query string, userId string, threshold float32, limit int, explain bool, ctx context.Context) ([]types.Memory, error) {
+	embedCtx, cancel := context.WithTimeout(ctx, embedTimeout)
+	defer cancel()
+	dense, sparse, err := m.EmbedClient.GenerateEmbeddings([]string{query}, embedCtx)
 	if err != nil {
-		slog.Warn("Got this error while getting similar memories! Trying to get Core Memories now", "error", err, "reqId", reqId)
+		return nil, fmt.Errorf("generating the query embeddings: %w", err)
 	}
-	CoreMemories, err := m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+	searchCtx, cancel := context.WithTimeout(ctx, searchTimeout)
+	defer cancel()
+	GeneralMemories, err := m.Vectordb.GetSimilarMemories(dense[0], sparse[0], userId, threshold, limit, searchCtx)
 	if err != nil {
-		slog.Info("Got this error while trying to get core memories", "userId", userId, "error", err)
+		return nil, fmt.Errorf("searching the vector db: %w", err)
 	}
-	Memories := append(CoreMemories, GeneralMemories...)
-	return Memories, nil
+	if explain && len(GeneralMemories) != 0 {
+		explanations, err := m.Vectordb.ExplainSimilarMemories(dense[0], sparse[0], userId, limit, searchCtx)
+		if err != nil {
+			slog.Warn("Got this error while explaining the search, returning the memories without it", "error", err)
+		}
+		for i := range GeneralMemories {
+			if e, ok := explanations[GeneralMemories[i].Memory_Id]; ok {
+				GeneralMemories[i].Explanation = &e
+			}
+		}
+	}
+	return GeneralMemories, nil
 }
 
-func (m *MemoryAgent) DeleteMemory(memoryIds []string, ctx context.Context) error {
-	err := m.Vectordb.DeleteMemories(memoryIds, ctx)
-	if err != nil {
-		return err
+// DeleteMemory deletes general and core memories of a user and reports what happened to every id. General memories of
+// other users are left alone and reported as forbidden. Core memories are looked up among the user's own, so an id
+// that isn't one of them is simply not found.
+func (m *MemoryAgent) DeleteMemory(userId string, memoryIds []string, coreMemoryIds []string, ctx context.Context) ([]types.MemoryDeletionResult, error) {
+	ctx, span := Tracer.Start(ctx, "Deleting Memories")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId))
+	results := []types.MemoryDeletionResult{}
+	result := func(id string, memoryType types.MemoryType, status types.DeletionStatus) {
+		results = append(results, types.MemoryDeletionResult{MemoryId: id, MemoryType: memoryType, Status: status})
+	}
+	reqId := uuid.NewString()
+	var changes []types.MemoryChange
+	newChange := func(mem types.Memory) types.MemoryChange {
+		return types.MemoryChange{
+			ReqId:      reqId,
+			UserId:     userId,
+			MemoryId:   mem.Memory_Id,
+			MemoryType: mem.Type,
+			Action:     "DELETE",
+			Before:     &mem.Memory_text,
+			Reasoning:  "Deleted through the API",
+		}
 	}
-	return nil
+
+	if len(memoryIds) != 0 {
+		// Every memory id is a uuid, anything else can't exist and would only make Qdrant reject the whole lookup.
+		var validIds []string
+		for _, id := range memoryIds {
+			if uuid.Validate(id) == nil {
+				validIds = append(validIds, id)
+			}
+		}
+		points, err := m.Vectordb.GetMemoriesByIds(validIds, ctx)
+		if err != nil {
+			slog.Error("Got this error while looking up the memories to delete", "error", err, "userId", userId)
+			return nil, err
+		}
+		found := make(map[string]types.Memory, len(points))
+		for _, p := range points {
+			found[p.Memory.Memory_Id] = p.Memory
+		}
+		var owned []string
+		for _, id := range memoryIds {
+			mem, ok := found[id]
+			switch {
+			case !ok:
+				result(id, types.MemoryTypeGeneral, types.DeletionStatusNotFound)
+			case mem.UserId != userId:
+				slog.Warn("Refusing to delete a memory of another user", "userId", userId, "memoryId", id)
+				result(id, types.MemoryTypeGeneral, types.DeletionStatusForbidden)
+			default:
+				owned = append(owned, id)
+			}
+		}
+		if len(owned) != 0 {
+			if err := m.Vectordb.DeleteMemories(owned, ctx); err != nil {
+				slog.Error("Got this error while deleting the memories of the user", "error", err, "userId", userId)
+				return nil, err
+			}
+			for _, id := range owned {
+				result(id, types.MemoryTypeGeneral, types.DeletionStatusDeleted)
+				changes = append(changes, newChange(found[id]))
+			}
+		}
+	}
+
+	if len(coreMemoryIds) != 0 {
+		existing, err := m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+		if err != nil {
+			slog.Error("Got this error while looking up the core memories to delete", "error", err, "userId", userId)
+			return nil, err
+		}
+		deleted, err := m.CoreMemoryCache.DeleteCoreMemory(userId, coreMemoryIds, ctx)
+		if err != nil {
+			slog.Error("Got this error while deleting the core memories of the user", "error", err, "userId", userId)
+			return nil, err
+		}
+		for _, id := range coreMemoryIds {
+			if !slices.Contains(deleted, id) {
+				result(id, types.MemoryTypeCore, types.DeletionStatusNotFound)
+				continue
+			}
+			result(id, types.MemoryTypeCore, types.DeletionStatusDeleted)
+			for _, mem := range existing {
+				if mem.Memory_Id == id {
+					mem.Type = types.MemoryTypeCore
+					changes = append(changes, newChange(mem))
+				}
+			}
+		}
+	}
+
+	if len(changes) != 0 {
+		if err := m.Store.InsertMemoryChanges(changes, ctx); err != nil {
+			slog.Warn("Got this error while recording the deletion in the audit log", "error", err, "userId", userId)
+		}
+	}
+	return results, nil
 }
 
-func (m *MemoryAgent) InsertMemory(memjob *types.MemoryInsertionJob) error {
+// InsertMemory runs the archivist pipeline for a single job and returns the status it ended in
+// (skipped when the conversation had nothing memory-worthy, succeeded otherwise).
+func (m *MemoryAgent) InsertMemory(memjob *types.MemoryInsertionJob) (types.JobStatus, error) {
 	//take the messages and pass it to llm -> get query
 	ctx, cancel_ctx := context.WithTimeout(context.Background(), time.Second*60)
 	ctx, span := Tracer.Start(ctx, "Insert Memory")
 	defer span.End()
 	span.SetAttributes(
+		attribute.String("tenantId", jobTenantId(*memjob)),
 		attribute.String("userId", memjob.UserId),
 		attribute.String("reqId", memjob.ReqId))
 	defer cancel_ctx()
+	// everything the job reads or writes belongs to the tenant that submitted it
+	ctx = types.WithTenantId(ctx, memjob.TenantId)
 	slog.Info("Insert Memory Request recieved!", "jobId", memjob.ReqId)
 	expandedQuery := m.LLM.ExpandQuery(memjob.Messages, ctx)
 
@@ -137,41 +436,69 @@ func (m *MemoryAgent) InsertMemory(memjob *types.MemoryInsertionJob) error {
 	if strings.ToLower(expandedQuery) == "skip" {
 		span.SetAttributes(attribute.Bool("memory insertion required", false))
 		slog.Info("Memory Insertion is NOT REQUIRED!", "messages", memjob.Messages)
-		return nil
+		return types.JobStatusSkipped, nil
 	}
 	span.SetAttributes(attribute.Bool("memory insertion required", true))
 
 	slog.Info("Preparing Embedding Generation!")
-	DenseEmbedding, SparseEmbedding, err := m.EmbedClient.GenerateEmbeddings([]string{"_Query_" + expandedQuery}, ctx)
+	DenseEmbedding, SparseEmbedding, err := m.EmbedClient.GenerateEmbeddings([]string{queryPrefix + expandedQuery}, ctx)
 	if err != nil {
 		slog.Info("Got this error message here while trying to generate expanded query Embeddings", "error", err, "reqId", memjob.ReqId)
-		return err
+		return types.JobStatusFailed, classifyError(err)
 	}
 	//take query and pass it to qdrant
 	//Here len of Embedding will be 0
 	slog.Info("Len of the emebddings should be in harmony", "len(DenseEmbedding)", len(DenseEmbedding), "len(SparseEmbedding)", len(SparseEmbedding), "num", 1)
-	Existing_General_Memories, err := m.Vectordb.GetSimilarMemories(DenseEmbedding[0], SparseEmbedding[0], memjob.UserId, memjob.Threshold, ctx)
+	Existing_General_Memories, err := m.Vectordb.GetSimilarMemories(DenseEmbedding[0], SparseEmbedding[0], memjob.UserId, memjob.Threshold, 0, ctx)
 	if err != nil {
-		slog.Warn("Got this error message here while trying to get similarity results with the expanded query", "error", err, "reqId", memjob.ReqId)
+		// without the memories the user has the archivist would write them all over again
+		slog.Error("Got this error message here while trying to get similarity results with the expanded query", "error", err, "reqId", memjob.ReqId)
+		return types.JobStatusFailed, classifyError(err)
 	}
-	Existing_Core_Memories, err := m.CoreMemoryCache.GetCoreMemory(memjob.UserId, ctx)
+	Existing_Core_Memories, coreVersion, err := m.CoreMemoryCache.GetCoreMemoryVersion(memjob.UserId, ctx)
 	if err != nil {
-		slog.Warn("Got this as the ERROR while getting exisiting core memories", "userId", memjob.UserId, "err", err)
+		slog.Error("Got this as the ERROR while getting exisiting core memories", "userId", memjob.UserId, "err", err, "reqId", memjob.ReqId)
+		return types.JobStatusFailed, classifyError(err)
 	}
 	//get the results and pass it to llm
 	MemoryOutput, err := m.LLM.GenerateMemoryText(memjob.Messages, Existing_Core_Memories, Existing_General_Memories, ctx)
 	if err != nil {
 		slog.Info("Got this error message here while trying to generate new memory text", "error", err, "reqId", memjob.ReqId)
-		return err
+		return types.JobStatusFailed, classifyError(err)
 	}
+	// every memory this job writes remembers when, and from which message, it was written
+	now := time.Now().UTC()
+	excerpt := sourceExcerpt(memjob.Messages)
 	var memories []string
-	var memoryIds []string //These are the memory ids to be deleted from the database!!
+	var memoryIds []string                    //These are the memory ids to be deleted from the database!!
+	generalUpdates := make(map[string]string) //memory id -> its new text
+	knownGeneral := make(map[string]bool)
+	for _, mem := range Existing_General_Memories {
+		knownGeneral[mem.Memory_Id] = true
+	}
 	for _, memory := range MemoryOutput.GeneralMemoryActions {
+		if memory.ActionType == "UPDATE" {
+			slog.Info("got an UPDATE!")
+			if memory.TargetMemoryID == nil || memory.Payload == nil {
+				slog.Warn("LLM made a mistake and didn't provide both a target memory Id and a payload in update.. skipping")
+				continue
+			}
+			// an update writes the point under the target id, so it has to be one the LLM was actually shown
+			if !knownGeneral[*memory.TargetMemoryID] {
+				slog.Warn("LLM tried to update a memory it was never shown.. skipping", "targetMemoryId", *memory.TargetMemoryID)
+				continue
+			}
+			generalUpdates[*memory.TargetMemoryID] = *memory.Payload
+		}
 		if memory.ActionType == "INSERT" {
 			slog.Info("got an insert!")
 			if memory.TargetMemoryID != nil {
 				slog.Info("Damn .. llm made a mistake and gave a target memory Id in an INSERT request", "targetMemoryId", memory.TargetMemoryID)
 			}
+			if memory.Payload == nil {
+				slog.Warn("LLM made a mistake and didn't provide a payload in Insert.. skipping")
+				continue
+			}
 			memories = append(memories, *memory.Payload)
 		}
 		if memory.ActionType == "DELETE" {
@@ -179,9 +506,32 @@ func (m *MemoryAgent) InsertMemory(memjob *types.MemoryInsertionJob) error {
 			if memory.Payload != nil {
 				slog.Info("Damn .. llm made a mistake and gave a payload in an DELETE request", "payload", memory.Payload)
 			}
+			if memory.TargetMemoryID == nil {
+				slog.Warn("LLM made a mistake and didn't provide a target memory Id in delete.. skipping")
+				continue
+			}
+			// same as an update, deleting a memory that isn't there would fail the whole job
+			if !knownGeneral[*memory.TargetMemoryID] {
+				slog.Warn("LLM tried to delete a memory it was never shown.. skipping", "targetMemoryId", *memory.TargetMemoryID)
+				continue
+			}
 			memoryIds = append(memoryIds, *memory.TargetMemoryID)
 		}
 	}
+	// Every change that actually got applied ends up in the audit log, so we can later explain why a memory appeared or disappeared.
+	var changes []types.MemoryChange
+	newChange := func(memoryId string, memoryType types.MemoryType, action string, before *string, after *string) types.MemoryChange {
+		return types.MemoryChange{
+			ReqId:      memjob.ReqId,
+			UserId:     memjob.UserId,
+			MemoryId:   memoryId,
+			MemoryType: memoryType,
+			Action:     action,
+			Before:     before,
+			After:      after,
+			Reasoning:  MemoryOutput.Reasoning,
+		}
+	}
 	//TODO: Handle the Core Memory Actions/Updations
 	//We will just create the update CoreMemories list ... taking in the existing ones and updating them in the variable only
 	//and then pushing that variable to redis.
@@ -189,8 +539,17 @@ func (m *MemoryAgent) InsertMemory(memjob *types.MemoryInsertionJob) error {
 	var updated bool
 	var CoreMemories []types.Memory
 	idsToDelete := make(map[string]bool)
+	coreUpdates := make(map[string]string) //memory id -> its new text
 	for _, memory := range MemoryOutput.CoreMemoryActions {
 		updated = true
+		if memory.ActionType == "UPDATE" {
+			slog.Info("got an UPDATE!")
+			if memory.TargetMemoryID == nil || memory.Payload == nil {
+				slog.Warn("LLM made a mistake and didn't provide both a target memory Id and a payload in update.. skipping")
+				continue
+			}
+			coreUpdates[*memory.TargetMemoryID] = *memory.Payload
+		}
 		if memory.ActionType == "INSERT" {
 			slog.Info("got an insert!")
 			if memory.TargetMemoryID != nil {
@@ -203,10 +562,14 @@ func (m *MemoryAgent) InsertMemory(memjob *types.MemoryInsertionJob) error {
 
 			id, _ := uuid.NewUUID()
 			CoreMemories = append(CoreMemories, types.Memory{
-				Memory_text: *memory.Payload,
-				Memory_Id:   id.String(),
-				Type:        types.MemoryTypeCore,
-				UserId:      memjob.UserId,
+				Memory_text:   *memory.Payload,
+				Memory_Id:     id.String(),
+				Type:          types.MemoryTypeCore,
+				UserId:        memjob.UserId,
+				CreatedAt:     now,
+				UpdatedAt:     now,
+				SourceReqId:   memjob.ReqId,
+				SourceExcerpt: excerpt,
 			})
 		}
 		if memory.ActionType == "DELETE" {
@@ -221,53 +584,522 @@ func (m *MemoryAgent) InsertMemory(memjob *types.MemoryInsertionJob) error {
 			idsToDelete[*memory.TargetMemoryID] = true
 		}
 	}
-	var UpdatedCoreMemories []types.Memory
-	for _, mem := range Existing_Core_Memories {
-		if !idsToDelete[mem.Memory_Id] {
-			UpdatedCoreMemories = append(UpdatedCoreMemories, mem)
+	NewMem, coreDeleted, coreBeforeUpdate := applyCoreActions(Existing_Core_Memories, CoreMemories, coreUpdates, idsToDelete, memjob.ReqId, excerpt, now)
+	for _, id := range memoryIds {
+		delete(generalUpdates, id) //deleting it wins over updating it
+	}
+	var updateIds []string
+	for id := range generalUpdates {
+		updateIds = append(updateIds, id)
+	}
+
+	// Snapshot everything this job is about to destroy before touching the stores, so that a bad LLM call can be reverted.
+	snapshot := types.JobSnapshot{
+		ReqId:  memjob.ReqId,
+		UserId: memjob.UserId,
+	}
+	if updated {
+		snapshot.DeletedCoreMemories = coreDeleted
+		for _, mem := range CoreMemories {
+			snapshot.InsertedCoreMemoryIds = append(snapshot.InsertedCoreMemoryIds, mem.Memory_Id)
+		}
+		snapshot.UpdatedCoreMemories = coreBeforeUpdate
+	}
+	if len(memoryIds) != 0 {
+		snapshot.DeletedGeneralMemories, err = m.Vectordb.GetMemoriesByIds(memoryIds, ctx)
+		if err != nil {
+			slog.Error("Got this error while snapshotting the memories to be deleted", "error", err, "reqId", memjob.ReqId)
+			return types.JobStatusFailed, classifyError(err)
+		}
+	}
+	if len(updateIds) != 0 {
+		snapshot.UpdatedGeneralMemories, err = m.Vectordb.GetMemoriesByIds(updateIds, ctx)
+		if err != nil {
+			slog.Error("Got this error while snapshotting the memories to be updated", "error", err, "reqId", memjob.ReqId)
+			return types.JobStatusFailed, classifyError(err)
 		}
 	}
-	NewMem := append(UpdatedCoreMemories, CoreMemories...)
+	writes := updated || len(memoryIds) != 0 || len(memories) != 0 || len(updateIds) != 0
+	if writes && m.userForgotten(memjob) {
+		return types.JobStatusFailed, errUserForgotten
+	}
+	if writes {
+		if err := m.Store.SaveJobSnapshot(snapshot, ctx); err != nil {
+			slog.Error("Got this error while saving the job snapshot, not applying any changes", "error", err, "reqId", memjob.ReqId)
+			return types.JobStatusFailed, classifyError(err)
+		}
+	}
+
 	if updated {
 		slog.Info("Core Memories have been updated!", "userId", memjob.UserId, "Old Core Memories", Existing_Core_Memories, "New Core Memories", NewMem, "LLM's thinking", MemoryOutput.Reasoning)
-		err := m.CoreMemoryCache.SetCoreMemory(memjob.UserId, NewMem, ctx)
+		planned := true
+		err := m.writeCoreMemories(memjob.UserId, Existing_Core_Memories, coreVersion, func(current []types.Memory) ([]types.Memory, error) {
+			// a user forgotten since the last look has no core memories to read, the actions would make them anew
+			if m.userForgotten(memjob) {
+				return nil, errUserForgotten
+			}
+			if planned {
+				planned = false
+				return NewMem, nil
+			}
+			// someone else changed the core memories since they were read, so the actions go on top of what they wrote
+			NewMem, coreDeleted, coreBeforeUpdate = applyCoreActions(current, CoreMemories, coreUpdates, idsToDelete, memjob.ReqId, excerpt, now)
+			snapshot.DeletedCoreMemories, snapshot.UpdatedCoreMemories = coreDeleted, coreBeforeUpdate
+			if err := m.Store.SaveJobSnapshot(snapshot, ctx); err != nil {
+				slog.Error("Got this error while saving the job snapshot again, not applying the core memory changes", "error", err, "reqId", memjob.ReqId)
+				return nil, err
+			}
+			return NewMem, nil
+		}, ctx)
+		if errors.Is(err, errUserForgotten) {
+			m.eraseJob(memjob, snapshot, ctx)
+			return types.JobStatusFailed, err
+		}
+		if errors.Is(err, redis.ErrCoreMemoryConflict) {
+			// other writers kept beating the job to the core memories, it goes back on the queue and reads them again
+			// later instead of dropping its core actions
+			slog.Warn("Lost every race for the core memories of the user, the memory job will be retried", "userId", memjob.UserId, "reqId", memjob.ReqId)
+			return types.JobStatusFailed, &JobError{Err: err, Transient: true}
+		}
 		if err != nil {
-			slog.Warn("Got this error while trying to set the core memories of the user", "userId", memjob.UserId, "err", err)
+			// nothing else has been written yet, so the job can simply run again
+			slog.Error("Got this error while trying to set the core memories of the user, failing the memory job", "userId", memjob.UserId, "err", err, "reqId", memjob.ReqId)
+			return types.JobStatusFailed, classifyError(err)
+		}
+		for _, mem := range coreDeleted {
+			changes = append(changes, newChange(mem.Memory_Id, types.MemoryTypeCore, "DELETE", &mem.Memory_text, nil))
+		}
+		for _, mem := range coreBeforeUpdate {
+			after := coreUpdates[mem.Memory_Id]
+			changes = append(changes, newChange(mem.Memory_Id, types.MemoryTypeCore, "UPDATE", &mem.Memory_text, &after))
+		}
+		for _, mem := range CoreMemories {
+			changes = append(changes, newChange(mem.Memory_Id, types.MemoryTypeCore, "INSERT", nil, &mem.Memory_text))
 		}
 		slog.Info("Core Memories of the user has been updated", "Core Memories", NewMem)
 	}
 
-	DenseEmbedding, SparseEmbedding, err = m.EmbedClient.GenerateEmbeddings(memories, ctx)
+	var insertErr error
+	var insertedIds []string
+	if len(memories) != 0 {
+		DenseEmbedding, SparseEmbedding, insertErr = m.EmbedClient.GenerateEmbeddings(memories, ctx)
+		if insertErr != nil {
+			slog.Error("Got this error while generating embeddings for the new memories", "error", insertErr, "reqId", memjob.ReqId)
+		} else if insertedIds, insertErr = m.generalMemoryIds(memories, memjob.UserId, ctx); insertErr != nil {
+			slog.Error("Got this error while picking the ids of the new memories", "error", insertErr, "reqId", memjob.ReqId)
+		}
+	}
 	if len(memoryIds) != 0 {
 		slog.Info("Memories to delete are: ", "memoryIds", memoryIds)
 		if err := m.Vectordb.DeleteMemories(memoryIds, ctx); err != nil {
-			slog.Error("Got this error while deleting old memories of the user", "error", err)
+			slog.Error("Got this error while deleting old memories of the user", "error", err, "reqId", memjob.ReqId)
+			insertErr = cmp.Or(insertErr, err)
+		} else {
+			deleted := make(map[string]bool)
+			for _, id := range memoryIds {
+				deleted[id] = true
+			}
+			for _, mem := range Existing_General_Memories {
+				if deleted[mem.Memory_Id] {
+					changes = append(changes, newChange(mem.Memory_Id, types.MemoryTypeGeneral, "DELETE", &mem.Memory_text, nil))
+				}
+			}
+		}
+	}
+	if len(snapshot.UpdatedGeneralMemories) != 0 && insertErr == nil {
+		insertErr = m.updateGeneralMemories(snapshot.UpdatedGeneralMemories, generalUpdates, memjob.ReqId, excerpt, ctx)
+		if insertErr != nil {
+			slog.Error("Got this error while updating the memories of the user", "error", insertErr, "reqId", memjob.ReqId)
+		} else {
+			for _, p := range snapshot.UpdatedGeneralMemories {
+				after := generalUpdates[p.Memory.Memory_Id]
+				changes = append(changes, newChange(p.Memory.Memory_Id, types.MemoryTypeGeneral, "UPDATE", &p.Memory.Memory_text, &after))
+			}
 		}
 	}
 	//get llm response and pass it to qdrant
-	if len(memories) != 0 {
+	if len(memories) != 0 && insertErr == nil {
 		slog.Info("Len of the emebddings should be in harmony", "len(DenseEmbedding)", len(DenseEmbedding), "len(SparseEmbedding)", len(SparseEmbedding), "memories", len(memories))
 		slog.Info("Memories to insert are: ", "memories", memories)
-		err = m.Vectordb.InsertNewMemories(DenseEmbedding, SparseEmbedding, memories, memjob.UserId, ctx) //will take in userId as well
+		points := make([]types.MemoryPoint, len(memories))
+		for idx, text := range memories {
+			points[idx] = types.MemoryPoint{
+				TenantId: types.TenantId(ctx),
+				Memory: types.Memory{
+					Memory_text:   text,
+					Memory_Id:     insertedIds[idx],
+					Type:          types.MemoryTypeGeneral,
+					UserId:        memjob.UserId,
+					CreatedAt:     now,
+					UpdatedAt:     now,
+					SourceReqId:   memjob.ReqId,
+					SourceExcerpt: excerpt,
+				},
+				Dense:  DenseEmbedding[idx],
+				Sparse: SparseEmbedding[idx],
+			}
+		}
+		insertErr = m.Vectordb.UpsertMemories(points, ctx)
+		if insertErr != nil {
+			slog.Info("Got this error while trying to insert the new memories into the vector db", "error", insertErr, "reqId", memjob.ReqId)
+		} else {
+			for idx, id := range insertedIds {
+				changes = append(changes, newChange(id, types.MemoryTypeGeneral, "INSERT", nil, &memories[idx]))
+			}
+			snapshot.InsertedGeneralMemoryIds = insertedIds
+			if err := m.Store.SaveJobSnapshot(snapshot, ctx); err != nil {
+				slog.Warn("Got this error while recording the inserted memories in the job snapshot", "error", err, "reqId", memjob.ReqId)
+			}
+		}
+	}
+	if insertErr == nil {
+		// the job may have left the core memories over their limits, or found them over them already
+		changes = append(changes, m.compactCoreMemories(memjob, &snapshot, ctx)...)
+	}
+	if len(changes) != 0 {
+		if err := m.Store.InsertMemoryChanges(changes, ctx); err != nil {
+			slog.Warn("Got this error while recording the memory changes in the audit log", "error", err, "reqId", memjob.ReqId)
+		}
+	}
+	if writes && m.userForgotten(memjob) {
+		m.eraseJob(memjob, snapshot, ctx)
+		return types.JobStatusFailed, errUserForgotten
+	}
+	if insertErr != nil {
+		// Losing the general memory writes would lose the whole point of the job, so let the worker decide whether to
+		// retry it.
+		return types.JobStatusFailed, classifyError(insertErr)
+	}
+	return types.JobStatusSucceeded, nil
+}
+
+// applyCoreActions applies the core memory actions of a job on top of the existing core memories of its user. Along with
+// the new core memories it returns the ones that were deleted and the ones that were updated as they were before.
+// Actions that target a memory that isn't there anymore are dropped.
+func applyCoreActions(existing []types.Memory, inserts []types.Memory, updates map[string]string, deletes map[string]bool, reqId string, excerpt string, now time.Time) (result []types.Memory, deleted []types.Memory, before []types.Memory) {
+	for _, mem := range existing {
+		if deletes[mem.Memory_Id] {
+			deleted = append(deleted, mem)
+			continue
+		}
+		if text, ok := updates[mem.Memory_Id]; ok {
+			before = append(before, mem)
+			mem.Memory_text = text
+			stamp(&mem, reqId, excerpt, now)
+		}
+		result = append(result, mem)
+	}
+	return append(result, inserts...), deleted, before
+}
+
+// writeCoreMemories writes the core memories modify makes out of the ones of the user, which were at version when
+// they were read. If someone else wrote them in the meantime they are read again and handed to modify once more.
+func (m *MemoryAgent) writeCoreMemories(userId string, existing []types.Memory, version int64, modify func([]types.Memory) ([]types.Memory, error), ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		updated, err := modify(existing)
 		if err != nil {
-			slog.Info("Got this error while trying to insert the new memories into the vector db", "error", err, "reqId", memjob.ReqId)
+			return err
+		}
+		err = m.CoreMemoryCache.CompareAndSetCoreMemory(userId, updated, version, ctx)
+		if !errors.Is(err, redis.ErrCoreMemoryConflict) || attempt == redis.MaxCoreMemoryAttempts {
+			return err
+		}
+		slog.Info("Lost a race for the core memories of the user, trying again", "userId", userId, "attempt", attempt)
+		if existing, version, err = m.CoreMemoryCache.GetCoreMemoryVersion(userId, ctx); err != nil {
+			return err
 		}
 	}
-	//update the entry in the database.
-	return nil
 }
 
-func (m *MemoryAgent) GetAllUserMemories(userId string, ctx context.Context) ([]types.Memory, error) {
-	Generalmem, err := m.Vectordb.GetAllUserMemories(userId, ctx)
+// modifyCoreMemories is writeCoreMemories for writers that haven't read the core memories of the user yet.
+func (m *MemoryAgent) modifyCoreMemories(userId string, modify func([]types.Memory) ([]types.Memory, error), ctx context.Context) error {
+	existing, version, err := m.CoreMemoryCache.GetCoreMemoryVersion(userId, ctx)
 	if err != nil {
-		slog.Warn("Got this error while trying to get general  memories of the user (in the memory agent)", "error", err, "userId", userId)
+		return err
 	}
-	CoreMem, err := m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+	return m.writeCoreMemories(userId, existing, version, modify, ctx)
+}
+
+// updateGeneralMemories embeds the new texts of the memories and overwrites their points in place, so they keep their ids
+// and creation times.
+func (m *MemoryAgent) updateGeneralMemories(points []types.MemoryPoint, newTexts map[string]string, reqId string, excerpt string, ctx context.Context) error {
+	texts := make([]string, len(points))
+	for i, p := range points {
+		texts[i] = newTexts[p.Memory.Memory_Id]
+	}
+	dense, sparse, err := m.EmbedClient.GenerateEmbeddings(texts, ctx)
 	if err != nil {
-		slog.Warn("Got this error while trying to get core memories of the user (in the memory agent)", "error", err, "userId", userId)
+		return err
 	}
-	AllMem := append(CoreMem, Generalmem...)
-	return AllMem, nil
+	updated := make([]types.MemoryPoint, len(points))
+	now := time.Now().UTC()
+	for i, p := range points {
+		p.Memory.Memory_text = texts[i]
+		stamp(&p.Memory, reqId, excerpt, now)
+		p.Dense, p.Sparse = dense[i], sparse[i]
+		updated[i] = p
+	}
+	return m.Vectordb.UpsertMemories(updated, ctx)
+}
+
+// generalMemoryIds picks the ids new general memories of the user are stored under. An id is derived from the text (see
+// vectordb.MemoryId) so storing the same memory twice overwrites it, but a memory edited in place keeps the id of the
+// text it had before. A new memory whose derived id is held by a memory with another text gets a fresh id instead of
+// overwriting it.
+func (m *MemoryAgent) generalMemoryIds(texts []string, userId string, ctx context.Context) ([]string, error) {
+	ids := make([]string, len(texts))
+	for i, text := range texts {
+		ids[i] = vectordb.MemoryId(text, userId, ctx)
+	}
+	existing, err := m.Vectordb.GetMemoriesByIds(ids, ctx)
+	if err != nil {
+		return nil, err
+	}
+	stored := make(map[string]string)
+	for _, p := range existing {
+		stored[p.Memory.Memory_Id] = p.Memory.Memory_text
+	}
+	for i, id := range ids {
+		if text, ok := stored[id]; ok && text != texts[i] {
+			slog.Info("The id of the memory belongs to an edited memory, giving it a fresh one", "id", id)
+			ids[i] = uuid.NewString()
+		}
+	}
+	return ids, nil
+}
+
+// RevertMemoryJob undoes what a job did using the snapshot it saved: the memories it inserted are removed, the ones it
+// deleted are put back, general ones with their original ids and vectors, and the ones it updated get their old text
+// back. Changes made by later jobs are left alone.
+func (m *MemoryAgent) RevertMemoryJob(reqId string, ctx context.Context) (*types.JobRevertResult, error) {
+	ctx, span := Tracer.Start(ctx, "Revert Memory Job")
+	defer span.End()
+	span.SetAttributes(attribute.String("reqId", reqId))
+	job, err := m.Store.GetMemoryJob(reqId, ctx)
+	if err != nil {
+		return nil, err
+	}
+	switch job.Status {
+	case types.JobStatusReverted:
+		return nil, ErrJobAlreadyReverted
+	case types.JobStatusQueued, types.JobStatusProcessing, types.JobStatusRetrying:
+		return nil, ErrJobNotFinished
+	}
+	result := &types.JobRevertResult{ReqId: reqId}
+	snapshot, err := m.Store.GetJobSnapshot(reqId, ctx)
+	if err != nil {
+		if !errors.Is(err, storage.ErrSnapshotNotFound) {
+			return nil, err
+		}
+		slog.Info("Job never changed any memories, nothing to revert", "reqId", reqId)
+		snapshot = &types.JobSnapshot{ReqId: reqId, UserId: job.UserId}
+	}
+	reasoning := "Reverted memory job " + reqId
+	var changes []types.MemoryChange
+
+	if len(snapshot.InsertedCoreMemoryIds) != 0 || len(snapshot.DeletedCoreMemories) != 0 || len(snapshot.UpdatedCoreMemories) != 0 {
+		var coreChanges []types.MemoryChange
+		err := m.modifyCoreMemories(snapshot.UserId, func(current []types.Memory) ([]types.Memory, error) {
+			coreChanges = nil
+			result.RemovedCoreMemories, result.UndoneUpdates, result.RestoredCoreMemories = 0, 0, 0
+			inserted := make(map[string]bool)
+			for _, id := range snapshot.InsertedCoreMemoryIds {
+				inserted[id] = true
+			}
+			beforeUpdate := make(map[string]types.Memory)
+			for _, mem := range snapshot.UpdatedCoreMemories {
+				beforeUpdate[mem.Memory_Id] = mem
+			}
+			present := make(map[string]bool)
+			var reverted []types.Memory
+			for _, mem := range current {
+				if inserted[mem.Memory_Id] {
+					coreChanges = append(coreChanges, types.MemoryChange{ReqId: reqId, UserId: snapshot.UserId, MemoryId: mem.Memory_Id, MemoryType: types.MemoryTypeCore, Action: "DELETE", Before: &mem.Memory_text, Reasoning: reasoning})
+					result.RemovedCoreMemories++
+					continue
+				}
+				if old, ok := beforeUpdate[mem.Memory_Id]; ok {
+					coreChanges = append(coreChanges, types.MemoryChange{ReqId: reqId, UserId: snapshot.UserId, MemoryId: mem.Memory_Id, MemoryType: types.MemoryTypeCore, Action: "UPDATE", Before: &mem.Memory_text, After: &old.Memory_text, Reasoning: reasoning})
+					mem = old
+					result.UndoneUpdates++
+				}
+				present[mem.Memory_Id] = true
+				reverted = append(reverted, mem)
+			}
+			for _, mem := range snapshot.DeletedCoreMemories {
+				if present[mem.Memory_Id] {
+					continue
+				}
+				coreChanges = append(coreChanges, types.MemoryChange{ReqId: reqId, UserId: snapshot.UserId, MemoryId: mem.Memory_Id, MemoryType: types.MemoryTypeCore, Action: "INSERT", After: &mem.Memory_text, Reasoning: reasoning})
+				reverted = append(reverted, mem)
+				result.RestoredCoreMemories++
+			}
+			return reverted, nil
+		}, ctx)
+		if err != nil {
+			slog.Error("Got this error while restoring the core memories", "error", err, "reqId", reqId)
+			return nil, err
+		}
+		changes = append(changes, coreChanges...)
+	}
+
+	// Inserted memories go first: a memory that was deleted and inserted again with the same text shares its id.
+	if len(snapshot.InsertedGeneralMemoryIds) != 0 {
+		existing, err := m.Vectordb.GetMemoriesByIds(snapshot.InsertedGeneralMemoryIds, ctx)
+		if err != nil {
+			slog.Error("Got this error while looking up the memories inserted by the job", "error", err, "reqId", reqId)
+			return nil, err
+		}
+		var ids []string
+		for _, p := range existing {
+			ids = append(ids, p.Memory.Memory_Id)
+			changes = append(changes, types.MemoryChange{ReqId: reqId, UserId: snapshot.UserId, MemoryId: p.Memory.Memory_Id, MemoryType: types.MemoryTypeGeneral, Action: "DELETE", Before: &p.Memory.Memory_text, Reasoning: reasoning})
+		}
+		if len(ids) != 0 {
+			if err := m.Vectordb.DeleteMemories(ids, ctx); err != nil {
+				slog.Error("Got this error while removing the memories inserted by the job", "error", err, "reqId", reqId)
+				return nil, err
+			}
+		}
+		result.RemovedGeneralMemories = len(ids)
+	}
+	if len(snapshot.DeletedGeneralMemories) != 0 {
+		if err := m.Vectordb.UpsertMemories(snapshot.DeletedGeneralMemories, ctx); err != nil {
+			slog.Error("Got this error while restoring the memories deleted by the job", "error", err, "reqId", reqId)
+			return nil, err
+		}
+		for _, p := range snapshot.DeletedGeneralMemories {
+			changes = append(changes, types.MemoryChange{ReqId: reqId, UserId: snapshot.UserId, MemoryId: p.Memory.Memory_Id, MemoryType: types.MemoryTypeGeneral, Action: "INSERT", After: &p.Memory.Memory_text, Reasoning: reasoning})
+		}
+		result.RestoredGeneralMemories = len(snapshot.DeletedGeneralMemories)
+	}
+	if len(snapshot.UpdatedGeneralMemories) != 0 {
+		// only memories that are still around get their old text back, a later job may have deleted them since
+		ids := make([]string, len(snapshot.UpdatedGeneralMemories))
+		for i, p := range snapshot.UpdatedGeneralMemories {
+			ids[i] = p.Memory.Memory_Id
+		}
+		existing, err := m.Vectordb.GetMemoriesByIds(ids, ctx)
+		if err != nil {
+			slog.Error("Got this error while looking up the memories updated by the job", "error", err, "reqId", reqId)
+			return nil, err
+		}
+		current := make(map[string]types.Memory)
+		for _, p := range existing {
+			current[p.Memory.Memory_Id] = p.Memory
+		}
+		var restore []types.MemoryPoint
+		for _, p := range snapshot.UpdatedGeneralMemories {
+			mem, ok := current[p.Memory.Memory_Id]
+			if !ok {
+				continue
+			}
+			restore = append(restore, p)
+			changes = append(changes, types.MemoryChange{ReqId: reqId, UserId: snapshot.UserId, MemoryId: p.Memory.Memory_Id, MemoryType: types.MemoryTypeGeneral, Action: "UPDATE", Before: &mem.Memory_text, After: &p.Memory.Memory_text, Reasoning: reasoning})
+		}
+		if err := m.Vectordb.UpsertMemories(restore, ctx); err != nil {
+			slog.Error("Got this error while undoing the updates of the job", "error", err, "reqId", reqId)
+			return nil, err
+		}
+		result.UndoneUpdates += len(restore)
+	}
+
+	if len(changes) != 0 {
+		if err := m.Store.InsertMemoryChanges(changes, ctx); err != nil {
+			slog.Warn("Got this error while recording the revert in the audit log", "error", err, "reqId", reqId)
+		}
+	}
+	if err := m.Store.UpdateJobStatus(reqId, types.JobStatusReverted, nil, ctx); err != nil {
+		slog.Error("Got this error while marking the job as reverted", "error", err, "reqId", reqId)
+		return nil, err
+	}
+	slog.Info("Memory job has been reverted", "reqId", reqId, "result", result)
+	return result, nil
+}
+
+// GetAllUserMemories returns every core memory of the user followed by every general one. Like GetMemories, a part
+// that can't be read only fails the whole of it if the other one can't be read either, otherwise the result is partial.
+func (m *MemoryAgent) GetAllUserMemories(userId string, ctx context.Context) (*types.RetrievalResult, error) {
+	ctx, span := Tracer.Start(ctx, "Getting All User Memories")
+	defer span.End()
+	var Generalmem, CoreMem []types.Memory
+	var coreErr, generalErr error
+	var g errgroup.Group
+	g.Go(func() error {
+		Generalmem, generalErr = m.Vectordb.GetAllUserMemories(userId, ctx)
+		return generalErr
+	})
+	g.Go(func() error {
+		CoreMem, coreErr = m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+		return coreErr
+	})
+	g.Wait()
+
+	result := &types.RetrievalResult{}
+	if coreErr != nil {
+		slog.Warn("Got this error while trying to get core memories of the user, returning the general ones only", "error", coreErr, "userId", userId)
+		result.FailedStages = append(result.FailedStages, types.RetrievalStageCore)
+	}
+	if generalErr != nil {
+		slog.Warn("Got this error while trying to get general memories of the user, returning the core ones only", "error", generalErr, "userId", userId)
+		result.FailedStages = append(result.FailedStages, types.RetrievalStageGeneral)
+	}
+	if coreErr != nil && generalErr != nil {
+		span.RecordError(generalErr)
+		return nil, errors.Join(coreErr, generalErr)
+	}
+	result.Partial = len(result.FailedStages) != 0
+	span.SetAttributes(attribute.Bool("partial", result.Partial))
+	result.Memories = append(CoreMem, Generalmem...)
+	if result.Memories == nil {
+		result.Memories = []types.Memory{}
+	}
+	return result, nil
+}
+
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// ListUserMemories returns a page of at most limit general memories of the user, the first page (an empty cursor)
+// also holds all of their core memories. The cursor of the next page is left empty after the last one.
+func (m *MemoryAgent) ListUserMemories(userId string, limit int, cursor string, ctx context.Context) (*types.MemoryPage, error) {
+	ctx, span := Tracer.Start(ctx, "Listing User Memories")
+	defer span.End()
+	span.SetAttributes(attribute.String("userId", userId), attribute.Int("limit", limit), attribute.Bool("firstPage", cursor == ""))
+	var offset string
+	if cursor != "" {
+		raw, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil || uuid.Validate(string(raw)) != nil {
+			return nil, ErrInvalidCursor
+		}
+		offset = string(raw)
+	}
+	page := &types.MemoryPage{Memories: []types.Memory{}}
+	if cursor == "" {
+		core, err := m.CoreMemoryCache.GetCoreMemory(userId, ctx)
+		if err != nil {
+			slog.Error("Got this error while getting the core memories for the first page", "error", err, "userId", userId)
+			return nil, err
+		}
+		page.Memories = append(page.Memories, core...)
+	}
+	general, next, err := m.Vectordb.ListUserMemories(userId, limit, offset, ctx)
+	if err != nil {
+		slog.Error("Got this error while getting a page of the general memories of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	page.Memories = append(page.Memories, general...)
+	if next != "" {
+		page.NextCursor = base64.RawURLEncoding.EncodeToString([]byte(next))
+	}
+	return page, nil
+}
+
+// jobTenantId is the tenant a job belongs to, jobs queued before tenants existed belong to the default one.
+func jobTenantId(job types.MemoryInsertionJob) string {
+	if job.TenantId == "" {
+		return types.DefaultTenantId
+	}
+	return job.TenantId
 }
 
 func LastUserContent(messages []types.Message) (string, bool) {
@@ -278,3 +1110,23 @@ func LastUserContent(messages []types.Message) (string, bool) {
 	}
 	return "", false
 }
+
+// maxSourceExcerpt is how many characters of the user message a memory keeps as its source.
+const maxSourceExcerpt = 280
+
+// sourceExcerpt is the message the memories of a job are taken from: the last thing the user said, cut short if long.
+func sourceExcerpt(messages []types.Message) string {
+	content, _ := LastUserContent(messages)
+	content = strings.TrimSpace(content)
+	if utf8.RuneCountInString(content) <= maxSourceExcerpt {
+		return content
+	}
+	return string([]rune(content)[:maxSourceExcerpt]) + "…"
+}
+
+// stamp records that a memory was just rewritten by the request, it keeps the time the memory was created at.
+func stamp(mem *types.Memory, reqId string, excerpt string, now time.Time) {
+	mem.UpdatedAt = now
+	mem.SourceReqId = reqId
+	mem.SourceExcerpt = excerpt
+}
@@ -1,11 +1,14 @@
 package memory
 
 import (
-	// "encoding/json"
+	"context"
+	"errors"
 	"fmt"
-	"log/slog"
+	"net"
+	"os"
 	"regexp"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -14,109 +17,399 @@ import (
 	"github.com/Prateek-Gupta001/GoMemory/redis"
 	"github.com/Prateek-Gupta001/GoMemory/types"
 	"github.com/Prateek-Gupta001/GoMemory/vectordb"
-	"github.com/nats-io/nats.go"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/genai"
 )
 
-func NewtestMemoryAgent() *MemoryAgent {
-	nc, err := nats.Connect(nats.DefaultURL)
-	if err != nil {
-		slog.Error("can't connect to NATS", "error", err)
+const parisMove = `I finally did it! I moved to Paris! It's amazing here.
+I actually sold that rusty Honda Civic before leaving Italy and just bought a bicycle to get around the city.`
+
+// NewtestMemoryAgent wires a MemoryAgent to the fake LLM and embedder, the in-memory vector db and in-memory stores, so the pipeline runs
+// without any network. JSClient is left nil, the tests call InsertMemory directly instead of going through NATS.
+func NewtestMemoryAgent(t *testing.T, fakeLLM *llm.FakeLLM) *MemoryAgent {
+	vectordb, err := vectordb.NewInMemoryMemoryDB("")
+	require.NoError(t, err)
+	return &MemoryAgent{
+		Vectordb:        vectordb,
+		LLM:             fakeLLM,
+		EmbedClient:     embed.NewFakeEmbedder(),
+		CoreMemoryCache: newFakeCoreMemoryCache(),
+		Store:           newFakeStore(),
+		MaxDeliver:      5,
+		WorkLanes:       16,
 	}
-	js, err := nc.JetStream()
-	if err != nil {
-		panic(err)
+}
+
+// seedMemories gives user_123 a core memory about Italy and two general memories, one of which the Paris move
+// makes stale.
+func seedMemories(t *testing.T, agent *MemoryAgent) {
+	setCoreMemories(t, agent, "user_123", []types.Memory{
+		{Memory_text: "User lives in Italy", Type: types.MemoryTypeCore, Memory_Id: "core-1", UserId: "user_123"},
+	})
+	insertGeneralMemories(t, agent, "user_123", "User drives a rusty Honda Civic car", "User is building an AI Gateway in Go")
+}
+
+// setCoreMemories replaces the core memories of the user with mems.
+func setCoreMemories(t *testing.T, agent *MemoryAgent, userId string, mems []types.Memory) {
+	_, version, err := agent.CoreMemoryCache.GetCoreMemoryVersion(userId, t.Context())
+	require.NoError(t, err)
+	require.NoError(t, agent.CoreMemoryCache.CompareAndSetCoreMemory(userId, mems, version, t.Context()))
+}
+
+// insertGeneralMemories writes the general memories of the user the way a job would and returns their ids.
+func insertGeneralMemories(t *testing.T, agent *MemoryAgent, userId string, texts ...string) []string {
+	ctx := t.Context()
+	dense, sparse, err := agent.EmbedClient.GenerateEmbeddings(texts, ctx)
+	require.NoError(t, err)
+	ids, err := agent.generalMemoryIds(texts, userId, ctx)
+	require.NoError(t, err)
+	points := make([]types.MemoryPoint, len(texts))
+	for idx, text := range texts {
+		points[idx] = types.MemoryPoint{
+			TenantId: types.TenantId(ctx),
+			Memory:   types.Memory{Memory_text: text, Type: types.MemoryTypeGeneral, Memory_Id: ids[idx], UserId: userId},
+			Dense:    dense[idx],
+			Sparse:   sparse[idx],
+		}
 	}
+	require.NoError(t, agent.Vectordb.UpsertMemories(points, ctx))
+	return ids
+}
 
-	// 3. Define the Stream (The "Hard Drive" storage)
-	// This is where you get .AddStream()
-	_, err = js.AddStream(&nats.StreamConfig{
-		Name:     "MEMORY_SYSTEM",
-		Subjects: []string{"memory_work"}, // This stream listens to this subject
-		// Storage:  nats.FileStorage,        // <--- SURVIVES POWER OUTAGE //For production, uncomment this line!
+func newParisJob(t *testing.T, agent *MemoryAgent) *types.MemoryInsertionJob {
+	job := &types.MemoryInsertionJob{
+		ReqId:     "1234",
+		UserId:    "user_123",
+		Messages:  []types.Message{{Role: types.RoleUser, Content: parisMove}},
+		Threshold: 0,
+	}
+	require.NoError(t, agent.Store.InsertMemoryJob(*job, t.Context()))
+	return job
+}
+
+func scriptParisMove(fakeLLM *llm.FakeLLM) {
+	fakeLLM.OnExpandQuery(parisMove, "Where does the user live, which car does the user drive, Honda Civic, Italy")
+	fakeLLM.OnGenerateMemoryText(parisMove, &types.MemoryOutput{
+		Reasoning: "User moved from Italy to Paris and replaced the car with a bicycle.",
+		CoreMemoryActions: []types.MemoryAction{
+			{ActionType: "DELETE", TargetMemoryID: ptr("User lives in Italy")},
+			{ActionType: "INSERT", Payload: ptr("User lives in Paris")},
+		},
+		GeneralMemoryActions: []types.MemoryAction{
+			{ActionType: "DELETE", TargetMemoryID: ptr("User drives a rusty Honda Civic car")},
+			{ActionType: "INSERT", Payload: ptr("User rides a bicycle to get around Paris")},
+		},
 	})
-	if err != nil {
-		panic(err)
+}
+
+func ptr(s string) *string {
+	return &s
+}
+
+func memoryTexts(memories []types.Memory) []string {
+	var texts []string
+	for _, m := range memories {
+		texts = append(texts, m.Memory_text)
 	}
-	defer nc.Close()
-	slog.Info("NATS JetStream is up!")
-	// llm, err := llm.NewGeminiLLM()
-	// if err != nil {
-	// 	slog.Info("Got this error while creating new Gemini LLM", "error", err)
-	// 	panic(err)
-	// }
-	slog.Info("Setting up Qdrant")
-	vectordb, err := vectordb.NewQdrantMemoryDB()
-	if err != nil {
-		slog.Info("Got this error while creating new Qdrant Memory db", "error", err)
-		panic(err)
+	return texts
+}
+
+func TestInsertMemory(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	job := newParisJob(t, agent)
+
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	assert.Equal(t, types.JobStatusSucceeded, status)
+
+	require.Len(t, fakeLLM.GenerateCalls, 1)
+	assert.Contains(t, memoryTexts(fakeLLM.GenerateCalls[0].OldMemories), "User drives a rusty Honda Civic car")
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Paris"}, memoryTexts(core))
+
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User is building an AI Gateway in Go", "User rides a bicycle to get around Paris"}, memoryTexts(general))
+
+	history, err := agent.Store.GetMemoryHistory("user_123", 100, t.Context())
+	require.NoError(t, err)
+	assert.Len(t, history, 4)
+
+	snapshot, err := agent.Store.GetJobSnapshot(job.ReqId, t.Context())
+	require.NoError(t, err)
+	require.Len(t, snapshot.DeletedGeneralMemories, 1)
+	assert.Equal(t, "User drives a rusty Honda Civic car", snapshot.DeletedGeneralMemories[0].Memory.Memory_text)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(snapshot.DeletedCoreMemories))
+}
+
+func TestInsertMemorySkipsSmallTalk(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	job := &types.MemoryInsertionJob{
+		ReqId:    "1234",
+		UserId:   "user_123",
+		Messages: []types.Message{{Role: types.RoleUser, Content: "haha thanks!"}},
 	}
-	slog.Info("Setting up new embed client")
-	embed, err := embed.NewEmbeddingClient("localhost:50051")
-	if err != nil {
-		slog.Info("Got this error while creating new Qdrant Memory db", "error", err)
-		panic(err)
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	assert.Equal(t, types.JobStatusSkipped, status)
+	assert.Empty(t, fakeLLM.GenerateCalls)
+}
+
+func TestInsertMemoryTransientLLMFailure(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	fakeLLM.OnExpandQuery(parisMove, "Where does the user live")
+	fakeLLM.FailGenerateMemoryText(parisMove, genai.APIError{Code: 503, Message: "model is overloaded"})
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	job := newParisJob(t, agent)
+
+	status, err := agent.InsertMemory(job)
+	require.Error(t, err)
+	assert.True(t, IsTransient(err))
+	assert.Equal(t, types.JobStatusFailed, status)
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(core))
+}
+
+func TestRevertMemoryJob(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	job := newParisJob(t, agent)
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	require.NoError(t, agent.Store.UpdateJobStatus(job.ReqId, status, nil, t.Context()))
+
+	result, err := agent.RevertMemoryJob(job.ReqId, t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, &types.JobRevertResult{ReqId: job.ReqId, RestoredCoreMemories: 1, RemovedCoreMemories: 1, RestoredGeneralMemories: 1, RemovedGeneralMemories: 1}, result)
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(core))
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User drives a rusty Honda Civic car", "User is building an AI Gateway in Go"}, memoryTexts(general))
+
+	_, err = agent.RevertMemoryJob(job.ReqId, t.Context())
+	assert.ErrorIs(t, err, ErrJobAlreadyReverted)
+}
+
+func TestRevertMemoryJobWaitsForRetries(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	job := newParisJob(t, agent)
+	_, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	// its redelivery would apply everything again right after the revert
+	require.NoError(t, agent.Store.UpdateJobStatus(job.ReqId, types.JobStatusRetrying, nil, t.Context()))
+
+	_, err = agent.RevertMemoryJob(job.ReqId, t.Context())
+	assert.ErrorIs(t, err, ErrJobNotFinished)
+}
+
+func TestRetriedJobKeepsItsBeforeImages(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	job := newParisJob(t, agent)
+	_, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+
+	// the job is run again, say after its ack was lost, and this time the stale memories are gone already
+	fakeLLM.OnGenerateMemoryText(parisMove, &types.MemoryOutput{
+		GeneralMemoryActions: []types.MemoryAction{{ActionType: "INSERT", Payload: ptr("User rides a bicycle to get around Paris")}},
+	})
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	require.NoError(t, agent.Store.UpdateJobStatus(job.ReqId, status, nil, t.Context()))
+
+	_, err = agent.RevertMemoryJob(job.ReqId, t.Context())
+	require.NoError(t, err)
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(core))
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User drives a rusty Honda Civic car", "User is building an AI Gateway in Go"}, memoryTexts(general))
+}
+
+func TestInsertMemoryUpdatesInPlace(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	fakeLLM.OnExpandQuery(parisMove, "Where does the user live, which car does the user drive, Honda Civic, Italy")
+	fakeLLM.OnGenerateMemoryText(parisMove, &types.MemoryOutput{
+		Reasoning: "User moved from Italy to Paris and replaced the car with a bicycle.",
+		CoreMemoryActions: []types.MemoryAction{
+			{ActionType: "UPDATE", TargetMemoryID: ptr("User lives in Italy"), Payload: ptr("User lives in Paris")},
+		},
+		GeneralMemoryActions: []types.MemoryAction{
+			{ActionType: "UPDATE", TargetMemoryID: ptr("User drives a rusty Honda Civic car"), Payload: ptr("User sold the Honda Civic and rides a bicycle")},
+			{ActionType: "UPDATE", TargetMemoryID: ptr("a memory the LLM made up"), Payload: ptr("User owns a yacht")},
+		},
+	})
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	ctx := t.Context()
+	hondaId := vectordb.MemoryId("User drives a rusty Honda Civic car", "user_123", ctx)
+	job := newParisJob(t, agent)
+
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	require.NoError(t, agent.Store.UpdateJobStatus(job.ReqId, status, nil, ctx))
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", ctx)
+	require.NoError(t, err)
+	require.Len(t, core, 1)
+	assert.Equal(t, "User lives in Paris", core[0].Memory_text)
+	assert.Equal(t, "core-1", core[0].Memory_Id)
+	assert.True(t, core[0].CreatedAt.IsZero(), "an update doesn't make up a creation time for a memory that had none")
+	assert.False(t, core[0].UpdatedAt.IsZero())
+	assert.Equal(t, job.ReqId, core[0].SourceReqId)
+	assert.Equal(t, parisMove, core[0].SourceExcerpt)
+	points, err := agent.Vectordb.GetMemoriesByIds([]string{hondaId}, ctx)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, "User sold the Honda Civic and rides a bicycle", points[0].Memory.Memory_text)
+	assert.Equal(t, job.ReqId, points[0].Memory.SourceReqId)
+	assert.True(t, points[0].Memory.UpdatedAt.After(points[0].Memory.CreatedAt), "an update keeps the creation time")
+	retrieved, err := agent.GetMemories("bicycle", "user_123", "req", 0.3, 0, ctx)
+	require.NoError(t, err)
+	memories := retrieved.Memories
+	assert.Contains(t, memoryTexts(memories), "User sold the Honda Civic and rides a bicycle", "the new text has to be embedded")
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", ctx)
+	require.NoError(t, err)
+	assert.Len(t, general, 2, "an update of an unknown memory must not create one")
+
+	history, err := agent.Store.GetMemoryHistory("user_123", 100, ctx)
+	require.NoError(t, err)
+	require.Len(t, history, 2)
+	for _, change := range history {
+		assert.Equal(t, "UPDATE", change.Action)
+		require.NotNil(t, change.Before)
+		assert.Contains(t, []string{"User lives in Italy", "User drives a rusty Honda Civic car"}, *change.Before)
 	}
-	slog.Info("Finished")
-	RC := redis.NewRedisCoreMemoryCache()
-	agent := &MemoryAgent{
-		vectordb,
-		&llm.GeminiLLM{},
-		embed,
-		RC,
-		js}
-	return agent
-}
-
-// func TestSumbitMemoryInsertionRequest(t *testing.T) {
-// 	slog.Info("Beginning test")
-// 	fmt.Println("Beginning Test")
-// 	memJob := types.MemoryInsertionJob{
-// 		ReqId:    "1234",
-// 		UserId:   "user_123",
-// 		Messages: []types.Message{},
-// 	}
-// 	agent := NewtestMemoryAgent()
-// 	go func() {
-// 		agent.JSClient.Subscribe("memory_work", func(msg *nats.Msg) {
-// 			fmt.Printf("Worker got a memory Job: %s\n", string(msg.Data))
-// 			memJob := &types.MemoryInsertionJob{}
-// 			if err := json.Unmarshal(msg.Data, memJob); err != nil {
-// 				slog.Error("error while unmarshalling NATS-jetstream data", "error", err)
-// 				t.Errorf("Memory Insertion Job wasn't in NATS!")
-// 			}
-// 			// InsertMemory(memJob)
-// 		})
-// 	}()
-// 	time.Sleep(time.Second)
-// 	agent.SumbitMemoryInsertionRequest(memJob)
-// 	time.Sleep(time.Second * 4)
-// }
-
-// func TestInsertMemory(t *testing.T) {
-// 	agent := NewtestMemoryAgent()
-// 	memJob := types.MemoryInsertionJob{
-// 		ReqId:  "1234",
-// 		UserId: "user_123",
-// 		Messages: []types.Message{
-// 			{
-// 				Role: types.RoleUser,
-// 				Content: `I finally did it! I moved to Paris! It's amazing here.
-// 			I actually sold that rusty Honda Civic before leaving Italy and just bought a bicycle to get around the city.
-
-// 			Oh, and for the AI Gateway? I'm rewriting the whole thing in Rust now.
-// 			Go and GORM were just giving me too many headaches, so I'm done with them for this project.`,
-// 			},
-// 		},
-// 	}
-// 	fmt.Println("agent", agent)
-// 	err := agent.InsertMemory(&memJob)
-// 	if err != nil {
-// 		t.Error("Got this error right here", err)
-// 	}
-// }
+
+	result, err := agent.RevertMemoryJob(job.ReqId, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 2, result.UndoneUpdates)
+	core, err = agent.CoreMemoryCache.GetCoreMemory("user_123", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(core))
+	points, err = agent.Vectordb.GetMemoriesByIds([]string{hondaId}, ctx)
+	require.NoError(t, err)
+	require.Len(t, points, 1)
+	assert.Equal(t, "User drives a rusty Honda Civic car", points[0].Memory.Memory_text)
+	assert.Empty(t, points[0].Memory.SourceReqId, "the revert puts the old provenance back as well")
+}
+
+func TestInsertMemoryDoesNotOverwriteAnUpdatedMemory(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	fakeLLM.OnExpandQuery(parisMove, "which car does the user drive")
+	fakeLLM.OnGenerateMemoryText(parisMove, &types.MemoryOutput{
+		GeneralMemoryActions: []types.MemoryAction{
+			{ActionType: "UPDATE", TargetMemoryID: ptr("User drives a rusty Honda Civic car"), Payload: ptr("User sold the Honda Civic and rides a bicycle")},
+		},
+	})
+	const boughtBack = "I bought my old Honda back!"
+	fakeLLM.OnExpandQuery(boughtBack, "which car does the user drive")
+	fakeLLM.OnGenerateMemoryText(boughtBack, &types.MemoryOutput{
+		GeneralMemoryActions: []types.MemoryAction{{ActionType: "INSERT", Payload: ptr("User drives a rusty Honda Civic car")}},
+	})
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	_, err := agent.InsertMemory(newParisJob(t, agent))
+	require.NoError(t, err)
+
+	// the updated memory is still stored under the id of the old text
+	job := &types.MemoryInsertionJob{ReqId: "5678", UserId: "user_123", Messages: []types.Message{{Role: types.RoleUser, Content: boughtBack}}}
+	require.NoError(t, agent.Store.InsertMemoryJob(*job, t.Context()))
+	_, err = agent.InsertMemory(job)
+	require.NoError(t, err)
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User is building an AI Gateway in Go", "User sold the Honda Civic and rides a bicycle", "User drives a rusty Honda Civic car"}, memoryTexts(general))
+}
+
+func TestInsertMemoryStaysInTheJobsTenant(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	job := &types.MemoryInsertionJob{ReqId: "1234", TenantId: "acme", UserId: "user_123", Messages: []types.Message{{Role: types.RoleUser, Content: parisMove}}}
+	require.NoError(t, agent.Store.InsertMemoryJob(*job, t.Context()))
+
+	status, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+	assert.Equal(t, types.JobStatusSucceeded, status)
+	// acme's user_123 starts from scratch, so the archivist sees none of the default tenant's memories
+	require.Len(t, fakeLLM.GenerateCalls, 1)
+	assert.Empty(t, fakeLLM.GenerateCalls[0].CoreMemories)
+	assert.Empty(t, fakeLLM.GenerateCalls[0].OldMemories)
+
+	acme := types.WithTenantId(t.Context(), "acme")
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", acme)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Paris"}, memoryTexts(core))
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", acme)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User rides a bicycle to get around Paris"}, memoryTexts(general))
+
+	core, err = agent.CoreMemoryCache.GetCoreMemory("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(core))
+	general, err = agent.Vectordb.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User drives a rusty Honda Civic car", "User is building an AI Gateway in Go"}, memoryTexts(general))
+}
+
+func TestDeleteMemory(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, agent)
+	ctx := t.Context()
+	otherIds := insertGeneralMemories(t, agent, "user_456", "User has a cat")
+	hondaId := vectordb.MemoryId("User drives a rusty Honda Civic car", "user_123", ctx)
+
+	results, err := agent.DeleteMemory("user_123", []string{hondaId, otherIds[0], "not-a-uuid"}, []string{"core-1", "core-2"}, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []types.MemoryDeletionResult{
+		{MemoryId: otherIds[0], MemoryType: types.MemoryTypeGeneral, Status: types.DeletionStatusForbidden},
+		{MemoryId: "not-a-uuid", MemoryType: types.MemoryTypeGeneral, Status: types.DeletionStatusNotFound},
+		{MemoryId: hondaId, MemoryType: types.MemoryTypeGeneral, Status: types.DeletionStatusDeleted},
+		{MemoryId: "core-1", MemoryType: types.MemoryTypeCore, Status: types.DeletionStatusDeleted},
+		{MemoryId: "core-2", MemoryType: types.MemoryTypeCore, Status: types.DeletionStatusNotFound},
+	}, results)
+
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User is building an AI Gateway in Go"}, memoryTexts(general))
+	other, err := agent.Vectordb.GetAllUserMemories("user_456", ctx)
+	require.NoError(t, err)
+	assert.Len(t, other, 1, "the memory of another user must survive")
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", ctx)
+	require.NoError(t, err)
+	assert.Empty(t, core)
+
+	history, err := agent.Store.GetMemoryHistory("user_123", 100, ctx)
+	require.NoError(t, err)
+	assert.Len(t, history, 2)
+}
 
 func TestGetMemories(t *testing.T) {
-	agent := NewtestMemoryAgent()
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, agent)
 	start := time.Now()
 	memories := []types.Message{
 		{
@@ -127,19 +420,145 @@ func TestGetMemories(t *testing.T) {
 			Role: types.RoleUser,
 			Content: `It's a workout, literally. My legs are burning every time I get to the office. 
 			
-			I honestly don't miss the insurance payments on my old ride, but I do miss the air conditioning. 
+			I honestly don't miss the insurance payments on my old Honda Civic car, but I do miss the air conditioning. 
 			Still, being able to just weave through the gridlock and park anywhere is a huge plus.`,
 		},
 	}
 	query := ConstructContextualQuery(memories, 500)
-	m, err := agent.GetMemories(query, "user_123", "1234", 0.65, t.Context())
-	if err != nil {
-		t.Error("ERROR ", err)
-		t.Fail()
+	ctx, cancel := context.WithTimeout(t.Context(), time.Second)
+	defer cancel()
+	retrieved, err := agent.GetMemories(query, "user_123", "1234", 0.65, 0, ctx)
+	require.NoError(t, err)
+	m := retrieved.Memories
+	fmt.Println("Time taken for Getting Memories is", "time", time.Since(start))
+	require.NotEmpty(t, m)
+	assert.Equal(t, types.MemoryTypeCore, m[0].Type)
+	// core memories come first, then the general ones best match first
+	require.Greater(t, len(m), 1)
+	assert.Equal(t, "User drives a rusty Honda Civic car", m[1].Memory_text)
+}
+
+// unavailableEmbedder stands in for an embedding service that is down.
+type unavailableEmbedder struct {
+	*embed.FakeEmbedder
+}
+
+func (unavailableEmbedder) GenerateEmbeddings(texts []string, ctx context.Context) ([]types.DenseEmbedding, []types.SparseEmbedding, error) {
+	return nil, nil, errors.New("embedding service unavailable")
+}
+
+func TestGetMemoriesReturnsPartialResults(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, agent)
+	agent.EmbedClient = unavailableEmbedder{embed.NewFakeEmbedder()}
+
+	result, err := agent.GetMemories("which car does the user drive?", "user_123", "req", 0.3, 0, t.Context())
+	require.NoError(t, err, "the core memories don't need the embedding")
+	assert.True(t, result.Partial)
+	assert.Equal(t, []types.RetrievalStage{types.RetrievalStageGeneral}, result.FailedStages)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(result.Memories))
+
+	healthy := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, healthy)
+	result, err = healthy.GetMemories("which car does the user drive?", "user_123", "req", 0.3, 0, t.Context())
+	require.NoError(t, err)
+	assert.False(t, result.Partial)
+	assert.Empty(t, result.FailedStages)
+}
+
+// refused is what reaching a Redis, Postgres or Qdrant that is down fails with.
+var refused = &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+
+// downCoreMemories can read the core memories but not write them.
+type downCoreMemories struct {
+	redis.CoreMemoryCache
+}
+
+func (downCoreMemories) CompareAndSetCoreMemory(userId string, CoreMemories []types.Memory, version int64, ctx context.Context) error {
+	return refused
+}
+
+// downVectorDB fails the searches or the deletes of the vector DB it wraps.
+type downVectorDB struct {
+	vectordb.VectorDB
+	search, delete bool
+}
+
+func (d downVectorDB) GetSimilarMemories(dense types.DenseEmbedding, sparse types.SparseEmbedding, userId string, threshold float32, limit int, ctx context.Context) ([]types.Memory, error) {
+	if d.search {
+		return nil, refused
 	}
-	end := time.Since(start)
-	fmt.Println("Time taken for Getting Memories is", "time", end)
-	fmt.Println("Memories", m)
+	return d.VectorDB.GetSimilarMemories(dense, sparse, userId, threshold, limit, ctx)
+}
+
+func (d downVectorDB) DeleteMemories(memoryIds []string, ctx context.Context) error {
+	if d.delete {
+		return refused
+	}
+	return d.VectorDB.DeleteMemories(memoryIds, ctx)
+}
+
+func TestInsertMemoryIsRetriedWhenAStoreIsDown(t *testing.T) {
+	for name, breakAgent := range map[string]func(agent *MemoryAgent){
+		"core memory write":     func(agent *MemoryAgent) { agent.CoreMemoryCache = downCoreMemories{agent.CoreMemoryCache} },
+		"general memory delete": func(agent *MemoryAgent) { agent.Vectordb = downVectorDB{VectorDB: agent.Vectordb, delete: true} },
+		"general memory search": func(agent *MemoryAgent) { agent.Vectordb = downVectorDB{VectorDB: agent.Vectordb, search: true} },
+	} {
+		t.Run(name, func(t *testing.T) {
+			fakeLLM := llm.NewFakeLLM()
+			scriptParisMove(fakeLLM)
+			agent := NewtestMemoryAgent(t, fakeLLM)
+			seedMemories(t, agent)
+			breakAgent(agent)
+
+			status, err := agent.InsertMemory(newParisJob(t, agent))
+			assert.Equal(t, types.JobStatusFailed, status)
+			assert.True(t, IsTransient(err), "the job waits for the store to come back instead of succeeding without its writes")
+			general, err := agent.Vectordb.GetAllUserMemories("user_123", t.Context())
+			require.NoError(t, err)
+			assert.ElementsMatch(t, []string{"User drives a rusty Honda Civic car", "User is building an AI Gateway in Go"}, memoryTexts(general), "no general memory was written")
+		})
+	}
+}
+
+// unavailableVectorDB and unavailableCoreMemories stand in for a vector DB and a core memory cache that are down.
+type unavailableVectorDB struct {
+	vectordb.VectorDB
+}
+
+func (unavailableVectorDB) GetAllUserMemories(userId string, ctx context.Context) ([]types.Memory, error) {
+	return nil, errors.New("vector db unavailable")
+}
+
+type unavailableCoreMemories struct {
+	redis.CoreMemoryCache
+}
+
+func (unavailableCoreMemories) GetCoreMemory(userId string, ctx context.Context) ([]types.Memory, error) {
+	return nil, errors.New("redis unavailable")
+}
+
+func TestGetAllUserMemoriesReturnsPartialResults(t *testing.T) {
+	agent := NewtestMemoryAgent(t, llm.NewFakeLLM())
+	seedMemories(t, agent)
+	healthyDB, healthyCache := agent.Vectordb, agent.CoreMemoryCache
+
+	agent.Vectordb = unavailableVectorDB{healthyDB}
+	result, err := agent.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.True(t, result.Partial)
+	assert.Equal(t, []types.RetrievalStage{types.RetrievalStageGeneral}, result.FailedStages)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(result.Memories))
+
+	agent.Vectordb, agent.CoreMemoryCache = healthyDB, unavailableCoreMemories{healthyCache}
+	result, err = agent.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []types.RetrievalStage{types.RetrievalStageCore}, result.FailedStages)
+	assert.NotEmpty(t, result.Memories)
+
+	agent.Vectordb = unavailableVectorDB{healthyDB}
+	_, err = agent.GetAllUserMemories("user_123", t.Context())
+	assert.Error(t, err, "nothing to return when both are down")
 }
 
 func ConstructContextualQuery(messages []types.Message, charLimit int) string {
@@ -192,3 +611,58 @@ func ConstructContextualQuery(messages []types.Message, charLimit int) string {
 	// Join all blocks with newlines to separate turns clearly
 	return strings.Join(accumulatedParts, "\n")
 }
+
+func TestInsertMemoryReappliesCoreActionsOnConflict(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	ctx := t.Context()
+	job := newParisJob(t, agent)
+
+	// another writer adds a core memory between the job reading the core memories and writing them back
+	cache := agent.CoreMemoryCache.(*fakeCoreMemoryCache)
+	cache.race = func() {
+		_, err := agent.CreateMemory("user_123", types.MemoryTypeCore, "User is vegetarian", ctx)
+		require.NoError(t, err)
+	}
+	_, err := agent.InsertMemory(job)
+	require.NoError(t, err)
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User is vegetarian", "User lives in Paris"}, memoryTexts(core), "the job's actions go on top of the other writer's")
+	snapshot, err := agent.Store.GetJobSnapshot(job.ReqId, ctx)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"User lives in Italy"}, memoryTexts(snapshot.DeletedCoreMemories))
+}
+
+func TestInsertMemoryIsRetriedWhenItKeepsLosingTheCoreMemories(t *testing.T) {
+	fakeLLM := llm.NewFakeLLM()
+	scriptParisMove(fakeLLM)
+	agent := NewtestMemoryAgent(t, fakeLLM)
+	seedMemories(t, agent)
+	ctx := t.Context()
+	job := newParisJob(t, agent)
+
+	// another writer gets in before every single attempt of the job
+	cache := agent.CoreMemoryCache.(*fakeCoreMemoryCache)
+	var race func()
+	race = func() {
+		_, err := agent.CreateMemory("user_123", types.MemoryTypeCore, "User is vegetarian", ctx)
+		require.NoError(t, err)
+		cache.race = race
+	}
+	cache.race = race
+	_, err := agent.InsertMemory(job)
+	require.ErrorIs(t, err, redis.ErrCoreMemoryConflict)
+	assert.True(t, IsTransient(err), "the worker retries the job instead of dropping its core actions")
+	cache.race = nil
+
+	core, err := agent.CoreMemoryCache.GetCoreMemory("user_123", ctx)
+	require.NoError(t, err)
+	assert.NotContains(t, memoryTexts(core), "User lives in Paris")
+	general, err := agent.Vectordb.GetAllUserMemories("user_123", ctx)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{"User drives a rusty Honda Civic car", "User is building an AI Gateway in Go"}, memoryTexts(general), "the general memories wait for the retry too")
+}
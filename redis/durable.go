@@ -0,0 +1,291 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"slices"
+	"strings"
+
+	"github.com/Prateek-Gupta001/GoMemory/storage"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+// DurableCoreMemoryCache keeps the core memories in a CoreMemoryStore and caches them in Redis. Reads go to Redis and
+// only fall through to the store when Redis doesn't have them, say after it was flushed, caching what the store
+// returned. Writes go to the store first, which is what decides whether a compare and set wins, and then to Redis.
+// A write that loses drops the cached copy, so the writer reads the winner's core memories from the store next.
+type DurableCoreMemoryCache struct {
+	Cache *RedisCoreMemoryCache
+	Store storage.CoreMemoryStore
+}
+
+// warmPageSize is how many users Warm loads from the store at once.
+const warmPageSize = 500
+
+func NewDurableCoreMemoryCache(cache *RedisCoreMemoryCache, store storage.CoreMemoryStore) *DurableCoreMemoryCache {
+	return &DurableCoreMemoryCache{
+		Cache: cache,
+		Store: store,
+	}
+}
+
+func (d *DurableCoreMemoryCache) GetCoreMemory(userId string, ctx context.Context) ([]types.Memory, error) {
+	mem, _, err := d.GetCoreMemoryVersion(userId, ctx)
+	return mem, err
+}
+
+func (d *DurableCoreMemoryCache) GetCoreMemoryVersion(userId string, ctx context.Context) ([]types.Memory, int64, error) {
+	ctx, span := Tracer.Start(ctx, "Getting Core Memories")
+	defer span.End()
+	mem, version, found, err := d.Cache.cached(userId, ctx)
+	if err != nil {
+		slog.Warn("Got this error while reading the cached core memories, reading them from the store instead", "error", err, "userId", userId)
+	}
+	if found && version == 0 && len(mem) != 0 {
+		// the store never writes version 0, so these were cached before the store kept them, say a legacy key that
+		// was just moved to the hash
+		return d.copyToStore(userId, mem, ctx)
+	}
+	if found {
+		return mem, version, nil
+	}
+	mem, version, err = d.Store.GetCoreMemories(userId, ctx)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := d.Cache.fill(userId, mem, version, false, ctx); err != nil {
+		slog.Warn("Got this error while caching the core memories of the user", "error", err, "userId", userId)
+	}
+	return mem, version, nil
+}
+
+// copyToStore saves core memories only Redis has into the store and caches them again at the version the store gave
+// them. If the store has core memories of the user by now, those win and are the ones cached and returned.
+func (d *DurableCoreMemoryCache) copyToStore(userId string, CoreMemories []types.Memory, ctx context.Context) ([]types.Memory, int64, error) {
+	version, err := d.Store.SaveCoreMemories(userId, CoreMemories, 0, ctx)
+	if errors.Is(err, storage.ErrCoreMemoryConflict) {
+		slog.Info("The store already has core memories of the user, dropping the ones only Redis had", "userId", userId)
+		CoreMemories, version, err = d.Store.GetCoreMemories(userId, ctx)
+	}
+	if err != nil {
+		slog.Error("Got this error while copying the core memories of the user from Redis to the store", "error", err, "userId", userId)
+		return nil, 0, err
+	}
+	slog.Info("Copied the core memories of the user from Redis to the store", "userId", userId, "memories", len(CoreMemories), "version", version)
+	if err := d.Cache.fill(userId, CoreMemories, version, false, ctx); err != nil {
+		slog.Warn("Got this error while caching the core memories of the user", "error", err, "userId", userId)
+	}
+	return CoreMemories, version, nil
+}
+
+// CompareAndSetCoreMemory writes the whole list of core memories and caches it the same way.
+func (d *DurableCoreMemoryCache) CompareAndSetCoreMemory(userId string, CoreMemories []types.Memory, version int64, ctx context.Context) error {
+	return d.write(userId, CoreMemories, version, func(newVersion int64) error {
+		return d.Cache.fill(userId, CoreMemories, newVersion, false, ctx)
+	}, ctx)
+}
+
+// write saves the core memories in the store if they are still at version, and then hands the version they are at now
+// to cache to bring Redis up to date with them.
+func (d *DurableCoreMemoryCache) write(userId string, CoreMemories []types.Memory, version int64, cache func(newVersion int64) error, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Saving Core Memories")
+	defer span.End()
+	newVersion, err := d.Store.SaveCoreMemories(userId, CoreMemories, version, ctx)
+	if err != nil {
+		if errors.Is(err, storage.ErrCoreMemoryConflict) {
+			slog.Info("The core memories were changed by someone else in the meantime", "userId", userId, "version", version)
+			if err := d.Cache.invalidate(userId, ctx); err != nil {
+				slog.Warn("Got this error while dropping the stale cached core memories", "error", err, "userId", userId)
+			}
+			return ErrCoreMemoryConflict
+		}
+		return err
+	}
+	if err := cache(newVersion); err != nil {
+		// the store has them, a stale copy in Redis would only be noticed on the next write
+		slog.Warn("Got this error while caching the new core memories, dropping the cached ones", "error", err, "userId", userId)
+		if err := d.Cache.invalidate(userId, ctx); err != nil {
+			slog.Error("Got this error while dropping the stale cached core memories", "error", err, "userId", userId)
+		}
+	}
+	return nil
+}
+
+// AddCoreMemory, UpdateCoreMemory and DeleteCoreMemory write the whole list of the user to the store, which keeps it in
+// a single row, but only the memories they change to Redis.
+
+func (d *DurableCoreMemoryCache) AddCoreMemory(userId string, mem types.Memory, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Adding a Core Memory")
+	defer span.End()
+	return d.modify(userId, func(existing []types.Memory) ([]types.Memory, error) {
+		existing = slices.DeleteFunc(existing, func(m types.Memory) bool { return m.Memory_Id == mem.Memory_Id })
+		return append(existing, mem), nil
+	}, func(newVersion int64) error {
+		return d.Cache.put(userId, mem, newVersion, ctx)
+	}, ctx)
+}
+
+func (d *DurableCoreMemoryCache) UpdateCoreMemory(userId string, mem types.Memory, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Updating a Core Memory")
+	defer span.End()
+	return d.modify(userId, func(existing []types.Memory) ([]types.Memory, error) {
+		for i := range existing {
+			if existing[i].Memory_Id == mem.Memory_Id {
+				existing[i] = mem
+				return existing, nil
+			}
+		}
+		return nil, ErrCoreMemoryNotFound
+	}, func(newVersion int64) error {
+		return d.Cache.put(userId, mem, newVersion, ctx)
+	}, ctx)
+}
+
+func (d *DurableCoreMemoryCache) DeleteCoreMemory(userId string, coreMemoryIds []string, ctx context.Context) ([]string, error) {
+	ctx, span := Tracer.Start(ctx, "Deleting Core Memories")
+	defer span.End()
+	var deleted []string
+	err := d.modify(userId, func(existing []types.Memory) ([]types.Memory, error) {
+		deleted = nil
+		remaining := slices.DeleteFunc(existing, func(mem types.Memory) bool {
+			if slices.Contains(coreMemoryIds, mem.Memory_Id) {
+				deleted = append(deleted, mem.Memory_Id)
+				return true
+			}
+			return false
+		})
+		if len(deleted) == 0 {
+			return nil, errUnchanged
+		}
+		return remaining, nil
+	}, func(newVersion int64) error {
+		return d.Cache.remove(userId, deleted, newVersion, ctx)
+	}, ctx)
+	if errors.Is(err, errUnchanged) {
+		slog.Info("None of the core memories to delete exist", "userId", userId, "coreMemoryIds", coreMemoryIds)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Core Memories of the user have been deleted", "userId", userId, "deleted", deleted)
+	return deleted, nil
+}
+
+// errUnchanged tells modify there is nothing to write.
+var errUnchanged = errors.New("core memories unchanged")
+
+// modify writes the core memories fn makes out of the current ones of the user, starting over whenever someone else
+// wrote them in between, and then brings Redis up to date with cache.
+func (d *DurableCoreMemoryCache) modify(userId string, fn func([]types.Memory) ([]types.Memory, error), cache func(newVersion int64) error, ctx context.Context) error {
+	for attempt := 1; ; attempt++ {
+		existing, version, err := d.GetCoreMemoryVersion(userId, ctx)
+		if err != nil {
+			return err
+		}
+		updated, err := fn(existing)
+		if err != nil {
+			return err
+		}
+		err = d.write(userId, updated, version, cache, ctx)
+		if !errors.Is(err, ErrCoreMemoryConflict) || attempt == MaxCoreMemoryAttempts {
+			return err
+		}
+	}
+}
+
+// DeleteUserCoreMemories deletes the core memories of the user from the store and from Redis, where some may only be
+// cached from before the store kept them.
+func (d *DurableCoreMemoryCache) DeleteUserCoreMemories(userId string, ctx context.Context) (int, error) {
+	ctx, span := Tracer.Start(ctx, "Deleting All Core Memories of the User")
+	defer span.End()
+	stored, err := d.Store.DeleteCoreMemories(userId, ctx)
+	if err != nil {
+		return 0, err
+	}
+	cached, err := d.Cache.DeleteUserCoreMemories(userId, ctx)
+	if err != nil {
+		return 0, err
+	}
+	return max(stored, cached), nil
+}
+
+// Warm first moves keys in the layouts Redis used before to the hash, so legacy keys aren't missed, and copies core
+// memories that are only in Redis, cached before the store kept them, over to the store. Then it loads the core
+// memories of every user of every tenant from the store into Redis, replacing whatever Redis held. It returns how many
+// users were copied to the store and how many were loaded into Redis.
+func (d *DurableCoreMemoryCache) Warm(ctx context.Context) (int, int, error) {
+	ctx, span := Tracer.Start(ctx, "Warming the Core Memory Cache")
+	defer span.End()
+	if _, err := d.Cache.MigrateKeys(ctx); err != nil {
+		return 0, 0, err
+	}
+	copied, err := d.copyCachedToStore(ctx)
+	if err != nil {
+		return copied, 0, err
+	}
+	warmed := 0
+	var afterTenantId, afterUserId string
+	for {
+		page, err := d.Store.ListCoreMemories(afterTenantId, afterUserId, warmPageSize, ctx)
+		if err != nil {
+			return copied, warmed, err
+		}
+		for _, user := range page {
+			userCtx := types.WithTenantId(ctx, user.TenantId)
+			if err := d.Cache.fill(user.UserId, user.Memories, user.Version, true, userCtx); err != nil {
+				slog.Error("Got this error while warming the core memories of the user", "error", err, "tenantId", user.TenantId, "userId", user.UserId)
+				return copied, warmed, err
+			}
+			warmed++
+		}
+		if len(page) < warmPageSize {
+			break
+		}
+		afterTenantId, afterUserId = page[len(page)-1].TenantId, page[len(page)-1].UserId
+	}
+	slog.Info("The core memory cache has been warmed", "copied", copied, "warmed", warmed)
+	return copied, warmed, nil
+}
+
+// copyCachedToStore saves the core memories of every user Redis has and the store doesn't into the store, at the
+// version Redis had them at.
+func (d *DurableCoreMemoryCache) copyCachedToStore(ctx context.Context) (int, error) {
+	copied := 0
+	iter := d.Cache.RedisClient.Scan(ctx, 0, "gomemory:*:core:*", 1000).Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if strings.HasSuffix(key, ":version") {
+			continue
+		}
+		tenantId, userId, ok := strings.Cut(strings.TrimPrefix(key, "gomemory:"), ":core:")
+		if !ok {
+			continue
+		}
+		userCtx := types.WithTenantId(ctx, tenantId)
+		_, storedVersion, err := d.Store.GetCoreMemories(userId, userCtx)
+		if err != nil {
+			return copied, err
+		}
+		if storedVersion != 0 {
+			continue
+		}
+		mem, version, found, err := d.Cache.cached(userId, userCtx)
+		if err != nil {
+			return copied, err
+		}
+		if !found || len(mem) == 0 {
+			continue
+		}
+		if _, err := d.Store.SaveCoreMemories(userId, mem, version, userCtx); err != nil {
+			if errors.Is(err, storage.ErrCoreMemoryConflict) {
+				continue //written to the store in the meantime
+			}
+			return copied, err
+		}
+		slog.Info("Copied the core memories of the user from Redis to the store", "tenantId", tenantId, "userId", userId, "memories", len(mem))
+		copied++
+	}
+	return copied, iter.Err()
+}
@@ -0,0 +1,150 @@
+package redis
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/redis/go-redis/v9"
+)
+
+// Core memories used to be stored as a single JSON list, first under the bare userId and then under the namespaced
+// key. Reading the core memories of a user moves their keys to the hash on the way, MigrateKeys moves all of them at once.
+
+// MigrateKeys moves the core memories of every user still stored in an older layout to the hash under the namespaced
+// key and returns how many keys it moved.
+func (r *RedisCoreMemoryCache) MigrateKeys(ctx context.Context) (int, error) {
+	ctx, span := Tracer.Start(ctx, "Migrating Core Memory Keys")
+	defer span.End()
+	migrated := 0
+	iter := r.RedisClient.ScanType(ctx, 0, "*", 1000, "string").Iterator()
+	for iter.Next(ctx) {
+		key := iter.Val()
+		if strings.HasSuffix(key, ":version") {
+			continue
+		}
+		if strings.HasPrefix(key, "gomemory:") {
+			if !strings.Contains(key, ":core:") {
+				continue
+			}
+			if err := r.migrateStringKey(key, ctx); err != nil {
+				return migrated, err
+			}
+			migrated++
+			continue
+		}
+		moved, err := r.migrateLegacyKey(key, types.WithTenantId(ctx, types.DefaultTenantId))
+		if err != nil {
+			return migrated, err
+		}
+		if moved {
+			migrated++
+		}
+	}
+	if err := iter.Err(); err != nil {
+		return migrated, err
+	}
+	slog.Info("Core memory keys have been migrated", "migrated", migrated)
+	return migrated, nil
+}
+
+// migrateStringKey turns the JSON list of core memories under key into the hash of them, in place.
+func (r *RedisCoreMemoryCache) migrateStringKey(key string, ctx context.Context) error {
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		res, err := tx.Get(ctx, key).Bytes()
+		if err != nil {
+			if err == redis.Nil || strings.HasPrefix(err.Error(), "WRONGTYPE") {
+				return nil //moved by someone else already
+			}
+			return err
+		}
+		var memories []types.Memory
+		if err := json.Unmarshal(res, &memories); err != nil {
+			slog.Warn("Skipping a core memory key that doesn't hold a list of memories", "error", err, "key", key)
+			return nil
+		}
+		fields, err := coreMemoryFields(memories)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			if len(fields) != 0 {
+				pipe.HSet(ctx, key, fields...)
+			}
+			return nil
+		})
+		return err
+	}, key)
+	if err != nil {
+		slog.Error("Got this error while moving the core memories to a hash", "error", err, "key", key)
+		return err
+	}
+	slog.Info("Moved the core memories to a hash", "key", key)
+	return nil
+}
+
+// migrateLegacyKey moves core memories stored under the bare userId, from before tenants existed, to the key of the
+// default tenant and reports whether there were any. The bare key is only trusted if every memory in it belongs to
+// userId, since any string could be a userId and the bare key might as well be someone else's namespaced key.
+func (r *RedisCoreMemoryCache) migrateLegacyKey(userId string, ctx context.Context) (bool, error) {
+	moved := false
+	key := coreMemoryKey(userId, ctx)
+	err := r.watch(ctx, func(tx *redis.Tx) error {
+		res, err := tx.Get(ctx, userId).Bytes()
+		if err != nil {
+			if err == redis.Nil || strings.HasPrefix(err.Error(), "WRONGTYPE") {
+				return nil
+			}
+			return err
+		}
+		var legacy []types.Memory
+		if err := json.Unmarshal(res, &legacy); err != nil || len(legacy) == 0 {
+			return nil
+		}
+		for _, mem := range legacy {
+			if mem.UserId != userId {
+				return nil
+			}
+		}
+		exists, err := tx.Exists(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		fields, err := coreMemoryFields(legacy)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			if exists == 0 {
+				pipe.HSet(ctx, key, fields...)
+			}
+			pipe.Del(ctx, userId)
+			return nil
+		})
+		moved = err == nil
+		return err
+	}, userId, key)
+	if err != nil {
+		slog.Warn("Got this error while moving the core memories to the namespaced key", "error", err, "userId", userId)
+		return false, err
+	}
+	if moved {
+		slog.Info("Moved the core memories of the user to the namespaced key", "userId", userId)
+	}
+	return moved, nil
+}
+
+// watch runs fn in a transaction that fails if any of keys changes before it commits, trying again if it does.
+func (r *RedisCoreMemoryCache) watch(ctx context.Context, fn func(*redis.Tx) error, keys ...string) error {
+	var err error
+	for range MaxCoreMemoryAttempts {
+		if err = r.RedisClient.Watch(ctx, fn, keys...); !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return err
+}
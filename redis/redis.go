@@ -3,7 +3,10 @@ package redis
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"log/slog"
+	"slices"
+	"strings"
 
 	"github.com/Prateek-Gupta001/GoMemory/types"
 	"github.com/redis/go-redis/v9"
@@ -12,21 +15,95 @@ import (
 
 type CoreMemoryCache interface {
 	GetCoreMemory(userId string, ctx context.Context) ([]types.Memory, error)
-	SetCoreMemory(userId string, CoreMemories []types.Memory, ctx context.Context) error
-	DeleteCoreMemory(CoreMemoryId string, ctx context.Context) error
+	// GetCoreMemoryVersion also returns the version the core memories are at, to pass on to CompareAndSetCoreMemory.
+	GetCoreMemoryVersion(userId string, ctx context.Context) ([]types.Memory, int64, error)
+	// CompareAndSetCoreMemory only writes the core memories if they are still at version, and returns
+	// ErrCoreMemoryConflict if someone else wrote them in the meantime.
+	CompareAndSetCoreMemory(userId string, CoreMemories []types.Memory, version int64, ctx context.Context) error
+	// AddCoreMemory stores a single core memory under its id, leaving the other core memories of the user alone.
+	AddCoreMemory(userId string, mem types.Memory, ctx context.Context) error
+	// UpdateCoreMemory replaces a single core memory of the user, or returns ErrCoreMemoryNotFound if the user doesn't have it.
+	UpdateCoreMemory(userId string, mem types.Memory, ctx context.Context) error
+	DeleteCoreMemory(userId string, coreMemoryIds []string, ctx context.Context) ([]string, error) //returns the ids that were actually deleted
+	DeleteUserCoreMemories(userId string, ctx context.Context) (int, error)                        //returns how many core memories were deleted
 }
 
+// The core memories of a user are cached in a hash under coreMemoryKey, from the id of every core memory to the memory
+// as JSON, so adding, editing or deleting a single one only touches its own field. Next to the hash is the version the
+// store had the core memories at when they were cached, which keeps a writer that lost a race, or a reader that fills
+// in what it read a moment ago, from caching older core memories over newer ones.
+
 type RedisCoreMemoryCache struct {
 	RedisClient *redis.Client
 }
 
 var Tracer = otel.Tracer("Go_Memory")
 
-func NewRedisCoreMemoryCache() *RedisCoreMemoryCache {
+var (
+	ErrCoreMemoryConflict = errors.New("core memories were changed by someone else")
+	ErrCoreMemoryNotFound = errors.New("core memory not found")
+)
+
+// MaxCoreMemoryAttempts is how many times a read-modify-write of the core memories is tried before giving up on the race for them.
+const MaxCoreMemoryAttempts = 5
+
+// fillIfNewer caches core memories read from or written to the store. Two writers can fill in the opposite order they
+// wrote in, so an older version never replaces a newer one unless ARGV[2] forces it.
+var fillIfNewer = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[2]) or "-1")
+if ARGV[2] ~= "1" and tonumber(ARGV[1]) < current then
+	return 0
+end
+redis.call("DEL", KEYS[1])
+for i = 3, #ARGV, 2 do
+	redis.call("HSET", KEYS[1], ARGV[i], ARGV[i + 1])
+end
+redis.call("SET", KEYS[2], ARGV[1])
+return 1
+`)
+
+// putCoreMemory stores the core memory ARGV[3] under the id ARGV[2] and moves the version on to ARGV[1], the version
+// the store wrote it at. Redis must hold the version right before it, or the change isn't the only one it is missing:
+// a copy that is further behind is dropped, to be read from the store again, and a newer one already has the change.
+var putCoreMemory = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[2]) or "-1")
+local version = tonumber(ARGV[1])
+if current >= version then
+	return 0
+end
+if current ~= version - 1 then
+	redis.call("DEL", KEYS[1], KEYS[2])
+	return 0
+end
+redis.call("HSET", KEYS[1], ARGV[2], ARGV[3])
+redis.call("SET", KEYS[2], ARGV[1])
+return 1
+`)
+
+// deleteCoreMemories deletes the ids in ARGV from ARGV[2] on from the hash and moves the version on to ARGV[1], the
+// same way putCoreMemory does.
+var deleteCoreMemories = redis.NewScript(`
+local current = tonumber(redis.call("GET", KEYS[2]) or "-1")
+local version = tonumber(ARGV[1])
+if current >= version then
+	return 0
+end
+if current ~= version - 1 then
+	redis.call("DEL", KEYS[1], KEYS[2])
+	return 0
+end
+for i = 2, #ARGV do
+	redis.call("HDEL", KEYS[1], ARGV[i])
+end
+redis.call("SET", KEYS[2], ARGV[1])
+return 1
+`)
+
+func NewRedisCoreMemoryCache(addr string, password string, db int) *RedisCoreMemoryCache {
 	rdb := redis.NewClient(&redis.Options{
-		Addr:     "localhost:6379",
-		Password: "", // no password
-		DB:       0,  // use default DB
+		Addr:     addr,
+		Password: password,
+		DB:       db,
 		Protocol: 2,
 	})
 	return &RedisCoreMemoryCache{
@@ -34,52 +111,164 @@ func NewRedisCoreMemoryCache() *RedisCoreMemoryCache {
 	}
 }
 
+// coreMemoryKey is the key the core memories of a user of the tenant ctx is scoped to live under.
+func coreMemoryKey(userId string, ctx context.Context) string {
+	return "gomemory:" + types.TenantId(ctx) + ":core:" + userId
+}
+
+// coreMemoryVersionKey holds the version of the core memories under coreMemoryKey.
+func coreMemoryVersionKey(userId string, ctx context.Context) string {
+	return coreMemoryKey(userId, ctx) + ":version"
+}
+
+// coreMemoryFields flattens core memories into the id and JSON pairs of their hash.
+func coreMemoryFields(CoreMemories []types.Memory) ([]any, error) {
+	fields := make([]any, 0, 2*len(CoreMemories))
+	for _, mem := range CoreMemories {
+		jsonBytes, err := json.Marshal(mem)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, mem.Memory_Id, jsonBytes)
+	}
+	return fields, nil
+}
+
 // Get Core Memories from the Redis Cache. It return nil,nil if the user has currently no core memories.
 func (r *RedisCoreMemoryCache) GetCoreMemory(userId string, ctx context.Context) ([]types.Memory, error) {
+	mem, _, err := r.GetCoreMemoryVersion(userId, ctx)
+	return mem, err
+}
+
+// GetCoreMemoryVersion reads the core memories and their version at once. Users who never had core memories are at version 0.
+func (r *RedisCoreMemoryCache) GetCoreMemoryVersion(userId string, ctx context.Context) ([]types.Memory, int64, error) {
+	mem, version, _, err := r.cached(userId, ctx)
+	return mem, version, err
+}
+
+// cached is GetCoreMemoryVersion that also tells whether Redis had the core memories of the user at all. Keys in
+// the layouts Redis used before are moved to the current one on the way.
+func (r *RedisCoreMemoryCache) cached(userId string, ctx context.Context) ([]types.Memory, int64, bool, error) {
 	ctx, span := Tracer.Start(ctx, "Getting Core Memories from Redis")
 	defer span.End()
-	res, err := r.RedisClient.Get(ctx, userId).Bytes()
-	if err != nil {
-		if err == redis.Nil {
-			slog.Info("Cache miss! The user has no core memories!", "userId", userId)
-			return nil, nil
+	mem, version, found, err := r.read(userId, ctx)
+	if err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE") {
+		if err = r.migrateStringKey(coreMemoryKey(userId, ctx), ctx); err == nil {
+			mem, version, found, err = r.read(userId, ctx)
+		}
+	} else if err == nil && !found && types.TenantId(ctx) == types.DefaultTenantId {
+		var moved bool
+		if moved, err = r.migrateLegacyKey(userId, ctx); err == nil && moved {
+			mem, version, found, err = r.read(userId, ctx)
 		}
-		slog.Error("Got this error while trying to get core memories of the user! redis error", "userId", userId, "error", err)
-		return nil, err
 	}
-	v := &[]types.Memory{}
-	err = json.Unmarshal(res, v)
 	if err != nil {
-		slog.Error("Got this error while trying to get core memories of the user (unmarshalling the json)", "userId", userId, "error", err)
-		return nil, err
+		slog.Error("Got this error while trying to get core memories of the user! redis error", "userId", userId, "error", err)
+		return nil, 0, false, err
+	}
+	if !found {
+		slog.Info("Cache miss! The user has no core memories!", "userId", userId)
+		return nil, 0, false, nil
 	}
-	slog.Info("Got this as the core memories of the user", "userId", userId, "memories", *v)
+	slog.Info("Got this as the core memories of the user", "userId", userId, "memories", mem, "version", version)
+	return mem, version, true, nil
+}
 
-	return *v, nil
+// read reads the hash and the version of the core memories of the user in one go. The core memories come back oldest
+// first, ties broken by id.
+func (r *RedisCoreMemoryCache) read(userId string, ctx context.Context) ([]types.Memory, int64, bool, error) {
+	var fields *redis.MapStringStringCmd
+	var versionCmd *redis.StringCmd
+	_, err := r.RedisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		fields = pipe.HGetAll(ctx, coreMemoryKey(userId, ctx))
+		versionCmd = pipe.Get(ctx, coreMemoryVersionKey(userId, ctx))
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, 0, false, err
+	}
+	if err := fields.Err(); err != nil {
+		return nil, 0, false, err
+	}
+	var version int64
+	found := len(fields.Val()) != 0
+	if versionCmd.Err() == nil {
+		if version, err = versionCmd.Int64(); err != nil {
+			slog.Error("Got this error while parsing the version of the core memories", "userId", userId, "error", err)
+			return nil, 0, false, err
+		}
+		found = true
+	}
+	memories := make([]types.Memory, 0, len(fields.Val()))
+	for id, data := range fields.Val() {
+		mem := types.Memory{}
+		if err := json.Unmarshal([]byte(data), &mem); err != nil {
+			slog.Error("Got this error while trying to get core memories of the user (unmarshalling the json)", "userId", userId, "memoryId", id, "error", err)
+			return nil, 0, false, err
+		}
+		memories = append(memories, mem)
+	}
+	slices.SortFunc(memories, func(a, b types.Memory) int {
+		if c := a.CreatedAt.Compare(b.CreatedAt); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Memory_Id, b.Memory_Id)
+	})
+	return memories, version, found, nil
 }
 
-func (r *RedisCoreMemoryCache) SetCoreMemory(userId string, CoreMemories []types.Memory, ctx context.Context) error {
-	ctx, span := Tracer.Start(ctx, "Setting Core Memories in Redis")
-	defer span.End()
-	jsonBytes, err := json.Marshal(CoreMemories)
+// fill caches the core memories of the user at version, unless Redis already holds a newer version of them. Even an
+// empty list is cached, the version key alone tells the user has none, so users without core memories don't go to the
+// store on every read. force overwrites whatever version Redis holds.
+func (r *RedisCoreMemoryCache) fill(userId string, CoreMemories []types.Memory, version int64, force bool, ctx context.Context) error {
+	fields, err := coreMemoryFields(CoreMemories)
 	if err != nil {
-		slog.Error("Got this error while trying to set the core memories.. marshalling the json", "error", err, "userId", userId)
 		return err
 	}
-	err = r.RedisClient.Set(ctx, userId, jsonBytes, 0).Err()
+	keys := []string{coreMemoryKey(userId, ctx), coreMemoryVersionKey(userId, ctx)}
+	return fillIfNewer.Run(ctx, r.RedisClient, keys, append([]any{version, force}, fields...)...).Err()
+}
+
+// invalidate drops the cached core memories of the user, the next read fetches them from the store again.
+func (r *RedisCoreMemoryCache) invalidate(userId string, ctx context.Context) error {
+	return r.RedisClient.Del(ctx, coreMemoryKey(userId, ctx), coreMemoryVersionKey(userId, ctx)).Err()
+}
+
+// put caches the core memory the store just wrote at version on its own, with HSET, instead of filling in the whole
+// hash again.
+func (r *RedisCoreMemoryCache) put(userId string, mem types.Memory, version int64, ctx context.Context) error {
+	jsonBytes, err := json.Marshal(mem)
 	if err != nil {
-		slog.Error("Got this error while trying to set the core memories", "error", err, "userId", userId)
+		slog.Error("Got this error while marshalling the core memory", "error", err, "userId", userId, "memoryId", mem.Memory_Id)
 		return err
 	}
-	return nil
+	keys := []string{coreMemoryKey(userId, ctx), coreMemoryVersionKey(userId, ctx)}
+	return putCoreMemory.Run(ctx, r.RedisClient, keys, version, mem.Memory_Id, jsonBytes).Err()
 }
 
-func (r *RedisCoreMemoryCache) DeleteCoreMemory(CoreMemoryId string, ctx context.Context) error {
-	ctx, span := Tracer.Start(ctx, "Deleting Core Memories in Redis")
-	defer span.End()
-	//TODO: Setup a system for deleting core memories ..
-
-	// err := r.RedisClient.del
+// remove drops the core memories the store just deleted at version from the cache, with HDEL.
+func (r *RedisCoreMemoryCache) remove(userId string, coreMemoryIds []string, version int64, ctx context.Context) error {
+	args := make([]any, 0, len(coreMemoryIds)+1)
+	args = append(args, version)
+	for _, id := range coreMemoryIds {
+		args = append(args, id)
+	}
+	keys := []string{coreMemoryKey(userId, ctx), coreMemoryVersionKey(userId, ctx)}
+	return deleteCoreMemories.Run(ctx, r.RedisClient, keys, args...).Err()
+}
 
-	return nil
+// DeleteUserCoreMemories drops the core memories of the user altogether. Reading them first also moves a legacy key of
+// the user over, so it is deleted along with them.
+func (r *RedisCoreMemoryCache) DeleteUserCoreMemories(userId string, ctx context.Context) (int, error) {
+	ctx, span := Tracer.Start(ctx, "Deleting All Core Memories of the User in Redis")
+	defer span.End()
+	existing, err := r.GetCoreMemory(userId, ctx)
+	if err != nil {
+		return 0, err
+	}
+	if err := r.RedisClient.Del(ctx, coreMemoryKey(userId, ctx), coreMemoryVersionKey(userId, ctx)).Err(); err != nil {
+		slog.Error("Got this error while deleting the core memories of the user", "error", err, "userId", userId)
+		return 0, err
+	}
+	return len(existing), nil
 }
@@ -1,8 +1,11 @@
 package redis
 
 import (
+	"context"
+	"encoding/json"
 	"testing"
 
+	"github.com/Prateek-Gupta001/GoMemory/storage"
 	"github.com/Prateek-Gupta001/GoMemory/types"
 	"github.com/redis/go-redis/v9"
 	"github.com/stretchr/testify/assert"
@@ -33,8 +36,8 @@ func TestGetCoreMemories(t *testing.T) {
 		{Memory_text: "Name is Prateek", Memory_Id: "2", UserId: "user_test"},
 	}
 
-	err := r.SetCoreMemory(testUserId, expectedMemories, ctx)
-	assert.NoError(err, "Setting core memories should not fail")
+	err := r.fill(testUserId, expectedMemories, 1, false, ctx)
+	assert.NoError(err, "Caching core memories should not fail")
 
 	missMemories, err := r.GetCoreMemory("user_Test_does_not_exist", ctx)
 	assert.NoError(err, "Cache miss should not return an error")
@@ -47,3 +50,182 @@ func TestGetCoreMemories(t *testing.T) {
 
 	assert.Len(actualMemories, 2)
 }
+
+// fakeCoreMemoryStore keeps the core memories the way Postgres does, in a map.
+type fakeCoreMemoryStore struct {
+	users map[string]types.UserCoreMemories
+}
+
+func (f *fakeCoreMemoryStore) GetCoreMemories(userId string, ctx context.Context) ([]types.Memory, int64, error) {
+	user := f.users[types.TenantId(ctx)+":"+userId]
+	return user.Memories, user.Version, nil
+}
+
+func (f *fakeCoreMemoryStore) SaveCoreMemories(userId string, memories []types.Memory, version int64, ctx context.Context) (int64, error) {
+	user, ok := f.users[types.TenantId(ctx)+":"+userId]
+	if ok && version != storage.AnyVersion && version != user.Version {
+		return 0, storage.ErrCoreMemoryConflict
+	}
+	if !ok {
+		user = types.UserCoreMemories{TenantId: types.TenantId(ctx), UserId: userId, Version: max(version, 0)}
+	}
+	user.Memories = memories
+	user.Version++
+	f.users[types.TenantId(ctx)+":"+userId] = user
+	return user.Version, nil
+}
+
+func (f *fakeCoreMemoryStore) DeleteCoreMemories(userId string, ctx context.Context) (int, error) {
+	n := len(f.users[types.TenantId(ctx)+":"+userId].Memories)
+	delete(f.users, types.TenantId(ctx)+":"+userId)
+	return n, nil
+}
+
+func (f *fakeCoreMemoryStore) ListCoreMemories(afterTenantId string, afterUserId string, limit int, ctx context.Context) ([]types.UserCoreMemories, error) {
+	var page []types.UserCoreMemories
+	for _, user := range f.users {
+		page = append(page, user)
+	}
+	return page, nil
+}
+
+func TestDurableCoreMemoryCache(t *testing.T) {
+	r := NewMockRedisCache()
+	r.RedisClient.FlushDB(t.Context())
+	defer r.RedisClient.FlushDB(t.Context())
+	assert := assert.New(t)
+	ctx := t.Context()
+	store := &fakeCoreMemoryStore{users: map[string]types.UserCoreMemories{}}
+	d := NewDurableCoreMemoryCache(r, store)
+
+	memories := []types.Memory{{Memory_text: "Lives in Paris", Memory_Id: "1", UserId: "user_test"}}
+	assert.NoError(d.CompareAndSetCoreMemory("user_test", memories, 0, ctx))
+	stored, version, _ := store.GetCoreMemories("user_test", ctx)
+	assert.Equal(memories, stored, "writes go to the store")
+	assert.Equal(int64(1), version)
+
+	r.RedisClient.FlushDB(ctx)
+	got, version, err := d.GetCoreMemoryVersion("user_test", ctx)
+	assert.NoError(err)
+	assert.Equal(memories, got, "a flushed Redis is rebuilt from the store")
+	assert.Equal(int64(1), version)
+	cached, _, found, err := r.cached("user_test", ctx)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal(memories, cached)
+
+	assert.ErrorIs(d.CompareAndSetCoreMemory("user_test", nil, 0, ctx), ErrCoreMemoryConflict)
+	_, _, found, _ = r.cached("user_test", ctx)
+	assert.False(found, "losing a race drops the cached copy")
+
+	// a user cached before the store existed is copied over by Warm
+	assert.NoError(r.fill("user_legacy", memories, 1, false, ctx))
+	r.RedisClient.Del(ctx, coreMemoryKey("user_test", ctx))
+	copied, warmed, err := d.Warm(ctx)
+	assert.NoError(err)
+	assert.Equal(1, copied)
+	assert.Equal(2, warmed)
+	stored, _, _ = store.GetCoreMemories("user_legacy", ctx)
+	assert.Equal(memories, stored)
+}
+
+func TestDurableCoreMemoryCacheCopiesLegacyKeysToTheStore(t *testing.T) {
+	r := NewMockRedisCache()
+	r.RedisClient.FlushDB(t.Context())
+	defer r.RedisClient.FlushDB(t.Context())
+	assert := assert.New(t)
+	ctx := types.WithTenantId(t.Context(), types.DefaultTenantId)
+	store := &fakeCoreMemoryStore{users: map[string]types.UserCoreMemories{}}
+	d := NewDurableCoreMemoryCache(r, store)
+
+	legacy := []types.Memory{{Memory_text: "Lives in Paris", Memory_Id: "1", UserId: "user_legacy"}}
+	legacyJson, _ := json.Marshal(legacy)
+	r.RedisClient.Set(ctx, "user_legacy", legacyJson, 0)
+	got, version, err := d.GetCoreMemoryVersion("user_legacy", ctx)
+	assert.NoError(err)
+	assert.Equal(legacy, got)
+	assert.Equal(int64(1), version)
+	stored, storedVersion, _ := store.GetCoreMemories("user_legacy", ctx)
+	assert.Equal(legacy, stored, "a legacy key read through the cache ends up in the store")
+	assert.Equal(int64(1), storedVersion)
+	assert.NoError(d.AddCoreMemory("user_legacy", types.Memory{Memory_text: "Is a nurse", Memory_Id: "2", UserId: "user_legacy"}, ctx))
+	stored, _, _ = store.GetCoreMemories("user_legacy", ctx)
+	assert.Len(stored, 2, "so writing after it keeps it")
+
+	otherJson, _ := json.Marshal([]types.Memory{{Memory_text: "Has a dog", Memory_Id: "3", UserId: "user_other"}})
+	r.RedisClient.Set(ctx, "user_other", otherJson, 0)
+	copied, _, err := d.Warm(ctx)
+	assert.NoError(err)
+	assert.Equal(1, copied, "Warm moves legacy keys before copying them")
+	stored, _, _ = store.GetCoreMemories("user_other", ctx)
+	assert.Len(stored, 1)
+}
+
+func TestSingleCoreMemoryWrites(t *testing.T) {
+	r := NewMockRedisCache()
+	r.RedisClient.FlushDB(t.Context())
+	defer r.RedisClient.FlushDB(t.Context())
+	assert := assert.New(t)
+	ctx := t.Context()
+	store := &fakeCoreMemoryStore{users: map[string]types.UserCoreMemories{}}
+	d := NewDurableCoreMemoryCache(r, store)
+
+	paris := types.Memory{Memory_text: "Lives in Paris", Memory_Id: "1", UserId: "user_test"}
+	name := types.Memory{Memory_text: "Name is Prateek", Memory_Id: "2", UserId: "user_test"}
+	assert.NoError(d.AddCoreMemory("user_test", paris, ctx))
+	assert.NoError(d.AddCoreMemory("user_test", name, ctx))
+	paris.Memory_text = "Lives in Rome"
+	assert.NoError(d.UpdateCoreMemory("user_test", paris, ctx))
+	assert.ErrorIs(d.UpdateCoreMemory("user_test", types.Memory{Memory_Id: "3"}, ctx), ErrCoreMemoryNotFound)
+
+	memories, version, found, err := r.cached("user_test", ctx)
+	assert.NoError(err)
+	assert.True(found)
+	assert.Equal([]types.Memory{paris, name}, memories)
+	assert.Equal(int64(3), version, "Redis is at the version of the store")
+	stored, _, _ := store.GetCoreMemories("user_test", ctx)
+	assert.Equal(memories, stored)
+	fields, err := r.RedisClient.HKeys(ctx, "gomemory:default:core:user_test").Result()
+	assert.NoError(err)
+	assert.ElementsMatch([]string{"1", "2"}, fields, "every core memory is a field of its own")
+
+	deleted, err := d.DeleteCoreMemory("user_test", []string{"2", "3"}, ctx)
+	assert.NoError(err)
+	assert.Equal([]string{"2"}, deleted)
+	memories, version, _, _ = r.cached("user_test", ctx)
+	assert.Equal([]types.Memory{paris}, memories)
+	assert.Equal(int64(4), version)
+
+	// a cached copy that missed a write of the store isn't patched, it is read from the store again
+	store.SaveCoreMemories("user_test", []types.Memory{paris, name}, storage.AnyVersion, ctx)
+	assert.NoError(r.put("user_test", name, 6, ctx))
+	_, _, found, _ = r.cached("user_test", ctx)
+	assert.False(found)
+}
+
+func TestMigrateKeys(t *testing.T) {
+	r := NewMockRedisCache()
+	r.RedisClient.FlushDB(t.Context())
+	defer r.RedisClient.FlushDB(t.Context())
+	assert := assert.New(t)
+	ctx := t.Context()
+
+	legacy := []types.Memory{{Memory_text: "Lives in Paris", Memory_Id: "1", UserId: "user_legacy"}}
+	namespaced := []types.Memory{{Memory_text: "Name is Prateek", Memory_Id: "2", UserId: "user_test"}}
+	legacyJson, _ := json.Marshal(legacy)
+	namespacedJson, _ := json.Marshal(namespaced)
+	r.RedisClient.Set(ctx, "user_legacy", legacyJson, 0)
+	r.RedisClient.Set(ctx, "gomemory:default:core:user_test", namespacedJson, 0)
+	r.RedisClient.Set(ctx, "something_else", "not a memory", 0)
+
+	migrated, err := r.MigrateKeys(ctx)
+	assert.NoError(err)
+	assert.Equal(2, migrated)
+	for userId, expected := range map[string][]types.Memory{"user_legacy": legacy, "user_test": namespaced} {
+		memories, err := r.GetCoreMemory(userId, ctx)
+		assert.NoError(err)
+		assert.Equal(expected, memories)
+	}
+	assert.Equal(int64(0), r.RedisClient.Exists(ctx, "user_legacy").Val())
+	assert.Equal("not a memory", r.RedisClient.Get(ctx, "something_else").Val())
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log/slog"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+// Postgres is where core memories are kept for good, Redis only caches them. The core memories of a user are a single
+// row holding the whole list along with a version that every write bumps, so writers can tell whether someone else
+// wrote them since they read them.
+
+// AnyVersion makes SaveCoreMemories overwrite the core memories whatever version they are at.
+const AnyVersion int64 = -1
+
+type CoreMemoryStore interface {
+	// GetCoreMemories returns the core memories of the user and their version. A user without any is at version 0.
+	GetCoreMemories(userId string, ctx context.Context) ([]types.Memory, int64, error)
+	// SaveCoreMemories writes the core memories if they are still at version and returns the version they are at now.
+	SaveCoreMemories(userId string, memories []types.Memory, version int64, ctx context.Context) (int64, error)
+	// DeleteCoreMemories drops the core memories of the user altogether and returns how many there were.
+	DeleteCoreMemories(userId string, ctx context.Context) (int, error)
+	// ListCoreMemories pages through the core memories of every user of every tenant, ordered by tenant and user,
+	// starting after the given ones.
+	ListCoreMemories(afterTenantId string, afterUserId string, limit int, ctx context.Context) ([]types.UserCoreMemories, error)
+}
+
+func (s *PostgresStore) GetCoreMemories(userId string, ctx context.Context) ([]types.Memory, int64, error) {
+	var data []byte
+	var version int64
+	err := s.db.QueryRowContext(ctx, `SELECT memories, version FROM core_memories WHERE tenant_id = $1 AND user_id = $2`,
+		types.TenantId(ctx), userId).Scan(&data, &version)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, 0, nil
+		}
+		slog.Error("Got this error while getting the core memories of the user", "error", err, "userId", userId)
+		return nil, 0, err
+	}
+	var memories []types.Memory
+	if err := json.Unmarshal(data, &memories); err != nil {
+		slog.Error("Got this error while unmarshalling the core memories of the user", "error", err, "userId", userId)
+		return nil, 0, err
+	}
+	return memories, version, nil
+}
+
+// SaveCoreMemories takes a user without a row at whatever version the writer read, so core memories that were only
+// ever in Redis end up here on their next write. An empty list is kept as a row, so the version never goes back.
+func (s *PostgresStore) SaveCoreMemories(userId string, memories []types.Memory, version int64, ctx context.Context) (int64, error) {
+	if memories == nil {
+		memories = []types.Memory{}
+	}
+	data, err := json.Marshal(memories)
+	if err != nil {
+		slog.Error("Got this error while marshalling the core memories of the user", "error", err, "userId", userId)
+		return 0, err
+	}
+	var newVersion int64
+	err = s.db.QueryRowContext(ctx, `
+	INSERT INTO core_memories (tenant_id, user_id, memories, version) VALUES ($1, $2, $3, GREATEST($4::BIGINT, 0) + 1)
+	ON CONFLICT (tenant_id, user_id) DO UPDATE SET memories = EXCLUDED.memories, version = core_memories.version + 1, updated_at = now()
+	WHERE $4::BIGINT = -1 OR core_memories.version = $4::BIGINT
+	RETURNING version`,
+		types.TenantId(ctx), userId, data, version).Scan(&newVersion)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, ErrCoreMemoryConflict
+		}
+		slog.Error("Got this error while saving the core memories of the user", "error", err, "userId", userId)
+		return 0, err
+	}
+	return newVersion, nil
+}
+
+func (s *PostgresStore) DeleteCoreMemories(userId string, ctx context.Context) (int, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `DELETE FROM core_memories WHERE tenant_id = $1 AND user_id = $2 RETURNING memories`,
+		types.TenantId(ctx), userId).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		slog.Error("Got this error while deleting the core memories of the user", "error", err, "userId", userId)
+		return 0, err
+	}
+	var memories []types.Memory
+	if err := json.Unmarshal(data, &memories); err != nil {
+		return 0, err
+	}
+	return len(memories), nil
+}
+
+func (s *PostgresStore) ListCoreMemories(afterTenantId string, afterUserId string, limit int, ctx context.Context) ([]types.UserCoreMemories, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT tenant_id, user_id, memories, version FROM core_memories
+	WHERE (tenant_id, user_id) > ($1, $2)
+	ORDER BY tenant_id, user_id
+	LIMIT $3`, afterTenantId, afterUserId, limit)
+	if err != nil {
+		slog.Error("Got this error while listing the core memories", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var page []types.UserCoreMemories
+	for rows.Next() {
+		var data []byte
+		user := types.UserCoreMemories{}
+		if err := rows.Scan(&user.TenantId, &user.UserId, &data, &user.Version); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(data, &user.Memories); err != nil {
+			slog.Error("Got this error while unmarshalling the core memories", "error", err, "tenantId", user.TenantId, "userId", user.UserId)
+			return nil, err
+		}
+		page = append(page, user)
+	}
+	return page, rows.Err()
+}
@@ -1,30 +1,50 @@
 package storage
 
 import (
+	"context"
 	"database/sql"
-	"fmt"
+	"encoding/json"
+	"errors"
 	"log/slog"
-	"os"
+	"slices"
 
 	"github.com/Prateek-Gupta001/GoMemory/types"
 	_ "github.com/lib/pq"
 )
 
+var (
+	ErrJobNotFound      = errors.New("memory job not found")
+	ErrSnapshotNotFound = errors.New("job snapshot not found")
+	ErrAPIKeyNotFound   = errors.New("api key not found")
+	// ErrCoreMemoryConflict is returned when the core memories aren't at the version the writer read them at anymore.
+	ErrCoreMemoryConflict = errors.New("core memories were changed by someone else")
+)
+
 type Storage interface {
-	InsertMemoryRequest(req *types.InsertMemoryRequest, reqId string) error
+	InsertMemoryJob(job types.MemoryInsertionJob, ctx context.Context) error
+	UpdateJobStatus(reqId string, status types.JobStatus, jobErr error, ctx context.Context) error
+	GetMemoryJob(reqId string, ctx context.Context) (*types.MemoryJob, error)
+	InsertMemoryChanges(changes []types.MemoryChange, ctx context.Context) error
+	GetMemoryHistory(userId string, limit int, ctx context.Context) ([]types.MemoryChange, error)
+	SaveJobSnapshot(snapshot types.JobSnapshot, ctx context.Context) error
+	GetJobSnapshot(reqId string, ctx context.Context) (*types.JobSnapshot, error)
+	InsertAPIKey(key types.APIKey, keyHash string, ctx context.Context) error
+	GetAPIKeyByHash(keyHash string, ctx context.Context) (*types.APIKey, error)
+	DeleteUserRecords(userId string, ctx context.Context) (*types.DeletedUserRecords, error)
+	// UserForgotten reports whether DeleteUserRecords ever forgot the user.
+	UserForgotten(userId string, ctx context.Context) (bool, error)
+	// DeleteJobRecords deletes the changes and the snapshot of a single job, for a job that outlived its user.
+	DeleteJobRecords(reqId string, ctx context.Context) error
 }
 
+// Jobs, changes and snapshots belong to the tenant the context is scoped to (see types.TenantId), reading them only
+// ever returns rows of that tenant.
+
 type PostgresStore struct {
 	db *sql.DB
 }
 
-func NewPostgresStore() (*PostgresStore, error) {
-	dbPassword := os.Getenv("DB_PASSWORD")
-	if dbPassword == "" {
-		dbPassword = "postgres" // Fallback for zero-friction local setup
-	}
-	connStr := fmt.Sprintf("host=127.0.0.1 port=5433 user=postgres dbname=memory password=%s sslmode=disable", dbPassword)
-	// ... rest of code
+func NewPostgresStore(connStr string) (*PostgresStore, error) {
 	db, err := sql.Open("postgres", connStr)
 	if err != nil {
 		slog.Info("Got this error while trying to open a connection to the database ", "error", err)
@@ -37,9 +57,410 @@ func NewPostgresStore() (*PostgresStore, error) {
 	ps := &PostgresStore{
 		db: db,
 	}
+	if err := ps.Init(); err != nil {
+		slog.Error("Got this error while trying to create the tables", "error", err)
+		return nil, err
+	}
 	return ps, nil
 }
 
-func (s *PostgresStore) InsertMemoryRequest(req *types.InsertMemoryRequest, reqId string) error {
+// DB exposes the connection pool, so other Postgres backed components (e.g. the pgvector memory db) can share it.
+func (s *PostgresStore) DB() *sql.DB {
+	return s.db
+}
+
+// Init creates the tables the store needs if they don't exist yet.
+func (s *PostgresStore) Init() error {
+	query := `
+	CREATE TABLE IF NOT EXISTS memory_jobs (
+		req_id      TEXT PRIMARY KEY,
+		user_id     TEXT NOT NULL,
+		messages    JSONB NOT NULL,
+		threshold   REAL NOT NULL,
+		status      TEXT NOT NULL,
+		error       TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at  TIMESTAMPTZ NOT NULL DEFAULT now(),
+		started_at  TIMESTAMPTZ,
+		finished_at TIMESTAMPTZ
+	);
+	ALTER TABLE memory_jobs ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+	ALTER TABLE memory_jobs ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+	CREATE INDEX IF NOT EXISTS memory_jobs_user_id_idx ON memory_jobs (user_id);
+
+	CREATE TABLE IF NOT EXISTS memory_changes (
+		id          BIGSERIAL PRIMARY KEY,
+		req_id      TEXT NOT NULL,
+		user_id     TEXT NOT NULL,
+		memory_id   TEXT NOT NULL,
+		memory_type TEXT NOT NULL,
+		action      TEXT NOT NULL,
+		before_text TEXT,
+		after_text  TEXT,
+		reasoning   TEXT NOT NULL DEFAULT '',
+		created_at  TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	ALTER TABLE memory_changes ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+	DROP INDEX IF EXISTS memory_changes_user_id_idx;
+	CREATE INDEX IF NOT EXISTS memory_changes_tenant_user_idx ON memory_changes (tenant_id, user_id, created_at DESC);
+
+	CREATE TABLE IF NOT EXISTS job_snapshots (
+		req_id     TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		snapshot   JSONB NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	ALTER TABLE job_snapshots ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+
+	CREATE TABLE IF NOT EXISTS forgotten_users (
+		tenant_id    TEXT NOT NULL,
+		user_id      TEXT NOT NULL,
+		forgotten_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (tenant_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS core_memories (
+		tenant_id  TEXT NOT NULL,
+		user_id    TEXT NOT NULL,
+		memories   JSONB NOT NULL,
+		version    BIGINT NOT NULL,
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		PRIMARY KEY (tenant_id, user_id)
+	);
+
+	CREATE TABLE IF NOT EXISTS api_keys (
+		id         TEXT PRIMARY KEY,
+		tenant_id  TEXT NOT NULL,
+		name       TEXT NOT NULL DEFAULT '',
+		key_hash   TEXT NOT NULL UNIQUE,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		revoked_at TIMESTAMPTZ
+	);`
+	_, err := s.db.Exec(query)
+	return err
+}
+
+func (s *PostgresStore) InsertMemoryJob(job types.MemoryInsertionJob, ctx context.Context) error {
+	messages, err := json.Marshal(job.Messages)
+	if err != nil {
+		slog.Error("Got this error while marshalling the messages of the memory job", "error", err, "reqId", job.ReqId)
+		return err
+	}
+	tenantId := job.TenantId
+	if tenantId == "" {
+		tenantId = types.DefaultTenantId
+	}
+	_, err = s.db.ExecContext(ctx,
+		`INSERT INTO memory_jobs (req_id, tenant_id, user_id, messages, threshold, status) VALUES ($1, $2, $3, $4, $5, $6)`,
+		job.ReqId, tenantId, job.UserId, messages, job.Threshold, types.JobStatusQueued)
+	if err != nil {
+		slog.Error("Got this error while inserting the memory job", "error", err, "reqId", job.ReqId)
+		return err
+	}
+	return nil
+}
+
+// UpdateJobStatus moves a job to the given status. It is only called by GoMemory itself, so it isn't scoped to a tenant. Every move to processing counts as an attempt, started_at is set
+// the first time the job is picked up and finished_at whenever it reaches a terminal status.
+func (s *PostgresStore) UpdateJobStatus(reqId string, status types.JobStatus, jobErr error, ctx context.Context) error {
+	errMsg := ""
+	if jobErr != nil {
+		errMsg = jobErr.Error()
+	}
+	res, err := s.db.ExecContext(ctx, `
+	UPDATE memory_jobs SET
+		status = $2,
+		error = $3,
+		updated_at = now(),
+		attempts = attempts + CASE WHEN $2 = 'processing' THEN 1 ELSE 0 END,
+		started_at = CASE WHEN $2 = 'processing' THEN COALESCE(started_at, now()) ELSE started_at END,
+		finished_at = CASE WHEN $2 IN ('skipped', 'succeeded', 'failed') THEN now() ELSE finished_at END
+	WHERE req_id = $1`, reqId, status, errMsg)
+	if err != nil {
+		slog.Error("Got this error while updating the status of the memory job", "error", err, "reqId", reqId, "status", status)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		return ErrJobNotFound
+	}
+	return nil
+}
+
+func (s *PostgresStore) GetMemoryJob(reqId string, ctx context.Context) (*types.MemoryJob, error) {
+	job := &types.MemoryJob{}
+	var messages []byte
+	err := s.db.QueryRowContext(ctx, `
+	SELECT req_id, user_id, messages, threshold, status, attempts, error, created_at, updated_at, started_at, finished_at
+	FROM memory_jobs WHERE req_id = $1 AND tenant_id = $2`, reqId, types.TenantId(ctx)).Scan(
+		&job.ReqId, &job.UserId, &messages, &job.Threshold, &job.Status, &job.Attempts, &job.Error,
+		&job.CreatedAt, &job.UpdatedAt, &job.StartedAt, &job.FinishedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrJobNotFound
+		}
+		slog.Error("Got this error while getting the memory job", "error", err, "reqId", reqId)
+		return nil, err
+	}
+	if err := json.Unmarshal(messages, &job.Messages); err != nil {
+		slog.Error("Got this error while unmarshalling the messages of the memory job", "error", err, "reqId", reqId)
+		return nil, err
+	}
+	return job, nil
+}
+
+// InsertMemoryChanges writes all the changes of a job in one transaction, so the audit log never holds half a job.
+func (s *PostgresStore) InsertMemoryChanges(changes []types.MemoryChange, ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Got this error while beginning the transaction for the memory changes", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+	INSERT INTO memory_changes (req_id, tenant_id, user_id, memory_id, memory_type, action, before_text, after_text, reasoning)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`)
+	if err != nil {
+		slog.Error("Got this error while preparing the insert for the memory changes", "error", err)
+		return err
+	}
+	defer stmt.Close()
+	for _, c := range changes {
+		if _, err := stmt.ExecContext(ctx, c.ReqId, types.TenantId(ctx), c.UserId, c.MemoryId, c.MemoryType, c.Action, c.Before, c.After, c.Reasoning); err != nil {
+			slog.Error("Got this error while inserting a memory change", "error", err, "reqId", c.ReqId, "memoryId", c.MemoryId)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetMemoryHistory returns the latest changes made to a user's memories, newest first.
+func (s *PostgresStore) GetMemoryHistory(userId string, limit int, ctx context.Context) ([]types.MemoryChange, error) {
+	rows, err := s.db.QueryContext(ctx, `
+	SELECT id, req_id, user_id, memory_id, memory_type, action, before_text, after_text, reasoning, created_at
+	FROM memory_changes WHERE tenant_id = $1 AND user_id = $2
+	ORDER BY created_at DESC, id DESC
+	LIMIT $3`, types.TenantId(ctx), userId, limit)
+	if err != nil {
+		slog.Error("Got this error while getting the memory history of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	defer rows.Close()
+	changes := []types.MemoryChange{}
+	for rows.Next() {
+		var c types.MemoryChange
+		if err := rows.Scan(&c.Id, &c.ReqId, &c.UserId, &c.MemoryId, &c.MemoryType, &c.Action, &c.Before, &c.After, &c.Reasoning, &c.CreatedAt); err != nil {
+			slog.Error("Got this error while scanning the memory history of the user", "error", err, "userId", userId)
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+// SaveJobSnapshot stores the snapshot of a job, merged into the one it saved before (see MergeJobSnapshots), so a retry
+// of a job that already changed some memories can't lose what they were like before the job.
+func (s *PostgresStore) SaveJobSnapshot(snapshot types.JobSnapshot, ctx context.Context) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Got this error while beginning the transaction for the job snapshot", "error", err, "reqId", snapshot.ReqId)
+		return err
+	}
+	defer tx.Rollback()
+	var stored []byte
+	err = tx.QueryRowContext(ctx, `SELECT snapshot FROM job_snapshots WHERE req_id = $1 AND tenant_id = $2 FOR UPDATE`,
+		snapshot.ReqId, types.TenantId(ctx)).Scan(&stored)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		slog.Error("Got this error while reading the previous job snapshot", "error", err, "reqId", snapshot.ReqId)
+		return err
+	}
+	if err == nil {
+		previous := types.JobSnapshot{}
+		if err := json.Unmarshal(stored, &previous); err != nil {
+			slog.Error("Got this error while unmarshalling the previous job snapshot", "error", err, "reqId", snapshot.ReqId)
+			return err
+		}
+		snapshot = MergeJobSnapshots(previous, snapshot)
+	}
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		slog.Error("Got this error while marshalling the job snapshot", "error", err, "reqId", snapshot.ReqId)
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+	INSERT INTO job_snapshots (req_id, tenant_id, user_id, snapshot) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (req_id) DO UPDATE SET snapshot = EXCLUDED.snapshot, updated_at = now()
+	WHERE job_snapshots.tenant_id = EXCLUDED.tenant_id`,
+		snapshot.ReqId, types.TenantId(ctx), snapshot.UserId, data)
+	if err != nil {
+		slog.Error("Got this error while saving the job snapshot", "error", err, "reqId", snapshot.ReqId)
+		return err
+	}
+	return tx.Commit()
+}
+
+// MergeJobSnapshots merges the snapshot a job is saving into the one it saved before. A memory keeps the first
+// before-image it got, which is what it was like before the job touched it, and the memories the job inserted add up.
+// A memory an earlier attempt inserted didn't exist before the job, so a later attempt deleting or updating it doesn't
+// give it a before-image: reverting the job just removes it.
+func MergeJobSnapshots(previous types.JobSnapshot, snapshot types.JobSnapshot) types.JobSnapshot {
+	inserted := make(map[string]bool)
+	for _, id := range previous.InsertedCoreMemoryIds {
+		inserted[id] = true
+	}
+	for _, id := range previous.InsertedGeneralMemoryIds {
+		inserted[id] = true
+	}
+	mergeMemories := func(previous []types.Memory, next []types.Memory) []types.Memory {
+		merged := slices.Clone(previous)
+		for _, mem := range next {
+			if inserted[mem.Memory_Id] || slices.ContainsFunc(merged, func(m types.Memory) bool { return m.Memory_Id == mem.Memory_Id }) {
+				continue
+			}
+			merged = append(merged, mem)
+		}
+		return merged
+	}
+	mergePoints := func(previous []types.MemoryPoint, next []types.MemoryPoint) []types.MemoryPoint {
+		merged := slices.Clone(previous)
+		for _, p := range next {
+			if inserted[p.Memory.Memory_Id] || slices.ContainsFunc(merged, func(m types.MemoryPoint) bool { return m.Memory.Memory_Id == p.Memory.Memory_Id }) {
+				continue
+			}
+			merged = append(merged, p)
+		}
+		return merged
+	}
+	union := func(previous []string, next []string) []string {
+		merged := slices.Clone(previous)
+		for _, id := range next {
+			if !slices.Contains(merged, id) {
+				merged = append(merged, id)
+			}
+		}
+		return merged
+	}
+	return types.JobSnapshot{
+		ReqId:                    snapshot.ReqId,
+		UserId:                   snapshot.UserId,
+		DeletedCoreMemories:      mergeMemories(previous.DeletedCoreMemories, snapshot.DeletedCoreMemories),
+		InsertedCoreMemoryIds:    union(previous.InsertedCoreMemoryIds, snapshot.InsertedCoreMemoryIds),
+		UpdatedCoreMemories:      mergeMemories(previous.UpdatedCoreMemories, snapshot.UpdatedCoreMemories),
+		DeletedGeneralMemories:   mergePoints(previous.DeletedGeneralMemories, snapshot.DeletedGeneralMemories),
+		InsertedGeneralMemoryIds: union(previous.InsertedGeneralMemoryIds, snapshot.InsertedGeneralMemoryIds),
+		UpdatedGeneralMemories:   mergePoints(previous.UpdatedGeneralMemories, snapshot.UpdatedGeneralMemories),
+	}
+}
+
+func (s *PostgresStore) GetJobSnapshot(reqId string, ctx context.Context) (*types.JobSnapshot, error) {
+	var data []byte
+	err := s.db.QueryRowContext(ctx, `SELECT snapshot FROM job_snapshots WHERE req_id = $1 AND tenant_id = $2`, reqId, types.TenantId(ctx)).Scan(&data)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrSnapshotNotFound
+		}
+		slog.Error("Got this error while getting the job snapshot", "error", err, "reqId", reqId)
+		return nil, err
+	}
+	snapshot := &types.JobSnapshot{}
+	if err := json.Unmarshal(data, snapshot); err != nil {
+		slog.Error("Got this error while unmarshalling the job snapshot", "error", err, "reqId", reqId)
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// DeleteUserRecords deletes every job, change and snapshot of a user in one transaction, and leaves a tombstone of the
+// user behind in the same one. A job of the user that is still running finds its ledger entry gone and the tombstone
+// there, and knows its user was forgotten rather than that it never had an entry.
+func (s *PostgresStore) DeleteUserRecords(userId string, ctx context.Context) (*types.DeletedUserRecords, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Got this error while beginning the transaction for deleting the records of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	defer tx.Rollback()
+	deleted := &types.DeletedUserRecords{}
+	for _, d := range []struct {
+		table string
+		count *int
+	}{
+		{"memory_jobs", &deleted.Jobs},
+		{"memory_changes", &deleted.MemoryChanges},
+		{"job_snapshots", &deleted.Snapshots},
+	} {
+		res, err := tx.ExecContext(ctx, `DELETE FROM `+d.table+` WHERE tenant_id = $1 AND user_id = $2`, types.TenantId(ctx), userId)
+		if err != nil {
+			slog.Error("Got this error while deleting the records of the user", "error", err, "userId", userId, "table", d.table)
+			return nil, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		*d.count = int(n)
+	}
+	if _, err := tx.ExecContext(ctx, `
+	INSERT INTO forgotten_users (tenant_id, user_id) VALUES ($1, $2)
+	ON CONFLICT (tenant_id, user_id) DO UPDATE SET forgotten_at = now()`, types.TenantId(ctx), userId); err != nil {
+		slog.Error("Got this error while leaving the tombstone of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		slog.Error("Got this error while committing the deletion of the records of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	return deleted, nil
+}
+
+func (s *PostgresStore) UserForgotten(userId string, ctx context.Context) (bool, error) {
+	var forgotten bool
+	err := s.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM forgotten_users WHERE tenant_id = $1 AND user_id = $2)`,
+		types.TenantId(ctx), userId).Scan(&forgotten)
+	if err != nil {
+		slog.Error("Got this error while looking for the tombstone of the user", "error", err, "userId", userId)
+		return false, err
+	}
+	return forgotten, nil
+}
+
+func (s *PostgresStore) InsertAPIKey(key types.APIKey, keyHash string, ctx context.Context) error {
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO api_keys (id, tenant_id, name, key_hash) VALUES ($1, $2, $3, $4)`,
+		key.Id, key.TenantId, key.Name, keyHash)
+	if err != nil {
+		slog.Error("Got this error while inserting the api key", "error", err, "tenantId", key.TenantId)
+		return err
+	}
+	return nil
+}
+
+// GetAPIKeyByHash looks up a key that hasn't been revoked by the hash of the key.
+func (s *PostgresStore) GetAPIKeyByHash(keyHash string, ctx context.Context) (*types.APIKey, error) {
+	key := &types.APIKey{}
+	err := s.db.QueryRowContext(ctx, `
+	SELECT id, tenant_id, name, created_at, revoked_at FROM api_keys
+	WHERE key_hash = $1 AND revoked_at IS NULL`, keyHash).Scan(&key.Id, &key.TenantId, &key.Name, &key.CreatedAt, &key.RevokedAt)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, ErrAPIKeyNotFound
+		}
+		slog.Error("Got this error while getting the api key", "error", err)
+		return nil, err
+	}
+	return key, nil
+}
+
+func (s *PostgresStore) DeleteJobRecords(reqId string, ctx context.Context) error {
+	for _, table := range []string{"memory_changes", "job_snapshots"} {
+		if _, err := s.db.ExecContext(ctx, `DELETE FROM `+table+` WHERE req_id = $1 AND tenant_id = $2`, reqId, types.TenantId(ctx)); err != nil {
+			slog.Error("Got this error while deleting the records of the job", "error", err, "reqId", reqId, "table", table)
+			return err
+		}
+	}
 	return nil
 }
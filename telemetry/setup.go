@@ -12,13 +12,13 @@ import (
 )
 
 // InitTracer initializes the OTel SDK
-func InitTracer(serviceName string) (func(context.Context) error, error) {
+func InitTracer(serviceName string, endpoint string) (func(context.Context) error, error) {
 	ctx := context.Background()
 
-	// Configure the OTLP HTTP exporter to send traces to Jaeger (localhost:4318)
+	// Configure the OTLP HTTP exporter to send traces to Jaeger (localhost:4318 locally)
 	exporter, err := otlptracehttp.New(ctx,
 		otlptracehttp.WithInsecure(), // Use HTTP, not HTTPS for local Jaeger
-		otlptracehttp.WithEndpoint("localhost:4318"),
+		otlptracehttp.WithEndpoint(endpoint),
 	)
 	if err != nil {
 		return nil, err
@@ -1,11 +1,20 @@
 package types
 
+import (
+	"context"
+	"time"
+)
+
 type MemoryRetrievalRequest struct {
 	UserId    string    `json:"userId"`
 	Messages  []Message `json:"messages,omitempty"`
 	UserQuery string    `json:"query,omitempty"`
 	Threshold float32   `json:"threshold,omitempty"`
-	ReqId     string
+	// Limit caps the number of general memories returned, the vector db's default when left out.
+	Limit int `json:"limit,omitempty"`
+	// Debug answers with a RetrievalDebug instead of the plain list of memories.
+	Debug bool `json:"debug,omitempty"`
+	ReqId string
 }
 
 type InsertMemoryRequest struct {
@@ -18,14 +27,64 @@ type GetAllUserMemoriesRequest struct {
 }
 
 type DeleteMemoryRequest struct {
-	UserId    string   `json:"userId"`
-	MemoryIds []string `json:"memoryId"`
+	UserId        string   `json:"userId"`
+	MemoryIds     []string `json:"memoryId"`
+	CoreMemoryIds []string `json:"coreMemoryId"`
+}
+
+// MemoryWriteRequest creates (type and text) or edits (text only) a single memory without going through the archivist.
+type MemoryWriteRequest struct {
+	Type MemoryType `json:"type,omitempty"`
+	Text string     `json:"text"`
 }
 
-const UserIdKey ctxKey = iota
+type DeletionStatus string
+
+const (
+	DeletionStatusDeleted   DeletionStatus = "deleted"
+	DeletionStatusNotFound  DeletionStatus = "not_found"
+	DeletionStatusForbidden DeletionStatus = "forbidden" //the memory exists but belongs to another user
+)
+
+// MemoryDeletionResult is what happened to a single memory id of a DeleteMemoryRequest.
+type MemoryDeletionResult struct {
+	MemoryId   string         `json:"memoryId"`
+	MemoryType MemoryType     `json:"memoryType"`
+	Status     DeletionStatus `json:"status"`
+}
+
+const (
+	UserIdKey ctxKey = iota
+	TenantIdKey
+)
 
 type ctxKey int
 
+// DefaultTenantId owns everything stored before tenants existed and every request when authentication is disabled.
+const DefaultTenantId = "default"
+
+// WithTenantId scopes ctx to a tenant, every store reads the tenant back from the context it is handed.
+func WithTenantId(ctx context.Context, tenantId string) context.Context {
+	return context.WithValue(ctx, TenantIdKey, tenantId)
+}
+
+// TenantId returns the tenant ctx is scoped to, the default tenant if it isn't scoped to any.
+func TenantId(ctx context.Context) string {
+	if tenantId, ok := ctx.Value(TenantIdKey).(string); ok && tenantId != "" {
+		return tenantId
+	}
+	return DefaultTenantId
+}
+
+// APIKey is a key a tenant authenticates with. Only the hash of the key itself is ever stored.
+type APIKey struct {
+	Id        string     `json:"id"`
+	TenantId  string     `json:"tenantId"`
+	Name      string     `json:"name"`
+	CreatedAt time.Time  `json:"createdAt"`
+	RevokedAt *time.Time `json:"revokedAt,omitempty"`
+}
+
 type Role string
 
 const (
@@ -41,11 +100,135 @@ type Message struct {
 
 type MemoryInsertionJob struct {
 	ReqId     string
+	TenantId  string
 	UserId    string
 	Messages  []Message
 	Threshold float32
 }
 
+type JobStatus string
+
+const (
+	JobStatusQueued     JobStatus = "queued"
+	JobStatusProcessing JobStatus = "processing"
+	JobStatusRetrying   JobStatus = "retrying"
+	JobStatusSkipped    JobStatus = "skipped"
+	JobStatusSucceeded  JobStatus = "succeeded"
+	JobStatusFailed     JobStatus = "failed"
+	JobStatusReverted   JobStatus = "reverted"
+)
+
+// DeadLetterJob is a job that failed for good, as published on the dead-letter subject.
+type DeadLetterJob struct {
+	Seq      uint64             `json:"seq,omitempty"` //sequence of the message in the dead-letter stream, filled in when reading it back
+	Job      MemoryInsertionJob `json:"job"`
+	Reason   string             `json:"reason"`
+	Attempts int                `json:"attempts"`
+	FailedAt time.Time          `json:"failedAt"`
+}
+
+// MemoryJob is the ledger entry of a MemoryInsertionJob as stored by the storage package.
+type MemoryJob struct {
+	ReqId      string     `json:"reqId"`
+	UserId     string     `json:"userId"`
+	Messages   []Message  `json:"messages"`
+	Threshold  float32    `json:"threshold"`
+	Status     JobStatus  `json:"status"`
+	Attempts   int        `json:"attempts"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+}
+
+// MemoryChange is a single INSERT/UPDATE/DELETE/MERGE applied to a user's memories, by a job or through the API, kept as an audit trail.
+type MemoryChange struct {
+	Id         int64      `json:"id"`
+	ReqId      string     `json:"reqId"`
+	UserId     string     `json:"userId"`
+	MemoryId   string     `json:"memoryId"`
+	MemoryType MemoryType `json:"memoryType"`
+	Action     string     `json:"action"`
+	Before     *string    `json:"before"`
+	After      *string    `json:"after"`
+	Reasoning  string     `json:"reasoning"`
+	CreatedAt  time.Time  `json:"createdAt"`
+}
+
+// JobSnapshot holds what a job destroyed and created, captured before it touched anything, so the job can be reverted.
+type JobSnapshot struct {
+	ReqId                    string        `json:"reqId"`
+	UserId                   string        `json:"userId"`
+	DeletedCoreMemories      []Memory      `json:"deletedCoreMemories"`
+	InsertedCoreMemoryIds    []string      `json:"insertedCoreMemoryIds"`
+	UpdatedCoreMemories      []Memory      `json:"updatedCoreMemories,omitempty"` //as they were before the update
+	DeletedGeneralMemories   []MemoryPoint `json:"deletedGeneralMemories"`
+	InsertedGeneralMemoryIds []string      `json:"insertedGeneralMemoryIds"`
+	UpdatedGeneralMemories   []MemoryPoint `json:"updatedGeneralMemories,omitempty"` //as they were before the update
+}
+
+// UserCoreMemories are the core memories of a user of a tenant at some version, as kept in Postgres.
+type UserCoreMemories struct {
+	TenantId string   `json:"tenantId"`
+	UserId   string   `json:"userId"`
+	Memories []Memory `json:"memories"`
+	Version  int64    `json:"version"`
+}
+
+// DeletedUserRecords counts the rows of a user that were deleted from Postgres.
+type DeletedUserRecords struct {
+	Jobs          int `json:"jobs"`
+	MemoryChanges int `json:"memoryChanges"`
+	Snapshots     int `json:"snapshots"`
+}
+
+// UserDeletionReceipt is handed back once everything GoMemory held about a user has been erased.
+type UserDeletionReceipt struct {
+	ReceiptId       string    `json:"receiptId"`
+	TenantId        string    `json:"tenantId"`
+	UserId          string    `json:"userId"`
+	GeneralMemories int       `json:"generalMemories"`
+	CoreMemories    int       `json:"coreMemories"`
+	QueuedJobs      int       `json:"queuedJobs"`
+	DeadLetters     int       `json:"deadLetters"`
+	DeletedAt       time.Time `json:"deletedAt"`
+	DeletedUserRecords
+}
+
+// MemoryBundle is the portable form of all the memories of a user, as exported and imported by GoMemory. As JSONL the
+// bundle without its memories is the first line and every memory a line of its own.
+type MemoryBundle struct {
+	Version        int            `json:"version"`
+	UserId         string         `json:"userId"`
+	EmbeddingModel string         `json:"embeddingModel,omitempty"` //the model the vectors were made with
+	ExportedAt     time.Time      `json:"exportedAt"`
+	Memories       []BundleMemory `json:"memories,omitempty"`
+}
+
+// BundleMemory is a memory of a MemoryBundle. Only general memories have vectors, and only if they were asked for.
+type BundleMemory struct {
+	Memory Memory           `json:"memory"`
+	Dense  *DenseEmbedding  `json:"dense,omitempty"`
+	Sparse *SparseEmbedding `json:"sparse,omitempty"`
+}
+
+type ImportResult struct {
+	UserId          string `json:"userId"`
+	CoreMemories    int    `json:"coreMemories"`
+	GeneralMemories int    `json:"generalMemories"`
+	Reembedded      int    `json:"reembedded"` //general memories whose vectors were missing or made with another model
+}
+
+type JobRevertResult struct {
+	ReqId                   string `json:"reqId"`
+	RestoredCoreMemories    int    `json:"restoredCoreMemories"`
+	RemovedCoreMemories     int    `json:"removedCoreMemories"`
+	RestoredGeneralMemories int    `json:"restoredGeneralMemories"`
+	RemovedGeneralMemories  int    `json:"removedGeneralMemories"`
+	UndoneUpdates           int    `json:"undoneUpdates"`
+}
+
 type DenseEmbedding struct {
 	Values []float32 `json:"values"`
 }
@@ -66,6 +249,71 @@ type Memory struct {
 	Type        MemoryType
 	Memory_Id   string
 	UserId      string
+	// When the memory was first written and last changed. Memories written before GoMemory kept track of this have
+	// neither.
+	CreatedAt time.Time `json:"CreatedAt,omitzero"`
+	UpdatedAt time.Time `json:"UpdatedAt,omitzero"`
+	// The request that last wrote the memory and an excerpt of the user message it was taken from.
+	SourceReqId   string `json:"SourceReqId,omitempty"`
+	SourceExcerpt string `json:"SourceExcerpt,omitempty"`
+	// The core memories this one was consolidated from, if it was.
+	MergedFrom []string `json:"MergedFrom,omitempty"`
+	// Only set on the general memories a search returns: the fused score they were ranked with and, when asked for,
+	// how each stage of the search ranked them.
+	Score       float32               `json:"Score,omitempty"`
+	Explanation *RetrievalExplanation `json:"Explanation,omitempty"`
+}
+
+// StageMatch is where one stage of the hybrid search ranked a memory. Ranks start at 1.
+type StageMatch struct {
+	Rank  int     `json:"rank"`
+	Score float32 `json:"score"`
+}
+
+// RetrievalExplanation tells how the dense and the sparse stage of the hybrid search ranked a memory, a stage that
+// didn't return the memory at all is left out.
+type RetrievalExplanation struct {
+	Dense  *StageMatch `json:"dense,omitempty"`
+	Sparse *StageMatch `json:"sparse,omitempty"`
+}
+
+// MemoryPage is a page of the memories of a user, NextCursor fetches the next one and is empty after the last page.
+type MemoryPage struct {
+	Memories   []Memory `json:"memories"`
+	NextCursor string   `json:"nextCursor,omitempty"`
+}
+
+// RetrievalStage is a part of the read path that can fail on its own without failing the whole retrieval.
+type RetrievalStage string
+
+const (
+	RetrievalStageCore    RetrievalStage = "core_memories"
+	RetrievalStageGeneral RetrievalStage = "general_memories"
+)
+
+// RetrievalResult is what a memory search found: the core memories of the user followed by the matching general ones.
+// When one stage fails or runs out of time the memories of the other are still returned, Partial is set and
+// FailedStages says which part is missing.
+type RetrievalResult struct {
+	Memories     []Memory         `json:"memories"`
+	Partial      bool             `json:"partial,omitempty"`
+	FailedStages []RetrievalStage `json:"failedStages,omitempty"`
+}
+
+// RetrievalDebug is what /get_memory answers with in debug mode.
+type RetrievalDebug struct {
+	Query         string  `json:"query"`         //the query GoMemory built from the request
+	EmbeddedQuery string  `json:"embeddedQuery"` //the text that was actually embedded
+	Threshold     float32 `json:"threshold"`
+	RetrievalResult
+}
+
+// MemoryPoint is a general memory along with the vectors it is indexed by in the vector db.
+type MemoryPoint struct {
+	TenantId string          `json:"tenantId,omitempty"`
+	Memory   Memory          `json:"memory"`
+	Dense    DenseEmbedding  `json:"dense"`
+	Sparse   SparseEmbedding `json:"sparse"`
 }
 
 type MemoryOutput struct {
@@ -79,3 +327,15 @@ type MemoryAction struct {
 	Payload        *string `json:"payload"`
 	TargetMemoryID *string `json:"target_memory_id"`
 }
+
+// ConsolidationOutput is what the LLM answers with when asked to consolidate the core memories of a user.
+type ConsolidationOutput struct {
+	Reasoning string            `json:"step_1 critical_reasoning"`
+	Merges    []CoreMemoryMerge `json:"step_2 merges"`
+}
+
+// CoreMemoryMerge replaces the core memories it was made from with a single one holding all of what they said.
+type CoreMemoryMerge struct {
+	SourceMemoryIds []string `json:"source_memory_ids"`
+	Payload         string   `json:"payload"`
+}
@@ -0,0 +1,326 @@
+package vectordb
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+)
+
+// Qdrant scores the i-th (0-based) result of every prefetch with 1/(i+2) under RRF fusion.
+const rrfK = 2
+
+// InMemoryMemoryDB is an in-process VectorDB for tests, demos and single binary deployments. Search mirrors what
+// GetSimilarMemories asks of Qdrant: a dense cosine and a sparse dot product stage fused with reciprocal rank fusion.
+// When Path is set every write is persisted to that file and the points are loaded back from it on start.
+type InMemoryMemoryDB struct {
+	mu     sync.RWMutex
+	points map[string]types.MemoryPoint
+	Path   string
+}
+
+func NewInMemoryMemoryDB(path string) (*InMemoryMemoryDB, error) {
+	db := &InMemoryMemoryDB{
+		points: make(map[string]types.MemoryPoint),
+		Path:   path,
+	}
+	if path == "" {
+		return db, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			slog.Info("No memory file found, starting with an empty in-memory vector db", "path", path)
+			return db, nil
+		}
+		slog.Error("Got this error while reading the memory file", "error", err, "path", path)
+		return nil, err
+	}
+	var points []types.MemoryPoint
+	if err := json.Unmarshal(data, &points); err != nil {
+		slog.Error("Got this error while unmarshalling the memory file", "error", err, "path", path)
+		return nil, err
+	}
+	for _, p := range points {
+		db.points[p.Memory.Memory_Id] = p
+	}
+	slog.Info("Loaded the in-memory vector db from file", "path", path, "memories", len(points))
+	return db, nil
+}
+
+type scoredPoint struct {
+	id    string
+	score float32
+}
+
+func (db *InMemoryMemoryDB) GetSimilarMemories(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, threshold float32, limit int, ctx context.Context) ([]types.Memory, error) {
+	ctx, span := Tracer.Start(ctx, "Vector Search for Memories")
+	defer span.End()
+	limit, stageLimit := searchLimits(limit)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	dense, sparse := db.searchStages(DenseEmbedding, SparseEmbedding, userId, stageLimit, ctx)
+	fused := make(map[string]float32)
+	for _, stage := range [][]scoredPoint{sparse, dense} {
+		for rank, sp := range stage {
+			fused[sp.id] += 1 / float32(rank+rrfK)
+		}
+	}
+	var results []scoredPoint
+	for id, score := range fused {
+		if score >= threshold {
+			results = append(results, scoredPoint{id, score})
+		}
+	}
+	var Memories []types.Memory
+	for _, r := range topK(results, limit) {
+		mem := db.points[r.id].Memory
+		mem.Score = r.score
+		Memories = append(Memories, mem)
+	}
+	if len(Memories) == 0 {
+		slog.Info("No Memories of the user found", "userId", userId)
+		return nil, nil
+	}
+	return Memories, nil
+}
+
+func (db *InMemoryMemoryDB) ExplainSimilarMemories(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, limit int, ctx context.Context) (map[string]types.RetrievalExplanation, error) {
+	ctx, span := Tracer.Start(ctx, "Explaining Vector Search for Memories")
+	defer span.End()
+	_, stageLimit := searchLimits(limit)
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	dense, sparse := db.searchStages(DenseEmbedding, SparseEmbedding, userId, stageLimit, ctx)
+	explanations := make(map[string]types.RetrievalExplanation)
+	for rank, sp := range dense {
+		e := explanations[sp.id]
+		e.Dense = &types.StageMatch{Rank: rank + 1, Score: sp.score}
+		explanations[sp.id] = e
+	}
+	for rank, sp := range sparse {
+		e := explanations[sp.id]
+		e.Sparse = &types.StageMatch{Rank: rank + 1, Score: sp.score}
+		explanations[sp.id] = e
+	}
+	return explanations, nil
+}
+
+// searchStages returns the stageLimit best matches of the user's points for the dense and the sparse stage of the
+// search, best first. Callers must hold the read lock.
+func (db *InMemoryMemoryDB) searchStages(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, stageLimit int, ctx context.Context) ([]scoredPoint, []scoredPoint) {
+	var dense, sparse []scoredPoint
+	for id, p := range db.points {
+		if !ownedBy(p, userId, ctx) {
+			continue
+		}
+		dense = append(dense, scoredPoint{id, cosine(DenseEmbedding.Values, p.Dense.Values)})
+		// like Qdrant, points that share no index with the query are not part of the sparse results
+		if score, ok := sparseDot(SparseEmbedding, p.Sparse); ok {
+			sparse = append(sparse, scoredPoint{id, score})
+		}
+	}
+	return topK(dense, stageLimit), topK(sparse, stageLimit)
+}
+
+func (db *InMemoryMemoryDB) GetAllUserMemories(userId string, ctx context.Context) ([]types.Memory, error) {
+	ctx, span := Tracer.Start(ctx, "Getting All User Memories")
+	defer span.End()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var Memories []types.Memory
+	for _, p := range db.points {
+		if ownedBy(p, userId, ctx) {
+			Memories = append(Memories, p.Memory)
+		}
+	}
+	// map order is random, ids keep the listing stable like a Qdrant scroll
+	slices.SortFunc(Memories, func(a, b types.Memory) int {
+		return cmp.Compare(a.Memory_Id, b.Memory_Id)
+	})
+	return Memories, nil
+}
+
+func (db *InMemoryMemoryDB) ListUserMemories(userId string, limit int, offset string, ctx context.Context) ([]types.Memory, string, error) {
+	all, err := db.GetAllUserMemories(userId, ctx)
+	if err != nil {
+		return nil, "", err
+	}
+	// like a Qdrant scroll the offset is the id of the first memory of the page
+	start, _ := slices.BinarySearchFunc(all, offset, func(m types.Memory, id string) int {
+		return cmp.Compare(m.Memory_Id, id)
+	})
+	all = all[start:]
+	if len(all) <= limit {
+		return all, "", nil
+	}
+	return all[:limit], all[limit].Memory_Id, nil
+}
+
+func (db *InMemoryMemoryDB) DeleteMemories(memoryIds []string, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Deleting Memories from the in-memory db")
+	defer span.End()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var found []string
+	for _, id := range memoryIds {
+		if p, ok := db.points[id]; ok && pointTenant(p) == types.TenantId(ctx) {
+			found = append(found, id)
+		}
+	}
+	if len(found) != len(memoryIds) {
+		slog.Info("LLM Probably hallucinated and gave an invalid memory id ... it doesn't exist in the db")
+	}
+	if len(found) == 0 {
+		slog.Info("No points found!", "points", memoryIds)
+		return errors.New("No points found!")
+	}
+	for _, id := range found {
+		delete(db.points, id)
+	}
+	return db.persist()
+}
+
+func (db *InMemoryMemoryDB) DeleteUserMemories(userId string, ctx context.Context) (int, error) {
+	ctx, span := Tracer.Start(ctx, "Deleting All User Memories from the in-memory db")
+	defer span.End()
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	deleted := 0
+	for id, p := range db.points {
+		if ownedBy(p, userId, ctx) {
+			delete(db.points, id)
+			deleted++
+		}
+	}
+	if deleted == 0 {
+		return 0, nil
+	}
+	return deleted, db.persist()
+}
+
+func (db *InMemoryMemoryDB) GetMemoriesByIds(memoryIds []string, ctx context.Context) ([]types.MemoryPoint, error) {
+	ctx, span := Tracer.Start(ctx, "Getting Memories by Ids from the in-memory db")
+	defer span.End()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var points []types.MemoryPoint
+	for _, id := range memoryIds {
+		if p, ok := db.points[id]; ok && pointTenant(p) == types.TenantId(ctx) {
+			points = append(points, p)
+		}
+	}
+	return points, nil
+}
+
+func (db *InMemoryMemoryDB) UpsertMemories(points []types.MemoryPoint, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Upserting Memories into the in-memory db")
+	defer span.End()
+	if len(points) == 0 {
+		return nil
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, p := range points {
+		if existing, ok := db.points[p.Memory.Memory_Id]; ok && pointTenant(existing) != types.TenantId(ctx) {
+			slog.Warn("Not overwriting a memory of another tenant", "id", p.Memory.Memory_Id)
+			continue
+		}
+		p.TenantId = types.TenantId(ctx)
+		db.points[p.Memory.Memory_Id] = p
+	}
+	return db.persist()
+}
+
+// persist writes all the points to Path through a temporary file, so a crash mid-write never leaves a torn file
+// behind. Callers must hold the write lock.
+func (db *InMemoryMemoryDB) persist() error {
+	if db.Path == "" {
+		return nil
+	}
+	points := make([]types.MemoryPoint, 0, len(db.points))
+	for _, p := range db.points {
+		points = append(points, p)
+	}
+	data, err := json.Marshal(points)
+	if err != nil {
+		slog.Error("Got this error while marshalling the in-memory vector db", "error", err)
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(db.Path), filepath.Base(db.Path)+".tmp")
+	if err != nil {
+		slog.Error("Got this error while creating the temporary memory file", "error", err, "path", db.Path)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		slog.Error("Got this error while writing the memory file", "error", err, "path", db.Path)
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), db.Path)
+}
+
+// pointTenant is the tenant a point belongs to, points persisted before tenants existed belong to the default one.
+func pointTenant(p types.MemoryPoint) string {
+	if p.TenantId == "" {
+		return types.DefaultTenantId
+	}
+	return p.TenantId
+}
+
+func ownedBy(p types.MemoryPoint, userId string, ctx context.Context) bool {
+	return p.Memory.UserId == userId && pointTenant(p) == types.TenantId(ctx)
+}
+
+func cosine(a, b []float32) float32 {
+	var dot, normA, normB float64
+	for i := range min(len(a), len(b)) {
+		dot += float64(a[i]) * float64(b[i])
+		normA += float64(a[i]) * float64(a[i])
+		normB += float64(b[i]) * float64(b[i])
+	}
+	if normA == 0 || normB == 0 {
+		return 0
+	}
+	return float32(dot / (math.Sqrt(normA) * math.Sqrt(normB)))
+}
+
+// sparseDot returns the dot product of two sparse vectors and whether they share any index at all.
+func sparseDot(a, b types.SparseEmbedding) (float32, bool) {
+	bValues := make(map[uint32]float32, len(b.Indices))
+	for i, idx := range b.Indices {
+		bValues[idx] = b.Values[i]
+	}
+	var score float32
+	overlap := false
+	for i, idx := range a.Indices {
+		if v, ok := bValues[idx]; ok {
+			score += a.Values[i] * v
+			overlap = true
+		}
+	}
+	return score, overlap
+}
+
+// topK sorts by score, highest first, ties broken by id so results are deterministic, and keeps the first k.
+func topK(points []scoredPoint, k int) []scoredPoint {
+	slices.SortFunc(points, func(a, b scoredPoint) int {
+		if c := cmp.Compare(b.score, a.score); c != 0 {
+			return c
+		}
+		return cmp.Compare(a.id, b.id)
+	})
+	return points[:min(k, len(points))]
+}
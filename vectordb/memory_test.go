@@ -0,0 +1,211 @@
+package vectordb
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/Prateek-Gupta001/GoMemory/embed"
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// upsertMemories writes the memories of the user of the tenant of ctx under the ids derived from their text and
+// returns the ids.
+func upsertMemories(t *testing.T, db *InMemoryMemoryDB, userId string, ctx context.Context, memories ...string) []string {
+	dense, sparse, err := embed.NewFakeEmbedder().GenerateEmbeddings(memories, ctx)
+	require.NoError(t, err)
+	points := make([]types.MemoryPoint, len(memories))
+	ids := make([]string, len(memories))
+	for idx, text := range memories {
+		ids[idx] = MemoryId(text, userId, ctx)
+		points[idx] = types.MemoryPoint{
+			TenantId: types.TenantId(ctx),
+			Memory:   types.Memory{Memory_text: text, Type: types.MemoryTypeGeneral, Memory_Id: ids[idx], UserId: userId},
+			Dense:    dense[idx],
+			Sparse:   sparse[idx],
+		}
+	}
+	require.NoError(t, db.UpsertMemories(points, ctx))
+	return ids
+}
+
+func seedInMemoryDB(t *testing.T, db *InMemoryMemoryDB, userId string, memories ...string) []string {
+	return upsertMemories(t, db, userId, t.Context(), memories...)
+}
+
+func queryInMemoryDB(t *testing.T, db *InMemoryMemoryDB, query string, userId string, threshold float32) []string {
+	dense, sparse, err := embed.NewFakeEmbedder().GenerateEmbeddings([]string{"_Query_" + query}, t.Context())
+	require.NoError(t, err)
+	memories, err := db.GetSimilarMemories(dense[0], sparse[0], userId, threshold, 0, t.Context())
+	require.NoError(t, err)
+	var texts []string
+	for _, m := range memories {
+		texts = append(texts, m.Memory_text)
+	}
+	return texts
+}
+
+func TestInMemoryGetSimilarMemories(t *testing.T) {
+	db, err := NewInMemoryMemoryDB("")
+	require.NoError(t, err)
+	seedInMemoryDB(t, db, "user_123", "User lives in Paris", "User drives a Honda Civic", "User is vegetarian")
+	seedInMemoryDB(t, db, "user_456", "User lives in Paris")
+
+	// the top result of both stages scores 1/2 + 1/2
+	assert.Equal(t, []string{"User lives in Paris"}, queryInMemoryDB(t, db, "where does the user live, Paris?", "user_123", 0.9))
+
+	all := queryInMemoryDB(t, db, "where does the user live, Paris?", "user_123", 0)
+	assert.Len(t, all, 3)
+	assert.Equal(t, "User lives in Paris", all[0])
+
+	assert.Empty(t, queryInMemoryDB(t, db, "Paris", "user_789", 0))
+}
+
+func TestInMemoryExplainSimilarMemories(t *testing.T) {
+	db, err := NewInMemoryMemoryDB("")
+	require.NoError(t, err)
+	ids := seedInMemoryDB(t, db, "user_123", "User lives in Paris", "User drives a Honda Civic", "User is vegetarian")
+	dense, sparse, err := embed.NewFakeEmbedder().GenerateEmbeddings([]string{"_Query_where does the user live, Paris?"}, t.Context())
+	require.NoError(t, err)
+
+	memories, err := db.GetSimilarMemories(dense[0], sparse[0], "user_123", 0, 0, t.Context())
+	require.NoError(t, err)
+	require.Len(t, memories, 3)
+	assert.Equal(t, float32(1), memories[0].Score, "the top result of both stages scores 1/2 + 1/2")
+	assert.Greater(t, memories[0].Score, memories[1].Score)
+
+	explanations, err := db.ExplainSimilarMemories(dense[0], sparse[0], "user_123", 0, t.Context())
+	require.NoError(t, err)
+	paris := explanations[ids[0]]
+	require.NotNil(t, paris.Dense)
+	require.NotNil(t, paris.Sparse)
+	assert.Equal(t, 1, paris.Dense.Rank)
+	assert.Equal(t, 1, paris.Sparse.Rank)
+	assert.Len(t, explanations, 3)
+
+	others, err := db.ExplainSimilarMemories(dense[0], sparse[0], "user_456", 0, t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, others)
+}
+
+func TestInMemoryLimitsAndPages(t *testing.T) {
+	db, err := NewInMemoryMemoryDB("")
+	require.NoError(t, err)
+	var texts []string
+	for i := range 25 {
+		texts = append(texts, fmt.Sprintf("User visited Paris in %d", 2000+i))
+	}
+	seedInMemoryDB(t, db, "user_123", texts...)
+
+	assert.Len(t, queryInMemoryDB(t, db, "Paris", "user_123", 0), DefaultSearchLimit)
+	dense, sparse, err := embed.NewFakeEmbedder().GenerateEmbeddings([]string{"_Query_Paris"}, t.Context())
+	require.NoError(t, err)
+	memories, err := db.GetSimilarMemories(dense[0], sparse[0], "user_123", 0, 20, t.Context())
+	require.NoError(t, err)
+	assert.Len(t, memories, 20, "a limit above the default widens the stages as well")
+
+	var listed []string
+	offset := ""
+	for pages := 0; ; pages++ {
+		require.Less(t, pages, 3)
+		page, next, err := db.ListUserMemories("user_123", 10, offset, t.Context())
+		require.NoError(t, err)
+		for _, m := range page {
+			listed = append(listed, m.Memory_text)
+		}
+		if next == "" {
+			break
+		}
+		offset = next
+	}
+	assert.ElementsMatch(t, texts, listed)
+}
+
+func TestInMemoryDeleteAndUpsert(t *testing.T) {
+	db, err := NewInMemoryMemoryDB("")
+	require.NoError(t, err)
+	ids := seedInMemoryDB(t, db, "user_123", "User lives in Paris", "User is vegetarian")
+
+	points, err := db.GetMemoriesByIds(append(ids, "missing"), t.Context())
+	require.NoError(t, err)
+	require.Len(t, points, 2)
+
+	require.NoError(t, db.DeleteMemories(ids[:1], t.Context()))
+	assert.Error(t, db.DeleteMemories([]string{"missing"}, t.Context()))
+	all, err := db.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, []types.Memory{points[1].Memory}, all)
+
+	require.NoError(t, db.UpsertMemories(points[:1], t.Context()))
+	restored, err := db.GetMemoriesByIds(ids[:1], t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, points[:1], restored)
+}
+
+func TestInMemoryPersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "memories.json")
+	db, err := NewInMemoryMemoryDB(path)
+	require.NoError(t, err)
+	ids := seedInMemoryDB(t, db, "user_123", "User lives in Paris", "User is vegetarian")
+	require.NoError(t, db.DeleteMemories(ids[1:], t.Context()))
+
+	reopened, err := NewInMemoryMemoryDB(path)
+	require.NoError(t, err)
+	all, err := reopened.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	require.Len(t, all, 1)
+	assert.Equal(t, "User lives in Paris", all[0].Memory_text)
+	assert.Equal(t, []string{"User lives in Paris"}, queryInMemoryDB(t, reopened, "Paris", "user_123", 0))
+}
+
+func TestInMemoryTenantIsolation(t *testing.T) {
+	db, err := NewInMemoryMemoryDB("")
+	require.NoError(t, err)
+	acme := types.WithTenantId(t.Context(), "acme")
+	acmeIds := upsertMemories(t, db, "user_123", acme, "User lives in Paris")
+	defaultIds := seedInMemoryDB(t, db, "user_123", "User lives in Paris")
+	assert.NotEqual(t, acmeIds, defaultIds)
+
+	all, err := db.GetAllUserMemories("user_123", acme)
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+	points, err := db.GetMemoriesByIds(acmeIds, t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, points)
+	assert.Error(t, db.DeleteMemories(acmeIds, t.Context()))
+	require.NoError(t, db.DeleteMemories(acmeIds, acme))
+	all, err = db.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Len(t, all, 1)
+}
+
+func TestInMemoryDeleteUserMemories(t *testing.T) {
+	db, err := NewInMemoryMemoryDB("")
+	require.NoError(t, err)
+	seedInMemoryDB(t, db, "user_123", "User lives in Paris", "User is vegetarian")
+	seedInMemoryDB(t, db, "user_456", "User lives in Paris")
+
+	deleted, err := db.DeleteUserMemories("user_123", types.WithTenantId(t.Context(), "acme"))
+	require.NoError(t, err)
+	assert.Zero(t, deleted, "another tenant can't forget the user")
+	deleted, err = db.DeleteUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Equal(t, 2, deleted)
+
+	all, err := db.GetAllUserMemories("user_123", t.Context())
+	require.NoError(t, err)
+	assert.Empty(t, all)
+	other, err := db.GetAllUserMemories("user_456", t.Context())
+	require.NoError(t, err)
+	assert.Len(t, other, 1)
+}
+
+func TestMemoryIdIsUnambiguous(t *testing.T) {
+	acme := types.WithTenantId(t.Context(), "acme")
+	assert.NotEqual(t, MemoryId("User lives in Paris", "u", acme), MemoryId("User lives in Paris", "u\x00acme", t.Context()), "a userId can't pose as another tenant")
+	assert.NotEqual(t, MemoryId("User lives in Parisu", "", t.Context()), MemoryId("User lives in Paris", "u", t.Context()), "nor can text pose as the userId")
+	assert.Equal(t, MemoryId("User lives in Paris", "u", acme), MemoryId("User lives in Paris", "u", acme))
+}
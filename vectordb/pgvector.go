@@ -0,0 +1,400 @@
+package vectordb
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/lib/pq"
+)
+
+const (
+	// BAAI/bge-small-en-v1.5
+	denseDimension = 384
+	// vocabulary size of the SPLADE model the sparse vectors come from
+	sparseDimension = 30522
+)
+
+// PgVectorMemoryDB keeps the general memories in Postgres using the pgvector extension (0.7 or newer, for sparsevec),
+// so deployments that already run Postgres for the storage package don't have to run Qdrant as well.
+type PgVectorMemoryDB struct {
+	db *sql.DB
+}
+
+func NewPgVectorMemoryDB(db *sql.DB) (*PgVectorMemoryDB, error) {
+	pg := &PgVectorMemoryDB{
+		db: db,
+	}
+	if err := pg.Init(); err != nil {
+		slog.Error("Got this error while trying to create the pgvector tables", "error", err)
+		return nil, err
+	}
+	return pg, nil
+}
+
+// Init enables pgvector and creates the memories table and its indexes if they don't exist yet.
+func (pg *PgVectorMemoryDB) Init() error {
+	query := fmt.Sprintf(`
+	CREATE EXTENSION IF NOT EXISTS vector;
+
+	CREATE TABLE IF NOT EXISTS general_memories (
+		id         TEXT PRIMARY KEY,
+		user_id    TEXT NOT NULL,
+		memory     TEXT NOT NULL,
+		dense      vector(%d) NOT NULL,
+		sparse     sparsevec(%d) NOT NULL,
+		created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+		updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+	);
+	ALTER TABLE general_memories ADD COLUMN IF NOT EXISTS tenant_id TEXT NOT NULL DEFAULT 'default';
+	ALTER TABLE general_memories ADD COLUMN IF NOT EXISTS source_req_id TEXT NOT NULL DEFAULT '';
+	ALTER TABLE general_memories ADD COLUMN IF NOT EXISTS source_excerpt TEXT NOT NULL DEFAULT '';
+	DROP INDEX IF EXISTS general_memories_user_id_idx;
+	CREATE INDEX IF NOT EXISTS general_memories_tenant_user_idx ON general_memories (tenant_id, user_id);
+	CREATE INDEX IF NOT EXISTS general_memories_dense_idx ON general_memories USING hnsw (dense vector_cosine_ops);`,
+		denseDimension, sparseDimension)
+	_, err := pg.db.Exec(query)
+	return err
+}
+
+// GetSimilarMemories fuses a cosine search on the dense vectors and an inner product search on the sparse ones with
+// reciprocal rank fusion, scoring like Qdrant does: 1/(rank+2) per stage with 0-based ranks.
+func (pg *PgVectorMemoryDB) GetSimilarMemories(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, threshold float32, limit int, ctx context.Context) ([]types.Memory, error) {
+	ctx, span := Tracer.Start(ctx, "Vector Search for Memories")
+	defer span.End()
+	limit, stageLimit := searchLimits(limit)
+	rows, err := pg.db.QueryContext(ctx, `
+	WITH dense AS (
+		SELECT id, ROW_NUMBER() OVER (ORDER BY dense <=> $2::vector, id) AS rank
+		FROM general_memories WHERE tenant_id = $5 AND user_id = $1
+		ORDER BY dense <=> $2::vector, id
+		LIMIT $7
+	), sparse AS (
+		SELECT id, ROW_NUMBER() OVER (ORDER BY sparse <#> $3::sparsevec, id) AS rank
+		FROM general_memories WHERE tenant_id = $5 AND user_id = $1 AND (sparse <#> $3::sparsevec) < 0
+		ORDER BY sparse <#> $3::sparsevec, id
+		LIMIT $7
+	), fused AS (
+		SELECT id, SUM(1.0 / (rank + 1)) AS score
+		FROM (SELECT * FROM dense UNION ALL SELECT * FROM sparse) stages
+		GROUP BY id
+	)
+	SELECT m.id, m.memory, m.created_at, m.updated_at, m.source_req_id, m.source_excerpt, f.score FROM fused f JOIN general_memories m ON m.id = f.id
+	WHERE f.score >= $4
+	ORDER BY f.score DESC, m.id
+	LIMIT $6`, userId, denseLiteral(DenseEmbedding), sparseLiteral(SparseEmbedding), threshold, types.TenantId(ctx), limit, stageLimit)
+	if err != nil {
+		slog.Error("Got this error while trying to get similar memories", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	var Memories []types.Memory
+	for rows.Next() {
+		mem := types.Memory{Type: types.MemoryTypeGeneral, UserId: userId}
+		if err := rows.Scan(&mem.Memory_Id, &mem.Memory_text, &mem.CreatedAt, &mem.UpdatedAt, &mem.SourceReqId, &mem.SourceExcerpt, &mem.Score); err != nil {
+			slog.Error("Got this error while scanning the similar memories", "error", err)
+			return nil, err
+		}
+		Memories = append(Memories, mem)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(Memories) == 0 {
+		slog.Info("No Memories of the user found", "userId", userId)
+		return nil, nil
+	}
+	return Memories, nil
+}
+
+// ExplainSimilarMemories runs the two stages of GetSimilarMemories and reports the rank and raw score of every memory
+// they return: the cosine similarity for the dense stage and the inner product for the sparse one.
+func (pg *PgVectorMemoryDB) ExplainSimilarMemories(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, limit int, ctx context.Context) (map[string]types.RetrievalExplanation, error) {
+	ctx, span := Tracer.Start(ctx, "Explaining Vector Search for Memories")
+	defer span.End()
+	_, stageLimit := searchLimits(limit)
+	rows, err := pg.db.QueryContext(ctx, `
+	(SELECT 'dense', id, ROW_NUMBER() OVER (ORDER BY dense <=> $2::vector, id), 1 - (dense <=> $2::vector)
+		FROM general_memories WHERE tenant_id = $4 AND user_id = $1
+		ORDER BY dense <=> $2::vector, id
+		LIMIT $5)
+	UNION ALL
+	(SELECT 'sparse', id, ROW_NUMBER() OVER (ORDER BY sparse <#> $3::sparsevec, id), -(sparse <#> $3::sparsevec)
+		FROM general_memories WHERE tenant_id = $4 AND user_id = $1 AND (sparse <#> $3::sparsevec) < 0
+		ORDER BY sparse <#> $3::sparsevec, id
+		LIMIT $5)`, userId, denseLiteral(DenseEmbedding), sparseLiteral(SparseEmbedding), types.TenantId(ctx), stageLimit)
+	if err != nil {
+		slog.Error("Got this error while running the stages of the search on their own", "error", err)
+		return nil, err
+	}
+	defer rows.Close()
+	explanations := make(map[string]types.RetrievalExplanation)
+	for rows.Next() {
+		var stage, id string
+		match := &types.StageMatch{}
+		if err := rows.Scan(&stage, &id, &match.Rank, &match.Score); err != nil {
+			slog.Error("Got this error while scanning the stages of the search", "error", err)
+			return nil, err
+		}
+		e := explanations[id]
+		if stage == "dense" {
+			e.Dense = match
+		} else {
+			e.Sparse = match
+		}
+		explanations[id] = e
+	}
+	return explanations, rows.Err()
+}
+
+func (pg *PgVectorMemoryDB) GetAllUserMemories(userId string, ctx context.Context) ([]types.Memory, error) {
+	ctx, span := Tracer.Start(ctx, "Getting All User Memories")
+	defer span.End()
+	rows, err := pg.db.QueryContext(ctx, `
+	SELECT id, memory, created_at, updated_at, source_req_id, source_excerpt
+	FROM general_memories WHERE tenant_id = $1 AND user_id = $2 ORDER BY id`, types.TenantId(ctx), userId)
+	if err != nil {
+		slog.Error("Got this error while trying to get all memories of the user", "error", err, "userId", userId)
+		return nil, err
+	}
+	defer rows.Close()
+	var Memories []types.Memory
+	for rows.Next() {
+		mem := types.Memory{Type: types.MemoryTypeGeneral, UserId: userId}
+		if err := rows.Scan(&mem.Memory_Id, &mem.Memory_text, &mem.CreatedAt, &mem.UpdatedAt, &mem.SourceReqId, &mem.SourceExcerpt); err != nil {
+			slog.Error("Got this error while scanning the memories of the user", "error", err, "userId", userId)
+			return nil, err
+		}
+		Memories = append(Memories, mem)
+	}
+	return Memories, rows.Err()
+}
+
+func (pg *PgVectorMemoryDB) ListUserMemories(userId string, limit int, offset string, ctx context.Context) ([]types.Memory, string, error) {
+	ctx, span := Tracer.Start(ctx, "Listing User Memories")
+	defer span.End()
+	// one row more than the page tells whether there is a next page and where it starts
+	rows, err := pg.db.QueryContext(ctx, `
+	SELECT id, memory, created_at, updated_at, source_req_id, source_excerpt
+	FROM general_memories WHERE tenant_id = $1 AND user_id = $2 AND id >= $3 ORDER BY id LIMIT $4`, types.TenantId(ctx), userId, offset, limit+1)
+	if err != nil {
+		slog.Error("Got this error while trying to get a page of the memories of the user", "error", err, "userId", userId, "offset", offset)
+		return nil, "", err
+	}
+	defer rows.Close()
+	var Memories []types.Memory
+	for rows.Next() {
+		mem := types.Memory{Type: types.MemoryTypeGeneral, UserId: userId}
+		if err := rows.Scan(&mem.Memory_Id, &mem.Memory_text, &mem.CreatedAt, &mem.UpdatedAt, &mem.SourceReqId, &mem.SourceExcerpt); err != nil {
+			slog.Error("Got this error while scanning the memories of the user", "error", err, "userId", userId)
+			return nil, "", err
+		}
+		Memories = append(Memories, mem)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(Memories) <= limit {
+		return Memories, "", nil
+	}
+	return Memories[:limit], Memories[limit].Memory_Id, nil
+}
+
+func (pg *PgVectorMemoryDB) DeleteMemories(memoryIds []string, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Deleting Memories from Postgres")
+	defer span.End()
+	res, err := pg.db.ExecContext(ctx, `DELETE FROM general_memories WHERE tenant_id = $1 AND id = ANY($2)`, types.TenantId(ctx), pq.Array(memoryIds))
+	if err != nil {
+		slog.Error("Got this error while Deleting Memories", "error", err)
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if int(n) != len(memoryIds) {
+		slog.Info("LLM Probably hallucinated and gave an invalid memory id ... it doesn't exist in the db")
+	}
+	if n == 0 {
+		slog.Info("No points found!", "points", memoryIds)
+		return errors.New("No points found!")
+	}
+	slog.Info("Deletion of the Memories was succesful!")
+	return nil
+}
+
+func (pg *PgVectorMemoryDB) DeleteUserMemories(userId string, ctx context.Context) (int, error) {
+	ctx, span := Tracer.Start(ctx, "Deleting All User Memories from Postgres")
+	defer span.End()
+	res, err := pg.db.ExecContext(ctx, `DELETE FROM general_memories WHERE tenant_id = $1 AND user_id = $2`, types.TenantId(ctx), userId)
+	if err != nil {
+		slog.Error("Got this error while deleting all the memories of the user", "error", err, "userId", userId)
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func (pg *PgVectorMemoryDB) GetMemoriesByIds(memoryIds []string, ctx context.Context) ([]types.MemoryPoint, error) {
+	ctx, span := Tracer.Start(ctx, "Getting Memories by Ids from Postgres")
+	defer span.End()
+	if len(memoryIds) == 0 {
+		return nil, nil
+	}
+	rows, err := pg.db.QueryContext(ctx, `
+	SELECT id, user_id, memory, created_at, updated_at, source_req_id, source_excerpt, dense::text, sparse::text
+	FROM general_memories WHERE tenant_id = $1 AND id = ANY($2)`, types.TenantId(ctx), pq.Array(memoryIds))
+	if err != nil {
+		slog.Error("Got this error while getting memories by their ids", "error", err, "memoryIds", memoryIds)
+		return nil, err
+	}
+	defer rows.Close()
+	var points []types.MemoryPoint
+	for rows.Next() {
+		p := types.MemoryPoint{TenantId: types.TenantId(ctx), Memory: types.Memory{Type: types.MemoryTypeGeneral}}
+		var dense, sparse string
+		if err := rows.Scan(&p.Memory.Memory_Id, &p.Memory.UserId, &p.Memory.Memory_text, &p.Memory.CreatedAt, &p.Memory.UpdatedAt, &p.Memory.SourceReqId, &p.Memory.SourceExcerpt, &dense, &sparse); err != nil {
+			slog.Error("Got this error while scanning memories by their ids", "error", err)
+			return nil, err
+		}
+		if p.Dense, err = parseDenseLiteral(dense); err != nil {
+			slog.Error("Got this error while parsing a dense vector", "error", err, "id", p.Memory.Memory_Id)
+			return nil, err
+		}
+		if p.Sparse, err = parseSparseLiteral(sparse); err != nil {
+			slog.Error("Got this error while parsing a sparse vector", "error", err, "id", p.Memory.Memory_Id)
+			return nil, err
+		}
+		points = append(points, p)
+	}
+	return points, rows.Err()
+}
+
+func (pg *PgVectorMemoryDB) UpsertMemories(points []types.MemoryPoint, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Upserting Memories into Postgres")
+	defer span.End()
+	if len(points) == 0 {
+		return nil
+	}
+	tx, err := pg.db.BeginTx(ctx, nil)
+	if err != nil {
+		slog.Error("Got this error while beginning the transaction for the memories", "error", err)
+		return err
+	}
+	defer tx.Rollback()
+	stmt, err := tx.PrepareContext(ctx, `
+	INSERT INTO general_memories (id, tenant_id, user_id, memory, dense, sparse, created_at, updated_at, source_req_id, source_excerpt)
+	VALUES ($1, $2, $3, $4, $5::vector, $6::sparsevec, COALESCE($7, now()), COALESCE($8, now()), $9, $10)
+	ON CONFLICT (id) DO UPDATE SET
+		user_id = EXCLUDED.user_id,
+		memory = EXCLUDED.memory,
+		dense = EXCLUDED.dense,
+		sparse = EXCLUDED.sparse,
+		created_at = EXCLUDED.created_at,
+		updated_at = EXCLUDED.updated_at,
+		source_req_id = EXCLUDED.source_req_id,
+		source_excerpt = EXCLUDED.source_excerpt
+	WHERE general_memories.tenant_id = EXCLUDED.tenant_id`)
+	if err != nil {
+		slog.Error("Got this error while preparing the upsert for the memories", "error", err)
+		return err
+	}
+	defer stmt.Close()
+	for _, p := range points {
+		if _, err := stmt.ExecContext(ctx, p.Memory.Memory_Id, types.TenantId(ctx), p.Memory.UserId, p.Memory.Memory_text, denseLiteral(p.Dense), sparseLiteral(p.Sparse),
+			nullTime(p.Memory.CreatedAt), nullTime(p.Memory.UpdatedAt), p.Memory.SourceReqId, p.Memory.SourceExcerpt); err != nil {
+			slog.Error("Got this error while upserting a memory", "error", err, "id", p.Memory.Memory_Id)
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// nullTime passes an unknown time as NULL, so the row gets the time it is written at instead.
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// denseLiteral formats a dense embedding as a pgvector literal, e.g. [0.1,0.2].
+func denseLiteral(e types.DenseEmbedding) string {
+	var b strings.Builder
+	b.WriteByte('[')
+	for i, v := range e.Values {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatFloat(float64(v), 'g', -1, 32))
+	}
+	b.WriteByte(']')
+	return b.String()
+}
+
+func parseDenseLiteral(s string) (types.DenseEmbedding, error) {
+	s = strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	if s == "" {
+		return types.DenseEmbedding{}, nil
+	}
+	parts := strings.Split(s, ",")
+	values := make([]float32, len(parts))
+	for i, part := range parts {
+		v, err := strconv.ParseFloat(part, 32)
+		if err != nil {
+			return types.DenseEmbedding{}, err
+		}
+		values[i] = float32(v)
+	}
+	return types.DenseEmbedding{Values: values}, nil
+}
+
+// sparseLiteral formats a sparse embedding as a sparsevec literal, e.g. {1:0.5,3:0.2}/30522. sparsevec indices are
+// 1-based while the SPLADE token ids are 0-based, hence the shift.
+func sparseLiteral(e types.SparseEmbedding) string {
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, idx := range e.Indices {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		b.WriteString(strconv.FormatUint(uint64(idx)+1, 10))
+		b.WriteByte(':')
+		b.WriteString(strconv.FormatFloat(float64(e.Values[i]), 'g', -1, 32))
+	}
+	b.WriteString("}/")
+	b.WriteString(strconv.Itoa(sparseDimension))
+	return b.String()
+}
+
+func parseSparseLiteral(s string) (types.SparseEmbedding, error) {
+	body, _, ok := strings.Cut(s, "/")
+	if !ok {
+		return types.SparseEmbedding{}, fmt.Errorf("malformed sparsevec %q", s)
+	}
+	body = strings.TrimSuffix(strings.TrimPrefix(body, "{"), "}")
+	sparse := types.SparseEmbedding{}
+	if body == "" {
+		return sparse, nil
+	}
+	for _, pair := range strings.Split(body, ",") {
+		idxStr, valStr, ok := strings.Cut(pair, ":")
+		if !ok {
+			return types.SparseEmbedding{}, fmt.Errorf("malformed sparsevec element %q", pair)
+		}
+		idx, err := strconv.ParseUint(idxStr, 10, 32)
+		if err != nil {
+			return types.SparseEmbedding{}, err
+		}
+		v, err := strconv.ParseFloat(valStr, 32)
+		if err != nil {
+			return types.SparseEmbedding{}, err
+		}
+		sparse.Indices = append(sparse.Indices, uint32(idx-1))
+		sparse.Values = append(sparse.Values, float32(v))
+	}
+	return sparse, nil
+}
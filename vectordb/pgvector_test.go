@@ -0,0 +1,29 @@
+package vectordb
+
+import (
+	"testing"
+
+	"github.com/Prateek-Gupta001/GoMemory/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPgVectorLiterals(t *testing.T) {
+	dense := types.DenseEmbedding{Values: []float32{0.25, -1, 3.5e-7}}
+	assert.Equal(t, "[0.25,-1,3.5e-07]", denseLiteral(dense))
+	parsedDense, err := parseDenseLiteral(denseLiteral(dense))
+	require.NoError(t, err)
+	assert.Equal(t, dense, parsedDense)
+
+	sparse := types.SparseEmbedding{Indices: []uint32{0, 2047}, Values: []float32{0.5, 1.25}}
+	assert.Equal(t, "{1:0.5,2048:1.25}/30522", sparseLiteral(sparse))
+	parsedSparse, err := parseSparseLiteral(sparseLiteral(sparse))
+	require.NoError(t, err)
+	assert.Equal(t, sparse, parsedSparse)
+
+	empty, err := parseSparseLiteral("{}/30522")
+	require.NoError(t, err)
+	assert.Empty(t, empty.Indices)
+	_, err = parseSparseLiteral("{1:0.5}")
+	assert.Error(t, err)
+}
@@ -2,8 +2,10 @@ package vectordb
 
 import (
 	"context"
+	"encoding/binary"
 	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/Prateek-Gupta001/GoMemory/types"
 	"github.com/google/uuid"
@@ -11,35 +13,58 @@ import (
 	"go.opentelemetry.io/otel"
 )
 
+// DefaultSearchLimit is how many memories a search returns when the caller doesn't ask for a number, which is also
+// how many a Qdrant prefetch stage returns by default.
+const DefaultSearchLimit = 10
+
 type VectorDB interface {
-	GetSimilarMemories(types.DenseEmbedding, types.SparseEmbedding, string, float32, context.Context) ([]types.Memory, error)
-	InsertNewMemories([]types.DenseEmbedding, []types.SparseEmbedding, []string, string, context.Context) error
+	// GetSimilarMemories returns at most limit memories of the user, DefaultSearchLimit for 0, best match first.
+	GetSimilarMemories(dense types.DenseEmbedding, sparse types.SparseEmbedding, userId string, threshold float32, limit int, ctx context.Context) ([]types.Memory, error)
 	DeleteMemories([]string, context.Context) error
 	GetAllUserMemories(userId string, ctx context.Context) ([]types.Memory, error)
+	// ListUserMemories returns a page of at most limit general memories of the user in id order, starting at the
+	// offset (the first page for ""), and the offset of the next page ("" after the last one).
+	ListUserMemories(userId string, limit int, offset string, ctx context.Context) ([]types.Memory, string, error)
+	GetMemoriesByIds(memoryIds []string, ctx context.Context) ([]types.MemoryPoint, error) //along with their vectors, missing ids are left out
+	UpsertMemories(points []types.MemoryPoint, ctx context.Context) error                  //writes the points under their own ids
+	DeleteUserMemories(userId string, ctx context.Context) (int, error)                    //returns how many memories were deleted
+	// ExplainSimilarMemories tells, by memory id, how the dense and the sparse stage of GetSimilarMemories rank the
+	// memories of the user.
+	ExplainSimilarMemories(dense types.DenseEmbedding, sparse types.SparseEmbedding, userId string, limit int, ctx context.Context) (map[string]types.RetrievalExplanation, error)
+}
+
+// searchLimits turns the limit a caller asked for into how many results the search returns and how many candidates
+// each of its stages contributes, which is never fewer than a Qdrant prefetch returns by default.
+func searchLimits(limit int) (int, int) {
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	return limit, max(limit, DefaultSearchLimit)
 }
 
 type QdrantMemoryDB struct {
-	Client *qdrant.Client
+	Client     *qdrant.Client
+	Collection string
 }
 
-func NewQdrantMemoryDB() (*QdrantMemoryDB, error) {
+func NewQdrantMemoryDB(host string, port int, collection string) (*QdrantMemoryDB, error) {
 	client, err := qdrant.NewClient(&qdrant.Config{
-		Host: "localhost",
-		Port: 6336,
+		Host: host,
+		Port: port,
 	})
 	if err != nil {
 		slog.Error("Got this error while trying to intialise the qdrant memory db!", "error", err)
 		panic(err)
 	}
-	// client.DeleteCollection(context.Background(),"Go_Memory_db")
-	exists, err1 := client.CollectionExists(context.Background(), "Go_Memory_db")
+	// client.DeleteCollection(context.Background(),collection)
+	exists, err1 := client.CollectionExists(context.Background(), collection)
 	if err1 != nil {
 		slog.Error("Got this error while checking if collection exists or not!", "error", err1)
 	}
 	if !exists {
 		slog.Info("new collection being created!")
 		err = client.CreateCollection(context.Background(), &qdrant.CreateCollection{
-			CollectionName: "Go_Memory_db",
+			CollectionName: collection,
 			// 1. Define the Dense Vector with a specific name (e.g., "dense")
 			VectorsConfig: qdrant.NewVectorsConfigMap(map[string]*qdrant.VectorParams{
 				"dense": {
@@ -59,7 +84,7 @@ func NewQdrantMemoryDB() (*QdrantMemoryDB, error) {
 		fieldType := qdrant.FieldType_FieldTypeKeyword
 
 		_, err := client.CreateFieldIndex(context.Background(), &qdrant.CreateFieldIndexCollection{
-			CollectionName: "Go_Memory_db",
+			CollectionName: collection,
 			FieldName:      "userId",
 			FieldType:      &fieldType,
 		})
@@ -67,32 +92,84 @@ func NewQdrantMemoryDB() (*QdrantMemoryDB, error) {
 			slog.Error("Got this error while trying to make the userId a field Index.", "error", err)
 		}
 	}
+	// Every query is filtered on the tenant, so it gets a tenant optimised index on every start (creating it again is a no-op).
+	fieldType := qdrant.FieldType_FieldTypeKeyword
+	_, err = client.CreateFieldIndex(context.Background(), &qdrant.CreateFieldIndexCollection{
+		CollectionName: collection,
+		FieldName:      "tenantId",
+		FieldType:      &fieldType,
+		FieldIndexParams: qdrant.NewPayloadIndexParamsKeyword(&qdrant.KeywordIndexParams{
+			IsTenant: qdrant.PtrOf(true),
+		}),
+	})
+	if err != nil {
+		slog.Error("Got this error while trying to make the tenantId a field Index.", "error", err)
+	}
+	// Memories stored before tenants existed belong to the default tenant.
+	_, err = client.SetPayload(context.Background(), &qdrant.SetPayloadPoints{
+		CollectionName: collection,
+		Payload:        qdrant.NewValueMap(map[string]any{"tenantId": types.DefaultTenantId}),
+		PointsSelector: qdrant.NewPointsSelectorFilter(&qdrant.Filter{
+			Must: []*qdrant.Condition{qdrant.NewIsEmpty("tenantId")},
+		}),
+	})
+	if err != nil {
+		slog.Error("Got this error while assigning the memories without a tenant to the default tenant", "error", err)
+	}
 	return &QdrantMemoryDB{
-		Client: client,
+		Client:     client,
+		Collection: collection,
 	}, nil
 }
 
 var Tracer = otel.Tracer("Go_Memory")
 
-func (qdb *QdrantMemoryDB) GetSimilarMemories(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, threshold float32, ctx context.Context) ([]types.Memory, error) {
+// memoryIdSpace is the namespace memory ids are derived in. Ids used to be derived in the OID namespace from the text
+// and the userId run together, so two different users could end up with the same id; memories stored back then keep
+// their ids, but a new copy of one of them gets an id of the new kind.
+var memoryIdSpace = uuid.MustParse("6f1c3a52-2b8e-4d7a-9c41-0e5d8b7f2a19")
+
+// MemoryId is the id a general memory is stored under. It is derived from the text, so inserting the same memory twice
+// overwrites it instead of duplicating it. The tenant, the user and the text are each prefixed with their length, so no
+// choice of userId or text can produce the id of a memory of someone else.
+func MemoryId(memory string, userId string, ctx context.Context) string {
+	var name []byte
+	for _, field := range []string{types.TenantId(ctx), userId, memory} {
+		name = binary.AppendUvarint(name, uint64(len(field)))
+		name = append(name, field...)
+	}
+	return uuid.NewSHA1(memoryIdSpace, name).String()
+}
+
+// userFilter matches the memories of a user of the tenant ctx is scoped to.
+func userFilter(userId string, ctx context.Context) *qdrant.Filter {
+	return &qdrant.Filter{
+		Must: []*qdrant.Condition{
+			qdrant.NewMatch("tenantId", types.TenantId(ctx)),
+			qdrant.NewMatch("userId", userId),
+		}}
+}
+
+func (qdb *QdrantMemoryDB) GetSimilarMemories(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, threshold float32, limit int, ctx context.Context) ([]types.Memory, error) {
 	ctx, span := Tracer.Start(ctx, "Vector Search for Memories")
 	defer span.End()
+	limit, stageLimit := searchLimits(limit)
 	res, err := qdb.Client.Query(ctx, &qdrant.QueryPoints{
-		CollectionName: "Go_Memory_db",
-		Filter: &qdrant.Filter{
-			Must: []*qdrant.Condition{
-				qdrant.NewMatch("userId", userId),
-			}},
+		CollectionName: qdb.Collection,
+		Filter:         userFilter(userId, ctx),
 		ScoreThreshold: &threshold,
 		WithPayload:    qdrant.NewWithPayload(true),
+		Limit:          qdrant.PtrOf(uint64(limit)),
 		Prefetch: []*qdrant.PrefetchQuery{
 			{
 				Query: qdrant.NewQuerySparse(SparseEmbedding.Indices, SparseEmbedding.Values),
 				Using: qdrant.PtrOf("sparse"),
+				Limit: qdrant.PtrOf(uint64(stageLimit)),
 			},
 			{
 				Query: qdrant.NewQueryDense(DenseEmbedding.Values),
 				Using: qdrant.PtrOf("dense"),
+				Limit: qdrant.PtrOf(uint64(stageLimit)),
 			},
 		},
 		Query: qdrant.NewQueryFusion(qdrant.Fusion_RRF),
@@ -114,85 +191,102 @@ func (qdb *QdrantMemoryDB) GetSimilarMemories(DenseEmbedding types.DenseEmbeddin
 			slog.Error("Payload is missing 'Memory' key", "id", r.Id)
 			continue
 		}
-		Memories = append(Memories, types.Memory{
-			Memory_text: string(y["Memory"].GetStringValue()),
-			Memory_Id:   r.Id.GetUuid(),
-			Type:        types.MemoryTypeGeneral,
-			UserId:      userId,
-		})
+		mem := memoryFromPayload(r.Id, y)
+		mem.Score = r.Score
+		Memories = append(Memories, mem)
 
 	}
 	slog.Info("Similar Memories are being returned from qdrant!", "memories", Memories)
 	return Memories, nil
 }
 
-func (qdb *QdrantMemoryDB) InsertNewMemories(DenseEmbedding []types.DenseEmbedding, SparseEmbeddings []types.SparseEmbedding, memories []string, userId string, ctx context.Context) error {
-	ctx, span := Tracer.Start(ctx, "Inserting New Memories")
+// ExplainSimilarMemories runs the two prefetch stages of GetSimilarMemories on their own and reports where each of
+// them ranks the memories it returns, along with the raw dense cosine and sparse dot product scores.
+func (qdb *QdrantMemoryDB) ExplainSimilarMemories(DenseEmbedding types.DenseEmbedding, SparseEmbedding types.SparseEmbedding, userId string, limit int, ctx context.Context) (map[string]types.RetrievalExplanation, error) {
+	ctx, span := Tracer.Start(ctx, "Explaining Vector Search for Memories")
 	defer span.End()
-	var Points []*qdrant.PointStruct
-	for idx, sp := range SparseEmbeddings {
-		id := uuid.NewSHA1(uuid.NameSpaceOID, []byte(memories[idx]+userId)).String()
-		Points = append(Points,
-			&qdrant.PointStruct{
-				Id: qdrant.NewIDUUID(id),
-				Vectors: qdrant.NewVectorsMap(map[string]*qdrant.Vector{
-					"sparse": qdrant.NewVectorSparse(
-						sp.Indices,
-						sp.Values),
-					"dense": qdrant.NewVectorDense(DenseEmbedding[idx].Values),
-				}),
-				Payload: qdrant.NewValueMap(map[string]any{
-					"userId": userId,
-					"Memory": memories[idx],
-				}),
-			})
+	_, stageLimit := searchLimits(limit)
+	explanations := make(map[string]types.RetrievalExplanation)
+	stages := []struct {
+		using string
+		query *qdrant.Query
+		set   func(*types.RetrievalExplanation, *types.StageMatch)
+	}{
+		{"dense", qdrant.NewQueryDense(DenseEmbedding.Values), func(e *types.RetrievalExplanation, m *types.StageMatch) { e.Dense = m }},
+		{"sparse", qdrant.NewQuerySparse(SparseEmbedding.Indices, SparseEmbedding.Values), func(e *types.RetrievalExplanation, m *types.StageMatch) { e.Sparse = m }},
 	}
-	_, err := qdb.Client.Upsert(ctx, &qdrant.UpsertPoints{
-		CollectionName: "Go_Memory_db",
-		Points:         Points,
-	})
-	if err != nil {
-		slog.Info("Got this error while upserting qdrant points", "error", err)
-		return err
+	for _, stage := range stages {
+		res, err := qdb.Client.Query(ctx, &qdrant.QueryPoints{
+			CollectionName: qdb.Collection,
+			Filter:         userFilter(userId, ctx),
+			Query:          stage.query,
+			Using:          qdrant.PtrOf(stage.using),
+			Limit:          qdrant.PtrOf(uint64(stageLimit)),
+		})
+		if err != nil {
+			slog.Error("Got this error while running a stage of the search on its own", "error", err, "stage", stage.using)
+			return nil, err
+		}
+		for i, r := range res {
+			e := explanations[r.Id.GetUuid()]
+			stage.set(&e, &types.StageMatch{Rank: i + 1, Score: r.Score})
+			explanations[r.Id.GetUuid()] = e
+		}
 	}
-	slog.Info("Memory insertion was successful!")
-	return nil
+	return explanations, nil
 }
 
+// scrollPageSize is how many points GetAllUserMemories asks Qdrant for at a time.
+const scrollPageSize = 256
+
 func (qdb *QdrantMemoryDB) GetAllUserMemories(userId string, ctx context.Context) ([]types.Memory, error) {
 	ctx, span := Tracer.Start(ctx, "Getting All User Memories")
 	defer span.End()
-	res, err := qdb.Client.Scroll(ctx, &qdrant.ScrollPoints{
-		CollectionName: "Go_Memory_db",
-		Filter: &qdrant.Filter{
-			Must: []*qdrant.Condition{
-				qdrant.NewMatch("userId", userId),
-			},
-		},
-		WithPayload: qdrant.NewWithPayload(true),
-	})
+	var Memories []types.Memory
+	offset := ""
+	for {
+		page, next, err := qdb.ListUserMemories(userId, scrollPageSize, offset, ctx)
+		if err != nil {
+			return nil, err
+		}
+		Memories = append(Memories, page...)
+		if next == "" {
+			break
+		}
+		offset = next
+	}
+	slog.Info("All the user Memories are being returned from qdrant!", "userId", userId, "count", len(Memories))
+	return Memories, nil
+}
+
+func (qdb *QdrantMemoryDB) ListUserMemories(userId string, limit int, offset string, ctx context.Context) ([]types.Memory, string, error) {
+	ctx, span := Tracer.Start(ctx, "Listing User Memories")
+	defer span.End()
+	req := &qdrant.ScrollPoints{
+		CollectionName: qdb.Collection,
+		Filter:         userFilter(userId, ctx),
+		WithPayload:    qdrant.NewWithPayload(true),
+		Limit:          qdrant.PtrOf(uint32(limit)),
+	}
+	if offset != "" {
+		req.Offset = qdrant.NewIDUUID(offset)
+	}
+	res, next, err := qdb.Client.ScrollAndOffset(ctx, req)
 	if err != nil {
-		slog.Error("Got this error while trying to get all memories of the user", "error", err, "userId", userId)
-		return nil, err
+		slog.Error("Got this error while trying to get a page of the memories of the user", "error", err, "userId", userId, "offset", offset)
+		return nil, "", err
 	}
 	var Memories []types.Memory
 	for _, r := range res {
 		y := r.Payload
-		slog.Info("memory is", "memory", y["Memory"].GetStringValue())
 		_, ok := y["Memory"]
 		if !ok {
 			slog.Error("Payload is missing 'Memory' key", "id", r.Id)
 			continue
 		}
-		Memories = append(Memories, types.Memory{
-			Memory_text: string(y["Memory"].GetStringValue()),
-			Memory_Id:   r.Id.GetUuid(),
-			Type:        types.MemoryTypeGeneral,
-			UserId:      userId,
-		})
+		Memories = append(Memories, memoryFromPayload(r.Id, y))
 	}
-	slog.Info("All the user Memories are being returned from qdrant!", "memories", Memories)
-	return Memories, nil
+	return Memories, next.GetUuid(), nil
 }
 
 func (qdb *QdrantMemoryDB) DeleteMemories(memoryIds []string, ctx context.Context) error {
@@ -203,27 +297,35 @@ func (qdb *QdrantMemoryDB) DeleteMemories(memoryIds []string, ctx context.Contex
 		qdrantPointIds = append(qdrantPointIds, qdrant.NewIDUUID(memId))
 	}
 	retrieveResp, err := qdb.Client.Get(ctx, &qdrant.GetPoints{
-		CollectionName: "Go_Memory_db",
+		CollectionName: qdb.Collection,
 		Ids:            qdrantPointIds,
-		WithPayload:    &qdrant.WithPayloadSelector{SelectorOptions: &qdrant.WithPayloadSelector_Enable{Enable: false}}, // We don't need the data, just existence
+		WithPayload:    qdrant.NewWithPayloadInclude("tenantId"),                                                        // We only need the owner, to check existence
 		WithVectors:    &qdrant.WithVectorsSelector{SelectorOptions: &qdrant.WithVectorsSelector_Enable{Enable: false}}, // Optimization: Don't fetch vectors
 	})
 	if err != nil {
 		slog.Error("failed to check points existence:", "error", err)
+		return fmt.Errorf("checking which memories belong to the tenant: %w", err)
+	}
+	// Points of other tenants are treated as if they didn't exist.
+	var ownedIds []*qdrant.PointId
+	for _, r := range retrieveResp {
+		if r.Payload["tenantId"].GetStringValue() == types.TenantId(ctx) {
+			ownedIds = append(ownedIds, r.Id)
+		}
 	}
 
 	// 3. VERIFY: Did we find anything?
-	slog.Info("Did we find as many memories as there are Ids", "num of memoryIds", len(memoryIds), "num of retrieved results", len(retrieveResp))
-	if len(retrieveResp) != len(memoryIds) {
+	slog.Info("Did we find as many memories as there are Ids", "num of memoryIds", len(memoryIds), "num of retrieved results", len(ownedIds))
+	if len(ownedIds) != len(memoryIds) {
 		slog.Info("LLM Probably hallucinated and gave an invalid memory id ... it doesn't exist in the db")
 	}
-	if len(retrieveResp) == 0 {
+	if len(ownedIds) == 0 {
 		slog.Info("No points found!", "points", memoryIds)
 		return fmt.Errorf("No points found!")
 	}
 	_, err = qdb.Client.Delete(ctx, &qdrant.DeletePoints{
-		CollectionName: "Go_Memory_db",
-		Points:         qdrant.NewPointsSelectorIDs(qdrantPointIds),
+		CollectionName: qdb.Collection,
+		Points:         qdrant.NewPointsSelectorIDs(ownedIds),
 	})
 	if err != nil {
 		slog.Error("Got this error while Deleting Memories", "error", err)
@@ -233,3 +335,195 @@ func (qdb *QdrantMemoryDB) DeleteMemories(memoryIds []string, ctx context.Contex
 
 	return nil
 }
+
+func (qdb *QdrantMemoryDB) DeleteUserMemories(userId string, ctx context.Context) (int, error) {
+	ctx, span := Tracer.Start(ctx, "Deleting All User Memories from Qdrant")
+	defer span.End()
+	count, err := qdb.Client.Count(ctx, &qdrant.CountPoints{
+		CollectionName: qdb.Collection,
+		Filter:         userFilter(userId, ctx),
+		Exact:          qdrant.PtrOf(true),
+	})
+	if err != nil {
+		slog.Error("Got this error while counting the memories of the user", "error", err, "userId", userId)
+		return 0, err
+	}
+	_, err = qdb.Client.Delete(ctx, &qdrant.DeletePoints{
+		CollectionName: qdb.Collection,
+		Points:         qdrant.NewPointsSelectorFilter(userFilter(userId, ctx)),
+		Wait:           qdrant.PtrOf(true),
+	})
+	if err != nil {
+		slog.Error("Got this error while deleting all the memories of the user", "error", err, "userId", userId)
+		return 0, err
+	}
+	slog.Info("All the memories of the user have been deleted from qdrant", "userId", userId, "count", count)
+	return int(count), nil
+}
+
+func (qdb *QdrantMemoryDB) GetMemoriesByIds(memoryIds []string, ctx context.Context) ([]types.MemoryPoint, error) {
+	ctx, span := Tracer.Start(ctx, "Getting Memories by Ids from Qdrant")
+	defer span.End()
+	if len(memoryIds) == 0 {
+		return nil, nil
+	}
+	var qdrantPointIds []*qdrant.PointId
+	for _, memId := range memoryIds {
+		qdrantPointIds = append(qdrantPointIds, qdrant.NewIDUUID(memId))
+	}
+	res, err := qdb.Client.Get(ctx, &qdrant.GetPoints{
+		CollectionName: qdb.Collection,
+		Ids:            qdrantPointIds,
+		WithPayload:    qdrant.NewWithPayload(true),
+		WithVectors:    qdrant.NewWithVectors(true),
+	})
+	if err != nil {
+		slog.Error("Got this error while getting memories by their ids", "error", err, "memoryIds", memoryIds)
+		return nil, err
+	}
+	var points []types.MemoryPoint
+	for _, r := range res {
+		y := r.Payload
+		_, ok := y["Memory"]
+		if !ok {
+			slog.Error("Payload is missing 'Memory' key", "id", r.Id)
+			continue
+		}
+		if y["tenantId"].GetStringValue() != types.TenantId(ctx) {
+			continue
+		}
+		vectors := r.GetVectors().GetVectors().GetVectors()
+		points = append(points, types.MemoryPoint{
+			TenantId: types.TenantId(ctx),
+			Memory:   memoryFromPayload(r.Id, y),
+			Dense:    denseFromOutput(vectors["dense"]),
+			Sparse:   sparseFromOutput(vectors["sparse"]),
+		})
+	}
+	return points, nil
+}
+
+func (qdb *QdrantMemoryDB) UpsertMemories(points []types.MemoryPoint, ctx context.Context) error {
+	ctx, span := Tracer.Start(ctx, "Upserting Memories into Qdrant")
+	defer span.End()
+	if len(points) == 0 {
+		return nil
+	}
+	foreign, err := qdb.foreignPoints(points, ctx)
+	if err != nil {
+		return err
+	}
+	var Points []*qdrant.PointStruct
+	for _, p := range points {
+		if foreign[p.Memory.Memory_Id] {
+			slog.Warn("Not overwriting a memory of another tenant", "id", p.Memory.Memory_Id)
+			continue
+		}
+		Points = append(Points,
+			&qdrant.PointStruct{
+				Id: qdrant.NewIDUUID(p.Memory.Memory_Id),
+				Vectors: qdrant.NewVectorsMap(map[string]*qdrant.Vector{
+					"sparse": qdrant.NewVectorSparse(
+						p.Sparse.Indices,
+						p.Sparse.Values),
+					"dense": qdrant.NewVectorDense(p.Dense.Values),
+				}),
+				Payload: memoryPayload(p.Memory, ctx),
+			})
+	}
+	if len(Points) == 0 {
+		return nil
+	}
+	_, err = qdb.Client.Upsert(ctx, &qdrant.UpsertPoints{
+		CollectionName: qdb.Collection,
+		Points:         Points,
+	})
+	if err != nil {
+		slog.Error("Got this error while upserting qdrant points", "error", err)
+		return err
+	}
+	return nil
+}
+
+// foreignPoints returns which of the points already exist in another tenant than the one ctx is scoped to, like the
+// other backends refuse to overwrite them.
+func (qdb *QdrantMemoryDB) foreignPoints(points []types.MemoryPoint, ctx context.Context) (map[string]bool, error) {
+	var ids []*qdrant.PointId
+	for _, p := range points {
+		ids = append(ids, qdrant.NewIDUUID(p.Memory.Memory_Id))
+	}
+	res, err := qdb.Client.Get(ctx, &qdrant.GetPoints{
+		CollectionName: qdb.Collection,
+		Ids:            ids,
+		WithPayload:    qdrant.NewWithPayloadInclude("tenantId"),
+	})
+	if err != nil {
+		slog.Error("Got this error while looking up the tenants of the memories to upsert", "error", err)
+		return nil, err
+	}
+	foreign := make(map[string]bool)
+	for _, r := range res {
+		tenantId := r.Payload["tenantId"].GetStringValue()
+		if tenantId == "" {
+			tenantId = types.DefaultTenantId
+		}
+		if tenantId != types.TenantId(ctx) {
+			foreign[r.Id.GetUuid()] = true
+		}
+	}
+	return foreign, nil
+}
+
+// memoryPayload is the payload a general memory is stored under in Qdrant. The timestamps are kept as RFC 3339 strings
+// and, like the provenance, left out when unknown.
+func memoryPayload(mem types.Memory, ctx context.Context) map[string]*qdrant.Value {
+	payload := map[string]any{
+		"tenantId": types.TenantId(ctx),
+		"userId":   mem.UserId,
+		"Memory":   mem.Memory_text,
+	}
+	if !mem.CreatedAt.IsZero() {
+		payload["createdAt"] = mem.CreatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if !mem.UpdatedAt.IsZero() {
+		payload["updatedAt"] = mem.UpdatedAt.UTC().Format(time.RFC3339Nano)
+	}
+	if mem.SourceReqId != "" {
+		payload["sourceReqId"] = mem.SourceReqId
+	}
+	if mem.SourceExcerpt != "" {
+		payload["sourceExcerpt"] = mem.SourceExcerpt
+	}
+	return qdrant.NewValueMap(payload)
+}
+
+// memoryFromPayload reads a general memory back from its point. Points written before the timestamps were stored
+// come back without them.
+func memoryFromPayload(id *qdrant.PointId, payload map[string]*qdrant.Value) types.Memory {
+	mem := types.Memory{
+		Memory_text:   payload["Memory"].GetStringValue(),
+		Memory_Id:     id.GetUuid(),
+		Type:          types.MemoryTypeGeneral,
+		UserId:        payload["userId"].GetStringValue(),
+		SourceReqId:   payload["sourceReqId"].GetStringValue(),
+		SourceExcerpt: payload["sourceExcerpt"].GetStringValue(),
+	}
+	mem.CreatedAt, _ = time.Parse(time.RFC3339Nano, payload["createdAt"].GetStringValue())
+	mem.UpdatedAt, _ = time.Parse(time.RFC3339Nano, payload["updatedAt"].GetStringValue())
+	return mem
+}
+
+// Older Qdrant servers fill the deprecated Data/Indices fields instead of the Dense/Sparse oneof, so we look at both.
+func denseFromOutput(v *qdrant.VectorOutput) types.DenseEmbedding {
+	if d := v.GetDense(); d != nil {
+		return types.DenseEmbedding{Values: d.GetData()}
+	}
+	return types.DenseEmbedding{Values: v.GetData()}
+}
+
+func sparseFromOutput(v *qdrant.VectorOutput) types.SparseEmbedding {
+	if sp := v.GetSparse(); sp != nil {
+		return types.SparseEmbedding{Indices: sp.GetIndices(), Values: sp.GetValues()}
+	}
+	return types.SparseEmbedding{Indices: v.GetIndices().GetData(), Values: v.GetData()}
+}
@@ -5,7 +5,7 @@ import (
 )
 
 func TestDeleteMemories(t *testing.T) {
-	q, err := NewQdrantMemoryDB()
+	q, err := NewQdrantMemoryDB("localhost", 6336, "Go_Memory_db")
 	if err != nil {
 		t.Error("Got this error while intialising a new qdrant db", "error", err)
 	}